@@ -29,6 +29,7 @@ import (
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethersphere/swarm/contracts/ens"
 	"github.com/ethersphere/swarm/network"
+	"github.com/ethersphere/swarm/network/stream"
 	"github.com/ethersphere/swarm/pss"
 	"github.com/ethersphere/swarm/storage"
 	"github.com/ethersphere/swarm/swap"
@@ -56,6 +57,8 @@ type Config struct {
 	SwapEnabled             bool           // whether SWAP incentives are enabled
 	SwapPaymentThreshold    uint64         // honey amount at which a payment is triggered
 	SwapDisconnectThreshold uint64         // honey amount at which a peer disconnects
+	SwapDisconnectPolicy    string         // what happens at the disconnect threshold, disconnect, throttle or suspend-accounting
+	SwapRequireVerified     bool           // refuse to serve peers on credit whose chequebook cannot be verified on chain
 	SwapSkipDeposit         bool           // do not ask the user to deposit during boot sequence
 	SwapDepositAmount       uint64         // deposit amount to the chequebook
 	SwapLogPath             string         // dir to swap related audit logs
@@ -78,6 +81,10 @@ type Config struct {
 	NetworkID          uint64
 	SyncEnabled        bool
 	PushSyncEnabled    bool
+	SyncStrategy       string // order in which the sync bins of peers are requested, breadth-first or depth-first
+	SyncDedupCacheSize int    // number of chunks tracked to not sync a chunk offered by several peers twice
+	SyncMaxInfoReqs    int    // number of stream info requests of a peer handled at once, further requests wait
+	SyncBudget         uint64 // number of chunks syncing may store, the most distant ones are evicted beyond it, unlimited if 0
 	LightNodeEnabled   bool
 	BootnodeMode       bool
 	DisableAutoConnect bool
@@ -85,6 +92,7 @@ type Config struct {
 	Cors               string
 	BzzAccount         string
 	GlobalStoreAPI     string
+	PrometheusAddr     string // listen address of the Prometheus endpoint of the swap and syncer metrics, disabled if empty
 	privateKey         *ecdsa.PrivateKey
 }
 
@@ -98,6 +106,7 @@ func NewConfig() *Config {
 		SwapDepositAmount:       swap.DefaultDepositAmount,
 		SwapPaymentThreshold:    swap.DefaultPaymentThreshold,
 		SwapDisconnectThreshold: swap.DefaultDisconnectThreshold,
+		SwapDisconnectPolicy:    swap.DefaultDisconnectPolicy.String(),
 		SwapLogPath:             "",
 		SwapLogLevel:            swap.DefaultSwapLogLevel,
 		HiveParams:              network.NewHiveParams(),
@@ -111,6 +120,9 @@ func NewConfig() *Config {
 		NetworkID:               network.DefaultNetworkID,
 		SyncEnabled:             true,
 		PushSyncEnabled:         true,
+		SyncStrategy:            stream.DefaultSyncStrategy.String(),
+		SyncDedupCacheSize:      stream.DefaultSyncDedupCacheSize,
+		SyncMaxInfoReqs:         stream.DefaultMaxStreamInfoReqs,
 		EnablePinning:           false,
 	}
 }
@@ -19,11 +19,13 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethersphere/swarm/chunk"
 	"github.com/ethersphere/swarm/log"
 	"github.com/ethersphere/swarm/network"
@@ -116,6 +118,15 @@ func (i *Inspector) Has(chunkAddresses []storage.Address) string {
 	return strings.Join(hostChunks, "")
 }
 
+// SyncStrategy returns the name of the strategy by which the sync bins of peers are requested
+func (i *Inspector) SyncStrategy() (string, error) {
+	strategy, ok := i.stream.SyncStrategy()
+	if !ok {
+		return "", errors.New("not syncing")
+	}
+	return strategy.String(), nil
+}
+
 func (i *Inspector) PeerStreams() (string, error) {
 	peerInfo, err := i.stream.PeerInfo()
 	if err != nil {
@@ -128,6 +139,54 @@ func (i *Inspector) PeerStreams() (string, error) {
 	return string(v), nil
 }
 
+// ProbePeerCursors asks a connected peer for its current cursors of the given sync bins
+// it does not change which streams are synced from the peer
+func (i *Inspector) ProbePeerCursors(peer enode.ID, bins []int) (*stream.StreamInfoRes, error) {
+	pos := make([]uint8, len(bins))
+	for j, bin := range bins {
+		if bin < 0 || bin > int(chunk.MaxPO) {
+			return nil, fmt.Errorf("invalid bin %d", bin)
+		}
+		pos[j] = uint8(bin)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return i.stream.ProbeCursors(ctx, peer, pos)
+}
+
+// ResyncPeer syncs the given bins from a connected peer again from the start, all synced bins if none are given
+// chunks already in the local store are not delivered again
+func (i *Inspector) ResyncPeer(peer enode.ID, bins []int) error {
+	pos := make([]uint8, len(bins))
+	for j, bin := range bins {
+		if bin < 0 || bin > int(chunk.MaxPO) {
+			return fmt.Errorf("invalid bin %d", bin)
+		}
+		pos[j] = uint8(bin)
+	}
+	return i.stream.Resync(peer, pos...)
+}
+
+// SyncBinRange is the proximity order of a peer and the range [Start, End) of the bins synced from it
+type SyncBinRange struct {
+	PO    int `json:"po"`
+	Start int `json:"start"` // -1 if no bins are synced from the peer
+	End   int `json:"end"`   // -1 if no bins are synced from the peer
+}
+
+// PeerSyncBins returns the proximity order of a connected peer and the range of bins synced from it at the current depth
+func (i *Inspector) PeerSyncBins(peer enode.ID) (*SyncBinRange, error) {
+	po, start, end, err := i.stream.PeerSyncBins(peer)
+	if err != nil {
+		return nil, err
+	}
+	return &SyncBinRange{
+		PO:    po,
+		Start: start,
+		End:   end,
+	}, nil
+}
+
 func (i *Inspector) StorageIndices() (map[string]int, error) {
 	return i.ls.DebugIndices()
 }
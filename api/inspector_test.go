@@ -42,7 +42,7 @@ func TestInspectorPeerStreams(t *testing.T) {
 	i := NewInspector(nil, nil, netStore, stream.New(state.NewInmemoryStore(), baseAddress, stream.NewSyncProvider(netStore, network.NewKademlia(
 		baseKey,
 		network.NewKadParams(),
-	), baseAddress, false, false)), localStore)
+	), baseAddress, false, false, stream.DefaultSyncStrategy, stream.DefaultSyncDedupCacheSize)), localStore)
 
 	server := rpc.NewServer()
 	if err := server.RegisterName("inspector", i); err != nil {
@@ -88,7 +88,7 @@ func TestInspectorStorageIndices(t *testing.T) {
 	i := NewInspector(nil, nil, netStore, stream.New(state.NewInmemoryStore(), network.NewBzzAddr(baseKey, baseKey), stream.NewSyncProvider(netStore, network.NewKademlia(
 		baseKey,
 		network.NewKadParams(),
-	), baseAddress, false, false)), localStore)
+	), baseAddress, false, false, stream.DefaultSyncStrategy, stream.DefaultSyncDedupCacheSize)), localStore)
 
 	server := rpc.NewServer()
 	if err := server.RegisterName("inspector", i); err != nil {
@@ -35,6 +35,7 @@ import (
 	"github.com/naoina/toml"
 
 	bzzapi "github.com/ethersphere/swarm/api"
+	"github.com/ethersphere/swarm/internal/flags"
 	"github.com/ethersphere/swarm/network"
 )
 
@@ -72,7 +73,13 @@ const (
 	SwarmEnvSwapBackendURL          = "SWARM_SWAP_BACKEND_URL"
 	SwarmEnvSwapPaymentThreshold    = "SWARM_SWAP_PAYMENT_THRESHOLD"
 	SwarmEnvSwapDisconnectThreshold = "SWARM_SWAP_DISCONNECT_THRESHOLD"
+	SwarmEnvSwapDisconnectPolicy    = "SWARM_SWAP_DISCONNECT_POLICY"
+	SwarmEnvSwapRequireVerified     = "SWARM_SWAP_REQUIRE_VERIFIED_CONTRACT"
 	SwarmNoSync                     = "SWARM_NO_SYNC"
+	SwarmEnvSyncStrategy            = "SWARM_SYNC_STRATEGY"
+	SwarmEnvSyncDedupCacheSize      = "SWARM_SYNC_DEDUP_CACHE_SIZE"
+	SwarmEnvSyncMaxInfoReqs         = "SWARM_SYNC_MAX_INFO_REQS"
+	SwarmEnvSyncBudget              = "SWARM_SYNC_BUDGET"
 	SwarmEnvSwapLogPath             = "SWARM_SWAP_LOG_PATH"
 	SwarmEnvSwapLogLevel            = "SWARM_SWAP_LOG_LEVEL"
 	SwarmEnvLightNodeEnable         = "SWARM_LIGHT_NODE_ENABLE"
@@ -228,10 +235,31 @@ func flagsOverride(currentConfig *bzzapi.Config, ctx *cli.Context) *bzzapi.Confi
 	if disconnectThreshold := ctx.GlobalUint64(SwarmSwapDisconnectThresholdFlag.Name); disconnectThreshold != 0 {
 		currentConfig.SwapDisconnectThreshold = disconnectThreshold
 	}
+	if disconnectPolicy := ctx.GlobalString(SwarmSwapDisconnectPolicyFlag.Name); disconnectPolicy != "" {
+		currentConfig.SwapDisconnectPolicy = disconnectPolicy
+	}
+	if requireVerified := ctx.GlobalBool(SwarmSwapRequireVerifiedFlag.Name); requireVerified {
+		currentConfig.SwapRequireVerified = true
+	}
 	if ctx.GlobalIsSet(SwarmNoSyncFlag.Name) {
 		val := !ctx.GlobalBool(SwarmNoSyncFlag.Name)
 		currentConfig.SyncEnabled, currentConfig.PushSyncEnabled = val, val // if the flag is set (true) - push and pull sync should be disabled
 	}
+	if syncStrategy := ctx.GlobalString(SwarmSyncStrategyFlag.Name); syncStrategy != "" {
+		currentConfig.SyncStrategy = syncStrategy
+	}
+	if dedupCacheSize := ctx.GlobalInt(SwarmSyncDedupCacheSizeFlag.Name); dedupCacheSize != 0 {
+		currentConfig.SyncDedupCacheSize = dedupCacheSize
+	}
+	if maxInfoReqs := ctx.GlobalInt(SwarmSyncMaxInfoReqsFlag.Name); maxInfoReqs != 0 {
+		currentConfig.SyncMaxInfoReqs = maxInfoReqs
+	}
+	if syncBudget := ctx.GlobalUint64(SwarmSyncBudgetFlag.Name); syncBudget != 0 {
+		currentConfig.SyncBudget = syncBudget
+	}
+	if prometheusAddr := ctx.GlobalString(flags.MetricsPrometheusAddrFlag.Name); prometheusAddr != "" {
+		currentConfig.PrometheusAddr = prometheusAddr
+	}
 	if ctx.GlobalIsSet(SwarmLightNodeEnabled.Name) {
 		currentConfig.LightNodeEnabled = true
 	}
@@ -73,6 +73,10 @@ var (
 		Name:  "trace",
 		Usage: "Write execution trace to the given file",
 	}
+	logFullPeerIDsFlag = cli.BoolFlag{
+		Name:  "log.fullpeerids",
+		Usage: "Log peers by their full id instead of its first 8 hex characters",
+	}
 )
 
 // debugFlags holds all command-line flags required for debugging.
@@ -80,4 +84,5 @@ var debugFlags = []cli.Flag{
 	verbosityFlag, vmoduleFlag, backtraceAtFlag, debugFlag,
 	pprofFlag, pprofAddrFlag, pprofPortFlag,
 	memprofilerateFlag, blockprofilerateFlag, cpuprofileFlag, traceFlag,
+	logFullPeerIDsFlag,
 }
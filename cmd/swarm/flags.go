@@ -94,11 +94,41 @@ var (
 		Usage:  "honey amount at which a peer disconnects",
 		EnvVar: SwarmEnvSwapDisconnectThreshold,
 	}
+	SwarmSwapDisconnectPolicyFlag = cli.StringFlag{
+		Name:   "swap-disconnect-policy",
+		Usage:  "What happens when a peer reaches the disconnect threshold: disconnect drops it, throttle stops serving it, suspend-accounting serves it for free",
+		EnvVar: SwarmEnvSwapDisconnectPolicy,
+	}
+	SwarmSwapRequireVerifiedFlag = cli.BoolFlag{
+		Name:   "swap-require-verified-contract",
+		Usage:  "Refuse to serve peers on credit whose chequebook is not deployed by the factory, not issued by them or without enough deposit",
+		EnvVar: SwarmEnvSwapRequireVerified,
+	}
 	SwarmNoSyncFlag = cli.BoolFlag{
 		Name:   "no-sync",
 		Usage:  "disable syncing",
 		EnvVar: SwarmNoSync,
 	}
+	SwarmSyncStrategyFlag = cli.StringFlag{
+		Name:   "sync-strategy",
+		Usage:  "Order in which the bins of peers are synced: breadth-first covers the whole address space sooner, depth-first the own neighbourhood",
+		EnvVar: SwarmEnvSyncStrategy,
+	}
+	SwarmSyncDedupCacheSizeFlag = cli.IntFlag{
+		Name:   "sync-dedup-cache-size",
+		Usage:  "Number of chunks tracked to not request or store a chunk offered by several peers twice",
+		EnvVar: SwarmEnvSyncDedupCacheSize,
+	}
+	SwarmSyncMaxInfoReqsFlag = cli.IntFlag{
+		Name:   "sync-max-info-reqs",
+		Usage:  "Number of stream info requests of a peer handled at once, further requests wait for their turn",
+		EnvVar: SwarmEnvSyncMaxInfoReqs,
+	}
+	SwarmSyncBudgetFlag = cli.Uint64Flag{
+		Name:   "sync-budget",
+		Usage:  "Number of chunks syncing may store, the chunks most distant from the node are evicted beyond it (default: unlimited)",
+		EnvVar: SwarmEnvSyncBudget,
+	}
 	SwarmSwapLogPathFlag = cli.StringFlag{
 		Name:   "swap-audit-logpath",
 		Usage:  "Write execution logs of swap audit to the given directory",
@@ -45,6 +45,7 @@ import (
 	bzzapi "github.com/ethersphere/swarm/api"
 	"github.com/ethersphere/swarm/internal/debug"
 	"github.com/ethersphere/swarm/internal/flags"
+	swarmlog "github.com/ethersphere/swarm/log"
 	swarmmetrics "github.com/ethersphere/swarm/metrics"
 	"github.com/ethersphere/swarm/network"
 	"github.com/ethersphere/swarm/storage/mock"
@@ -183,6 +184,8 @@ func init() {
 		SwarmSwapEnabledFlag,
 		SwarmSwapBackendURLFlag,
 		SwarmSwapDisconnectThresholdFlag,
+		SwarmSwapDisconnectPolicyFlag,
+		SwarmSwapRequireVerifiedFlag,
 		SwarmSwapPaymentThresholdFlag,
 		SwarmSwapLogPathFlag,
 		SwarmSwapLogLevelFlag,
@@ -192,6 +195,10 @@ func init() {
 		SwarmSwapDepositAmountFlag,
 		// end of swap flags
 		SwarmNoSyncFlag,
+		SwarmSyncStrategyFlag,
+		SwarmSyncDedupCacheSizeFlag,
+		SwarmSyncMaxInfoReqsFlag,
+		SwarmSyncBudgetFlag,
 		SwarmLightNodeEnabled,
 		SwarmListenAddrFlag,
 		SwarmPortFlag,
@@ -246,6 +253,12 @@ func init() {
 		}); err != nil {
 			return err
 		}
+		if ctx.GlobalBool(logFullPeerIDsFlag.Name) {
+			swarmlog.EnableFullPeerIDs()
+		}
+		if ctx.GlobalBool(flags.MetricsPeersFlag.Name) {
+			swarmlog.EnablePeerMetrics()
+		}
 		swarmmetrics.Setup(swarmmetrics.Options{
 			Endoint:       ctx.GlobalString(flags.MetricsInfluxDBEndpointFlag.Name),
 			Database:      ctx.GlobalString(flags.MetricsInfluxDBDatabaseFlag.Name),
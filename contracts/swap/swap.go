@@ -20,9 +20,13 @@
 package swap
 
 import (
+	"context"
 	"fmt"
 	"math/big"
+	"strings"
 
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -41,8 +45,12 @@ type Contract interface {
 	CashChequeBeneficiaryStart(opts *bind.TransactOpts, beneficiary common.Address, cumulativePayout *int256.Uint256, ownerSig []byte) (*types.Transaction, error)
 	// CashChequeBeneficiaryResult processes the receipt from a CashChequeBeneficiary transaction
 	CashChequeBeneficiaryResult(receipt *types.Receipt) *CashChequeResult
+	// CashChequeBeneficiaryEstimate simulates cashing a cheque as the beneficiary opts.From without sending a transaction
+	CashChequeBeneficiaryEstimate(opts *bind.CallOpts, recipient common.Address, cumulativePayout *int256.Uint256, ownerSig []byte) (uint64, error)
 	// LiquidBalance returns the LiquidBalance (total balance in ERC20-token - total hard deposits in ERC20-token) of the chequebook
 	LiquidBalance(auth *bind.CallOpts) (*big.Int, error)
+	// LiquidBalanceFor returns the balance available for paying out to beneficiary, the liquid balance plus its hard deposit
+	LiquidBalanceFor(auth *bind.CallOpts, beneficiary common.Address) (*big.Int, error)
 	//Token returns the address of the ERC20 contract, used by the chequebook
 	Token(auth *bind.CallOpts) (common.Address, error)
 	//BalanceAtTokenContract returns the balance of the account for the underlying ERC20 contract of the chequebook
@@ -166,11 +174,42 @@ func (s simpleContract) CashChequeBeneficiaryResult(receipt *types.Receipt) *Cas
 	return result
 }
 
+// CashChequeBeneficiaryEstimate simulates cashing a cheque as the beneficiary opts.From against the current state of the chain
+// no transaction is sent. It returns the gas the transaction would use, or an error if it would fail.
+// the gas estimation is used instead of a call because calls do not report failing transactions
+func (s simpleContract) CashChequeBeneficiaryEstimate(opts *bind.CallOpts, recipient common.Address, cumulativePayout *int256.Uint256, ownerSig []byte) (uint64, error) {
+	if opts == nil {
+		opts = new(bind.CallOpts)
+	}
+	parsed, err := abi.JSON(strings.NewReader(contract.ERC20SimpleSwapABI))
+	if err != nil {
+		return 0, err
+	}
+	input, err := parsed.Pack("cashChequeBeneficiary", recipient, big.NewInt(0).Set(cumulativePayout.Value()), ownerSig)
+	if err != nil {
+		return 0, err
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return s.backend.EstimateGas(ctx, ethereum.CallMsg{
+		From: opts.From,
+		To:   &s.address,
+		Data: input,
+	})
+}
+
 // LiquidBalance returns the LiquidBalance (total balance in ERC20-token - total hard deposits in ERC20-token) of the chequebook
 func (s simpleContract) LiquidBalance(opts *bind.CallOpts) (*big.Int, error) {
 	return s.instance.LiquidBalance(opts)
 }
 
+// LiquidBalanceFor returns the balance available for paying out to beneficiary, the liquid balance plus its hard deposit
+func (s simpleContract) LiquidBalanceFor(opts *bind.CallOpts, beneficiary common.Address) (*big.Int, error) {
+	return s.instance.LiquidBalanceFor(opts, beneficiary)
+}
+
 //Token returns the address of the ERC20 contract, used by the chequebook
 func (s simpleContract) Token(opts *bind.CallOpts) (common.Address, error) {
 	return s.instance.Token(opts)
@@ -30,6 +30,8 @@ var Metrics = []cli.Flag{
 	MetricsInfluxDBUsernameFlag,
 	MetricsInfluxDBPasswordFlag,
 	MetricsInfluxDBTagsFlag,
+	MetricsPeersFlag,
+	MetricsPrometheusAddrFlag,
 }
 
 var (
@@ -66,4 +68,14 @@ var (
 		Usage: "Comma-separated InfluxDB tags (key/values) attached to all measurements",
 		Value: "host=localhost",
 	}
+	// Metrics per peer add series for every peer the node was ever connected to, so they are disabled by default.
+	MetricsPeersFlag = cli.BoolFlag{
+		Name:  "metrics.peers",
+		Usage: "Enable metrics per peer",
+	}
+	// The Prometheus endpoint only serves the swap and syncer metrics, the metrics per peer are left out.
+	MetricsPrometheusAddrFlag = cli.StringFlag{
+		Name:  "metrics.prometheus.addr",
+		Usage: "Listen address of the endpoint serving the swap and syncer metrics in the Prometheus text format at /metrics, disabled if empty",
+	}
 )
@@ -9,10 +9,14 @@ const (
 	// CallDepth is set to 1 in order to influence to reported line number of
 	// the log message with 1 skipped stack frame of calling l.Output()
 	CallDepth = 1
+	// ShortPeerIDLength is the number of leading hex characters of its id a peer is logged with by default
+	ShortPeerIDLength = 8
 )
 
 var (
-	logBaseAddr = false
+	logBaseAddr    = false
+	logFullPeerIDs = false
+	peerMetrics    = false
 )
 
 // Export go-ethereum/log interface so that swarm/log can be used with it interchangeably
@@ -38,6 +42,41 @@ func EnableBaseAddress() {
 	logBaseAddr = true
 }
 
+// EnableFullPeerIDs logs peers by their full id instead of its short form
+func EnableFullPeerIDs() {
+	logFullPeerIDs = true
+}
+
+// PeerCtx returns the log context identifying the peer with the hex encoded id
+// by default the short form is logged as "peer" and the full id as "peer_id" for correlation,
+// with full peer ids enabled the full id is logged as "peer"
+func PeerCtx(id string) []interface{} {
+	if logFullPeerIDs || len(id) <= ShortPeerIDLength {
+		return []interface{}{"peer", id}
+	}
+	return []interface{}{"peer", id[:ShortPeerIDLength], "peer_id", id}
+}
+
+// EnablePeerMetrics enables metrics per peer
+// they are disabled by default, as every peer adds its own series to the metrics
+func EnablePeerMetrics() {
+	peerMetrics = true
+}
+
+// PeerMetricsEnabled tells whether metrics per peer are collected
+func PeerMetricsEnabled() bool {
+	return peerMetrics
+}
+
+// PeerMetricName returns the name of a metric of the peer with the hex encoded id
+// the peer is identified by the short form of its id: prefix/<peer>/name
+func PeerMetricName(prefix, id, name string) string {
+	if len(id) > ShortPeerIDLength {
+		id = id[:ShortPeerIDLength]
+	}
+	return prefix + "/" + id + "/" + name
+}
+
 // Warn is a convenient alias for log.Warn with stats
 func Warn(msg string, ctx ...interface{}) {
 	metrics.GetOrRegisterCounter("warn", nil).Inc(1)
@@ -0,0 +1,161 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package prometheus exports the swap accounting and syncer metrics in the Prometheus text format,
+// with names following the Prometheus conventions and labels identifying the node
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// Namespace is the prefix of the names of all exported metrics
+const Namespace = "swarm"
+
+// DefaultPrefixes are the prefixes of the metrics exported by default, the ones of the swap accounting and of the syncer
+var DefaultPrefixes = []string{"swap/", "network/stream/"}
+
+// DefaultExclude are the prefixes of the metrics not exported by default, the ones per peer,
+// which would add series for every peer the node was ever connected to
+var DefaultExclude = []string{"swap/peer/"}
+
+// quantiles are the quantiles exported for histograms and timers
+var quantiles = []float64{0.5, 0.9, 0.99}
+
+// Options selects the exported metrics and sets the labels of their samples
+type Options struct {
+	Prefixes []string          // prefixes of the names of the exported metrics, DefaultPrefixes if nil
+	Exclude  []string          // prefixes of the names of metrics which are not exported, DefaultExclude if nil
+	Labels   map[string]string // labels added to every sample, which must only take a few values, e.g. the chain ID and the role of the node
+}
+
+// Handler returns an HTTP handler which writes the selected metrics of reg in the Prometheus text format
+// counters and meters are exported as counters, with a _total suffix, gauges as gauges and histograms and timers as summaries
+// resetting timers are left out, as reading them would reset them for other reporters like InfluxDB
+func Handler(reg metrics.Registry, o Options) http.Handler {
+	if o.Prefixes == nil {
+		o.Prefixes = DefaultPrefixes
+	}
+	if o.Exclude == nil {
+		o.Exclude = DefaultExclude
+	}
+	labels := formatLabels(o.Labels)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var names []string
+		reg.Each(func(name string, _ interface{}) {
+			if hasPrefix(name, o.Prefixes) && !hasPrefix(name, o.Exclude) {
+				names = append(names, name)
+			}
+		})
+		sort.Strings(names)
+
+		buf := new(bytes.Buffer)
+		for _, name := range names {
+			writeMetric(buf, metricName(name), labels, reg.Get(name))
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	})
+}
+
+// writeMetric writes the samples of metric m named name to buf
+func writeMetric(buf *bytes.Buffer, name string, labels []string, m interface{}) {
+	switch m := m.(type) {
+	case metrics.Counter:
+		writeSample(buf, "counter", name+"_total", labels, m.Count())
+	case metrics.Meter:
+		writeSample(buf, "counter", name+"_total", labels, m.Snapshot().Count())
+	case metrics.Gauge:
+		writeSample(buf, "gauge", name, labels, m.Value())
+	case metrics.GaugeFloat64:
+		writeSample(buf, "gauge", name, labels, m.Value())
+	case metrics.Histogram:
+		h := m.Snapshot()
+		writeSummary(buf, name, labels, h.Percentiles(quantiles), h.Count(), h.Sum())
+	case metrics.Timer:
+		t := m.Snapshot()
+		writeSummary(buf, name, labels, t.Percentiles(quantiles), t.Count(), t.Sum())
+	}
+}
+
+// writeSample writes the type and the only sample of a counter or gauge
+func writeSample(buf *bytes.Buffer, typ, name string, labels []string, value interface{}) {
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(buf, "%s%s %v\n", name, joinLabels(labels), value)
+}
+
+// writeSummary writes the type and the samples of a summary
+func writeSummary(buf *bytes.Buffer, name string, labels []string, values []float64, count, sum int64) {
+	fmt.Fprintf(buf, "# TYPE %s summary\n", name)
+	for i, q := range quantiles {
+		quantile := fmt.Sprintf("quantile=%q", strconv.FormatFloat(q, 'f', -1, 64))
+		fmt.Fprintf(buf, "%s%s %v\n", name, joinLabels(append(labels[:len(labels):len(labels)], quantile)), values[i])
+	}
+	fmt.Fprintf(buf, "%s_sum%s %d\n", name, joinLabels(labels), sum)
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, joinLabels(labels), count)
+}
+
+// metricName returns the Prometheus name of the metric named name
+// the name is prefixed with the Namespace and characters which are not allowed, like the / separating the parts of the name, are replaced by _
+func metricName(name string) string {
+	return Namespace + "_" + sanitize(name)
+}
+
+// sanitize replaces all characters which are not allowed in a Prometheus metric or label name by _
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// formatLabels returns the labels formatted as name="value" pairs, sorted by name
+func formatLabels(labels map[string]string) []string {
+	formatted := make([]string, 0, len(labels))
+	for name, value := range labels {
+		formatted = append(formatted, fmt.Sprintf("%s=%q", sanitize(name), value))
+	}
+	sort.Strings(formatted)
+	return formatted
+}
+
+// joinLabels returns the label set of a sample, an empty string if there are no labels
+func joinLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// hasPrefix reports whether name starts with one of prefixes
+func hasPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
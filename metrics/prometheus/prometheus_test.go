@@ -0,0 +1,86 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package prometheus
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// TestHandler tests that only the selected metrics are exported, named after the Prometheus conventions and labelled
+func TestHandler(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+
+	reg := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("swap/cheques/emitted/num", reg).Inc(3)
+	metrics.NewRegisteredGauge("network/stream/sync_provider/strategy", reg).Update(1)
+	metrics.NewRegisteredGauge("swap/peer/0123456789abcdef/balance", reg).Update(42)
+	metrics.NewRegisteredCounter("localstore/gc", reg).Inc(1)
+
+	rec := httptest.NewRecorder()
+	Handler(reg, Options{
+		Labels: map[string]string{"role": "full", "chain_id": "5"},
+	}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# TYPE swarm_network_stream_sync_provider_strategy gauge
+swarm_network_stream_sync_provider_strategy{chain_id="5",role="full"} 1
+# TYPE swarm_swap_cheques_emitted_num_total counter
+swarm_swap_cheques_emitted_num_total{chain_id="5",role="full"} 3
+`
+	if string(body) != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, body)
+	}
+}
+
+// TestSummary tests that histograms are exported as summaries with their quantiles, sum and count
+func TestSummary(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+
+	reg := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("swap/cashout/gas", reg, metrics.NewUniformSample(10))
+	h.Update(2)
+	h.Update(4)
+
+	rec := httptest.NewRecorder()
+	Handler(reg, Options{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# TYPE swarm_swap_cashout_gas summary
+swarm_swap_cashout_gas{quantile="0.5"} 3
+swarm_swap_cashout_gas{quantile="0.9"} 4
+swarm_swap_cashout_gas{quantile="0.99"} 4
+swarm_swap_cashout_gas_sum 6
+swarm_swap_cashout_gas_count 2
+`
+	if string(body) != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, body)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Capabilities is a set of optional extensions of the stream protocol
+// an extension is used with a peer only if both sides support it
+type Capabilities uint64
+
+const (
+	CapHashCompression Capabilities = 1 << iota // offered hashes are sent compressed, see compressHashes
+	CapSyncedAck                                // clients acknowledge the cursors they synced streams up to, see StreamSyncedAck
+	CapRangeInfo                                // clients can ask how many chunks are within an interval, see RangeInfoReq
+	CapCursorProbe                              // clients can ask for cursors without subscribing to the streams, see CursorProbeReq
+
+	// AllCapabilities are the extensions supported by this node by default
+	AllCapabilities = CapHashCompression | CapSyncedAck | CapRangeInfo | CapCursorProbe
+)
+
+// capabilityNames are the names of the capabilities in the order of their bits
+var capabilityNames = []string{"hash-compression", "synced-ack", "range-info", "cursor-probe"}
+
+// capabilitiesHandshakeTimeout limits the time waiting for the capabilities of a peer
+var capabilitiesHandshakeTimeout = 3 * time.Second
+
+// Has returns whether all capabilities of c are in the set
+func (cs Capabilities) Has(c Capabilities) bool {
+	return cs&c == c
+}
+
+// String returns the names of the capabilities in the set
+// unknown capabilities, e.g. of a newer peer, are shown as their bit
+func (cs Capabilities) String() string {
+	var names []string
+	for i := uint(0); i < 64; i++ {
+		if cs&(1<<i) == 0 {
+			continue
+		}
+		if int(i) < len(capabilityNames) {
+			names = append(names, capabilityNames[i])
+		} else {
+			names = append(names, fmt.Sprintf("bit-%d", i))
+		}
+	}
+	return "[" + strings.Join(names, ",") + "]"
+}
+
+// negotiateCapabilities returns the capabilities to use with the peer, which are the ones both sides support
+// they are exchanged in a handshake from capabilitiesVersion on, peers running an older version support none of them
+func (r *Registry) negotiateCapabilities(p *Peer, version uint) (Capabilities, error) {
+	if version < capabilitiesVersion {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), capabilitiesHandshakeTimeout)
+	defer cancel()
+
+	rhs, err := p.Handshake(ctx, &CapabilitiesHandshake{Capabilities: r.capabilities}, func(msg interface{}) error {
+		if _, ok := msg.(*CapabilitiesHandshake); !ok {
+			return fmt.Errorf("unexpected handshake message %T", msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("capabilities handshake: %w", err)
+	}
+	remote := rhs.(*CapabilitiesHandshake).Capabilities
+	p.logger.Debug("negotiated capabilities", "ours", r.capabilities, "theirs", remote)
+	return r.capabilities & remote, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethersphere/swarm/network"
+	"github.com/ethersphere/swarm/network/simulation"
+	"github.com/ethersphere/swarm/state"
+)
+
+// versionedRegistry is a Registry which only supports the protocol versions up to maxVersion
+type versionedRegistry struct {
+	*Registry
+	maxVersion uint
+}
+
+func (r *versionedRegistry) Protocols() []p2p.Protocol {
+	var protos []p2p.Protocol
+	for _, p := range r.Registry.Protocols() {
+		if p.Version <= r.maxVersion {
+			protos = append(protos, p)
+		}
+	}
+	return protos
+}
+
+// TestCapabilitiesNegotiation tests that peers with different capabilities use only the ones both of them support,
+// that peers running the version before the capabilities handshake use none of them, and that syncing works either way
+func TestCapabilitiesNegotiation(t *testing.T) {
+	type nodeOptions struct {
+		capabilities Capabilities
+		maxVersion   uint
+	}
+	for _, tc := range []struct {
+		name  string
+		nodes [2]nodeOptions
+		want  Capabilities
+	}{
+		{
+			name:  "same capabilities",
+			nodes: [2]nodeOptions{{AllCapabilities, capabilitiesVersion}, {AllCapabilities, capabilitiesVersion}},
+			want:  AllCapabilities,
+		},
+		{
+			name:  "subset",
+			nodes: [2]nodeOptions{{AllCapabilities, capabilitiesVersion}, {CapSyncedAck, capabilitiesVersion}},
+			want:  CapSyncedAck,
+		},
+		{
+			name:  "disjoint",
+			nodes: [2]nodeOptions{{CapHashCompression, capabilitiesVersion}, {CapSyncedAck | CapRangeInfo, capabilitiesVersion}},
+			want:  0,
+		},
+		{
+			name:  "unknown capabilities",
+			nodes: [2]nodeOptions{{AllCapabilities | 1<<63, capabilitiesVersion}, {AllCapabilities, capabilitiesVersion}},
+			want:  AllCapabilities,
+		},
+		{
+			name:  "older version",
+			nodes: [2]nodeOptions{{AllCapabilities, capabilitiesVersion}, {AllCapabilities, protocolVersion}},
+			want:  0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var created int32
+			opts := &SyncSimServiceOptions{
+				InitialChunkCount: 100,
+				Autostart:         true,
+				StreamConstructorFunc: func(s state.Store, b *network.BzzAddr, p ...StreamProvider) node.Service {
+					r := New(s, b, p...)
+					n := tc.nodes[atomic.AddInt32(&created, 1)-1]
+					r.capabilities = n.capabilities
+					return &versionedRegistry{Registry: r, maxVersion: n.maxVersion}
+				},
+			}
+			sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+				serviceNameStream: newSyncSimServiceFunc(opts),
+			}, false)
+			defer sim.Close()
+
+			if _, err := sim.AddNodesAndConnectStar(2); err != nil {
+				t.Fatal(err)
+			}
+			nodeIDs := sim.UpNodeIDs()
+			for i, id := range nodeIDs {
+				registry := sim.Service(serviceNameStream, id).(*versionedRegistry).Registry
+
+				// the history of the other node is synced
+				var peer *Peer
+				for j := 0; peer == nil || peer.stats.stats().ChunksDelivered == 0; j++ {
+					if j == 200 {
+						t.Fatal("timeout waiting for chunks to be synced")
+					}
+					time.Sleep(50 * time.Millisecond)
+					peer = registry.getPeer(nodeIDs[1-i])
+				}
+				if peer.capabilities != tc.want {
+					t.Fatalf("expected capabilities %v, got %v", tc.want, peer.capabilities)
+				}
+
+				// range info requests are refused if the peer does not support them
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_, err := registry.RangeInfo(ctx, nodeIDs[1-i], NewID(syncStreamName, encodeSyncKey(0)), 1, nil)
+				cancel()
+				if supported := tc.want.Has(CapRangeInfo); supported != (err == nil) {
+					t.Fatalf("expected range info supported %v, got error %v", supported, err)
+				}
+
+				// so are cursor probes
+				ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+				_, err = registry.ProbeCursors(ctx, nodeIDs[1-i], []uint8{0})
+				cancel()
+				if supported := tc.want.Has(CapCursorProbe); supported != (err == nil) {
+					t.Fatalf("expected cursor probes supported %v, got error %v", supported, err)
+				}
+			}
+		})
+	}
+}
+
+// TestCapabilitiesString tests the names of the capabilities
+func TestCapabilitiesString(t *testing.T) {
+	for _, tc := range []struct {
+		capabilities Capabilities
+		want         string
+	}{
+		{0, "[]"},
+		{CapSyncedAck, "[synced-ack]"},
+		{AllCapabilities, "[hash-compression,synced-ack,range-info,cursor-probe]"},
+		{CapHashCompression | 1<<10, "[hash-compression,bit-10]"},
+	} {
+		if got := tc.capabilities.String(); got != tc.want {
+			t.Errorf("expected %s, got %s", tc.want, got)
+		}
+	}
+}
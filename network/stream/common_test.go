@@ -95,6 +95,7 @@ type SyncSimServiceOptions struct {
 	InitialChunkCount     uint64
 	SyncOnlyWithinDepth   bool
 	Autostart             bool
+	SyncStrategy          SyncStrategy
 	StreamConstructorFunc func(state.Store, *network.BzzAddr, ...StreamProvider) node.Service
 }
 
@@ -155,7 +156,7 @@ func newSyncSimServiceFunc(o *SyncSimServiceOptions) func(ctx *adapters.ServiceC
 		if err != nil {
 			return nil, nil, err
 		}
-		sp := NewSyncProvider(netStore, kad, addr, o.Autostart, o.SyncOnlyWithinDepth)
+		sp := NewSyncProvider(netStore, kad, addr, o.Autostart, o.SyncOnlyWithinDepth, o.SyncStrategy, 0)
 		ss := o.StreamConstructorFunc(store, addr, sp)
 
 		cleanup = func() {
@@ -0,0 +1,83 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import "fmt"
+
+// compressHashes compresses the concatenated hashes of an OfferedHashes message
+// all hashes offered for a bin share the proximity prefix with the address of the server, so the
+// bytes common to all hashes are sent only once:
+//
+//	prefix length (1 byte) | prefix | hash 1 without prefix | hash 2 without prefix | ...
+//
+// the prefix is shorter than HashSize, so that the number of hashes can be derived from the length
+// no hashes are compressed to no bytes
+func compressHashes(hashes []byte) []byte {
+	if len(hashes) == 0 {
+		return []byte{}
+	}
+	prefixLen := HashSize - 1
+	first := hashes[:HashSize]
+	for i := HashSize; i < len(hashes) && prefixLen > 0; i += HashSize {
+		prefixLen = commonPrefixLen(first[:prefixLen], hashes[i:i+prefixLen])
+	}
+
+	count := len(hashes) / HashSize
+	compressed := make([]byte, 0, 1+prefixLen+count*(HashSize-prefixLen))
+	compressed = append(compressed, byte(prefixLen))
+	compressed = append(compressed, first[:prefixLen]...)
+	for i := 0; i < len(hashes); i += HashSize {
+		compressed = append(compressed, hashes[i+prefixLen:i+HashSize]...)
+	}
+	return compressed
+}
+
+// decompressHashes restores the concatenated hashes compressed by compressHashes
+func decompressHashes(compressed []byte) ([]byte, error) {
+	if len(compressed) == 0 {
+		return []byte{}, nil
+	}
+	prefixLen := int(compressed[0])
+	if prefixLen >= HashSize {
+		return nil, fmt.Errorf("invalid prefix length %d", prefixLen)
+	}
+	if len(compressed) < 1+prefixLen {
+		return nil, fmt.Errorf("compressed hashes of length %d too short for prefix length %d", len(compressed), prefixLen)
+	}
+	prefix := compressed[1 : 1+prefixLen]
+	suffixes := compressed[1+prefixLen:]
+	suffixLen := HashSize - prefixLen
+	if len(suffixes) == 0 || len(suffixes)%suffixLen != 0 {
+		return nil, fmt.Errorf("invalid compressed hashes length %d for prefix length %d", len(compressed), prefixLen)
+	}
+
+	hashes := make([]byte, 0, len(suffixes)/suffixLen*HashSize)
+	for i := 0; i < len(suffixes); i += suffixLen {
+		hashes = append(hashes, prefix...)
+		hashes = append(hashes, suffixes[i:i+suffixLen]...)
+	}
+	return hashes, nil
+}
+
+// commonPrefixLen returns the number of leading bytes a and b have in common
+func commonPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethersphere/swarm/network"
+	"github.com/ethersphere/swarm/network/simulation"
+	"github.com/ethersphere/swarm/state"
+)
+
+// binHashes returns count random hashes which fall into bin po of base, as the hashes offered for that bin
+func binHashes(t testing.TB, base []byte, po, count int) []byte {
+	hashes := make([]byte, count*HashSize)
+	if _, err := rand.Read(hashes); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(hashes); i += HashSize {
+		hash := hashes[i : i+HashSize]
+		// the first po bits are the ones of base, the next one differs
+		for bit := 0; bit <= po && bit < HashSize*8; bit++ {
+			mask := byte(0x80) >> uint(bit%8)
+			want := base[bit/8] & mask
+			if bit == po {
+				want ^= mask
+			}
+			hash[bit/8] = hash[bit/8]&^mask | want
+		}
+	}
+	return hashes
+}
+
+// TestCompressHashes tests that compressed hashes are restored and the shared prefix is sent only once
+func TestCompressHashes(t *testing.T) {
+	base := make([]byte, HashSize)
+	if _, err := rand.Read(base); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		hashes    []byte
+		maxLength int
+	}{
+		{"empty", []byte{}, 0},
+		{"single", binHashes(t, base, 0, 1), 1 + HashSize},
+		{"bin 0", binHashes(t, base, 0, BatchSize), 1 + BatchSize*HashSize},
+		{"bin 8", binHashes(t, base, 8, BatchSize), 1 + 1 + BatchSize*(HashSize-1)},
+		{"bin 16", binHashes(t, base, 16, BatchSize), 1 + 2 + BatchSize*(HashSize-2)},
+		{"equal", bytes.Repeat(base, 3), 1 + HashSize - 1 + 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			compressed := compressHashes(tc.hashes)
+			if len(compressed) > tc.maxLength {
+				t.Fatalf("expected at most %d compressed bytes, got %d", tc.maxLength, len(compressed))
+			}
+			hashes, err := decompressHashes(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(hashes, tc.hashes) {
+				t.Fatalf("expected hashes %x, got %x", tc.hashes, hashes)
+			}
+		})
+	}
+
+	for _, compressed := range [][]byte{
+		{HashSize},       // prefix as long as a hash
+		{2, 0},           // prefix cut off
+		{1, 0},           // no hashes
+		{1, 0, 1, 2, 3},  // hash cut off
+		{0, 1, 2, 3, 4},  // hash cut off without prefix
+		{31, 0, 1, 2, 3}, // prefix cut off with long prefix
+	} {
+		if _, err := decompressHashes(compressed); err == nil {
+			t.Fatalf("expected an error decompressing %v", compressed)
+		}
+	}
+}
+
+// uncompressedRegistry is a Registry which only supports the protocol version without hash compression
+type uncompressedRegistry struct {
+	*Registry
+}
+
+func (r *uncompressedRegistry) Protocols() []p2p.Protocol {
+	return r.Registry.Protocols()[:1]
+}
+
+// TestHashCompressionNegotiation tests that offered hashes are compressed only if both peers support it
+// and that syncing works either way
+func TestHashCompressionNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		oldNodes     int32
+		wantCompress bool
+	}{
+		{"both new", 0, true},
+		{"one old", 1, false},
+		{"both old", 2, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var created int32
+			opts := &SyncSimServiceOptions{
+				InitialChunkCount: 100,
+				Autostart:         true,
+				StreamConstructorFunc: func(s state.Store, b *network.BzzAddr, p ...StreamProvider) node.Service {
+					r := New(s, b, p...)
+					if atomic.AddInt32(&created, 1) <= tc.oldNodes {
+						return &uncompressedRegistry{r}
+					}
+					return r
+				},
+			}
+			sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+				serviceNameStream: newSyncSimServiceFunc(opts),
+			}, false)
+			defer sim.Close()
+
+			if _, err := sim.AddNodesAndConnectStar(2); err != nil {
+				t.Fatal(err)
+			}
+			nodeIDs := sim.UpNodeIDs()
+			for i, id := range nodeIDs {
+				var registry *Registry
+				switch s := sim.Service(serviceNameStream, id).(type) {
+				case *Registry:
+					registry = s
+				case *uncompressedRegistry:
+					registry = s.Registry
+				}
+
+				// the history of the other node is synced
+				var peer *Peer
+				for j := 0; peer == nil || peer.stats.stats().ChunksDelivered == 0; j++ {
+					if j == 200 {
+						t.Fatal("timeout waiting for chunks to be synced")
+					}
+					time.Sleep(50 * time.Millisecond)
+					peer = registry.getPeer(nodeIDs[1-i])
+				}
+				if got := peer.capabilities.Has(CapHashCompression); got != tc.wantCompress {
+					t.Fatalf("expected hash compression %v, got %v", tc.wantCompress, got)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCompressHashes measures compressing full batches of hashes offered for different bins
+// and reports the size of the compressed hashes relative to the uncompressed ones
+func BenchmarkCompressHashes(b *testing.B) {
+	base := make([]byte, HashSize)
+	if _, err := rand.Read(base); err != nil {
+		b.Fatal(err)
+	}
+	for _, po := range []int{0, 4, 8, 12, 16} {
+		b.Run(fmt.Sprintf("bin-%d", po), func(b *testing.B) {
+			hashes := binHashes(b, base, po, BatchSize)
+			var compressed []byte
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				compressed = compressHashes(hashes)
+			}
+			b.ReportMetric(float64(len(compressed))/float64(len(hashes)), "size-ratio")
+		})
+	}
+}
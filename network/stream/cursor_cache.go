@@ -0,0 +1,92 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// cursorCacheTTL is how long the cursor of a bin read from the store is served to all peers asking for it
+const cursorCacheTTL = time.Second
+
+var (
+	cursorCacheHitCount  = metrics.GetOrRegisterCounter("network/stream/sync_provider/cursor/cachehit", nil)
+	cursorCacheMissCount = metrics.GetOrRegisterCounter("network/stream/sync_provider/cursor/cachemiss", nil)
+)
+
+// cursorCache shares the cursors of the bins read from the store between the stream info requests of all peers,
+// so that many peers asking for the same bin at once, e.g. when they reconnect after a network event, cause one store read
+// a cached cursor may be behind the store by the chunks stored since it was read, which is safe, as a peer syncs
+// the chunks after the cursor it was given by its live stream
+type cursorCache struct {
+	ttl  time.Duration
+	bins [chunk.MaxPO + 1]cachedCursor
+}
+
+// cachedCursor is the cursor of a bin, the lock is held while it is read from the store so that concurrent requests wait for it
+type cachedCursor struct {
+	mtx     sync.Mutex
+	cursor  uint64
+	expires time.Time // zero if the cursor was never read or is invalidated
+}
+
+// newCursorCache creates a cursorCache which serves a cursor for ttl after it was read
+func newCursorCache(ttl time.Duration) *cursorCache {
+	return &cursorCache{
+		ttl: ttl,
+	}
+}
+
+// get returns the cursor of bin, with load reading it from the store if it is not cached or expired
+func (c *cursorCache) get(bin uint8, load func(bin uint8) (uint64, error)) (uint64, error) {
+	if int(bin) >= len(c.bins) {
+		return load(bin)
+	}
+	b := &c.bins[bin]
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if time.Now().Before(b.expires) {
+		cursorCacheHitCount.Inc(1)
+		return b.cursor, nil
+	}
+	cursorCacheMissCount.Inc(1)
+	cursor, err := load(bin)
+	if err != nil {
+		return 0, err
+	}
+	b.cursor = cursor
+	b.expires = time.Now().Add(c.ttl)
+	return cursor, nil
+}
+
+// invalidate drops the cached cursors of bins, e.g. because chunks were stored in them
+func (c *cursorCache) invalidate(bins ...uint8) {
+	for _, bin := range bins {
+		if int(bin) >= len(c.bins) {
+			continue
+		}
+		b := &c.bins[bin]
+		b.mtx.Lock()
+		b.expires = time.Time{}
+		b.mtx.Unlock()
+	}
+}
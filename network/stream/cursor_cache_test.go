@@ -0,0 +1,81 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCursorCache tests that concurrent requests for the cursor of a bin cause a single store read,
+// and that the cursor is read again once it expired or was invalidated
+func TestCursorCache(t *testing.T) {
+	var loads int32
+	load := func(bin uint8) (uint64, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(10 * time.Millisecond)
+		return uint64(bin) * 100, nil
+	}
+	c := newCursorCache(time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cursor, err := c.get(3, load)
+			if err != nil {
+				t.Error(err)
+			}
+			if cursor != 300 {
+				t.Errorf("expected cursor 300, got %d", cursor)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Fatalf("expected 1 store read, got %d", n)
+	}
+
+	// bins are cached separately
+	if _, err := c.get(4, load); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&loads); n != 2 {
+		t.Fatalf("expected 2 store reads, got %d", n)
+	}
+
+	c.invalidate(3)
+	if _, err := c.get(3, load); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&loads); n != 3 {
+		t.Fatalf("expected the invalidated cursor to be read again, got %d store reads", n)
+	}
+
+	c = newCursorCache(0)
+	for i := 0; i < 2; i++ {
+		if _, err := c.get(3, load); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&loads); n != 5 {
+		t.Fatalf("expected expired cursors to be read again, got %d store reads", n)
+	}
+}
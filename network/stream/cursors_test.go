@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"math"
 	"math/rand"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -41,6 +42,7 @@ import (
 	"github.com/ethersphere/swarm/p2p/protocols"
 	"github.com/ethersphere/swarm/pot"
 	"github.com/ethersphere/swarm/state"
+	"github.com/ethersphere/swarm/storage/localstore"
 )
 
 func init() {
@@ -94,6 +96,97 @@ func TestNodesExchangeCorrectBinIndexes(t *testing.T) {
 	}
 }
 
+// TestNodesTrackLiveCursorsSeparately tests that the live cursors of the streams
+// advance with new chunks while the cursors up to which history is backfilled stay the same
+func TestNodesTrackLiveCursorsSeparately(t *testing.T) {
+	const (
+		nodeCount  = 2
+		chunkCount = 500
+	)
+	opts := &SyncSimServiceOptions{
+		InitialChunkCount: chunkCount,
+		Autostart:         true,
+	}
+
+	sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+		serviceNameStream: newSyncSimServiceFunc(opts),
+	}, false)
+	defer sim.Close()
+
+	_, err := sim.AddNodesAndConnectStar(nodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeIDs := sim.UpNodeIDs()
+	if len(nodeIDs) != nodeCount {
+		t.Fatal("not enough nodes up")
+	}
+
+	idOne := nodeIDs[0]
+	idOther := nodeIDs[1]
+
+	waitForCursors(t, sim, idOne, idOther, true)
+	registry := nodeRegistry(sim, idOne)
+	peer := registry.getPeer(idOther)
+	// the cursors can be advertised in several messages, wait for all synced bins
+	_, start, end, err := registry.PeerSyncBins(idOther)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursors := peer.getCursorsCopy()
+	for i := 0; len(cursors) < end-start; i++ {
+		if i == 200 {
+			t.Fatalf("got cursors %v, want %d", cursors, end-start)
+		}
+		time.Sleep(50 * time.Millisecond)
+		cursors = peer.getCursorsCopy()
+	}
+
+	// waitLive waits until the live cursor of every stream satisfies ok
+	waitLive := func(ok func(bin uint8, cursor, live uint64) bool) {
+		var live map[string]uint64
+		for i := 0; i < 200; i++ {
+			live = peer.getLiveCursorsCopy()
+			done := len(live) == len(cursors)
+			for stream, c := range live {
+				bin, err := parseSyncKey(parseID(stream).Key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok(bin, cursors[stream], c) {
+					done = false
+				}
+			}
+			if done {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("live cursors %v did not reach the expected values, cursors %v", live, cursors)
+	}
+
+	// the head is requested after the advertised cursor
+	waitLive(func(bin uint8, cursor, live uint64) bool {
+		return live > cursor
+	})
+
+	mustUploadChunks(context.Background(), t, nodeFileStore(sim, idOther), chunkCount)
+
+	// the live cursors follow the chunks the other node got in every bin since the cursors were advertised
+	otherStore := sim.MustNodeItem(idOther, bucketKeyLocalStore).(*localstore.DB)
+	waitLive(func(bin uint8, cursor, live uint64) bool {
+		last, err := otherStore.LastPullSubscriptionBinID(bin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return last == cursor || live == last+1
+	})
+
+	if got := peer.getCursorsCopy(); !reflect.DeepEqual(got, cursors) {
+		t.Fatalf("got history cursors %v, want %v", got, cursors)
+	}
+}
+
 // TestNodesCorrectBinsDynamic adds nodes to a star topology, connecting new nodes to the pivot node
 // after each connection is made, the cursors on the pivot are checked, to reflect the bins that we are
 // currently still interested in. this makes sure that correct bins are of interest
@@ -40,11 +40,25 @@ type Peer struct {
 
 	streamCursorsMu    sync.Mutex
 	streamCursors      map[string]uint64 // key: Stream ID string representation, value: session cursor. Keeps cursors for all streams. when unset - we are not interested in that bin
+	liveCursors        map[string]uint64 // key: Stream ID string representation, value: next index requested from the stream head. history is backfilled up to the session cursor
 	openWants          map[uint]*want    // maintain open wants on the client side
 	openOffers         map[uint]offer    // maintain open offers on the server side
 	clientOpenGetRange map[string]uint   // maintain open GetRange requests to eliminate overlapping requests on the client side
 	serverOpenGetRange map[string]uint   // maintain open GetRange requests to eliminate overlapping requests on the server side
 
+	stats *syncCounters // syncing counters for this peer
+
+	capabilities  Capabilities      // protocol extensions supported by both sides, negotiated when the peer connects
+	syncedCursors map[string]uint64 // key: Stream ID string representation, value: highest cursor the client acknowledged to have synced. guarded by mtx
+
+	probesMu sync.Mutex
+	probes   map[uint]chan *CursorProbeRes // outstanding cursor probes by ruid
+
+	rangeInfosMu sync.Mutex
+	rangeInfos   map[uint]chan *RangeInfoRes // outstanding range info requests by ruid
+
+	infoReqs *requestLimiter // bounds the StreamInfoReq messages of the peer handled at once
+
 	quit chan struct{} // closed when peer is going offline
 }
 
@@ -55,12 +69,18 @@ func newPeer(peer *network.BzzPeer, baseAddress *network.BzzAddr, i state.Store,
 		providers:          providers,
 		intervalsStore:     i,
 		streamCursors:      make(map[string]uint64),
+		liveCursors:        make(map[string]uint64),
 		openWants:          make(map[uint]*want),
 		openOffers:         make(map[uint]offer),
 		clientOpenGetRange: make(map[string]uint),
 		serverOpenGetRange: make(map[string]uint),
+		syncedCursors:      make(map[string]uint64),
+		probes:             make(map[uint]chan *CursorProbeRes),
+		rangeInfos:         make(map[uint]chan *RangeInfoRes),
+		stats:              new(syncCounters),
+		infoReqs:           newRequestLimiter(DefaultMaxStreamInfoReqs),
 		quit:               make(chan struct{}),
-		logger:             log.NewBaseAddressLogger(baseAddress.ShortString(), "peer", peer.BzzAddr.ShortString()),
+		logger:             log.NewBaseAddressLogger(baseAddress.ShortString(), append(log.PeerCtx(peer.ID().String()), "addr", peer.BzzAddr.ShortString())...),
 	}
 	return p
 }
@@ -102,6 +122,31 @@ func (p *Peer) deleteCursor(stream ID) {
 	defer p.streamCursorsMu.Unlock()
 
 	delete(p.streamCursors, stream.String())
+	delete(p.liveCursors, stream.String())
+}
+
+// getLiveCursorsCopy returns the live cursors of all unbounded streams
+func (p *Peer) getLiveCursorsCopy() map[string]uint64 {
+	p.streamCursorsMu.Lock()
+	defer p.streamCursorsMu.Unlock()
+
+	c := make(map[string]uint64, len(p.liveCursors))
+	for k, v := range p.liveCursors {
+		c[k] = v
+	}
+	return c
+}
+
+// setLiveCursor records the index from which the head of the stream is requested
+// it is only set while the session cursor of the stream exists, so that a stream we lost interest in is not tracked
+func (p *Peer) setLiveCursor(stream ID, cursor uint64) {
+	p.streamCursorsMu.Lock()
+	defer p.streamCursorsMu.Unlock()
+
+	if _, ok := p.streamCursors[stream.String()]; !ok {
+		return
+	}
+	p.liveCursors[stream.String()] = cursor
 }
 
 // InitProviders initializes a provider for a certain peer
@@ -135,6 +180,29 @@ type want struct {
 	requested time.Time           // requested at time
 	chunks    chan chunk.Address  // chunk arrived notification channel
 	closeC    chan error          // signal polling goroutine to terminate due to empty batch or timeout
+	caughtUp  bool                // the server offered less than a full batch of the head of the stream, so the client caught up
+}
+
+// setSyncedCursor records that the client synced the stream up to cursor
+// acknowledgements can arrive out of order, so only a higher cursor is recorded
+func (p *Peer) setSyncedCursor(stream ID, cursor uint64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if cur, ok := p.syncedCursors[stream.String()]; !ok || cursor > cur {
+		p.syncedCursors[stream.String()] = cursor
+	}
+}
+
+// getSyncedCursorsCopy returns the cursors the client acknowledged to have synced the streams up to
+func (p *Peer) getSyncedCursorsCopy() map[string]uint64 {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	c := make(map[string]uint64, len(p.syncedCursors))
+	for k, v := range p.syncedCursors {
+		c[k] = v
+	}
+	return c
 }
 
 // getOffer gets on open offer for the requested ruid
@@ -0,0 +1,130 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethersphere/swarm/p2p/protocols"
+)
+
+// ProbeCursors asks a connected peer for its current cursors of the given sync bins and waits for the answer
+// until ctx is done. Unlike the StreamInfoReq sent on depth changes, the response does not change
+// which streams are synced from the peer, so it can be used to compare what the peer advertises with what
+// was synced so far.
+// The probe is answered with a CursorProbeRes carrying its ruid, so that it is never mistaken for the response
+// to a subscription request for the same streams.
+func (r *Registry) ProbeCursors(ctx context.Context, id enode.ID, bins []uint8) (*StreamInfoRes, error) {
+	if len(bins) == 0 {
+		return nil, errors.New("no bins to probe")
+	}
+	p := r.getPeer(id)
+	if p == nil {
+		return nil, fmt.Errorf("peer %s not connected", id)
+	}
+	if !p.capabilities.Has(CapCursorProbe) {
+		return nil, fmt.Errorf("peer %s does not support cursor probes", id)
+	}
+
+	streams := make([]ID, len(bins))
+	for i, bin := range bins {
+		streams[i] = NewID(syncStreamName, encodeSyncKey(bin))
+	}
+	ruid := uint(rand.Uint32())
+	res := make(chan *CursorProbeRes, 1)
+	p.addProbe(ruid, res)
+	defer p.removeProbe(ruid)
+	if err := p.Send(ctx, &CursorProbeReq{
+		Ruid:    ruid,
+		Streams: streams,
+	}); err != nil {
+		return nil, fmt.Errorf("sending cursor probe: %w", err)
+	}
+
+	select {
+	case res := <-res:
+		return &StreamInfoRes{Streams: res.Streams}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.quit:
+		return nil, fmt.Errorf("peer %s disconnected", id)
+	case <-r.quit:
+		return nil, errors.New("stream registry stopped")
+	}
+}
+
+// serverHandleCursorProbeReq answers with the current cursors of the requested streams (Peer is the client)
+// it shares the limit of cursor lookups with StreamInfoReq
+func (r *Registry) serverHandleCursorProbeReq(ctx context.Context, p *Peer, msg *CursorProbeReq) error {
+	if len(msg.Streams) == 0 {
+		return protocols.Break(errors.New("nil streams msg requested"))
+	}
+	if err := p.infoReqs.acquire(p.quit); err != nil {
+		return err
+	}
+	defer p.infoReqs.release()
+
+	res := &CursorProbeRes{Ruid: msg.Ruid}
+	for _, v := range msg.Streams {
+		descriptor, err := r.streamDescriptor(v)
+		if err != nil {
+			return err
+		}
+		res.Streams = append(res.Streams, descriptor)
+	}
+	return p.Send(ctx, res)
+}
+
+// clientHandleCursorProbeRes hands the response to the probe waiting for it (Peer is the server)
+// responses to probes which were given up on are dropped
+func (r *Registry) clientHandleCursorProbeRes(ctx context.Context, p *Peer, msg *CursorProbeRes) error {
+	if !p.deliverProbe(msg) {
+		p.logger.Debug("clientHandleCursorProbeRes: no probe waiting", "ruid", msg.Ruid)
+	}
+	return nil
+}
+
+// addProbe registers a channel for the response to the cursor probe with ruid
+func (p *Peer) addProbe(ruid uint, res chan *CursorProbeRes) {
+	p.probesMu.Lock()
+	defer p.probesMu.Unlock()
+	p.probes[ruid] = res
+}
+
+// removeProbe unregisters the cursor probe with ruid
+func (p *Peer) removeProbe(ruid uint) {
+	p.probesMu.Lock()
+	defer p.probesMu.Unlock()
+	delete(p.probes, ruid)
+}
+
+// deliverProbe hands msg to the probe with its ruid and reports whether there was such a probe
+func (p *Peer) deliverProbe(msg *CursorProbeRes) bool {
+	p.probesMu.Lock()
+	defer p.probesMu.Unlock()
+	res, ok := p.probes[msg.Ruid]
+	if !ok {
+		return false
+	}
+	delete(p.probes, msg.Ruid)
+	res <- msg
+	return true
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethersphere/swarm/p2p/protocols"
+)
+
+// rangeInfoTimeout limits the time the server spends counting the chunks of an interval
+var rangeInfoTimeout = 10 * time.Second
+
+// RangeInfo asks a connected peer how many chunks it has within the interval [from, to] of a stream,
+// or [from, cursor] if to is nil, and waits for the answer until ctx is done.
+// Unlike GetRange no hashes are offered, so it is a cheap way to estimate the progress of syncing
+// an interval or to decide which intervals to request first.
+func (r *Registry) RangeInfo(ctx context.Context, id enode.ID, stream ID, from uint64, to *uint64) (*RangeInfoRes, error) {
+	p := r.getPeer(id)
+	if p == nil {
+		return nil, fmt.Errorf("peer %s not connected", id)
+	}
+	if !p.capabilities.Has(CapRangeInfo) {
+		return nil, fmt.Errorf("peer %s does not support range info requests", id)
+	}
+
+	ruid := uint(rand.Uint32())
+	res := make(chan *RangeInfoRes, 1)
+	p.addRangeInfo(ruid, res)
+	defer p.removeRangeInfo(ruid)
+	if err := p.Send(ctx, &RangeInfoReq{
+		Ruid:   ruid,
+		Stream: stream,
+		From:   from,
+		To:     to,
+	}); err != nil {
+		return nil, fmt.Errorf("sending range info request: %w", err)
+	}
+
+	select {
+	case res := <-res:
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.quit:
+		return nil, fmt.Errorf("peer %s disconnected", id)
+	case <-r.quit:
+		return nil, errors.New("stream registry stopped")
+	}
+}
+
+// serverHandleRangeInfoReq counts the chunks within the requested interval of the stream
+// from the descriptors of its subscription, which does not touch the chunk data (Peer is the client)
+func (r *Registry) serverHandleRangeInfoReq(ctx context.Context, p *Peer, msg *RangeInfoReq) error {
+	provider := r.getProvider(msg.Stream)
+	if provider == nil {
+		return protocols.Break(fmt.Errorf("unsupported provider for stream: %s", msg.Stream))
+	}
+	key, err := provider.ParseKey(msg.Stream.Key)
+	if err != nil {
+		return protocols.Break(fmt.Errorf("parsing stream key for stream %s: %w", msg.Stream, err))
+	}
+	p.logger.Debug("serverHandleRangeInfoReq", "ruid", msg.Ruid, "stream", msg.Stream, "from", msg.From, "to", msg.To)
+
+	cursor, err := provider.Cursor(msg.Stream.Key)
+	if err != nil {
+		return fmt.Errorf("getting cursor for stream %s: %w", msg.Stream, err)
+	}
+	// the subscription only ends at an existing chunk, which the cursor is
+	to := cursor
+	if msg.To != nil && *msg.To < to {
+		to = *msg.To
+	}
+
+	res := &RangeInfoRes{Ruid: msg.Ruid}
+	if cursor > 0 && msg.From <= to {
+		subCtx, cancel := context.WithTimeout(ctx, rangeInfoTimeout)
+		defer cancel()
+		descriptors, stop := provider.Subscribe(subCtx, key, msg.From, to)
+		defer stop()
+	count:
+		for {
+			select {
+			case d, ok := <-descriptors:
+				if !ok {
+					break count
+				}
+				if res.Count == 0 {
+					res.First = d.BinID
+				}
+				res.Last = d.BinID
+				res.Count++
+			case <-subCtx.Done():
+				return fmt.Errorf("counting chunks of stream %s: %w", msg.Stream, subCtx.Err())
+			case <-r.quit:
+				return nil
+			}
+		}
+	}
+	return p.Send(ctx, res)
+}
+
+// clientHandleRangeInfoRes hands the response to the request waiting for it (Peer is the server)
+// responses to requests which were given up on are dropped
+func (r *Registry) clientHandleRangeInfoRes(ctx context.Context, p *Peer, msg *RangeInfoRes) error {
+	if !p.deliverRangeInfo(msg) {
+		p.logger.Debug("clientHandleRangeInfoRes: no request waiting", "ruid", msg.Ruid)
+	}
+	return nil
+}
+
+// addRangeInfo registers a channel for the response to the range info request with ruid
+func (p *Peer) addRangeInfo(ruid uint, res chan *RangeInfoRes) {
+	p.rangeInfosMu.Lock()
+	defer p.rangeInfosMu.Unlock()
+	p.rangeInfos[ruid] = res
+}
+
+// removeRangeInfo unregisters the range info request with ruid
+func (p *Peer) removeRangeInfo(ruid uint) {
+	p.rangeInfosMu.Lock()
+	defer p.rangeInfosMu.Unlock()
+	delete(p.rangeInfos, ruid)
+}
+
+// deliverRangeInfo hands msg to the request with its ruid and reports whether there was such a request
+func (p *Peer) deliverRangeInfo(msg *RangeInfoRes) bool {
+	p.rangeInfosMu.Lock()
+	defer p.rangeInfosMu.Unlock()
+	res, ok := p.rangeInfos[msg.Ruid]
+	if !ok {
+		return false
+	}
+	delete(p.rangeInfos, msg.Ruid)
+	res <- msg
+	return true
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// DefaultMaxStreamInfoReqs is the default number of StreamInfoReq messages of a peer which are handled at once
+const DefaultMaxStreamInfoReqs = 8
+
+var streamInfoReqQueued = metrics.GetOrRegisterCounter("network/stream/info_req_queued", nil)
+
+// requestLimiter bounds the number of requests of a peer which are handled at once
+// up to size requests are handled while further requests wait for their turn
+// each message is handled in its own goroutine, so waiting requests only cost their goroutine, not store lookups
+type requestLimiter struct {
+	slots chan struct{} // one element for each request being handled
+}
+
+// newRequestLimiter creates a requestLimiter which handles size requests at once, DefaultMaxStreamInfoReqs if size is 0
+func newRequestLimiter(size int) *requestLimiter {
+	if size <= 0 {
+		size = DefaultMaxStreamInfoReqs
+	}
+	return &requestLimiter{
+		slots: make(chan struct{}, size),
+	}
+}
+
+// acquire takes a slot, waiting for one if all of them are taken
+// it returns p2p.ErrShuttingDown if quit is closed while waiting
+// a request which acquired a slot has to release it when it is handled
+func (l *requestLimiter) acquire(quit <-chan struct{}) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	streamInfoReqQueued.Inc(1)
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-quit:
+		return p2p.ErrShuttingDown
+	}
+}
+
+// release frees the slot taken by acquire
+func (l *requestLimiter) release() {
+	<-l.slots
+}
+
+// SetMaxStreamInfoReqs sets the number of StreamInfoReq messages of a peer which are handled at once,
+// further requests wait until one of them is handled
+// it applies to peers connecting afterwards, 0 restores DefaultMaxStreamInfoReqs
+func (r *Registry) SetMaxStreamInfoReqs(n int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.maxStreamInfoReqs = n
+}
+
+// newStreamInfoLimiter creates the limiter of the StreamInfoReq messages of a connecting peer
+func (r *Registry) newStreamInfoLimiter() *requestLimiter {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return newRequestLimiter(r.maxStreamInfoReqs)
+}
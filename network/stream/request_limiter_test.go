@@ -0,0 +1,74 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// TestRequestLimiter tests that the limiter handles up to its size requests at once, queues further requests
+// until a slot is released, and that queued requests give up when the peer quits
+func TestRequestLimiter(t *testing.T) {
+	l := newRequestLimiter(2)
+	quit := make(chan struct{})
+
+	for i := 0; i < 2; i++ {
+		if err := l.acquire(quit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// more requests than the limiter handles at once wait, none of them is refused
+	const queuedReqs = 5
+	queued := make(chan error, queuedReqs)
+	for i := 0; i < queuedReqs; i++ {
+		go func() {
+			queued <- l.acquire(quit)
+		}()
+	}
+	select {
+	case err := <-queued:
+		t.Fatalf("expected request to wait for a slot, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a released slot is taken by a queued request
+	l.release()
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for queued request to be handled")
+	}
+
+	close(quit)
+	for i := 1; i < queuedReqs; i++ {
+		select {
+		case err := <-queued:
+			if err != p2p.ErrShuttingDown {
+				t.Fatalf("expected error %v, got %v", p2p.ErrShuttingDown, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for queued request to give up")
+		}
+	}
+}
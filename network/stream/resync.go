@@ -0,0 +1,107 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/ethersphere/swarm/network/stream/intervals"
+)
+
+var streamResyncs = metrics.GetOrRegisterCounter("network/stream/resyncs", nil)
+
+// Resync syncs the history of sync bins of a connected peer again from the start, to fetch chunks which may have been lost.
+// All bins synced with the peer are resynced if no bins are given.
+// The history synced so far is forgotten and requested again up to the session cursor through the GetRange flow
+// of the initial sync, with at most one outstanding range per stream. The offered chunks are filtered by NeedData,
+// so only chunks missing from the local store are delivered again. The live stream is not interrupted.
+func (r *Registry) Resync(id enode.ID, bins ...uint8) error {
+	p := r.getPeer(id)
+	if p == nil {
+		return fmt.Errorf("peer %s not connected", id)
+	}
+	provider := r.getProvider(NewID(syncStreamName, ""))
+	if provider == nil {
+		return errors.New("not syncing")
+	}
+
+	var streams []ID
+	if len(bins) == 0 {
+		for bin := 0; bin <= int(chunk.MaxPO); bin++ {
+			stream := NewID(syncStreamName, encodeSyncKey(uint8(bin)))
+			if _, ok := p.getCursor(stream); ok {
+				streams = append(streams, stream)
+			}
+		}
+	}
+	for _, bin := range bins {
+		stream := NewID(syncStreamName, encodeSyncKey(bin))
+		if _, ok := p.getCursor(stream); !ok {
+			return fmt.Errorf("bin %d is not synced with peer %s", bin, id)
+		}
+		streams = append(streams, stream)
+	}
+
+	// chunks which were lost may still be cached as seen
+	if sp, ok := provider.(*syncProvider); ok {
+		sp.purgeCache()
+	}
+
+	for _, stream := range streams {
+		cursor, ok := p.getCursor(stream)
+		if !ok {
+			// the stream was quit meanwhile
+			continue
+		}
+		if err := p.resetInterval(stream, cursor); err != nil {
+			return fmt.Errorf("resetting synced intervals of stream %s: %w", stream, err)
+		}
+		streamResyncs.Inc(1)
+		p.logger.Info("resyncing stream", "stream", stream, "cursor", cursor)
+		if !provider.Autostart() || cursor == 0 {
+			continue
+		}
+		// if the history is still being synced, the outstanding range continues from the start once it is sealed
+		go func(stream ID) {
+			if err := r.clientRequestStreamRange(context.Background(), p, provider, stream, cursor); err != nil {
+				p.logger.Error("error requesting resynced history", "stream", stream, "err", err)
+			}
+		}(stream)
+	}
+	return nil
+}
+
+// resetInterval forgets the history synced from stream up to and including cursor
+// the interval synced from the live stream beyond the cursor is kept
+func (p *Peer) resetInterval(stream ID, cursor uint64) error {
+	live, ok := p.getLiveCursorsCopy()[stream.String()]
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	// key interval values are ALWAYS > 0
+	i := intervals.NewIntervals(1)
+	if ok && live > cursor+1 {
+		i.Add(cursor+1, live-1)
+	}
+	return p.intervalsStore.Put(p.peerStreamIntervalKey(stream), i)
+}
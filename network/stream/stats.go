@@ -0,0 +1,97 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+var (
+	statsChunksOffered   = metrics.GetOrRegisterCounter("network/stream/stats/chunks_offered", nil)
+	statsChunksRequested = metrics.GetOrRegisterCounter("network/stream/stats/chunks_requested", nil)
+	statsChunksDelivered = metrics.GetOrRegisterCounter("network/stream/stats/chunks_delivered", nil)
+	statsChunksSkipped   = metrics.GetOrRegisterCounter("network/stream/stats/chunks_skipped", nil)
+	statsBytesDelivered  = metrics.GetOrRegisterCounter("network/stream/stats/bytes_delivered", nil)
+)
+
+// SyncStats holds the counters of the client side of syncing
+type SyncStats struct {
+	ChunksOffered   uint64 `json:"chunksOffered"`   // chunks offered by upstream peers
+	ChunksRequested uint64 `json:"chunksRequested"` // offered chunks that were requested
+	ChunksDelivered uint64 `json:"chunksDelivered"` // chunks delivered by upstream peers
+	ChunksSkipped   uint64 `json:"chunksSkipped"`   // delivered chunks that were already in the local store
+	BytesDelivered  uint64 `json:"bytesDelivered"`  // chunk data delivered by upstream peers
+}
+
+// syncCounters are the atomically updated counters behind SyncStats
+// they are allocated on their own to guarantee the 64-bit alignment needed by atomic operations
+type syncCounters struct {
+	chunksOffered   uint64
+	chunksRequested uint64
+	chunksDelivered uint64
+	chunksSkipped   uint64
+	bytesDelivered  uint64
+}
+
+// stats returns a snapshot of the counters
+func (c *syncCounters) stats() SyncStats {
+	return SyncStats{
+		ChunksOffered:   atomic.LoadUint64(&c.chunksOffered),
+		ChunksRequested: atomic.LoadUint64(&c.chunksRequested),
+		ChunksDelivered: atomic.LoadUint64(&c.chunksDelivered),
+		ChunksSkipped:   atomic.LoadUint64(&c.chunksSkipped),
+		BytesDelivered:  atomic.LoadUint64(&c.bytesDelivered),
+	}
+}
+
+// countOffered records the number of chunks offered by the peer in a batch and how many of them were requested
+func (r *Registry) countOffered(p *Peer, offered, requested uint64) {
+	for _, c := range []*syncCounters{r.stats, p.stats} {
+		atomic.AddUint64(&c.chunksOffered, offered)
+		atomic.AddUint64(&c.chunksRequested, requested)
+	}
+	statsChunksOffered.Inc(int64(offered))
+	statsChunksRequested.Inc(int64(requested))
+}
+
+// countDelivered records the chunks delivered by the peer in a message, how many of them were already stored and their size
+func (r *Registry) countDelivered(p *Peer, delivered, skipped, bytes uint64) {
+	for _, c := range []*syncCounters{r.stats, p.stats} {
+		atomic.AddUint64(&c.chunksDelivered, delivered)
+		atomic.AddUint64(&c.chunksSkipped, skipped)
+		atomic.AddUint64(&c.bytesDelivered, bytes)
+	}
+	statsChunksDelivered.Inc(int64(delivered))
+	statsChunksSkipped.Inc(int64(skipped))
+	statsBytesDelivered.Inc(int64(bytes))
+}
+
+// Stats returns the syncing counters aggregated over all peers since the node started,
+// and the counters of every connected peer since it connected
+func (r *Registry) Stats() (total SyncStats, peers map[enode.ID]SyncStats) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	peers = make(map[enode.ID]SyncStats, len(r.peers))
+	for id, p := range r.peers {
+		peers[id] = p.stats.stats()
+	}
+	return r.stats.stats(), peers
+}
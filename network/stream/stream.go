@@ -49,6 +49,16 @@ const (
 	HashSize     = 32
 	BatchSize    = 64
 	MinFrameSize = 16
+
+	// StreamInfoBatchSize is the maximum number of stream descriptors sent in one StreamInfoRes message
+	// wider requests are answered with several messages, so that the client can start on the first streams early
+	StreamInfoBatchSize = 4
+)
+
+// versions of the bzz-stream devp2p protocol, peers run the highest version both of them support
+const (
+	protocolVersion     = 1 // no extensions are used
+	capabilitiesVersion = 2 // peers exchange the extensions they support in a handshake, see CapabilitiesHandshake
 )
 
 var (
@@ -61,6 +71,7 @@ var (
 	streamSeenChunkDelivery       = metrics.GetOrRegisterCounter("network/stream/seen_chunk_delivery", nil)
 	streamEmptyWantedHashes       = metrics.GetOrRegisterCounter("network/stream/empty_wanted_hashes", nil)
 	streamWantedHashes            = metrics.GetOrRegisterCounter("network/stream/wanted_hashes", nil)
+	streamFilteredHashes          = metrics.GetOrRegisterCounter("network/stream/filtered_hashes", nil)
 
 	streamBatchFail               = metrics.GetOrRegisterCounter("network/stream/batch_fail", nil)
 	streamChunkDeliveryFail       = metrics.GetOrRegisterCounter("network/stream/delivery_fail", nil)
@@ -71,6 +82,9 @@ var (
 
 	streamPeersCount = metrics.GetOrRegisterGauge("network/stream/peers", nil)
 
+	streamSyncedAcks   = metrics.GetOrRegisterCounter("network/stream/synced_acks", nil)
+	streamSyncedAckLag = metrics.GetOrRegisterGauge("network/stream/synced_ack_lag", nil) // distance of the last acknowledged cursor to our cursor
+
 	collectBatchLiveTimer    = metrics.GetOrRegisterResettingTimer("network/stream/server_collect_batch_head/total-time", nil)
 	collectBatchHistoryTimer = metrics.GetOrRegisterResettingTimer("network/stream/server_collect_batch/total-time", nil)
 	providerGetTimer         = metrics.GetOrRegisterResettingTimer("network/stream/provider_get/total-time", nil)
@@ -81,7 +95,7 @@ var (
 	// Protocol spec
 	Spec = &protocols.Spec{
 		Name:       "bzz-stream",
-		Version:    8,
+		Version:    9,
 		MaxMsgSize: 10 * 1024 * 1024,
 		Messages: []interface{}{
 			StreamInfoReq{},
@@ -90,6 +104,12 @@ var (
 			OfferedHashes{},
 			ChunkDelivery{},
 			WantedHashes{},
+			StreamSyncedAck{},
+			RangeInfoReq{},
+			RangeInfoRes{},
+			CapabilitiesHandshake{},
+			CursorProbeReq{},
+			CursorProbeRes{},
 		},
 	}
 
@@ -97,6 +117,10 @@ var (
 	handleMsgPauser protocols.MsgPauser = nil
 )
 
+// ChunkFilter decides whether a chunk offered by an upstream peer should be requested
+// it must be safe for concurrent use as it is called from the handlers of all peers
+type ChunkFilter func(addr chunk.Address) bool
+
 // Registry is the base type that handles all client/server operations on a node
 // it is instantiated once per stream protocol instance, that is, it should have
 // one instance per node
@@ -110,6 +134,11 @@ type Registry struct {
 	quit                    chan struct{}             // signal shutdown
 	lastReceivedChunkTimeMu sync.RWMutex              // synchronize access to lastReceivedChunkTime
 	lastReceivedChunkTime   time.Time                 // last received chunk time
+	chunkFilterMu           sync.RWMutex              // synchronize access to chunkFilter
+	chunkFilter             ChunkFilter               // optional filter for offered chunks, nil accepts all
+	capabilities            Capabilities              // protocol extensions this node supports, AllCapabilities unless restricted
+	maxStreamInfoReqs       int                       // StreamInfoReq messages of a peer handled at once, see SetMaxStreamInfoReqs
+	stats                   *syncCounters             // syncing counters aggregated over all peers
 	logger                  log.Logger                // the logger for the registry. appends base address to all logs
 }
 
@@ -123,6 +152,8 @@ func New(intervalsStore state.Store, address *network.BzzAddr, providers ...Stre
 		address:        address,
 		logger:         log.New("base", address.ShortString()),
 		spec:           Spec,
+		stats:          new(syncCounters),
+		capabilities:   AllCapabilities,
 	}
 	for _, p := range providers {
 		r.providers[p.StreamName()] = p
@@ -133,7 +164,18 @@ func New(intervalsStore state.Store, address *network.BzzAddr, providers ...Stre
 
 // Run is being dispatched when 2 nodes connect
 func (r *Registry) Run(bp *network.BzzPeer) error {
+	return r.run(bp, protocolVersion)
+}
+
+// run runs the protocol with the peer, version is the protocol version negotiated with the peer
+func (r *Registry) run(bp *network.BzzPeer, version uint) error {
 	sp := newPeer(bp, r.address, r.intervalsStore, r.providers)
+	capabilities, err := r.negotiateCapabilities(sp, version)
+	if err != nil {
+		return err
+	}
+	sp.capabilities = capabilities
+	sp.infoReqs = r.newStreamInfoLimiter()
 	// enable msg pauser for stream protocol, this is used only in tests
 	sp.Peer.SetMsgPauser(handleMsgPauser)
 	r.addPeer(sp)
@@ -159,6 +201,16 @@ func (r *Registry) HandleMsg(p *Peer) func(context.Context, interface{}) error {
 			return r.serverHandleWantedHashes(ctx, p, msg)
 		case *ChunkDelivery:
 			return r.clientHandleChunkDelivery(ctx, p, msg)
+		case *StreamSyncedAck:
+			return r.serverHandleStreamSyncedAck(ctx, p, msg)
+		case *RangeInfoReq:
+			return r.serverHandleRangeInfoReq(ctx, p, msg)
+		case *RangeInfoRes:
+			return r.clientHandleRangeInfoRes(ctx, p, msg)
+		case *CursorProbeReq:
+			return r.serverHandleCursorProbeReq(ctx, p, msg)
+		case *CursorProbeRes:
+			return r.clientHandleCursorProbeRes(ctx, p, msg)
 
 		default:
 			// todo: maybe a special error for unknown message, or at least just log it
@@ -173,43 +225,70 @@ func (r *Registry) serverHandleStreamInfoReq(ctx context.Context, p *Peer, msg *
 	if len(msg.Streams) == 0 {
 		return protocols.Break(errors.New("nil streams msg requested"))
 	}
+	// every message is handled in its own goroutine, a peer flooding requests must not flood the store with cursor lookups
+	if err := p.infoReqs.acquire(p.quit); err != nil {
+		return err
+	}
+	defer p.infoReqs.release()
 
 	streamRes := &StreamInfoRes{}
-	for _, v := range msg.Streams {
-		provider := r.getProvider(v)
-		if provider == nil {
-			return fmt.Errorf("unsupported provider for stream: %s", v)
-		}
-
-		// get the current cursor from the data source
-		streamCursor, err := provider.Cursor(v.Key)
+	for i, v := range msg.Streams {
+		// cursors are only looked up once the descriptors before them were sent
+		descriptor, err := r.streamDescriptor(v)
 		if err != nil {
-			return protocols.Break(fmt.Errorf("get cursor for stream key failed, name %s, key %s: %w", v.Name, v.Key, err))
-		}
-		descriptor := StreamDescriptor{
-			Stream:  v,
-			Cursor:  streamCursor,
-			Bounded: provider.Boundedness(),
+			return err
 		}
 		streamRes.Streams = append(streamRes.Streams, descriptor)
+
+		if len(streamRes.Streams) == StreamInfoBatchSize || i == len(msg.Streams)-1 {
+			if sent, err := r.serverSendStreamInfoRes(ctx, p, streamRes); !sent {
+				return err
+			}
+			streamRes = &StreamInfoRes{}
+		}
 	}
 
+	return nil
+}
+
+// streamDescriptor returns the descriptor of stream v with its current cursor
+func (r *Registry) streamDescriptor(v ID) (StreamDescriptor, error) {
+	provider := r.getProvider(v)
+	if provider == nil {
+		return StreamDescriptor{}, fmt.Errorf("unsupported provider for stream: %s", v)
+	}
+
+	// get the current cursor from the data source
+	streamCursor, err := provider.Cursor(v.Key)
+	if err != nil {
+		return StreamDescriptor{}, protocols.Break(fmt.Errorf("get cursor for stream key failed, name %s, key %s: %w", v.Name, v.Key, err))
+	}
+	return StreamDescriptor{
+		Stream:  v,
+		Cursor:  streamCursor,
+		Bounded: provider.Boundedness(),
+	}, nil
+}
+
+// serverSendStreamInfoRes sends one StreamInfoRes message in response to a StreamInfoReq
+// it returns false if the message was not sent, either because of an error or because we're shutting down or the peer left
+func (r *Registry) serverSendStreamInfoRes(ctx context.Context, p *Peer, msg *StreamInfoRes) (sent bool, err error) {
 	// don't send the message in case we're shutting down or the peer left
 	select {
 	case <-r.quit:
 		// shutdown
-		return nil
+		return false, nil
 	case <-p.quit:
 		// peer has been removed, quit
-		return nil
+		return false, nil
 	default:
 	}
 
-	if err := p.Send(ctx, streamRes); err != nil {
-		return protocols.Break(err)
+	if err := p.Send(ctx, msg); err != nil {
+		return false, protocols.Break(err)
 	}
 
-	return nil
+	return true, nil
 }
 
 // clientHandleStreamInfoRes handles the StreamInfoRes message (Peer is the server)
@@ -265,6 +344,7 @@ func (r *Registry) clientHandleStreamInfoRes(ctx context.Context, p *Peer, msg *
 			if !s.Bounded {
 				//constantly fetch the head of the stream
 				p.logger.Debug("asking for live stream", "stream", s.Stream, "cursor", s.Cursor)
+				p.setLiveCursor(s.Stream, s.Cursor+1)
 				// ask the tip (cursor + 1)
 				go func() {
 					// todo: return DropError
@@ -303,7 +383,7 @@ func (r *Registry) clientRequestStreamRange(ctx context.Context, p *Peer, provid
 	// nothing to do - the next interval is bigger than the cursor or theinterval is empty
 	if from > cursor || empty {
 		p.logger.Debug("peer.requestStreamRange stream finished", "stream", stream, "cursor", cursor)
-		return nil
+		return r.clientSendSyncedAck(ctx, p, stream, cursor)
 	}
 	return r.clientCreateSendWant(ctx, p, stream, from, &cursor, false)
 }
@@ -432,6 +512,9 @@ func (r *Registry) serverHandleGetRange(ctx context.Context, p *Peer, msg *GetRa
 		LastIndex: t,
 		Hashes:    h,
 	}
+	if p.capabilities.Has(CapHashCompression) {
+		offered.Hashes = compressHashes(h)
+	}
 	l := len(h) / HashSize
 	if msg.To == nil {
 		headBatchSizeGauge.Update(int64(l))
@@ -464,6 +547,13 @@ func (r *Registry) clientHandleOfferedHashes(ctx context.Context, p *Peer, msg *
 	}
 
 	p.logger.Debug("clientHandleOfferedHashes", "ruid", msg.Ruid, "msg.lastIndex", msg.LastIndex)
+	if p.capabilities.Has(CapHashCompression) {
+		hashes, err := decompressHashes(msg.Hashes)
+		if err != nil {
+			return protocols.Break(fmt.Errorf("decompressing offered hashes, ruid %d: %w", msg.Ruid, err))
+		}
+		msg.Hashes = hashes
+	}
 	start := time.Now()
 	defer func(start time.Time) {
 		metrics.GetOrRegisterResettingTimer("network/stream/handle_offered_hashes/total-time", nil).UpdateSince(start)
@@ -482,6 +572,8 @@ func (r *Registry) clientHandleOfferedHashes(ctx context.Context, p *Peer, msg *
 	}
 
 	w.to = &msg.LastIndex // we can set the open wants upper bound to the index supplied in the msg
+	// a batch which is not full means that the server has no more chunks, so the client reached the head of the stream
+	w.caughtUp = lenHashes > 0 && lenHashes < BatchSize*HashSize
 
 	// this code block handles the case of a complete gap on the interval on the server side
 	// lenhashes == 0 means there's no hashes in the requested range with the upper bound of
@@ -519,23 +611,31 @@ func (r *Registry) clientHandleOfferedHashes(ctx context.Context, p *Peer, msg *
 		p.logger.Trace("clientHandleOfferedHashes peer offered hash", "ruid", msg.Ruid, "stream", w.stream, "chunk", addresses[i/HashSize])
 	}
 
+	// skip the chunks rejected by the chunk filter, they are neither checked nor requested
+	candidates, indexes := r.filterChunks(addresses)
+	if filtered := len(addresses) - len(candidates); filtered > 0 {
+		p.logger.Trace("clientHandleOfferedHashes filtered offered hashes", "ruid", msg.Ruid, "stream", w.stream, "filtered", filtered)
+		streamFilteredHashes.Inc(int64(filtered))
+	}
+
 	startNeed := time.Now()
 
 	// check which hashes we want
-	wants, err := provider.NeedData(ctx, addresses...)
+	wants, err := provider.NeedData(ctx, candidates...)
 	if err != nil {
 		return protocols.Break(err)
 	}
 
 	for i, wantChunk := range wants {
 		if wantChunk {
-			ctr++                                     // increment number of wanted chunks
-			want.Set(i)                               // set the bitvector
-			w.hashes[addresses[i].Hex()] = struct{}{} // set unsolicited chunks guard
+			ctr++                                      // increment number of wanted chunks
+			want.Set(indexes[i])                       // set the bitvector
+			w.hashes[candidates[i].Hex()] = struct{}{} // set unsolicited chunks guard
 		}
 	}
 
 	providerNeedDataTimer.UpdateSince(startNeed)
+	r.countOffered(p, uint64(len(addresses)), ctr)
 
 	// set the number of remaining chunks to ctr
 	atomic.AddUint64(&w.remaining, ctr)
@@ -570,6 +670,7 @@ func (r *Registry) clientHandleOfferedHashes(ctx context.Context, p *Peer, msg *
 	case err := <-errc:
 		if err != nil {
 			streamBatchFail.Inc(1)
+			r.releaseWant(p, provider, w)
 			return protocols.Break(fmt.Errorf("sealing batch from %d, to %d: %w", w.from, w.to, err))
 		}
 
@@ -583,6 +684,7 @@ func (r *Registry) clientHandleOfferedHashes(ctx context.Context, p *Peer, msg *
 		p.mtx.Lock()
 		delete(p.openWants, msg.Ruid)
 		p.mtx.Unlock()
+		r.releaseWant(p, provider, w)
 
 		// todo: this should happen because of the returned error anyway
 		// if the stream is wanted and has timed out
@@ -598,6 +700,7 @@ func (r *Registry) clientHandleOfferedHashes(ctx context.Context, p *Peer, msg *
 	case <-r.quit:
 		return nil
 	case <-p.quit:
+		r.releaseWant(p, provider, w)
 		return nil
 	}
 	return r.requestSubsequentRange(ctx, p, provider, w, msg.LastIndex)
@@ -772,11 +875,17 @@ func (r *Registry) clientHandleChunkDelivery(ctx context.Context, p *Peer, msg *
 	providerPutTimer.UpdateSince(startPut)
 
 	// increment seen chunk delivery metric. duplicate delivery is possible when the same chunk is asked from multiple peers, we currently do not limit this
+	var skipped, bytes uint64
 	for _, v := range seen {
 		if v {
 			streamSeenChunkDelivery.Inc(1)
+			skipped++
 		}
 	}
+	for _, c := range chunks {
+		bytes += uint64(len(c.Data()))
+	}
+	r.countDelivered(p, uint64(len(chunks)), skipped, bytes)
 
 	for _, dc := range chunks {
 		select {
@@ -931,6 +1040,12 @@ func (r *Registry) requestSubsequentRange(ctx context.Context, p *Peer, provider
 		return nil
 	}
 	if w.head {
+		if w.caughtUp {
+			if err := r.clientSendSyncedAck(ctx, p, w.stream, lastIndex); err != nil {
+				return protocols.Break(fmt.Errorf("sending synced ack: %w", err))
+			}
+		}
+		p.setLiveCursor(w.stream, lastIndex+1)
 		if err := r.clientRequestStreamHead(ctx, p, w.stream, lastIndex+1); err != nil {
 			streamRequestNextIntervalFail.Inc(1)
 			return protocols.Break(fmt.Errorf("requesting next interval from peer: %w", err))
@@ -945,6 +1060,78 @@ func (r *Registry) requestSubsequentRange(ctx context.Context, p *Peer, provider
 	return nil
 }
 
+// clientSendSyncedAck tells the server that the stream was synced up to and including cursor (Peer is the server)
+// nothing is sent to servers which do not support the acknowledgement
+func (r *Registry) clientSendSyncedAck(ctx context.Context, p *Peer, stream ID, cursor uint64) error {
+	if !p.capabilities.Has(CapSyncedAck) {
+		return nil
+	}
+	p.logger.Debug("clientSendSyncedAck", "stream", stream, "cursor", cursor)
+	return p.Send(ctx, &StreamSyncedAck{
+		Stream: stream,
+		Cursor: cursor,
+	})
+}
+
+// serverHandleStreamSyncedAck records the cursor up to which the client synced a stream (Peer is the client)
+func (r *Registry) serverHandleStreamSyncedAck(ctx context.Context, p *Peer, msg *StreamSyncedAck) error {
+	provider := r.getProvider(msg.Stream)
+	if provider == nil {
+		return protocols.Break(fmt.Errorf("unsupported provider for stream: %s", msg.Stream))
+	}
+	p.logger.Debug("serverHandleStreamSyncedAck", "stream", msg.Stream, "cursor", msg.Cursor)
+	p.setSyncedCursor(msg.Stream, msg.Cursor)
+
+	streamSyncedAcks.Inc(1)
+	if cursor, err := provider.Cursor(msg.Stream.Key); err == nil && cursor >= msg.Cursor {
+		streamSyncedAckLag.Update(int64(cursor - msg.Cursor))
+	}
+	return nil
+}
+
+// SyncedCursors returns the cursors up to which a connected peer acknowledged syncing our streams, by stream
+// streams the peer did not acknowledge yet are missing, as well as all streams of peers which do not support acknowledgements
+func (r *Registry) SyncedCursors(id enode.ID) (map[string]uint64, error) {
+	p := r.getPeer(id)
+	if p == nil {
+		return nil, fmt.Errorf("peer %s not connected", id)
+	}
+	return p.getSyncedCursorsCopy(), nil
+}
+
+// SetChunkFilter sets the filter that decides which of the chunks offered by upstream peers are requested
+// chunks rejected by the filter are skipped and the interval they belong to is still sealed as synced
+// a nil filter accepts all chunks, which is the default
+func (r *Registry) SetChunkFilter(filter ChunkFilter) {
+	r.chunkFilterMu.Lock()
+	defer r.chunkFilterMu.Unlock()
+	r.chunkFilter = filter
+}
+
+// filterChunks returns the addresses accepted by the chunk filter along with their indexes in addrs
+func (r *Registry) filterChunks(addrs []chunk.Address) (accepted []chunk.Address, indexes []int) {
+	r.chunkFilterMu.RLock()
+	filter := r.chunkFilter
+	r.chunkFilterMu.RUnlock()
+
+	indexes = make([]int, 0, len(addrs))
+	if filter == nil {
+		for i := range addrs {
+			indexes = append(indexes, i)
+		}
+		return addrs, indexes
+	}
+
+	accepted = make([]chunk.Address, 0, len(addrs))
+	for i, addr := range addrs {
+		if filter(addr) {
+			accepted = append(accepted, addr)
+			indexes = append(indexes, i)
+		}
+	}
+	return accepted, indexes
+}
+
 func (r *Registry) getProvider(stream ID) StreamProvider {
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
@@ -989,8 +1176,9 @@ type PeerInfo struct {
 
 // PeerState holds information about a connected peer.
 type PeerState struct {
-	Peer    string            `json:"peer"` // the peer address
-	Cursors map[string]uint64 `json:"cursors"`
+	Peer        string            `json:"peer"`        // the peer address
+	Cursors     map[string]uint64 `json:"cursors"`     // history is backfilled up to these cursors
+	LiveCursors map[string]uint64 `json:"liveCursors"` // indexes from which the stream heads are requested
 }
 
 // PeerInfo returns a response in which the queried node's
@@ -1034,8 +1222,9 @@ func (r *Registry) PeerInfo() (*PeerInfo, error) {
 	}
 	for _, p := range r.peers {
 		info.Peers = append(info.Peers, PeerState{
-			Peer:    hex.EncodeToString(p.OAddr)[:16],
-			Cursors: p.getCursorsCopy(),
+			Peer:        hex.EncodeToString(p.OAddr)[:16],
+			Cursors:     p.getCursorsCopy(),
+			LiveCursors: p.getLiveCursorsCopy(),
 		})
 	}
 	return info, nil
@@ -1056,21 +1245,26 @@ func (r *Registry) setLastReceivedChunkTime() {
 	r.lastReceivedChunkTimeMu.Unlock()
 }
 
+// Protocols returns the protocol versions this node runs, a peer runs the highest version both support
 func (r *Registry) Protocols() []p2p.Protocol {
-	return []p2p.Protocol{
-		{
+	var protos []p2p.Protocol
+	for _, version := range []uint{protocolVersion, capabilitiesVersion} {
+		protos = append(protos, p2p.Protocol{
 			Name:    "bzz-stream",
-			Version: 1,
+			Version: version,
 			Length:  10 * 1024 * 1024,
-			Run:     r.runProtocol,
-		},
+			Run:     r.runProtocol(version),
+		})
 	}
+	return protos
 }
 
-func (r *Registry) runProtocol(p *p2p.Peer, rw p2p.MsgReadWriter) error {
-	peer := protocols.NewPeer(p, rw, r.spec)
-	bp := network.NewBzzPeer(peer)
-	return r.Run(bp)
+func (r *Registry) runProtocol(version uint) func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+	return func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+		peer := protocols.NewPeer(p, rw, r.spec)
+		bp := network.NewBzzPeer(peer)
+		return r.run(bp, version)
+	}
 }
 
 func (r *Registry) APIs() []rpc.API {
@@ -1083,6 +1277,9 @@ func (r *Registry) Start(server *p2p.Server) error {
 	return nil
 }
 
+// Stop stops the handlers of all peers and closes the providers
+// providers stop their subscriptions and wait for their store operations in progress when they are closed,
+// so the stores they use, e.g. the NetStore of the sync provider, must only be closed after Stop returned
 func (r *Registry) Stop() error {
 	log.Debug("stream registry stopping")
 	r.mtx.Lock()
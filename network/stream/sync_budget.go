@@ -0,0 +1,180 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/metrics"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// syncBudgetNearPercent is the share of the budget in percent from which chunks outside of the depth are not requested anymore
+const syncBudgetNearPercent = 90
+
+var (
+	syncBudgetGauge        = metrics.GetOrRegisterGauge("network/stream/sync_provider/budget", nil)       // chunks syncing may store, 0 if unlimited
+	syncBudgetUsageGauge   = metrics.GetOrRegisterGauge("network/stream/sync_provider/budget_usage", nil) // chunks stored by syncing within the budget
+	syncBudgetEvictedCount = metrics.GetOrRegisterCounter("network/stream/sync_provider/budget_evicted", nil)
+)
+
+// SyncBudgetUsage is the number of chunks stored by syncing compared to the budget
+type SyncBudgetUsage struct {
+	Budget  uint64 `json:"budget"`  // chunks syncing may store, 0 if unlimited
+	Usage   uint64 `json:"usage"`   // chunks stored by syncing since the budget was set and not evicted
+	Evicted uint64 `json:"evicted"` // chunks removed from the store to stay within the budget
+}
+
+// syncBudget limits the number of chunks stored by syncing
+// it keeps the addresses of the chunks stored by syncing by bin, oldest first, so that once the budget is exceeded
+// the chunks of the most distant bins are removed from the store and the neighbourhood is retained the longest
+// chunks stored before the budget was set are not counted, chunks collected by the store's GC are counted until they are evicted
+type syncBudget struct {
+	mtx     sync.Mutex
+	limit   uint64                           // chunks syncing may store, 0 if unlimited
+	usage   uint64                           // number of addresses in bins
+	evicted uint64                           // chunks evicted since the budget was set
+	bins    [chunk.MaxPO + 1][]chunk.Address // addresses of the chunks stored by syncing by proximity to the base address
+}
+
+// setLimit sets the number of chunks syncing may store, 0 removes the limit and forgets the stored chunks
+func (b *syncBudget) setLimit(limit uint64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if limit == 0 {
+		b.bins = [chunk.MaxPO + 1][]chunk.Address{}
+		b.usage, b.evicted = 0, 0
+	}
+	b.limit = limit
+	syncBudgetGauge.Update(int64(limit))
+	syncBudgetUsageGauge.Update(int64(b.usage))
+}
+
+// add counts the chunks newly stored by syncing against the budget, base is the address of this node
+func (b *syncBudget) add(base []byte, addrs ...chunk.Address) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.limit == 0 {
+		return
+	}
+	for _, addr := range addrs {
+		po := chunk.Proximity(base, addr)
+		b.bins[po] = append(b.bins[po], addr)
+	}
+	b.usage += uint64(len(addrs))
+	syncBudgetUsageGauge.Update(int64(b.usage))
+}
+
+// nearLimit reports whether the chunks stored by syncing reached syncBudgetNearPercent of the budget
+func (b *syncBudget) nearLimit() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.limit > 0 && b.usage*100 >= b.limit*syncBudgetNearPercent
+}
+
+// excess removes the chunks beyond the budget from the budget and returns their addresses,
+// the oldest chunks of the most distant bin first
+func (b *syncBudget) excess() (addrs []chunk.Address) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.limit == 0 || b.usage <= b.limit {
+		return nil
+	}
+	n := b.usage - b.limit
+	for po := range b.bins {
+		if n == 0 {
+			break
+		}
+		k := uint64(len(b.bins[po]))
+		if k > n {
+			k = n
+		}
+		addrs = append(addrs, b.bins[po][:k]...)
+		b.bins[po] = b.bins[po][k:]
+		n -= k
+	}
+	b.usage -= uint64(len(addrs))
+	b.evicted += uint64(len(addrs))
+	syncBudgetUsageGauge.Update(int64(b.usage))
+	syncBudgetEvictedCount.Inc(int64(len(addrs)))
+	return addrs
+}
+
+// info returns the usage of the budget
+func (b *syncBudget) info() SyncBudgetUsage {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return SyncBudgetUsage{
+		Budget:  b.limit,
+		Usage:   b.usage,
+		Evicted: b.evicted,
+	}
+}
+
+// evictExcess removes the chunks stored by syncing beyond the budget from the store
+// chunks which are not in the store anymore, e.g. as the store's GC collected them, are skipped
+func (s *syncProvider) evictExcess(ctx context.Context) error {
+	addrs := s.budget.excess()
+	if len(addrs) == 0 {
+		return nil
+	}
+	has, err := s.netStore.Store.HasMulti(ctx, addrs...)
+	if err != nil {
+		return err
+	}
+	remove := make([]chunk.Address, 0, len(addrs))
+	for i, have := range has {
+		if have {
+			remove = append(remove, addrs[i])
+		}
+	}
+	s.cacheMtx.Lock()
+	for _, addr := range addrs {
+		s.cache.Remove(addr.Hex())
+	}
+	s.cacheMtx.Unlock()
+	if len(remove) == 0 {
+		return nil
+	}
+	s.logger.Debug("evicting synced chunks beyond budget", "chunks", len(remove))
+	return s.netStore.Set(ctx, chunk.ModeSetRemove, remove...)
+}
+
+// SetSyncBudget sets the number of chunks syncing may store, 0 removes the limit
+// once the budget is exceeded the chunks stored by syncing which are the most distant from this node are removed from the store,
+// and when the chunks stored reach syncBudgetNearPercent of the budget only chunks within the neighbourhood depth are requested,
+// the intervals of the skipped chunks are still sealed as synced
+// it returns false if the registry does not sync
+func (r *Registry) SetSyncBudget(chunks uint64) bool {
+	p, ok := r.providers[syncStreamName].(*syncProvider)
+	if !ok {
+		return false
+	}
+	p.budget.setLimit(chunks)
+	return true
+}
+
+// SyncBudget returns the number of chunks stored by syncing compared to the budget
+// and false if the registry does not sync
+func (r *Registry) SyncBudget() (SyncBudgetUsage, bool) {
+	if p, ok := r.providers[syncStreamName].(*syncProvider); ok {
+		return p.budget.info(), true
+	}
+	return SyncBudgetUsage{}, false
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/ethersphere/swarm/network"
+	"github.com/ethersphere/swarm/storage"
+)
+
+// TestSyncBudget tests that the chunks stored by syncing beyond the budget are removed from the store,
+// the oldest of the most distant bin first, and that the usage of the budget is reported
+func TestSyncBudget(t *testing.T) {
+	addr := network.RandomBzzAddr()
+	localStore, cleanup, err := newTestLocalStore(enode.ID{}, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	defer localStore.Close()
+	netStore := storage.NewNetStore(localStore, addr)
+	kad := network.NewKademlia(addr.Over(), network.NewKadParams())
+	sp := NewSyncProvider(netStore, kad, addr, false, false, DefaultSyncStrategy, 0).(*syncProvider)
+	defer sp.Close()
+	r := New(nil, addr, sp)
+
+	// two chunks in the most distant bin and one closer to us
+	var distant []chunk.Chunk
+	var near chunk.Chunk
+	for len(distant) < 2 || near == nil {
+		ch := storage.GenerateRandomChunk(4096)
+		if chunk.Proximity(addr.Over(), ch.Address()) == 0 {
+			if len(distant) < 2 {
+				distant = append(distant, ch)
+			}
+		} else if near == nil {
+			near = ch
+		}
+	}
+
+	if !r.SetSyncBudget(2) {
+		t.Fatal("expected the registry to sync")
+	}
+	ctx := context.Background()
+	for _, ch := range []chunk.Chunk{distant[0], near, distant[1]} {
+		if _, err := sp.Put(ctx, ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		ch   chunk.Chunk
+		want bool
+	}{
+		{distant[0], false},
+		{near, true},
+		{distant[1], true},
+	} {
+		has, err := localStore.Has(ctx, c.ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has != c.want {
+			t.Fatalf("chunk %s: got stored %t, want %t", c.ch.Address(), has, c.want)
+		}
+	}
+
+	usage, ok := r.SyncBudget()
+	if !ok {
+		t.Fatal("expected the registry to sync")
+	}
+	if want := (SyncBudgetUsage{Budget: 2, Usage: 2, Evicted: 1}); usage != want {
+		t.Fatalf("got budget usage %+v, want %+v", usage, want)
+	}
+	if !sp.budget.nearLimit() {
+		t.Fatal("expected the budget to be nearly used")
+	}
+
+	// without a budget the stored chunks are not tracked anymore
+	r.SetSyncBudget(0)
+	if usage, _ := r.SyncBudget(); usage != (SyncBudgetUsage{}) {
+		t.Fatalf("expected no budget, got %+v", usage)
+	}
+	if sp.budget.nearLimit() {
+		t.Fatal("expected an unlimited budget never to be nearly used")
+	}
+}
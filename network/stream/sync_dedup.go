@@ -0,0 +1,152 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// DefaultSyncDedupCacheSize is the default number of chunks tracked by the delivery deduplication of the syncer client
+const DefaultSyncDedupCacheSize = 10000
+
+var (
+	syncDedupRequestHitCount  = metrics.GetOrRegisterCounter("network/stream/sync_provider/dedup/request/hit", nil)  // chunks not requested as they were requested from another peer
+	syncDedupDeliveryHitCount = metrics.GetOrRegisterCounter("network/stream/sync_provider/dedup/delivery/hit", nil) // redundant deliveries discarded before the store write
+)
+
+// dedupEntry is the state of a chunk tracked by deliveryDedup
+type dedupEntry struct {
+	requested time.Time // when the chunk was last requested
+	delivered bool      // whether the chunk was delivered and stored
+}
+
+// deliveryDedup tracks the chunks the syncer client requested or stored recently,
+// so that a chunk offered by several peers which serve overlapping bins is only requested from one of them
+// and a redundant delivery is discarded before it is stored
+type deliveryDedup struct {
+	mtx   sync.Mutex
+	cache *lru.Cache    // chunk address -> *dedupEntry
+	ttl   time.Duration // time after which a chunk which was requested but not delivered is requested again
+}
+
+// newDeliveryDedup creates a deliveryDedup which tracks up to size chunks, DefaultSyncDedupCacheSize if size is 0
+func newDeliveryDedup(size int, ttl time.Duration) *deliveryDedup {
+	if size <= 0 {
+		size = DefaultSyncDedupCacheSize
+	}
+	c, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return &deliveryDedup{
+		cache: c,
+		ttl:   ttl,
+	}
+}
+
+// request returns whether addr should be requested and marks it as requested if so
+// a chunk is not requested again while it is requested from another peer, unless the request is older than the ttl,
+// or once it was delivered
+func (d *deliveryDedup) request(addr chunk.Address) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := time.Now()
+	if v, ok := d.cache.Get(string(addr)); ok {
+		e := v.(*dedupEntry)
+		if e.delivered || now.Sub(e.requested) < d.ttl {
+			syncDedupRequestHitCount.Inc(1)
+			return false
+		}
+		e.requested = now
+		return true
+	}
+	d.cache.Add(string(addr), &dedupEntry{requested: now})
+	return true
+}
+
+// delivered returns whether addr was already delivered and stored
+func (d *deliveryDedup) delivered(addr chunk.Address) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	v, ok := d.cache.Get(string(addr))
+	if ok && v.(*dedupEntry).delivered {
+		syncDedupDeliveryHitCount.Inc(1)
+		return true
+	}
+	return false
+}
+
+// setDelivered marks the chunks as delivered and stored
+func (d *deliveryDedup) setDelivered(chunks ...chunk.Chunk) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for _, c := range chunks {
+		if v, ok := d.cache.Get(string(c.Address())); ok {
+			v.(*dedupEntry).delivered = true
+			continue
+		}
+		d.cache.Add(string(c.Address()), &dedupEntry{delivered: true})
+	}
+}
+
+// release forgets the chunks which were requested but not delivered, so that they are requested again right away
+func (d *deliveryDedup) release(addrs ...chunk.Address) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for _, addr := range addrs {
+		if v, ok := d.cache.Peek(string(addr)); ok && !v.(*dedupEntry).delivered {
+			d.cache.Remove(string(addr))
+		}
+	}
+}
+
+// purge forgets all tracked chunks
+func (d *deliveryDedup) purge() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.cache.Purge()
+}
+
+// releaseWant releases the chunks of a batch which failed before they were delivered from the delivery deduplication,
+// otherwise the retried range, possibly from another peer, would skip them until the ttl expires and be sealed without them
+func (r *Registry) releaseWant(p *Peer, provider StreamProvider, w *want) {
+	sp, ok := provider.(*syncProvider)
+	if !ok {
+		return
+	}
+	p.mtx.Lock()
+	undelivered := make([]chunk.Address, 0, len(w.hashes))
+	for h := range w.hashes {
+		if addr, err := hex.DecodeString(h); err == nil {
+			undelivered = append(undelivered, addr)
+		}
+	}
+	p.mtx.Unlock()
+	sp.dedup.release(undelivered...)
+}
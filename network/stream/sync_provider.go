@@ -44,8 +44,12 @@ const (
 var (
 	setCacheMissCount = metrics.GetOrRegisterCounter("network/stream/sync_provider/set/cachemiss", nil)
 	setCacheHitCount  = metrics.GetOrRegisterCounter("network/stream/sync_provider/set/cachehit", nil)
+	syncStrategyGauge = metrics.GetOrRegisterGauge("network/stream/sync_provider/strategy", nil) // value of the SyncStrategy in use
 )
 
+// errSyncProviderClosed is returned by the store operations of a sync provider which is closed
+var errSyncProviderClosed = errors.New("sync provider closed")
+
 type syncProvider struct {
 	netStore                *storage.NetStore // netstore
 	kad                     *network.Kademlia // kademlia
@@ -53,10 +57,19 @@ type syncProvider struct {
 	syncBinsOnlyWithinDepth bool              // true means streams are established only within depth, false means outside of depth too
 	autostart               bool              // start fetching streams automatically when cursors arrive from peer
 	quit                    chan struct{}     // shutdown
+	closeMtx                sync.RWMutex      // guards closed and subscriptions
+	closed                  bool              // whether Close was called, no store operations are started afterwards
+	inFlight                sync.WaitGroup    // store operations and subscriptions in progress, Close waits for them
+	subscriptions           map[uint64]func() // stop functions of the active pull subscriptions by id
+	nextSubscription        uint64            // id of the next pull subscription
 	cacheMtx                sync.RWMutex      // synchronization primitive to protect cache
 	cache                   *lru.Cache        // cache to minimize load on netstore
 	setCacheMtx             sync.RWMutex      // set cache mutex
 	setCache                *lru.Cache        // cache to reduce load on localstore to not set the same chunk as synced
+	dedup                   *deliveryDedup    // chunks requested from or delivered by any peer recently
+	strategy                SyncStrategy      // order in which the sync bins of a peer are requested
+	budget                  syncBudget        // limit of the chunks stored by syncing, see Registry.SetSyncBudget
+	cursors                 *cursorCache      // cursors of the bins shared between the stream info requests of all peers
 	logger                  log.Logger        // logger that appends the base address to loglines
 }
 
@@ -64,7 +77,10 @@ type syncProvider struct {
 // syncOnlyWithinDepth toggles stream establishment in reference to kademlia. When true - streams are
 // established only within depth ( >=depth ). This is needed for Push Sync. When set to false, the streams are
 // established on all bins as they did traditionally with Pull Sync.
-func NewSyncProvider(ns *storage.NetStore, kad *network.Kademlia, baseAddr *network.BzzAddr, autostart bool, syncOnlyWithinDepth bool) StreamProvider {
+// strategy sets the order in which the bins of a peer are requested, see SyncStrategy.
+// dedupCacheSize is the number of chunks tracked to not request or store chunks offered by several peers twice,
+// DefaultSyncDedupCacheSize if 0.
+func NewSyncProvider(ns *storage.NetStore, kad *network.Kademlia, baseAddr *network.BzzAddr, autostart bool, syncOnlyWithinDepth bool, strategy SyncStrategy, dedupCacheSize int) StreamProvider {
 	c, err := lru.New(cacheCapacity)
 	if err != nil {
 		panic(err)
@@ -73,16 +89,21 @@ func NewSyncProvider(ns *storage.NetStore, kad *network.Kademlia, baseAddr *netw
 	if err != nil {
 		panic(err)
 	}
+	syncStrategyGauge.Update(int64(strategy))
 
 	return &syncProvider{
 		netStore:                ns,
 		kad:                     kad,
 		syncBinsOnlyWithinDepth: syncOnlyWithinDepth,
 		autostart:               autostart,
+		strategy:                strategy,
 		name:                    syncStreamName,
 		quit:                    make(chan struct{}),
+		subscriptions:           make(map[uint64]func()),
 		cache:                   c,
 		setCache:                sc,
+		dedup:                   newDeliveryDedup(dedupCacheSize, timeouts.SyncerClientWaitTimeout),
+		cursors:                 newCursorCache(cursorCacheTTL),
 		logger:                  log.NewBaseAddressLogger(baseAddr.ShortString()),
 	}
 }
@@ -97,11 +118,10 @@ func (s *syncProvider) NeedData(ctx context.Context, addrs ...chunk.Address) ([]
 	)
 
 	// don't check if we're shutting down
-	select {
-	case <-s.quit:
+	if !s.acquire() {
 		return wants, nil
-	default:
 	}
+	defer s.inFlight.Done()
 
 	// if the cache contains the chunk key - it is most probable to exist in the localstore
 	// therefore we do not want the chunk
@@ -128,9 +148,22 @@ func (s *syncProvider) NeedData(ctx context.Context, addrs ...chunk.Address) ([]
 		return nil, err
 	}
 
+	// close to the budget only chunks within depth are requested
+	var (
+		nearBudget = s.budget.nearLimit()
+		depth      = s.kad.NeighbourhoodDepth()
+	)
+
 	// inspect results
 	for i, have := range has {
 		if !have {
+			if nearBudget && chunk.Proximity(s.kad.BaseAddr(), check[i]) < depth {
+				continue
+			}
+			// the chunk may be on its way from another peer already
+			if !s.dedup.request(check[i]) {
+				continue
+			}
 			wants[indexes[i]] = true // if we dont have it - we want it
 			fi, _, ok := s.netStore.GetOrCreateFetcher(ctx, check[i], "syncer")
 			if !ok {
@@ -153,6 +186,15 @@ func (s *syncProvider) NeedData(ctx context.Context, addrs ...chunk.Address) ([]
 	return wants, nil
 }
 
+// purgeCache forgets which chunks were seen, requested or delivered recently, so that NeedData checks all of them in the localstore
+func (s *syncProvider) purgeCache() {
+	s.cacheMtx.Lock()
+	s.cache.Purge()
+	s.cacheMtx.Unlock()
+
+	s.dedup.purge()
+}
+
 // Get the supplied addresses for delivery
 func (s *syncProvider) Get(ctx context.Context, addr ...chunk.Address) ([]chunk.Chunk, error) {
 	var (
@@ -161,6 +203,10 @@ func (s *syncProvider) Get(ctx context.Context, addr ...chunk.Address) ([]chunk.
 		lsChunks  = make([]chunk.Address, 0)       // the chunks that we need to Get from localstore
 		indices   = make([]int, 0)                 // backreferences to glue retChunks and lsChunks together
 	)
+	if !s.acquire() {
+		return nil, errSyncProviderClosed
+	}
+	defer s.inFlight.Done()
 
 	defer func(start time.Time) {
 		metrics.GetOrRegisterResettingTimer("network/stream/sync_provider/get/total-time", nil).UpdateSince(start)
@@ -200,6 +246,11 @@ func (s *syncProvider) Get(ctx context.Context, addr ...chunk.Address) ([]chunk.
 
 // Set the supplied addrs as synced in order to allow for garbage collection
 func (s *syncProvider) Set(ctx context.Context, addrs ...chunk.Address) error {
+	if !s.acquire() {
+		return errSyncProviderClosed
+	}
+	defer s.inFlight.Done()
+
 	var chunksToSet []chunk.Address
 
 	s.setCacheMtx.RLock()
@@ -230,23 +281,57 @@ func (s *syncProvider) Set(ctx context.Context, addrs ...chunk.Address) error {
 
 // Put the given chunks to the local storage
 func (s *syncProvider) Put(ctx context.Context, ch ...chunk.Chunk) (exists []bool, err error) {
-	seen, err := s.netStore.Put(ctx, chunk.ModePutSync, ch...)
+	if !s.acquire() {
+		return nil, errSyncProviderClosed
+	}
+	defer s.inFlight.Done()
+
+	// chunks which were delivered by another peer already are discarded without a store write
+	exists = make([]bool, len(ch))
+	put := make([]chunk.Chunk, 0, len(ch))
+	indexes := make([]int, 0, len(ch))
+	for i, c := range ch {
+		if s.dedup.delivered(c.Address()) {
+			exists[i] = true
+			continue
+		}
+		put = append(put, c)
+		indexes = append(indexes, i)
+	}
+	if len(put) == 0 {
+		return exists, nil
+	}
+	seen, err := s.netStore.Put(ctx, chunk.ModePutSync, put...)
+	if err != nil {
+		return seen, err
+	}
+	s.dedup.setDelivered(put...)
+	stored := make([]chunk.Address, 0, len(put))
 	for i, v := range seen {
+		exists[indexes[i]] = v
 		if v {
 			if putSeenTestHook != nil {
 				// call the test function if it is set
-				putSeenTestHook(ch[i].Address(), s.netStore.LocalID)
+				putSeenTestHook(put[i].Address(), s.netStore.LocalID)
 			}
+		} else {
+			// the cursor of the bin moved on, it is read again for the next stream info request
+			s.cursors.invalidate(uint8(chunk.Proximity(s.kad.BaseAddr(), put[i].Address())))
+			stored = append(stored, put[i].Address())
 		}
 	}
+	s.budget.add(s.kad.BaseAddr(), stored...)
+	if err := s.evictExcess(ctx); err != nil {
+		s.logger.Error("evicting synced chunks beyond budget", "err", err)
+	}
 	go func(chunks ...chunk.Chunk) {
 		s.cacheMtx.Lock()
 		defer s.cacheMtx.Unlock()
 		for _, c := range chunks {
 			s.cache.Add(c.Address().Hex(), c.Data())
 		}
-	}(ch...)
-	return seen, err
+	}(put...)
+	return exists, nil
 }
 
 // Function used only in tests to detect chunks that are synced
@@ -255,12 +340,36 @@ func (s *syncProvider) Put(ctx context.Context, ch ...chunk.Chunk) (exists []boo
 var putSeenTestHook func(addr chunk.Address, id enode.ID)
 
 // Subscribe wraps SubscribePull to retrieve chunks within a certain interval
+// the subscription is active until it is stopped or the provider is closed, a closed provider returns a closed channel
 func (s *syncProvider) Subscribe(ctx context.Context, key interface{}, from, to uint64) (<-chan chunk.Descriptor, func()) {
 	// convert the key to the actual value and call SubscribePull
 	bin := key.(uint8)
 	log.Debug("syncProvider.Subscribe", "bin", bin, "from", from, "to", to)
 
-	return s.netStore.SubscribePull(ctx, bin, from, to)
+	s.closeMtx.Lock()
+	defer s.closeMtx.Unlock()
+	if s.closed {
+		c := make(chan chunk.Descriptor)
+		close(c)
+		return c, func() {}
+	}
+	s.inFlight.Add(1)
+	descriptors, stop := s.netStore.SubscribePull(ctx, bin, from, to)
+
+	id := s.nextSubscription
+	s.nextSubscription++
+	var once sync.Once
+	stopSubscription := func() {
+		once.Do(func() {
+			stop()
+			s.closeMtx.Lock()
+			delete(s.subscriptions, id)
+			s.closeMtx.Unlock()
+			s.inFlight.Done()
+		})
+	}
+	s.subscriptions[id] = stopSubscription
+	return descriptors, stopSubscription
 }
 
 // Cursor gets the cursor from the localstore for a given stream key
@@ -276,7 +385,11 @@ func (s *syncProvider) Cursor(k string) (cursor uint64, err error) {
 	if !ok {
 		return 0, errors.New("could not unmarshal key to uint8")
 	}
-	return s.netStore.LastPullSubscriptionBinID(bin)
+	if !s.acquire() {
+		return 0, errSyncProviderClosed
+	}
+	defer s.inFlight.Done()
+	return s.cursors.get(bin, s.netStore.LastPullSubscriptionBinID)
 }
 
 // WantStream checks if we are interested in a given stream for a peer
@@ -354,10 +467,10 @@ func (s *syncProvider) InitPeer(p *Peer) {
 // and the second one representing bins for syncing subscriptions that
 // need to be removed.
 func (s *syncProvider) updateSyncSubscriptions(p *Peer, subBins, quitBins []int) {
-	p.logger.Debug("syncProvider.updateSyncSubscriptions", "subBins", subBins, "quitBins", quitBins)
+	p.logger.Debug("syncProvider.updateSyncSubscriptions", "subBins", subBins, "quitBins", quitBins, "strategy", s.strategy)
 	if l := len(subBins); l > 0 {
 		streams := make([]ID, l)
-		for i, po := range subBins {
+		for i, po := range s.strategy.order(subBins) {
 
 			stream := NewID(s.StreamName(), encodeSyncKey(uint8(po)))
 			_, err := p.getOrCreateInterval(p.peerStreamIntervalKey(stream))
@@ -429,6 +542,22 @@ func syncSubscriptionsDiff(peerPO, prevDepth, newDepth, max int, syncBinsOnlyWit
 	return subBins, quitBins
 }
 
+// PeerSyncBins returns the proximity order of a connected peer and the range [start, end) of the bins
+// which are synced from it at the current neighbourhood depth, see syncBins. The range is -1, -1 if no bins are synced.
+func (r *Registry) PeerSyncBins(id enode.ID) (po int, start, end int, err error) {
+	p := r.getPeer(id)
+	if p == nil {
+		return 0, 0, 0, fmt.Errorf("peer %s not connected", id)
+	}
+	s, ok := r.providers[syncStreamName].(*syncProvider)
+	if !ok {
+		return 0, 0, 0, errors.New("not syncing")
+	}
+	po = chunk.Proximity(p.BzzAddr.Over(), s.kad.BaseAddr())
+	start, end = syncBins(po, s.kad.NeighbourhoodDepth(), s.kad.MaxProxDisplay, s.syncBinsOnlyWithinDepth)
+	return po, start, end, nil
+}
+
 // syncBins returns the range to which proximity order bins syncing
 // subscriptions need to be requested, based on peer proximity and
 // kademlia neighbourhood depth. Returned range is [start,end), inclusive for
@@ -486,7 +615,39 @@ func (s *syncProvider) Boundedness() bool { return false }
 
 func (s *syncProvider) Autostart() bool { return s.autostart }
 
-func (s *syncProvider) Close() { close(s.quit) }
+// acquire registers a store operation which Close waits for, the caller has to call s.inFlight.Done when it is finished
+// it returns false without registering anything if the provider is closed
+func (s *syncProvider) acquire() bool {
+	s.closeMtx.RLock()
+	defer s.closeMtx.RUnlock()
+	if s.closed {
+		return false
+	}
+	s.inFlight.Add(1)
+	return true
+}
+
+// Close stops all pull subscriptions and waits for the store operations in progress to finish
+// no store operations are started afterwards, so the NetStore can be closed safely once Close returns
+func (s *syncProvider) Close() {
+	s.closeMtx.Lock()
+	if s.closed {
+		s.closeMtx.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.quit)
+	stops := make([]func(), 0, len(s.subscriptions))
+	for _, stop := range s.subscriptions {
+		stops = append(stops, stop)
+	}
+	s.closeMtx.Unlock()
+
+	for _, stop := range stops {
+		stop()
+	}
+	s.inFlight.Wait()
+}
 
 func parseSyncKey(streamKey string) (uint8, error) {
 	b, err := strconv.ParseUint(streamKey, 36, 8)
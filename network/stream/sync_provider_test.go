@@ -17,10 +17,16 @@
 package stream
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethersphere/swarm/chunk"
 	"github.com/ethersphere/swarm/network"
+	"github.com/ethersphere/swarm/storage"
 )
 
 // TestSyncSubscriptionsDiff validates the output of syncSubscriptionsDiff
@@ -188,3 +194,183 @@ func TestSyncSubscriptionsDiff(t *testing.T) {
 		}
 	}
 }
+
+// TestSyncStrategy tests the order in which the subscribed bins are requested with each strategy
+func TestSyncStrategy(t *testing.T) {
+	subBins, _ := syncSubscriptionsDiff(10, -1, 8, 12, false)
+	for _, tc := range []struct {
+		name string
+		want []int
+	}{
+		{name: "", want: []int{8, 9, 10, 11, 12}},
+		{name: "breadth-first", want: []int{8, 9, 10, 11, 12}},
+		{name: "depth-first", want: []int{12, 11, 10, 9, 8}},
+	} {
+		strategy, err := ParseSyncStrategy(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.name != "" && strategy.String() != tc.name {
+			t.Errorf("expected strategy %q, got %q", tc.name, strategy)
+		}
+		if got := strategy.order(subBins); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("strategy %q: got bins %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if _, err := ParseSyncStrategy("random"); err == nil {
+		t.Error("expected an unknown strategy to fail")
+	}
+}
+
+// TestSyncDeliveryDedup tests that a chunk is not requested again while it is requested from another peer
+// and that a redundant delivery is discarded
+func TestSyncDeliveryDedup(t *testing.T) {
+	addr := network.RandomBzzAddr()
+	localStore, cleanup, err := newTestLocalStore(enode.ID{}, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	defer localStore.Close()
+	netStore := storage.NewNetStore(localStore, addr)
+	kad := network.NewKademlia(addr.Over(), network.NewKadParams())
+	sp := NewSyncProvider(netStore, kad, addr, false, false, DefaultSyncStrategy, 10).(*syncProvider)
+	defer sp.Close()
+
+	ctx := context.Background()
+	ch := storage.GenerateRandomChunk(4096)
+
+	for i, want := range []bool{true, false} {
+		wants, err := sp.NeedData(ctx, ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wants[0] != want {
+			t.Fatalf("need data %d: got %t, want %t", i, wants[0], want)
+		}
+	}
+
+	for i, want := range []bool{false, true} {
+		exists, err := sp.Put(ctx, ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists[0] != want {
+			t.Fatalf("put %d: got exists %t, want %t", i, exists[0], want)
+		}
+	}
+	if has, err := localStore.Has(ctx, ch.Address()); err != nil || !has {
+		t.Fatalf("expected the delivered chunk to be stored, got %t (err: %v)", has, err)
+	}
+
+	// requests expire after the ttl and the oldest chunks are evicted
+	dedup := newDeliveryDedup(1, 0)
+	other := storage.GenerateRandomChunk(4096)
+	for i, addr := range []chunk.Address{ch.Address(), ch.Address(), other.Address()} {
+		if !dedup.request(addr) {
+			t.Fatalf("request %d: expected chunk %s to be requested", i, addr)
+		}
+	}
+	dedup.setDelivered(ch)
+	dedup.setDelivered(other)
+	if dedup.delivered(ch.Address()) || !dedup.delivered(other.Address()) {
+		t.Fatal("expected only the last delivered chunk to be tracked")
+	}
+}
+
+// TestSyncProviderClose tests that closing the sync provider with active subscriptions and store operations in progress
+// stops the subscriptions, waits for the operations and refuses new ones, so that the store can be closed afterwards
+func TestSyncProviderClose(t *testing.T) {
+	addr := network.RandomBzzAddr()
+	localStore, cleanup, err := newTestLocalStore(enode.ID{}, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	netStore := storage.NewNetStore(localStore, addr)
+	kad := network.NewKademlia(addr.Over(), network.NewKadParams())
+	sp := NewSyncProvider(netStore, kad, addr, false, false, DefaultSyncStrategy, 0).(*syncProvider)
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if _, err := localStore.Put(ctx, chunk.ModePutUpload, storage.GenerateRandomChunk(4096)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// live subscriptions on all bins, which never end on their own
+	var subscriptions []<-chan chunk.Descriptor
+	for bin := uint8(0); bin <= chunk.MaxPO; bin++ {
+		descriptors, _ := sp.Subscribe(ctx, bin, 0, 0)
+		subscriptions = append(subscriptions, descriptors)
+	}
+
+	// syncing goes on while the provider is closed
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("syncing panicked: %v", r)
+				}
+			}()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				ch := storage.GenerateRandomChunk(4096)
+				if _, err := sp.NeedData(ctx, ch.Address()); err != nil {
+					t.Error(err)
+				}
+				if _, err := sp.Put(ctx, ch); err != nil && err != errSyncProviderClosed {
+					t.Error(err)
+				}
+				if _, err := sp.Get(ctx, ch.Address()); err != nil && err != errSyncProviderClosed {
+					t.Error(err)
+				}
+				if _, err := sp.Cursor(encodeSyncKey(0)); err != nil && err != errSyncProviderClosed {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	sp.Close()
+	if err := localStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	for bin, descriptors := range subscriptions {
+		timeout := time.After(5 * time.Second)
+	drain:
+		for {
+			select {
+			case _, ok := <-descriptors:
+				if !ok {
+					break drain
+				}
+			case <-timeout:
+				t.Fatalf("subscription of bin %d not stopped", bin)
+			}
+		}
+	}
+
+	if _, err := sp.Put(ctx, storage.GenerateRandomChunk(4096)); err != errSyncProviderClosed {
+		t.Fatalf("expected put to fail with %v, got %v", errSyncProviderClosed, err)
+	}
+	descriptors, _ := sp.Subscribe(ctx, uint8(0), 0, 0)
+	if _, ok := <-descriptors; ok {
+		t.Fatal("expected the subscription of a closed provider to be closed")
+	}
+	// closing again is a noop
+	sp.Close()
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import "fmt"
+
+// SyncStrategy sets the order in which the sync bins of a peer are requested, both in the StreamInfoReq
+// and, as the descriptors are answered in the same order, in the GetRange requests following it.
+// All bins are still synced with every strategy, only the ones requested first get their chunks earlier.
+type SyncStrategy int
+
+const (
+	// SyncBreadthFirst requests the bins from the shallowest to the deepest.
+	// Shallow bins cover most of the address space, so a fresh node soon holds chunks from everywhere
+	// and is ready to serve retrievals, while the neighbourhood it is responsible for is synced last.
+	SyncBreadthFirst SyncStrategy = iota
+	// SyncDepthFirst requests the bins from the deepest to the shallowest.
+	// The neighbourhood a node is responsible for storing is synced first, so it can sooner
+	// serve the chunks closest to it, at the cost of covering the rest of the address space later.
+	SyncDepthFirst
+)
+
+// DefaultSyncStrategy is the order in which bins were always requested
+const DefaultSyncStrategy = SyncBreadthFirst
+
+var syncStrategyNames = map[SyncStrategy]string{
+	SyncBreadthFirst: "breadth-first",
+	SyncDepthFirst:   "depth-first",
+}
+
+// String returns the name of the strategy as accepted by ParseSyncStrategy
+func (s SyncStrategy) String() string {
+	if name, ok := syncStrategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("SyncStrategy(%d)", int(s))
+}
+
+// ParseSyncStrategy returns the strategy with the given name, DefaultSyncStrategy for an empty name
+func ParseSyncStrategy(name string) (SyncStrategy, error) {
+	if name == "" {
+		return DefaultSyncStrategy, nil
+	}
+	for s, n := range syncStrategyNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync strategy %q", name)
+}
+
+// order returns bins, which are ascending, in the order they are requested with the strategy
+func (s SyncStrategy) order(bins []int) []int {
+	if s != SyncDepthFirst {
+		return bins
+	}
+	ordered := make([]int, len(bins))
+	for i, bin := range bins {
+		ordered[len(bins)-1-i] = bin
+	}
+	return ordered
+}
+
+// SyncStrategy returns the strategy by which the sync bins of peers are requested
+// and false if the registry does not sync
+func (r *Registry) SyncStrategy() (SyncStrategy, bool) {
+	if p, ok := r.providers[syncStreamName].(*syncProvider); ok {
+		return p.strategy, true
+	}
+	return 0, false
+}
@@ -23,11 +23,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"runtime"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/node"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethersphere/swarm/chunk"
@@ -36,6 +38,7 @@ import (
 	"github.com/ethersphere/swarm/network/simulation"
 	"github.com/ethersphere/swarm/p2p/protocols"
 	"github.com/ethersphere/swarm/pot"
+	"github.com/ethersphere/swarm/state"
 	"github.com/ethersphere/swarm/storage"
 	"github.com/ethersphere/swarm/storage/localstore"
 	"github.com/ethersphere/swarm/testutil"
@@ -216,6 +219,415 @@ func TestTwoNodesSyncWithGaps(t *testing.T) {
 	}
 }
 
+// TestTwoNodesSyncWithChunkFilter checks that a node with a chunk filter set
+// only syncs the chunks accepted by the filter
+func TestTwoNodesSyncWithChunkFilter(t *testing.T) {
+	const chunkCount = 200
+	// accept only chunks with an even first byte, roughly half of them
+	filter := func(addr chunk.Address) bool {
+		return addr[0]%2 == 0
+	}
+
+	sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+		"bzz-sync": newSyncSimServiceFunc(&SyncSimServiceOptions{
+			Autostart: true,
+			StreamConstructorFunc: func(s state.Store, b *network.BzzAddr, p ...StreamProvider) node.Service {
+				r := New(s, b, p...)
+				r.SetChunkFilter(filter)
+				return r
+			},
+		}),
+	}, false)
+	defer sim.Close()
+	defer catchDuplicateChunkSync(t)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	uploadNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadStore := sim.MustNodeItem(uploadNode, bucketKeyFileStore).(chunk.Store)
+	chunks := mustUploadChunks(ctx, t, uploadStore, chunkCount)
+
+	var wantCount uint64
+	for _, addr := range chunks {
+		if filter(addr) {
+			wantCount++
+		}
+	}
+
+	syncNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Net.Connect(uploadNode, syncNode); err != nil {
+		t.Fatal(err)
+	}
+
+	syncStore := sim.MustNodeItem(syncNode, bucketKeyFileStore).(chunk.Store)
+	if err := waitChunks(syncStore, wantCount, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	synced, err := getChunks(syncStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(synced)) != wantCount {
+		t.Fatalf("got %v synced chunks, want %v", len(synced), wantCount)
+	}
+	for _, addr := range chunks {
+		if _, ok := synced[addr.Hex()]; ok != filter(addr) {
+			t.Fatalf("chunk %s synced: %v, accepted by filter: %v", addr, ok, filter(addr))
+		}
+	}
+}
+
+// TestTwoNodesSyncStats checks that the syncing counters of the downstream node
+// account for every synced chunk, in aggregate and for the upstream peer
+func TestTwoNodesSyncStats(t *testing.T) {
+	const chunkCount = 100
+
+	sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+		serviceNameStream: newSyncSimServiceFunc(&SyncSimServiceOptions{Autostart: true}),
+	}, false)
+	defer sim.Close()
+	defer catchDuplicateChunkSync(t)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	uploadNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadStore := sim.MustNodeItem(uploadNode, bucketKeyFileStore).(chunk.Store)
+	mustUploadChunks(ctx, t, uploadStore, chunkCount)
+
+	syncNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Net.Connect(uploadNode, syncNode); err != nil {
+		t.Fatal(err)
+	}
+
+	syncStore := sim.MustNodeItem(syncNode, bucketKeyFileStore).(chunk.Store)
+	if err := waitChunks(syncStore, chunkCount, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the counters are updated after the chunks are stored, give them some time to catch up
+	var (
+		total SyncStats
+		peers map[enode.ID]SyncStats
+	)
+	registry := nodeRegistry(sim, syncNode)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		total, peers = registry.Stats()
+		if total.ChunksDelivered >= chunkCount {
+			break
+		}
+	}
+
+	if total.ChunksDelivered != chunkCount || total.ChunksRequested != chunkCount {
+		t.Fatalf("got %v delivered and %v requested chunks, want %v", total.ChunksDelivered, total.ChunksRequested, chunkCount)
+	}
+	if total.ChunksOffered < chunkCount {
+		t.Fatalf("got %v offered chunks, want at least %v", total.ChunksOffered, chunkCount)
+	}
+	if total.ChunksSkipped != 0 {
+		t.Fatalf("got %v skipped chunks, want 0", total.ChunksSkipped)
+	}
+	if total.BytesDelivered < chunkCount*4096 {
+		t.Fatalf("got %v delivered bytes, want at least %v", total.BytesDelivered, chunkCount*4096)
+	}
+	if peers[uploadNode] != total {
+		t.Fatalf("got stats %+v for upstream peer, want %+v", peers[uploadNode], total)
+	}
+}
+
+// TestProbeCursors checks that the cursors of a peer can be probed
+// and that probing does not change the subscriptions to the peer
+func TestProbeCursors(t *testing.T) {
+	const chunkCount = 100
+
+	sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+		serviceNameStream: newSyncSimServiceFunc(&SyncSimServiceOptions{Autostart: true}),
+	}, false)
+	defer sim.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	uploadNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadStore := sim.MustNodeItem(uploadNode, bucketKeyFileStore).(chunk.Store)
+	mustUploadChunks(ctx, t, uploadStore, chunkCount)
+
+	syncNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Net.Connect(uploadNode, syncNode); err != nil {
+		t.Fatal(err)
+	}
+	syncStore := sim.MustNodeItem(syncNode, bucketKeyFileStore).(chunk.Store)
+	if err := waitChunks(syncStore, chunkCount, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := nodeRegistry(sim, syncNode)
+	peer := registry.getPeer(uploadNode)
+	if peer == nil {
+		t.Fatal("upload node is not a peer of the sync node")
+	}
+	cursors := peer.getCursorsCopy()
+
+	bins := []uint8{0, 1, 2, 3, 4, 5}
+	res, err := registry.ProbeCursors(ctx, uploadNode, bins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Streams) != len(bins) {
+		t.Fatalf("got %d stream descriptors, want %d", len(res.Streams), len(bins))
+	}
+	for i, bin := range bins {
+		want, err := uploadStore.LastPullSubscriptionBinID(bin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := res.Streams[i]
+		if s.Stream != NewID(syncStreamName, encodeSyncKey(bin)) {
+			t.Fatalf("got stream %v for bin %d", s.Stream, bin)
+		}
+		if s.Cursor != want {
+			t.Fatalf("got cursor %d for bin %d, want %d", s.Cursor, bin, want)
+		}
+	}
+
+	if got := peer.getCursorsCopy(); !reflect.DeepEqual(got, cursors) {
+		t.Fatalf("probing changed the cursors of the peer from %v to %v", cursors, got)
+	}
+	peer.probesMu.Lock()
+	defer peer.probesMu.Unlock()
+	if len(peer.probes) != 0 {
+		t.Fatalf("got %d outstanding probes after the response, want 0", len(peer.probes))
+	}
+}
+
+// TestRangeInfo checks that the number of chunks within an interval of a stream can be requested from a peer
+func TestRangeInfo(t *testing.T) {
+	const chunkCount = 100
+
+	sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+		serviceNameStream: newSyncSimServiceFunc(&SyncSimServiceOptions{Autostart: false}),
+	}, false)
+	defer sim.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	uploadNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadStore := sim.MustNodeItem(uploadNode, bucketKeyFileStore).(chunk.Store)
+	mustUploadChunks(ctx, t, uploadStore, chunkCount)
+
+	syncNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Net.Connect(uploadNode, syncNode); err != nil {
+		t.Fatal(err)
+	}
+	registry := nodeRegistry(sim, syncNode)
+	for start := time.Now(); registry.getPeer(uploadNode) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("upload node is not a peer of the sync node")
+		}
+	}
+
+	// the bins of the upload node are not garbage collected, so their indexes are 1 to cursor
+	var bin uint8
+	var cursor uint64
+	for ; cursor < 3; bin++ {
+		if cursor, err = uploadStore.LastPullSubscriptionBinID(bin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bin--
+	stream := NewID(syncStreamName, encodeSyncKey(bin))
+	to := cursor - 1
+	above := cursor + 10
+	empty, err := uploadStore.LastPullSubscriptionBinID(chunk.MaxPO)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		stream ID
+		from   uint64
+		to     *uint64
+		want   RangeInfoRes
+	}{
+		{name: "up to the cursor", stream: stream, from: 0, want: RangeInfoRes{Count: uint(cursor), First: 1, Last: cursor}},
+		{name: "within", stream: stream, from: 2, to: &to, want: RangeInfoRes{Count: uint(cursor - 2), First: 2, Last: to}},
+		{name: "beyond the cursor", stream: stream, from: 2, to: &above, want: RangeInfoRes{Count: uint(cursor - 1), First: 2, Last: cursor}},
+		{name: "after the cursor", stream: stream, from: cursor + 1},
+		{name: "empty bin", stream: NewID(syncStreamName, encodeSyncKey(chunk.MaxPO)), from: empty + 1},
+	} {
+		res, err := registry.RangeInfo(ctx, uploadNode, tc.stream, tc.from, tc.to)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if res.Count != tc.want.Count || res.First != tc.want.First || res.Last != tc.want.Last {
+			t.Fatalf("%s: got %+v, want %+v", tc.name, *res, tc.want)
+		}
+	}
+
+	peer := registry.getPeer(uploadNode)
+	peer.rangeInfosMu.Lock()
+	defer peer.rangeInfosMu.Unlock()
+	if len(peer.rangeInfos) != 0 {
+		t.Fatalf("got %d outstanding range info requests after the responses, want 0", len(peer.rangeInfos))
+	}
+}
+
+// TestResync checks that chunks lost after the history was synced are synced again
+// when the peer is resynced
+func TestResync(t *testing.T) {
+	const chunkCount = 100
+
+	sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+		serviceNameStream: newSyncSimServiceFunc(&SyncSimServiceOptions{Autostart: true}),
+	}, false)
+	defer sim.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	uploadNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadStore := sim.MustNodeItem(uploadNode, bucketKeyFileStore).(chunk.Store)
+	chunks := mustUploadChunks(ctx, t, uploadStore, chunkCount)
+
+	syncNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Net.Connect(uploadNode, syncNode); err != nil {
+		t.Fatal(err)
+	}
+	syncStore := sim.MustNodeItem(syncNode, bucketKeyFileStore).(chunk.Store)
+	if err := waitChunks(syncStore, chunkCount, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := nodeRegistry(sim, syncNode)
+	if err := registry.Resync(enode.ID{}); err == nil {
+		t.Fatal("expected resyncing a peer which is not connected to fail")
+	}
+
+	lost := chunks[:10]
+	if err := syncStore.Set(ctx, chunk.ModeSetRemove, lost...); err != nil {
+		t.Fatal(err)
+	}
+	missing := func() (count int) {
+		for _, addr := range lost {
+			has, err := syncStore.Has(ctx, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !has {
+				count++
+			}
+		}
+		return count
+	}
+	if got := missing(); got != len(lost) {
+		t.Fatalf("got %d missing chunks after removing %d", got, len(lost))
+	}
+
+	if err := registry.Resync(uploadNode); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); missing() > 0; time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("%d lost chunks were not resynced", missing())
+		}
+	}
+}
+
+// TestTwoNodesSyncedAck checks that the syncing node acknowledges the cursors up to which it synced the history
+// and that the upload node records them
+func TestTwoNodesSyncedAck(t *testing.T) {
+	const chunkCount = 100
+
+	sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+		serviceNameStream: newSyncSimServiceFunc(&SyncSimServiceOptions{Autostart: true}),
+	}, false)
+	defer sim.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	uploadNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadStore := sim.MustNodeItem(uploadNode, bucketKeyFileStore).(chunk.Store)
+	mustUploadChunks(ctx, t, uploadStore, chunkCount)
+
+	syncNode, err := sim.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Net.Connect(uploadNode, syncNode); err != nil {
+		t.Fatal(err)
+	}
+	syncStore := sim.MustNodeItem(syncNode, bucketKeyFileStore).(chunk.Store)
+	if err := waitChunks(syncStore, chunkCount, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := nodeRegistry(sim, syncNode).getPeer(uploadNode)
+	if peer == nil {
+		t.Fatal("upload node is not a peer of the sync node")
+	}
+	// streams with a zero cursor have no history to sync
+	want := make(map[string]uint64)
+	for stream, cursor := range peer.getCursorsCopy() {
+		if cursor > 0 {
+			want[stream] = cursor
+		}
+	}
+	if len(want) == 0 {
+		t.Fatal("no history synced from the upload node")
+	}
+
+	// the acknowledgement is sent after the last interval is sealed, give it some time to arrive
+	registry := nodeRegistry(sim, uploadNode)
+	var got map[string]uint64
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if got, err = registry.SyncedCursors(syncNode); err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+	}
+	t.Fatalf("got synced cursors %v, want %v", got, want)
+}
+
 // TestTheeNodesUnionHistoricalSync brings up three nodes, uploads content too all of them and then
 // asserts that all of them have the union of all 3 local stores (depth is assumed to be 0)
 func TestThreeNodesUnionHistoricalSync(t *testing.T) {
@@ -564,9 +976,10 @@ func BenchmarkHistoricalStream(b *testing.B) {
 func benchmarkHistoricalStream(b *testing.B, chunks uint64) {
 	b.StopTimer()
 
+	var total SyncStats
 	for i := 0; i < b.N; i++ {
 		sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
-			"bzz-sync": newSyncSimServiceFunc(&SyncSimServiceOptions{Autostart: true}),
+			serviceNameStream: newSyncSimServiceFunc(&SyncSimServiceOptions{Autostart: true}),
 		}, false)
 
 		uploaderNode, err := sim.AddNode()
@@ -599,6 +1012,10 @@ func benchmarkHistoricalStream(b *testing.B, chunks uint64) {
 			b.Fatal(err)
 		}
 		b.StopTimer()
+		stats, _ := nodeRegistry(sim, syncingNode).Stats()
+		total.ChunksOffered += stats.ChunksOffered
+		total.ChunksSkipped += stats.ChunksSkipped
+		total.BytesDelivered += stats.BytesDelivered
 		err = sim.Net.Stop(syncingNode)
 		if err != nil {
 			b.Fatal(err)
@@ -606,6 +1023,11 @@ func benchmarkHistoricalStream(b *testing.B, chunks uint64) {
 
 		sim.Close()
 	}
+
+	// report the syncing counters to compare overhead and duplicate deliveries between changes
+	b.ReportMetric(float64(total.ChunksOffered)/float64(b.N), "offered/op")
+	b.ReportMetric(float64(total.ChunksSkipped)/float64(b.N), "skipped/op")
+	b.ReportMetric(float64(total.BytesDelivered)/float64(b.N), "delivered-B/op")
 }
 
 // Function that uses putSeenTestHook to record and report
@@ -823,3 +1245,42 @@ func getAllRefs(testData []byte) (storage.AddressCollection, error) {
 	reader := bytes.NewReader(testData)
 	return fileStore.GetAllReferences(context.Background(), reader)
 }
+
+// TestPeerSyncBins checks that the proximity order of a connected peer and the bins synced from it are reported
+func TestPeerSyncBins(t *testing.T) {
+	sim := simulation.NewBzzInProc(map[string]simulation.ServiceFunc{
+		serviceNameStream: newSyncSimServiceFunc(&SyncSimServiceOptions{Autostart: true}),
+	}, false)
+	defer sim.Close()
+
+	nodeIDs, err := sim.AddNodesAndConnectStar(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := nodeRegistry(sim, nodeIDs[0])
+	if _, _, _, err := registry.PeerSyncBins(enode.ID{}); err == nil {
+		t.Fatal("expected a peer which is not connected to fail")
+	}
+
+	kad := nodeKademlia(sim, nodeIDs[0])
+	var p *Peer
+	for i := 0; p == nil; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for the peer to connect")
+		}
+		time.Sleep(50 * time.Millisecond)
+		p = registry.getPeer(nodeIDs[1])
+	}
+	po, start, end, err := registry.PeerSyncBins(nodeIDs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantPO := chunk.Proximity(p.BzzAddr.Over(), kad.BaseAddr()); po != wantPO {
+		t.Fatalf("got po %d, want %d", po, wantPO)
+	}
+	// the only peer is within the neighbourhood, so all bins from the depth on are synced
+	depth := kad.NeighbourhoodDepth()
+	if start != depth || end != kad.MaxProxDisplay+1 {
+		t.Fatalf("got bins [%d, %d), want [%d, %d)", start, end, depth, kad.MaxProxDisplay+1)
+	}
+}
@@ -140,6 +140,49 @@ type StreamState struct {
 	Message string
 }
 
+// StreamSyncedAck is a message sent from the downstream peer to the upstream peer when it synced a stream
+// up to and including Cursor, either the history up to the session cursor or the head of a live stream it caught up with
+type StreamSyncedAck struct {
+	Stream ID
+	Cursor uint64
+}
+
+// RangeInfoReq is a message sent from the downstream peer to the upstream peer asking how many chunks
+// it has within a particular interval of a stream, without offering their hashes as it does for GetRange
+type RangeInfoReq struct {
+	Ruid   uint
+	Stream ID
+	From   uint64
+	To     *uint64 `rlp:"nil"` // up to the cursor of the stream when nil
+}
+
+// RangeInfoRes is a response to RangeInfoReq with the same Ruid
+type RangeInfoRes struct {
+	Ruid  uint
+	Count uint   // number of chunks within the interval
+	First uint64 // index of the first chunk within the interval, 0 if there is none
+	Last  uint64 // index of the last chunk within the interval, 0 if there is none
+}
+
+// CursorProbeReq is a message sent from the downstream peer to the upstream peer asking for the current cursors
+// of the streams, like StreamInfoReq, but without subscribing to them
+type CursorProbeReq struct {
+	Ruid    uint
+	Streams []ID
+}
+
+// CursorProbeRes is a response to CursorProbeReq with the same Ruid
+type CursorProbeRes struct {
+	Ruid    uint
+	Streams []StreamDescriptor
+}
+
+// CapabilitiesHandshake is exchanged by both peers when they connect with capabilitiesVersion or later,
+// it advertises the protocol extensions the sender supports
+type CapabilitiesHandshake struct {
+	Capabilities Capabilities
+}
+
 // Stream defines a unique stream identifier in a textual representation
 type ID struct {
 	// Name is used for the Stream provider identification
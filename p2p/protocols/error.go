@@ -16,6 +16,8 @@
 
 package protocols
 
+import "errors"
+
 // HandlerError wraps standard error
 // This error is handled specially by protocol.Run
 // It causes the protocol to return with ErrHandler(err)
@@ -38,3 +40,34 @@ func (e *breakError) Unwrap() error { return e.err }
 func (w *breakError) Error() string {
 	return w.err.Error()
 }
+
+// refusedError wraps an error of the accounting hook which refuses a message without dropping the peer
+type refusedError struct {
+	err error
+}
+
+// Refuse wraps an error of the accounting hook so that the message is not handled but, unlike with other accounting errors,
+// the peer is kept, e.g. to give a peer over its debt limit the chance to settle
+func Refuse(err error) error {
+	return &refusedError{
+		err: err,
+	}
+}
+
+// Unwrap returns an underlying error
+func (e *refusedError) Unwrap() error { return e.err }
+
+// Error implements function of the standard go error interface
+func (e *refusedError) Error() string {
+	return e.err.Error()
+}
+
+// accountingError returns the error of the message handler for an error of the accounting hook
+// which drops the peer unless the hook refused the message with Refuse
+func accountingError(err error) error {
+	var e *refusedError
+	if errors.As(err, &e) {
+		return err
+	}
+	return Break(err)
+}
@@ -379,7 +379,7 @@ func (p *Peer) handleMsg(msg p2p.Msg, handle func(ctx context.Context, msg inter
 		costToLocalNode, err := p.spec.Hook.Validate(p, size, val, Receiver)
 		if err != nil {
 			// ...because if it would fail, we return and don't handle the message
-			return Break(err)
+			return accountingError(err)
 		}
 
 		// seems like accounting would be fine, so handle the message
@@ -389,7 +389,7 @@ func (p *Peer) handleMsg(msg p2p.Msg, handle func(ctx context.Context, msg inter
 
 		// handling succeeded, finally apply accounting
 		if err := p.spec.Hook.Apply(p, costToLocalNode, size); err != nil {
-			return Break(err)
+			return accountingError(err)
 		}
 	} else {
 		// call the registered handler callbacks
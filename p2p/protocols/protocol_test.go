@@ -379,6 +379,47 @@ func TestNoHook(t *testing.T) {
 	}
 }
 
+// TestRefusedAccounting tests that a message refused by the accounting hook with Refuse is not handled
+// but, unlike a message for which the accounting fails otherwise, does not make the peer drop
+func TestRefusedAccounting(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		drop bool
+	}{
+		{"refused", Refuse(errors.New("over the limit")), false},
+		{"failed", errors.New("over the limit"), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := createTestSpec()
+			spec.Hook = &dummyHook{
+				err:   tc.err,
+				waitC: make(chan struct{}, 1),
+			}
+			p := p2p.NewPeer(adapters.RandomNodeConfig().ID, "testPeer", nil)
+			rw := &dummyRW{msg: &perBytesMsgReceiverPays{Content: "testBalance"}}
+			peer := NewPeer(p, rw, spec)
+
+			handled := false
+			handler := func(ctx context.Context, msg interface{}) error {
+				handled = true
+				return nil
+			}
+			err := peer.receive(handler)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if handled {
+				t.Fatal("expected the message not to be handled")
+			}
+			var e *breakError
+			if errors.As(err, &e) != tc.drop {
+				t.Fatalf("expected the peer to be dropped: %v, got error %v", tc.drop, err)
+			}
+		})
+	}
+}
+
 func TestPeer_Receive(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
 		rw := &dummyRW{}
@@ -1,10 +1,13 @@
 package swap
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"math/big"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/rpc"
 	contract "github.com/ethersphere/swarm/contracts/swap"
@@ -28,8 +31,32 @@ type swapAPI interface {
 	AvailableBalance() (*int256.Uint256, error)
 	PeerBalance(peer enode.ID) (int64, error)
 	Balances() (map[enode.ID]int64, error)
+	BalancesFor(peers []enode.ID) (map[enode.ID]int64, error)
 	PeerCheques(peer enode.ID) (PeerCheques, error)
+	ReceivedCheques(peer enode.ID) ([]*Cheque, error)
+	ReceivedChequeSummary(peer enode.ID) (*ChequeHistorySummary, error)
+	PruneChequeHistory(keep int) error
+	LastCashedSerial(ctx context.Context, peer enode.ID) (uint64, error)
+	SentChequeConversion(peer enode.ID, cumulativePayout *int256.Uint256) (*ChequeConversion, error)
 	Cheques() (map[enode.ID]*PeerCheques, error)
+	ChequeEventsSince(seq uint64) ([]ChequeEvent, error)
+	PeerInfo(peer enode.ID) (*PeerAccounting, error)
+	CashoutQueue() ([]*CashoutQueueItem, error)
+	CashoutQueueDepth() (int, error)
+	PendingCashIns() ([]PendingCashIn, error)
+	CancelCashIn(peer enode.ID) error
+	CashCheque(ctx context.Context, peer enode.ID) (*types.Transaction, error)
+	ResendLastCheque(peer enode.ID) error
+	PriceTable() (PriceTable, error)
+	SetPriceTable(table PriceTable) error
+	SetMessagePrice(msgType string, price uint64) error
+	DisconnectPolicy() (DisconnectPolicy, error)
+	SetDisconnectPolicy(policy DisconnectPolicy) error
+	VerifyContract(ctx context.Context) error
+	SwitchChequebook(ctx context.Context, address common.Address) error
+	TestCashable(ctx context.Context, peer enode.ID) (bool, error)
+	Summary() (*SwapSummary, error)
+	OracleInfo() (*OraclePriceInfo, error)
 }
 
 // API would be the API accessor for protocol methods
@@ -45,6 +72,22 @@ type PeerCheques struct {
 	LastReceivedCheque *Cheque
 }
 
+// PeerAccounting is a snapshot of the complete accounting state with a peer
+type PeerAccounting struct {
+	Peer                enode.ID
+	Connected           bool           // whether the peer is connected, the beneficiary is only known for connected peers and peers which switched chequebooks
+	Balance             int64          // honey balance with the peer, negative if we owe the peer
+	PendingCheque       *Cheque        // cheque sent to the peer which is not yet confirmed
+	LastSentCheque      *Cheque        // last cheque sent to the peer which was confirmed
+	LastReceivedCheque  *Cheque        // last cheque received from the peer
+	PaymentThreshold    int64          // honey amount at which a cheque is sent to the peer, weighted by ThresholdWeight
+	DisconnectThreshold int64          // honey amount at which the peer is disconnected, weighted by ThresholdWeight
+	ThresholdWeight     float64        // multiplier applied to the thresholds with the peer
+	Blacklisted         bool           // whether accounting with the peer is refused
+	Beneficiary         common.Address // address of the peers chequebook owner
+	Liability           uint64         // honey owed to the peer which is not yet paid with a confirmed cheque
+}
+
 // NewAPI creates a new API instance
 func NewAPI(s *Swap) *API {
 	return &API{
@@ -55,16 +98,20 @@ func NewAPI(s *Swap) *API {
 
 // AvailableBalance returns the total balance of the chequebook against which new cheques can be written
 func (s *Swap) AvailableBalance() (*int256.Uint256, error) {
+	if err := s.checkBackend(); err != nil {
+		return nil, fmt.Errorf("getting liquid balance: %w", err)
+	}
+	chequebook := s.getContract()
 	// get the LiquidBalance of the chequebook
-	contractLiquidBalance, err := s.contract.LiquidBalance(nil)
+	contractLiquidBalance, err := chequebook.LiquidBalance(nil)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("getting liquid balance: %w", err)
 	}
 
 	// get all cheques
 	cheques, err := s.Cheques()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("getting cheques: %w", err)
 	}
 
 	// Compute the total worth of cheques sent and how much of of this is cashed
@@ -79,11 +126,15 @@ func (s *Swap) AvailableBalance() (*int256.Uint256, error) {
 		} else {
 			continue
 		}
+		// cheques drawn on a previous chequebook are not paid from this one
+		if sentCheque.Contract != chequebook.ContractParams().ContractAddress {
+			continue
+		}
 		cumulativePayout := sentCheque.ChequeParams.CumulativePayout.Value()
 		sentChequesWorth.Add(sentChequesWorth, cumulativePayout)
-		paidOut, err := s.contract.PaidOut(nil, sentCheque.ChequeParams.Beneficiary)
+		paidOut, err := chequebook.PaidOut(nil, sentCheque.ChequeParams.Beneficiary)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("getting paid out amount for %v: %w", sentCheque.ChequeParams.Beneficiary.Hex(), err)
 		}
 		cashedChequesWorth.Add(cashedChequesWorth, paidOut)
 	}
@@ -106,6 +157,9 @@ func (s *Swap) PeerBalance(peer enode.ID) (balance int64, err error) {
 }
 
 // Balances returns the balances for all known SWAP peers
+// the balances are complete: the stored balances are enumerated in a single pass over the store,
+// and if it cannot be completed, e.g. because the store fails during the iteration or holds an entry which cannot be read,
+// an error is returned instead of the balances found so far
 func (s *Swap) Balances() (map[enode.ID]int64, error) {
 	balances := make(map[enode.ID]int64)
 
@@ -119,24 +173,111 @@ func (s *Swap) Balances() (map[enode.ID]int64, error) {
 
 	// add store balances, if peer was not already added
 	balanceIterFunction := func(key []byte, value []byte) (stop bool, err error) {
-		peer := keyToID(string(key), balancePrefix)
+		peer, err := parseKeyID(string(key), balancePrefix)
+		if err != nil {
+			return true, err
+		}
 		if _, peerHasBalance := balances[peer]; !peerHasBalance {
 			var peerBalance int64
-			err = json.Unmarshal(value, &peerBalance)
-			if err == nil {
-				balances[peer] = peerBalance
+			if err = s.codec.Decode(value, &peerBalance); err != nil {
+				return true, fmt.Errorf("decoding balance of peer %s: %w", peer, err)
 			}
+			balances[peer] = peerBalance
 		}
-		return stop, err
+		return false, nil
 	}
 	err := s.store.Iterate(balancePrefix, balanceIterFunction)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("loading balances: %w", err)
 	}
 
 	return balances, nil
 }
 
+// BalancesFor returns the balances of the given peers, read in one pass under the peers lock
+// connected peers are read from memory and the others from the store, without enumerating the balances of all peers
+// peers without a balance are missing from the result, a zero balance is returned as 0
+func (s *Swap) BalancesFor(peers []enode.ID) (map[enode.ID]int64, error) {
+	balances := make(map[enode.ID]int64, len(peers))
+
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	for _, peer := range peers {
+		if swapPeer, ok := s.peers[peer]; ok {
+			swapPeer.lock.Lock()
+			balances[peer] = swapPeer.getBalance()
+			swapPeer.lock.Unlock()
+			continue
+		}
+		var balance int64
+		switch err := s.store.Get(balanceKey(peer), &balance); err {
+		case nil:
+			balances[peer] = balance
+		case state.ErrNotFound:
+		default:
+			return nil, fmt.Errorf("loading balance of peer %s: %w", peer, err)
+		}
+	}
+	return balances, nil
+}
+
+// Summary returns a snapshot of the accounting with all peers
+// it only reads the balances and the cheque totals, so it is cheap enough to be polled
+func (s *Swap) Summary() (*SwapSummary, error) {
+	balances, err := s.Balances()
+	if err != nil {
+		return nil, err
+	}
+	summary := &SwapSummary{
+		PaymentThreshold:    s.params.PaymentThreshold,
+		DisconnectThreshold: s.params.DisconnectThreshold,
+	}
+	if err := s.getChequebookErr(); err != nil {
+		summary.ChequebookError = err.Error()
+	}
+	s.peersLock.RLock()
+	summary.Peers = len(s.peers)
+	s.peersLock.RUnlock()
+	for _, balance := range balances {
+		if balance > 0 {
+			summary.TotalCredit += balance
+		} else {
+			summary.TotalDebt += balance
+		}
+	}
+
+	s.chequeEventsLock.Lock()
+	summary.ChequeTotals, err = s.loadChequeTotals()
+	s.chequeEventsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// OracleInfo describes the price per honey the oracle returns right now, where it comes from and when it was produced
+// for oracles which cache or smooth their price it is the cached price, the oracle is not updated
+func (s *Swap) OracleInfo() (*OraclePriceInfo, error) {
+	info, err := describeOracle(s.honeyPriceOracle)
+	if err != nil {
+		return nil, fmt.Errorf("getting oracle price: %w", err)
+	}
+	if info.AsOf.IsZero() {
+		info.AsOf = s.clock.Now()
+	}
+	return &info, nil
+}
+
+// OraclePrice returns the price per honey the oracle returns right now, the source which produced it and when
+// see OracleInfo for the prices of the sources the price is derived from
+func (s *Swap) OraclePrice() (price uint64, source string, asOf time.Time, err error) {
+	info, err := s.OracleInfo()
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	return info.Price, info.Source, info.AsOf, nil
+}
+
 // PeerCheques returns the last sent and received cheques for a given peer
 func (s *Swap) PeerCheques(peer enode.ID) (PeerCheques, error) {
 	var pendingCheque, sentCheque, receivedCheque *Cheque
@@ -144,27 +285,92 @@ func (s *Swap) PeerCheques(peer enode.ID) (PeerCheques, error) {
 	swapPeer := s.getPeer(peer)
 	if swapPeer != nil {
 		swapPeer.lock.Lock()
-		pendingCheque = swapPeer.getPendingCheque()
-		sentCheque = swapPeer.getLastSentCheque()
-		receivedCheque = swapPeer.getLastReceivedCheque()
+		// copy the cheques so that callers do not share them with the peer
+		pendingCheque = swapPeer.getPendingCheque().Copy()
+		sentCheque = swapPeer.getLastSentCheque().Copy()
+		receivedCheque = swapPeer.getLastReceivedCheque().Copy()
 		swapPeer.lock.Unlock()
 	} else {
 		errPendingCheque := s.store.Get(pendingChequeKey(peer), &pendingCheque)
 		if errPendingCheque != nil && errPendingCheque != state.ErrNotFound {
-			return PeerCheques{}, errPendingCheque
+			return PeerCheques{}, fmt.Errorf("loading pending cheque: %w", errPendingCheque)
 		}
 		errSentCheque := s.store.Get(sentChequeKey(peer), &sentCheque)
 		if errSentCheque != nil && errSentCheque != state.ErrNotFound {
-			return PeerCheques{}, errSentCheque
+			return PeerCheques{}, fmt.Errorf("loading last sent cheque: %w", errSentCheque)
 		}
 		errReceivedCheque := s.store.Get(receivedChequeKey(peer), &receivedCheque)
 		if errReceivedCheque != nil && errReceivedCheque != state.ErrNotFound {
-			return PeerCheques{}, errReceivedCheque
+			return PeerCheques{}, fmt.Errorf("loading last received cheque: %w", errReceivedCheque)
 		}
 	}
 	return PeerCheques{pendingCheque, sentCheque, receivedCheque}, nil
 }
 
+// PeerInfo returns the complete accounting state with a peer
+// for a connected peer the state is a consistent snapshot taken under the peer lock
+// for other peers it is loaded from the store, state.ErrNotFound is returned if nothing is known about the peer
+func (s *Swap) PeerInfo(peer enode.ID) (*PeerAccounting, error) {
+	info := &PeerAccounting{
+		Peer: peer,
+	}
+
+	if swapPeer := s.getPeer(peer); swapPeer != nil {
+		swapPeer.lock.Lock()
+		info.Connected = true
+		info.Balance = swapPeer.getBalance()
+		info.PendingCheque = swapPeer.getPendingCheque().Copy()
+		info.LastSentCheque = swapPeer.getLastSentCheque().Copy()
+		info.LastReceivedCheque = swapPeer.getLastReceivedCheque().Copy()
+		info.Blacklisted = swapPeer.blacklisted
+		info.ThresholdWeight = swapPeer.thresholdWeight
+		info.Beneficiary = swapPeer.beneficiary
+		swapPeer.lock.Unlock()
+	} else {
+		err := s.store.Get(balanceKey(peer), &info.Balance)
+		if err != nil && err != state.ErrNotFound {
+			return nil, fmt.Errorf("loading balance: %w", err)
+		}
+		known := err == nil
+		cheques, err := s.PeerCheques(peer)
+		if err != nil {
+			return nil, err
+		}
+		info.PendingCheque = cheques.PendingCheque
+		info.LastSentCheque = cheques.LastSentCheque
+		info.LastReceivedCheque = cheques.LastReceivedCheque
+		if info.Blacklisted, err = s.loadBlacklisted(peer); err != nil {
+			return nil, fmt.Errorf("loading blacklist entry: %w", err)
+		}
+		if info.ThresholdWeight, err = s.loadThresholdWeight(peer); err != nil {
+			return nil, fmt.Errorf("loading threshold weight: %w", err)
+		}
+		// the beneficiary is saved once the peer connected, see startPeerChequebooks
+		var chequebook *peerChequebook
+		if err := s.store.Get(peerChequebookKey(peer), &chequebook); err == nil {
+			info.Beneficiary = chequebook.Beneficiary
+			known = true
+		} else if err != state.ErrNotFound {
+			return nil, fmt.Errorf("loading chequebook of peer: %w", err)
+		}
+		if !known && !info.Blacklisted && info.ThresholdWeight == 1 && info.PendingCheque == nil && info.LastSentCheque == nil && info.LastReceivedCheque == nil {
+			return nil, fmt.Errorf("no accounting state for peer %v: %w", peer, state.ErrNotFound)
+		}
+	}
+
+	info.PaymentThreshold = weightThreshold(s.params.PaymentThreshold, info.ThresholdWeight)
+	info.DisconnectThreshold = weightThreshold(s.params.DisconnectThreshold, info.ThresholdWeight)
+
+	// the honey of the pending cheque was already deducted from the balance
+	if info.Balance < 0 {
+		info.Liability = uint64(-info.Balance)
+	}
+	if info.PendingCheque != nil {
+		info.Liability += info.PendingCheque.Honey
+	}
+	return info, nil
+}
+
 // Cheques returns all known last sent and received cheques, grouped by peer
 func (s *Swap) Cheques() (map[enode.ID]*PeerCheques, error) {
 	cheques := make(map[enode.ID]*PeerCheques)
@@ -187,15 +393,15 @@ func (s *Swap) Cheques() (map[enode.ID]*PeerCheques, error) {
 	// get peer cheques from store
 	err := s.addStoreCheques(pendingChequePrefix, cheques)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("loading pending cheques: %w", err)
 	}
 	err = s.addStoreCheques(sentChequePrefix, cheques)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("loading sent cheques: %w", err)
 	}
 	err = s.addStoreCheques(receivedChequePrefix, cheques)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("loading received cheques: %w", err)
 	}
 
 	return cheques, nil
@@ -212,7 +418,7 @@ func (s *Swap) addStoreCheques(chequePrefix string, cheques map[enode.ID]*PeerCh
 
 		// add cheque from store if not already in result
 		var peerCheque Cheque
-		err = json.Unmarshal(value, &peerCheque)
+		err = s.codec.Decode(value, &peerCheque)
 		if err == nil {
 			switch chequePrefix {
 			case pendingChequePrefix:
@@ -229,3 +435,23 @@ func (s *Swap) addStoreCheques(chequePrefix string, cheques map[enode.ID]*PeerCh
 	}
 	return s.store.Iterate(chequePrefix, chequesIterFunction)
 }
+
+// ChequeEventsSince returns the journaled cheque events with a sequence number larger than seq, in order
+// the journal is persisted, so a consumer can resume from the last sequence number it processed
+func (s *Swap) ChequeEventsSince(seq uint64) ([]ChequeEvent, error) {
+	events := make([]ChequeEvent, 0)
+	err := s.store.Iterate(chequeEventPrefix, func(key []byte, value []byte) (stop bool, err error) {
+		var event ChequeEvent
+		if err := s.codec.Decode(value, &event); err != nil {
+			return true, err
+		}
+		if event.Seq > seq {
+			events = append(events, event)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading cheque events: %w", err)
+	}
+	return events, nil
+}
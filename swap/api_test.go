@@ -1,6 +1,8 @@
 package swap
 
 import (
+	"errors"
+	"os"
 	"reflect"
 	"testing"
 
@@ -135,6 +137,72 @@ func TestBalances(t *testing.T) {
 	testBalances(t, swap, map[enode.ID]int64{testPeerID: 303, testPeer2ID: 123})
 }
 
+// TestBalancesIncomplete tests that Balances fails instead of returning the balances found so far
+// if not all stored balances can be read
+func TestBalancesIncomplete(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+
+	peer := newDummyPeer().ID()
+	if err := swap.saveBalance(peer, 42); err != nil {
+		t.Fatal(err)
+	}
+	testBalances(t, swap, map[enode.ID]int64{peer: 42})
+
+	undecodable := newDummyPeer().ID()
+	if err := swap.store.Put(balanceKey(undecodable), "not a balance"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := swap.Balances(); err == nil {
+		t.Fatal("expected a balance which cannot be decoded to fail")
+	}
+	if err := swap.store.Delete(balanceKey(undecodable)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := swap.store.Put(balancePrefix+"unknown", int64(42)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := swap.Balances(); err == nil {
+		t.Fatal("expected a balance under a malformed key to fail")
+	}
+}
+
+// TestBalancesFor tests that the balances of the requested peers are returned, both connected and stored ones,
+// and that peers without a balance are left out instead of being reported with 0
+func TestBalancesFor(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+
+	connected := addPeer(t, swap)
+	setBalance(t, connected, 808)
+	zero := addPeer(t, swap)
+	stored := newDummyPeer().ID()
+	if err := swap.saveBalance(stored, -42); err != nil {
+		t.Fatal(err)
+	}
+	unknown := newDummyPeer().ID()
+	other := addPeer(t, swap)
+	setBalance(t, other, 123)
+
+	balances, err := swap.BalancesFor([]enode.ID{connected.ID(), zero.ID(), stored, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[enode.ID]int64{connected.ID(): 808, zero.ID(): 0, stored: -42}
+	if !reflect.DeepEqual(balances, expected) {
+		t.Fatalf("expected balances %v, got %v", expected, balances)
+	}
+
+	undecodable := newDummyPeer().ID()
+	if err := swap.store.Put(balanceKey(undecodable), "not a balance"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := swap.BalancesFor([]enode.ID{undecodable}); err == nil {
+		t.Fatal("expected a balance which cannot be decoded to fail")
+	}
+}
+
 // tests that a map of peerID:balance matches the result of the Balances function
 func testBalances(t *testing.T, s *Swap, expectedBalances map[enode.ID]int64) {
 	t.Helper()
@@ -546,3 +614,191 @@ func verifyCheques(t *testing.T, s *Swap, peer enode.ID, expectedCheques PeerChe
 		t.Fatalf("Expected peer %v cheques to be %v, but are %v", peer, expectedCheques, peerCheques)
 	}
 }
+
+// TestChequeEventsSince tests that cheque events are journaled in order and survive a restart
+func TestChequeEventsSince(t *testing.T) {
+	testBackend := newTestBackend(t)
+	defer testBackend.Close()
+
+	swap, testDir := newBaseTestSwap(t, ownerKey, testBackend)
+	defer os.RemoveAll(testDir)
+
+	peer1 := newDummyPeer().Peer.ID()
+	peer2 := newDummyPeer().Peer.ID()
+	sentCheque := newRandomTestCheque()
+	receivedCheque := newRandomTestCheque()
+
+	if err := swap.appendChequeEvent(ChequeSentEvent, peer1, sentCheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.appendChequeEvent(ChequeReceivedEvent, peer2, receivedCheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.appendChequeEvent(ChequeSentEvent, peer2, sentCheque); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		eventType ChequeEventType
+		peer      enode.ID
+		cheque    *Cheque
+	}{
+		{ChequeSentEvent, peer1, sentCheque},
+		{ChequeReceivedEvent, peer2, receivedCheque},
+		{ChequeSentEvent, peer2, sentCheque},
+	}
+
+	events, err := swap.ChequeEventsSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for i, event := range events {
+		if event.Seq != uint64(i+1) || event.Type != expected[i].eventType || event.Peer != expected[i].peer || !event.Cheque.Equal(expected[i].cheque) {
+			t.Fatalf("unexpected event %d: %v", i, event)
+		}
+	}
+
+	events, err = swap.ChequeEventsSince(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Seq != 3 {
+		t.Fatalf("expected only event 3, got %v", events)
+	}
+
+	// reopen the store and check that the sequence continues
+	if err := swap.store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stateStore, err := state.NewDBStore(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stateStore.Close()
+	swap.store = stateStore
+
+	if err := swap.appendChequeEvent(ChequeReceivedEvent, peer1, receivedCheque); err != nil {
+		t.Fatal(err)
+	}
+	events, err = swap.ChequeEventsSince(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Seq != 4 || events[0].Peer != peer1 {
+		t.Fatalf("expected only event 4, got %v", events)
+	}
+}
+
+// TestSummary tests that the summary aggregates the balances of connected and disconnected peers and the cheque journal
+func TestSummary(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+
+	setBalance(t, addPeer(t, swap), 808)
+	setBalance(t, addPeer(t, swap), -303)
+	if err := swap.store.Put(balanceKey(newDummyPeer().ID()), int64(-100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// events journaled before the totals were kept
+	sentCheque := newRandomTestCheque()
+	receivedCheque := newRandomTestCheque()
+	if err := swap.store.Put(chequeEventKey(1), &ChequeEvent{Seq: 1, Type: ChequeSentEvent, Cheque: sentCheque}); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.store.Put(lastChequeEventKey, uint64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.appendChequeEvent(ChequeReceivedEvent, newDummyPeer().ID(), receivedCheque); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := swap.Summary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &SwapSummary{
+		Peers:               2,
+		TotalCredit:         808,
+		TotalDebt:           -403,
+		PaymentThreshold:    swap.params.PaymentThreshold,
+		DisconnectThreshold: swap.params.DisconnectThreshold,
+		ChequeTotals: ChequeTotals{
+			ChequesSent:     1,
+			ChequesReceived: 1,
+			HoneySent:       sentCheque.Honey,
+			HoneyReceived:   receivedCheque.Honey,
+		},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected summary %+v, got %+v", expected, summary)
+	}
+}
+
+// TestPeerInfo tests that the accounting state of connected and disconnected peers is reported completely
+func TestPeerInfo(t *testing.T) {
+	swap, testPeer, clean := newTestSwapAndPeer(t, ownerKey)
+	defer clean()
+	testPeerID := testPeer.ID()
+
+	pendingCheque := newRandomTestCheque()
+	sentCheque := newRandomTestCheque()
+	receivedCheque := newRandomTestCheque()
+	setBalance(t, testPeer, -100)
+	if err := testPeer.setPendingCheque(pendingCheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := testPeer.setLastSentCheque(sentCheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := testPeer.setLastReceivedCheque(receivedCheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.Blacklist(testPeerID); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.SetThresholdWeight(testPeerID, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &PeerAccounting{
+		Peer:                testPeerID,
+		Connected:           true,
+		Balance:             -100,
+		PendingCheque:       pendingCheque,
+		LastSentCheque:      sentCheque,
+		LastReceivedCheque:  receivedCheque,
+		PaymentThreshold:    2 * swap.params.PaymentThreshold,
+		DisconnectThreshold: 2 * swap.params.DisconnectThreshold,
+		ThresholdWeight:     2,
+		Blacklisted:         true,
+		Beneficiary:         ownerAddress,
+		Liability:           100 + pendingCheque.Honey,
+	}
+	info, err := swap.PeerInfo(testPeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("expected peer info %+v, got %+v", expected, info)
+	}
+
+	// a disconnected peer is loaded from the store, without beneficiary
+	swap.removePeer(testPeer)
+	expected.Connected = false
+	expected.Beneficiary = common.Address{}
+	info, err = swap.PeerInfo(testPeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("expected peer info %+v, got %+v", expected, info)
+	}
+
+	if _, err := swap.PeerInfo(adapters.RandomNodeConfig().ID); !errors.Is(err, state.ErrNotFound) {
+		t.Fatalf("expected error %v for unknown peer, got %v", state.ErrNotFound, err)
+	}
+}
@@ -18,10 +18,12 @@ package swap
 
 import (
 	"context"
-	"crypto/ecdsa"
+	"fmt"
+	"math/big"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/metrics"
 	contract "github.com/ethersphere/swarm/contracts/swap"
 	"github.com/ethersphere/swarm/swap/chain"
@@ -33,9 +35,9 @@ const CashChequeBeneficiaryTransactionCost = 50000
 
 // CashoutProcessor holds all relevant fields needed for processing cashouts
 type CashoutProcessor struct {
-	backend    chain.Backend     // ethereum backend to use
-	privateKey *ecdsa.PrivateKey // private key to use
-	Logger     Logger
+	backend chain.Backend // ethereum backend to use
+	signer  Signer        // signer of the cashout transactions
+	Logger  Logger
 }
 
 // CashoutRequest represents a request for a cashout operation
@@ -53,95 +55,137 @@ type ActiveCashout struct {
 }
 
 // newCashoutProcessor creates a new instance of CashoutProcessor
-func newCashoutProcessor(backend chain.Backend, privateKey *ecdsa.PrivateKey) *CashoutProcessor {
+func newCashoutProcessor(backend chain.Backend, signer Signer) *CashoutProcessor {
 	return &CashoutProcessor{
-		backend:    backend,
-		privateKey: privateKey,
+		backend: backend,
+		signer:  signer,
 	}
 }
 
 // cashCheque tries to cash the cheque specified in the request
 // after the transaction is sent it waits on its success
 func (c *CashoutProcessor) cashCheque(ctx context.Context, request *CashoutRequest) error {
+	_, err := c.cashChequeTx(ctx, request)
+	return err
+}
+
+// cashChequeTx is cashCheque, returning the transaction which cashed the cheque
+func (c *CashoutProcessor) cashChequeTx(ctx context.Context, request *CashoutRequest) (*types.Transaction, error) {
 	cheque := request.Cheque
-	opts := bind.NewKeyedTransactor(c.privateKey)
+	opts := newTransactor(c.signer)
 	opts.Context = ctx
 
 	otherSwap, err := contract.InstanceAt(cheque.Contract, c.backend)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("instantiating chequebook at %v: %w", cheque.Contract.Hex(), err)
 	}
 
 	tx, err := otherSwap.CashChequeBeneficiaryStart(opts, request.Destination, cheque.CumulativePayout, cheque.Signature)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("sending cash cheque transaction: %w", err)
 	}
 
 	// this blocks until the cashout has been successfully processed
-	return c.waitForAndProcessActiveCashout(&ActiveCashout{
+	err = c.waitForAndProcessActiveCashout(ctx, &ActiveCashout{
 		Request:         *request,
 		TransactionHash: tx.Hash(),
 		Logger:          request.Logger,
 	})
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
 }
 
 // estimatePayout estimates the payout for a given cheque as well as the transaction cost
 func (c *CashoutProcessor) estimatePayout(ctx context.Context, cheque *Cheque) (expectedPayout *int256.Uint256, transactionCosts *int256.Uint256, err error) {
 	otherSwap, err := contract.InstanceAt(cheque.Contract, c.backend)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("instantiating chequebook at %v: %w", cheque.Contract.Hex(), err)
 	}
 
 	po, err := otherSwap.PaidOut(&bind.CallOpts{Context: ctx}, cheque.Beneficiary)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("reading paid out amount: %w", err)
 	}
 
 	paidOut, err := int256.NewUint256(po)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("converting paid out amount: %w", err)
 	}
 
 	gp, err := c.backend.SuggestGasPrice(ctx)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("getting gas price: %w", err)
 	}
 
 	gasPrice, err := int256.NewUint256(gp)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("converting gas price: %w", err)
 	}
 
 	transactionCosts, err = new(int256.Uint256).Mul(gasPrice, int256.Uint256From(CashChequeBeneficiaryTransactionCost))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("computing transaction costs: %w", err)
 	}
 
 	if paidOut.Cmp(cheque.CumulativePayout) > 0 {
-		return new(int256.Uint256), transactionCosts, nil
+		return int256.Uint256From(0), transactionCosts, nil
 	}
 
 	expectedPayout, err = new(int256.Uint256).Sub(cheque.CumulativePayout, paidOut)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("computing expected payout: %w", err)
 	}
 
 	return expectedPayout, transactionCosts, nil
 }
 
-// waitForAndProcessActiveCashout waits for activeCashout to complete
-func (c *CashoutProcessor) waitForAndProcessActiveCashout(activeCashout *ActiveCashout) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTransactionTimeout)
+// simulateCashCheque checks whether the beneficiary of cheque could cash it now without the cheque bouncing
+// it returns the reason why it could not, or an empty string if it could
+func (c *CashoutProcessor) simulateCashCheque(ctx context.Context, cheque *Cheque) (reason string, err error) {
+	otherSwap, err := contract.InstanceAt(cheque.Contract, c.backend)
+	if err != nil {
+		return "", fmt.Errorf("instantiating chequebook at %v: %w", cheque.Contract.Hex(), err)
+	}
+	opts := &bind.CallOpts{From: cheque.Beneficiary, Context: ctx}
+
+	paidOut, err := otherSwap.PaidOut(opts, cheque.Beneficiary)
+	if err != nil {
+		return "", fmt.Errorf("reading paid out amount: %w", err)
+	}
+	available, err := otherSwap.LiquidBalanceFor(opts, cheque.Beneficiary)
+	if err != nil {
+		return "", fmt.Errorf("reading liquid balance: %w", err)
+	}
+	payout := new(big.Int).Sub(cheque.CumulativePayout.Value(), paidOut)
+	if payout.Sign() <= 0 {
+		return fmt.Sprintf("cumulative payout %v was already paid out", cheque.CumulativePayout), nil
+	}
+	if payout.Cmp(available) > 0 {
+		return fmt.Sprintf("cheque would bounce, payout %v exceeds the available balance %v", payout, available), nil
+	}
+
+	// the backend reports transactions which would fail as errors
+	if _, err := otherSwap.CashChequeBeneficiaryEstimate(opts, cheque.Beneficiary, cheque.CumulativePayout, cheque.Signature); err != nil {
+		return fmt.Sprintf("cashing would fail: %v", err), nil
+	}
+	return "", nil
+}
+
+// waitForAndProcessActiveCashout waits for activeCashout to complete or ctx to be done
+func (c *CashoutProcessor) waitForAndProcessActiveCashout(ctx context.Context, activeCashout *ActiveCashout) error {
+	ctx, cancel := context.WithTimeout(ctx, DefaultTransactionTimeout)
 	defer cancel()
 
 	receipt, err := chain.WaitMined(ctx, c.backend, activeCashout.TransactionHash)
 	if err != nil {
-		return err
+		return fmt.Errorf("waiting for cash cheque transaction %v: %w", activeCashout.TransactionHash.Hex(), err)
 	}
 
 	otherSwap, err := contract.InstanceAt(activeCashout.Request.Cheque.Contract, c.backend)
 	if err != nil {
-		return err
+		return fmt.Errorf("instantiating chequebook at %v: %w", activeCashout.Request.Cheque.Contract.Hex(), err)
 	}
 
 	result := otherSwap.CashChequeBeneficiaryResult(receipt)
@@ -18,9 +18,11 @@ package swap
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethersphere/swarm/network"
 	"github.com/ethersphere/swarm/swap/chain"
@@ -121,7 +123,7 @@ func TestCashCheque(t *testing.T) {
 	reset := setupContractTest()
 	defer reset()
 
-	cashoutProcessor := newCashoutProcessor(backend, ownerKey)
+	cashoutProcessor := newCashoutProcessor(backend, NewLocalSigner(ownerKey))
 	payout := int256.Uint256From(42)
 
 	chequebook, err := testDeployWithPrivateKey(context.Background(), backend, ownerKey, ownerAddress, payout)
@@ -155,13 +157,54 @@ func TestCashCheque(t *testing.T) {
 	}
 }
 
+// TestCashoutRecipient tests that cashed cheques pay out to the recipient set with SetCashoutRecipient
+// and that the zero address is refused
+func TestCashoutRecipient(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+	swap, clean := newTestSwap(t, beneficiaryKey, backend)
+	defer clean()
+	reset := setupContractTest()
+	defer reset()
+	ctx := context.Background()
+
+	payout := int256.Uint256From(42)
+	chequebook, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, payout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheque, err := newSignedTestCheque(chequebook.ContractParams().ContractAddress, beneficiaryAddress, payout, ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := swap.SetCashoutRecipient(common.Address{}); err != ErrZeroCashoutRecipient {
+		t.Fatalf("expected error %v, got %v", ErrZeroCashoutRecipient, err)
+	}
+	recipient := common.HexToAddress("0x7e5a5d12c9b1a2a8e4c1f09a1d6c6d0ad3bb5c6e")
+	if err := swap.SetCashoutRecipient(recipient); err != nil {
+		t.Fatal(err)
+	}
+	if err := cashCheque(ctx, swap, cheque); err != nil {
+		t.Fatal(err)
+	}
+
+	balance, err := chequebook.BalanceAtTokenContract(nil, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Cmp(payout.Value()) != 0 {
+		t.Fatalf("expected the recipient to be paid %v, got %v", payout, balance)
+	}
+}
+
 // TestEstimatePayout creates a valid cheque and feeds it to cashoutProcessor.estimatePayout
 func TestEstimatePayout(t *testing.T) {
 	backend := newTestBackend(t)
 	reset := setupContractTest()
 	defer reset()
 
-	cashoutProcessor := newCashoutProcessor(backend, ownerKey)
+	cashoutProcessor := newCashoutProcessor(backend, NewLocalSigner(ownerKey))
 	payout := int256.Uint256From(42)
 
 	chequebook, err := testDeployWithPrivateKey(context.Background(), backend, ownerKey, ownerAddress, payout)
@@ -188,3 +231,59 @@ func TestEstimatePayout(t *testing.T) {
 		t.Fatalf("unexpected transaction cost: got %v, wanted: %d", transactionCost, 0)
 	}
 }
+
+// TestCashable tests that the last cheque exchanged with a peer is simulated to be cashed
+// and that bouncing cheques and cheques with an invalid signature are not cashable
+func TestCashable(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+	swap, clean := newTestSwap(t, beneficiaryKey, backend)
+	defer clean()
+	ctx := context.Background()
+
+	payout := int256.Uint256From(42)
+	chequebook, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, payout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chequebookAddress := chequebook.ContractParams().ContractAddress
+
+	for _, tc := range []struct {
+		name     string
+		payout   *int256.Uint256
+		signer   *ecdsa.PrivateKey
+		sent     bool
+		cashable bool
+	}{
+		{"received", payout, ownerKey, false, true},
+		{"sent", payout, ownerKey, true, true},
+		{"bouncing", int256.Uint256From(43), ownerKey, false, false},
+		{"invalid signature", payout, beneficiaryKey, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cheque, err := newSignedTestCheque(chequebookAddress, beneficiaryAddress, tc.payout, tc.signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peer := newDummyPeer().ID()
+			key := receivedChequeKey(peer)
+			if tc.sent {
+				key = sentChequeKey(peer)
+			}
+			if err := swap.store.Put(key, cheque); err != nil {
+				t.Fatal(err)
+			}
+			cashable, err := swap.TestCashable(ctx, peer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cashable != tc.cashable {
+				t.Fatalf("expected cashable %v, got %v", tc.cashable, cashable)
+			}
+		})
+	}
+
+	if _, err := swap.TestCashable(ctx, newDummyPeer().ID()); err != ErrNoCheque {
+		t.Fatalf("expected error %v for a peer without cheques, got %v", ErrNoCheque, err)
+	}
+}
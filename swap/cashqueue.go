@@ -0,0 +1,458 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethersphere/swarm/state"
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// CashoutStatus is the state of a cheque in the cashout queue
+type CashoutStatus string
+
+const (
+	CashoutQueued    CashoutStatus = "queued"    // the cheque waits for its first attempt
+	CashoutRetrying  CashoutStatus = "retrying"  // an attempt failed, the cheque is cashed again after a backoff
+	CashoutDropped   CashoutStatus = "dropped"   // the cheque cannot be cashed and is not retried
+	CashoutCancelled CashoutStatus = "cancelled" // cashing was cancelled by the operator, the cheque can still be cashed manually
+)
+
+// ErrNoPendingCashIn indicates that there is no cheque of a peer which is going to be cashed automatically
+var ErrNoPendingCashIn = errors.New("no pending cash-in for peer")
+
+// ErrChequeAlreadyCashed indicates that the cumulative payout of a cheque was already cashed
+var ErrChequeAlreadyCashed = errors.New("cheque already cashed")
+
+var (
+	cashoutQueueInterval       = 10 * time.Second // how often the queue is checked for cheques due for a retry
+	cashoutRetryInitialBackoff = 1 * time.Minute  // wait time after the first failed attempt
+	cashoutRetryMaxBackoff     = 1 * time.Hour    // upper bound of the doubling wait time between attempts
+)
+
+// CashoutQueueItem is a cheque in the cashout queue
+// there is at most one item per chequebook, as a cheque also cashes the payout of all previous cheques
+type CashoutQueueItem struct {
+	Cheque      *Cheque
+	Status      CashoutStatus
+	Attempts    int       // number of failed attempts
+	LastError   string    // error of the last failed attempt, or the reason why the cheque was dropped
+	NextAttempt time.Time // time at which the cheque is cashed next
+}
+
+// pending returns whether the cheque of the item is still going to be cashed automatically
+func (item *CashoutQueueItem) pending() bool {
+	return item.Status != CashoutDropped && item.Status != CashoutCancelled
+}
+
+// PendingCashIn is a cheque which is going to be cashed automatically
+type PendingCashIn struct {
+	Peer             enode.ID        // peer which sent the cheque, zero if its last received cheque is from another chequebook
+	Chequebook       common.Address  // chequebook the cheque is cashed from
+	CumulativePayout *int256.Uint256 // cumulative payout of the cheque
+	Attempts         int             // number of failed attempts
+	ScheduledAt      time.Time       // time of the next attempt
+}
+
+// returns the store key for the cashout queue item of a chequebook
+func cashoutQueueKey(chequebook common.Address) string {
+	return cashoutQueuePrefix + chequebook.Hex()
+}
+
+// returns the store key for the cashed cumulative payout of a chequebook
+func cashedPayoutKey(chequebook common.Address) string {
+	return cashedPayoutPrefix + chequebook.Hex()
+}
+
+// cashoutBackoff returns the wait time after the given number of failed attempts
+func cashoutBackoff(attempts int) time.Duration {
+	backoff := cashoutRetryInitialBackoff
+	for i := 1; i < attempts && backoff < cashoutRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > cashoutRetryMaxBackoff {
+		backoff = cashoutRetryMaxBackoff
+	}
+	return backoff
+}
+
+// loadCashedPayout loads the highest cumulative payout cashed from the chequebook
+// and returns nil if no cheque of it was cashed
+func (s *Swap) loadCashedPayout(chequebook common.Address) (payout *int256.Uint256, err error) {
+	err = s.store.Get(cashedPayoutKey(chequebook), &payout)
+	if err == state.ErrNotFound {
+		return nil, nil
+	}
+	return payout, err
+}
+
+// enqueueCashout adds the cheque to the cashout queue and wakes up the cashout worker
+// a queued cheque of the same chequebook is replaced if the new cheque has a higher cumulative payout
+func (s *Swap) enqueueCashout(cheque *Cheque) error {
+	s.cashoutQueueLock.Lock()
+	var item *CashoutQueueItem
+	err := s.store.Get(cashoutQueueKey(cheque.Contract), &item)
+	if err != nil && err != state.ErrNotFound {
+		s.cashoutQueueLock.Unlock()
+		return fmt.Errorf("loading cashout queue item: %w", err)
+	}
+	if err == nil && item.Cheque.CumulativePayout.Cmp(cheque.CumulativePayout) >= 0 {
+		s.cashoutQueueLock.Unlock()
+		return nil
+	}
+	item = &CashoutQueueItem{
+		Cheque:      cheque,
+		Status:      CashoutQueued,
+		NextAttempt: s.clock.Now(),
+	}
+	err = s.store.Put(cashoutQueueKey(cheque.Contract), item)
+	s.cashoutQueueLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("saving cashout queue item: %w", err)
+	}
+
+	s.startCashoutQueue()
+	select {
+	case s.cashoutQueueSignal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// startCashoutQueue starts the cashout worker unless it is already running
+func (s *Swap) startCashoutQueue() {
+	s.cashoutQueueOnce.Do(func() {
+		s.runBackground(s.processCashoutQueue)
+	})
+}
+
+// processCashoutQueue cashes the queued cheques which are due whenever a cheque is queued
+// and every cashoutQueueInterval, until ctx is done
+// cheques are cashed one after another so that their transactions do not compete for nonces
+func (s *Swap) processCashoutQueue(ctx context.Context) {
+	ticker := s.clock.NewTicker(cashoutQueueInterval)
+	defer ticker.Stop()
+	for {
+		items, err := s.CashoutQueue()
+		if err != nil {
+			s.logger.Error(CashChequeAction, "error while loading cashout queue", "err", err)
+		}
+		for _, item := range items {
+			if ctx.Err() != nil {
+				return
+			}
+			if item.pending() && !item.NextAttempt.After(s.clock.Now()) {
+				s.processCashout(ctx, item.Cheque)
+			}
+		}
+
+		select {
+		case <-s.cashoutQueueSignal:
+		case <-ticker.C():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// processCashout makes one attempt to cash the cheque and updates its queue item with the result
+func (s *Swap) processCashout(ctx context.Context, cheque *Cheque) {
+	s.cashoutLock.Lock()
+	defer s.cashoutLock.Unlock()
+
+	reason, err := s.checkCashoutPossible(ctx, cheque)
+	if err == nil && reason == "" {
+		unfreeze := s.freezeBalance(cheque.Contract)
+		err = defaultCashCheque(ctx, s, cheque)
+		unfreeze()
+	}
+	// an attempt interrupted by shutdown is not counted, the cheque is cashed again after the restart
+	if ctx.Err() != nil {
+		return
+	}
+
+	s.cashoutQueueLock.Lock()
+	defer s.cashoutQueueLock.Unlock()
+
+	batch := new(state.StoreBatch)
+	if err == nil && reason == "" {
+		if err := s.batchPut(batch, cashedPayoutKey(cheque.Contract), cheque.CumulativePayout); err != nil {
+			s.logger.Error(CashChequeAction, "error while encoding cashed payout", "err", err)
+			return
+		}
+	}
+
+	var item *CashoutQueueItem
+	if err := s.store.Get(cashoutQueueKey(cheque.Contract), &item); err != nil && err != state.ErrNotFound {
+		s.logger.Error(CashChequeAction, "error while loading cashout queue item", "err", err)
+		return
+	}
+	// the item is only updated if no newer cheque of the chequebook was queued in the meantime
+	if item != nil && item.Cheque.Equal(cheque) {
+		switch {
+		case reason != "":
+			metrics.GetOrRegisterCounter("swap/cheques/cashed/dropped", nil).Inc(1)
+			s.logger.Warn(CashChequeAction, "dropping cheque from cashout queue", "chequebook", cheque.Contract, "reason", reason)
+			item.Status = CashoutDropped
+			item.LastError = reason
+		case err != nil && item.Status == CashoutCancelled:
+			// cashing was cancelled during the attempt, so it is not retried
+		case err != nil:
+			metrics.GetOrRegisterCounter("swap/cheques/cashed/errors", nil).Inc(1)
+			item.Status = CashoutRetrying
+			item.Attempts++
+			item.LastError = err.Error()
+			item.NextAttempt = s.clock.Now().Add(cashoutBackoff(item.Attempts))
+			s.logger.Error(CashChequeAction, "cashing cheque failed, retrying later", "chequebook", cheque.Contract, "attempts", item.Attempts, "next attempt", item.NextAttempt, "err", err)
+		}
+		if reason == "" && err == nil {
+			batch.Delete(cashoutQueueKey(cheque.Contract))
+		} else if err := s.batchPut(batch, cashoutQueueKey(cheque.Contract), item); err != nil {
+			s.logger.Error(CashChequeAction, "error while encoding cashout queue item", "err", err)
+			return
+		}
+	}
+
+	if err := s.store.WriteBatch(batch); err != nil {
+		s.logger.Error(CashChequeAction, "error while saving cashout queue item", "err", err)
+	}
+}
+
+// freezeBalance freezes the balance of the connected peer whose chequebook is contract while its cheque is being cashed
+// amounts accounted with the peer meanwhile are merged into the balance when the returned function is called
+func (s *Swap) freezeBalance(contract common.Address) (unfreeze func()) {
+	var peer *Peer
+	s.peersLock.RLock()
+	for _, p := range s.peers {
+		// the chequebook of a peer can change during the session, see updateChequebook
+		p.lock.RLock()
+		found := p.contractAddress == contract
+		p.lock.RUnlock()
+		if found {
+			peer = p
+			break
+		}
+	}
+	s.peersLock.RUnlock()
+	if peer == nil {
+		return func() {}
+	}
+
+	peer.lock.Lock()
+	peer.freezeBalance()
+	peer.lock.Unlock()
+
+	return func() {
+		peer.lock.Lock()
+		defer peer.lock.Unlock()
+		if err := peer.unfreezeBalance(); err != nil {
+			peer.logger.Error(CashChequeAction, "error while merging the amount accounted during cashing into the balance", "err", err)
+			return
+		}
+		// the merged amount can take the balance over the payment threshold
+		if err := s.checkPaymentThresholdAndSendCheque(peer); err != nil {
+			peer.logger.Error(SendChequeAction, "error while sending cheque after cashing", "err", err)
+		}
+	}
+}
+
+// checkCashoutPossible returns the reason why the cheque can never be cashed, or an empty string if it can be
+// an error means that this could not be determined and the cheque should be retried
+func (s *Swap) checkCashoutPossible(ctx context.Context, cheque *Cheque) (reason string, err error) {
+	cashed, err := s.loadCashedPayout(cheque.Contract)
+	if err != nil {
+		return "", fmt.Errorf("loading cashed payout: %w", err)
+	}
+	if cashed != nil && cashed.Cmp(cheque.CumulativePayout) >= 0 {
+		return fmt.Sprintf("cumulative payout %v was already cashed, cashed %v", cheque.CumulativePayout, cashed), nil
+	}
+
+	expectedPayout, _, err := s.cashoutProcessor.estimatePayout(ctx, cheque)
+	if err != nil {
+		return "", fmt.Errorf("estimating payout: %w", err)
+	}
+	if expectedPayout.Cmp(int256.Uint256From(0)) == 0 {
+		return fmt.Sprintf("cumulative payout %v was already paid out by the chequebook", cheque.CumulativePayout), nil
+	}
+	return "", nil
+}
+
+// CashoutQueue returns all cheques in the cashout queue, including the dropped ones
+func (s *Swap) CashoutQueue() ([]*CashoutQueueItem, error) {
+	var items []*CashoutQueueItem
+	err := s.store.Iterate(cashoutQueuePrefix, func(key []byte, value []byte) (stop bool, err error) {
+		var item *CashoutQueueItem
+		if err := s.codec.Decode(value, &item); err != nil {
+			return true, fmt.Errorf("decoding cashout queue item %s: %w", key, err)
+		}
+		items = append(items, item)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// CashoutQueueDepth returns the number of cheques in the cashout queue which are still going to be cashed
+func (s *Swap) CashoutQueueDepth() (int, error) {
+	items, err := s.CashoutQueue()
+	if err != nil {
+		return 0, err
+	}
+	depth := 0
+	for _, item := range items {
+		if item.pending() {
+			depth++
+		}
+	}
+	return depth, nil
+}
+
+// PendingCashIns returns the cheques which are going to be cashed automatically
+// the peers are resolved from the stored received cheques, so the list is complete after a restart
+func (s *Swap) PendingCashIns() ([]PendingCashIn, error) {
+	items, err := s.CashoutQueue()
+	if err != nil {
+		return nil, err
+	}
+	peers := make(map[common.Address]enode.ID)
+	err = s.store.Iterate(receivedChequePrefix, func(key []byte, value []byte) (stop bool, err error) {
+		var cheque Cheque
+		if err := s.codec.Decode(value, &cheque); err != nil {
+			return true, fmt.Errorf("decoding received cheque %s: %w", key, err)
+		}
+		peers[cheque.Contract] = keyToID(string(key), receivedChequePrefix)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]PendingCashIn, 0)
+	for _, item := range items {
+		if !item.pending() {
+			continue
+		}
+		pending = append(pending, PendingCashIn{
+			Peer:             peers[item.Cheque.Contract],
+			Chequebook:       item.Cheque.Contract,
+			CumulativePayout: item.Cheque.CumulativePayout,
+			Attempts:         item.Attempts,
+			ScheduledAt:      item.NextAttempt,
+		})
+	}
+	return pending, nil
+}
+
+// CancelCashIn cancels cashing the last cheque received from peer automatically, e.g. to cash it manually
+// the cheque stays in the cashout queue as cancelled, a newer cheque of the peer is cashed automatically again
+// it returns ErrNoPendingCashIn if no cheque of the peer is going to be cashed
+func (s *Swap) CancelCashIn(peer enode.ID) error {
+	cheque, err := s.loadLastReceivedCheque(peer)
+	if err != nil {
+		return fmt.Errorf("loading last received cheque: %w", err)
+	}
+	if cheque == nil {
+		return ErrNoPendingCashIn
+	}
+
+	s.cashoutQueueLock.Lock()
+	defer s.cashoutQueueLock.Unlock()
+	var item *CashoutQueueItem
+	err = s.store.Get(cashoutQueueKey(cheque.Contract), &item)
+	if err == state.ErrNotFound || (err == nil && !item.pending()) {
+		return ErrNoPendingCashIn
+	}
+	if err != nil {
+		return fmt.Errorf("loading cashout queue item: %w", err)
+	}
+	item.Status = CashoutCancelled
+	if err := s.store.Put(cashoutQueueKey(cheque.Contract), item); err != nil {
+		return fmt.Errorf("saving cashout queue item: %w", err)
+	}
+	s.logger.Info(CashChequeAction, "cancelled cashing cheque", peerCtx(peer, "chequebook", cheque.Contract)...)
+	return nil
+}
+
+// CashCheque cashes the last cheque received from peer and returns the transaction once it is mined
+// it returns ErrChequeAlreadyCashed if the cumulative payout of the cheque was already cashed, manually or by the cashout worker,
+// so calling it again does not send another transaction
+// a queued cash-in of the cheque is completed by cashing it manually
+func (s *Swap) CashCheque(ctx context.Context, peer enode.ID) (*types.Transaction, error) {
+	if err := s.checkBackend(); err != nil {
+		return nil, fmt.Errorf("cashing cheque: %w", err)
+	}
+	cheque, err := s.loadLastReceivedCheque(peer)
+	if err != nil {
+		return nil, fmt.Errorf("loading last received cheque: %w", err)
+	}
+	if cheque == nil {
+		return nil, ErrNoCheque
+	}
+
+	s.cashoutLock.Lock()
+	defer s.cashoutLock.Unlock()
+
+	reason, err := s.checkCashoutPossible(ctx, cheque)
+	if err != nil {
+		return nil, err
+	}
+	if reason != "" {
+		return nil, fmt.Errorf("%w: %s", ErrChequeAlreadyCashed, reason)
+	}
+
+	unfreeze := s.freezeBalance(cheque.Contract)
+	tx, err := s.cashoutProcessor.cashChequeTx(ctx, &CashoutRequest{
+		Cheque:      *cheque,
+		Destination: s.getCashoutRecipient(),
+		Logger:      s.logger,
+	})
+	unfreeze()
+	if err != nil {
+		return nil, err
+	}
+
+	s.cashoutQueueLock.Lock()
+	defer s.cashoutQueueLock.Unlock()
+
+	batch := new(state.StoreBatch)
+	if err := s.batchPut(batch, cashedPayoutKey(cheque.Contract), cheque.CumulativePayout); err != nil {
+		return nil, fmt.Errorf("encoding cashed payout: %w", err)
+	}
+	var item *CashoutQueueItem
+	err = s.store.Get(cashoutQueueKey(cheque.Contract), &item)
+	if err != nil && err != state.ErrNotFound {
+		return nil, fmt.Errorf("loading cashout queue item: %w", err)
+	}
+	if item != nil && item.Cheque.CumulativePayout.Cmp(cheque.CumulativePayout) <= 0 {
+		batch.Delete(cashoutQueueKey(cheque.Contract))
+	}
+	if err := s.store.WriteBatch(batch); err != nil {
+		return nil, fmt.Errorf("saving cashed payout: %w", err)
+	}
+	s.logger.Info(CashChequeAction, "cashed cheque manually", peerCtx(peer, "chequebook", cheque.Contract, "tx", tx.Hash())...)
+	return tx, nil
+}
@@ -0,0 +1,484 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	contract "github.com/ethersphere/swarm/contracts/swap"
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// newCashoutQueueTest creates a swap with a test clock and a cheque it can cash
+// cashing is replaced by a function which reports every attempt on the returned channel and returns the next result of results
+func newCashoutQueueTest(t *testing.T, results ...error) (*Swap, *testClock, *Cheque, chan *Cheque, func()) {
+	t.Helper()
+	testBackend := newTestBackend(t)
+	swap, clean := newTestSwap(t, beneficiaryKey, testBackend)
+	ctx := context.Background()
+	if err := testDeploy(ctx, swap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+	chequebook, err := testDeployWithPrivateKey(ctx, testBackend, ownerKey, ownerAddress, int256.Uint256From(DefaultPaymentThreshold))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheque, err := newSignedTestCheque(chequebook.ContractParams().ContractAddress, swap.owner.address, int256.Uint256From(DefaultPaymentThreshold), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newTestClock(time.Now())
+	swap.clock = clock
+
+	attempts := make(chan *Cheque)
+	currentCashCheque := defaultCashCheque
+	defaultCashCheque = func(ctx context.Context, s *Swap, cheque *Cheque) error {
+		var result error
+		if len(results) > 0 {
+			result, results = results[0], results[1:]
+		}
+		select {
+		case attempts <- cheque:
+		case <-ctx.Done():
+		}
+		return result
+	}
+
+	return swap, clock, cheque, attempts, func() {
+		clean()
+		defaultCashCheque = currentCashCheque
+		testBackend.Close()
+	}
+}
+
+// waitForCashout waits for the next attempt to cash a cheque
+func waitForCashout(t *testing.T, attempts chan *Cheque) *Cheque {
+	t.Helper()
+	select {
+	case cheque := <-attempts:
+		return cheque
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for cashing attempt")
+	}
+	return nil
+}
+
+// syncCashoutQueue returns once the cashout worker finished processing the cheques which were due
+// the tick of the clock is only received when the worker waits for the next round
+func syncCashoutQueue(clock *testClock) {
+	clock.Advance(cashoutQueueInterval)
+}
+
+// expectCashoutQueue checks that the queue holds exactly the given item, ignoring the time of its next attempt
+func expectCashoutQueue(t *testing.T, s *Swap, expected *CashoutQueueItem) {
+	t.Helper()
+	items, err := s.CashoutQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected 1 item in the cashout queue, got %d", len(items))
+	}
+	item := items[0]
+	if !item.Cheque.Equal(expected.Cheque) || item.Status != expected.Status || item.Attempts != expected.Attempts || item.LastError != expected.LastError {
+		t.Fatalf("expected cashout queue item %+v, got %+v", expected, item)
+	}
+}
+
+// TestCashoutQueueRetry tests that a cheque which fails to be cashed is retried after a backoff
+// and removed from the queue once it is cashed
+func TestCashoutQueueRetry(t *testing.T) {
+	errCashing := errors.New("gas too low")
+	swap, clock, cheque, attempts, clean := newCashoutQueueTest(t, errCashing, nil)
+	defer clean()
+
+	if err := swap.enqueueCashout(cheque); err != nil {
+		t.Fatal(err)
+	}
+	clock.waitForTicker(t)
+	if got := waitForCashout(t, attempts); !got.Equal(cheque) {
+		t.Fatalf("expected cheque %v to be cashed, got %v", cheque, got)
+	}
+	syncCashoutQueue(clock)
+	expectCashoutQueue(t, swap, &CashoutQueueItem{
+		Cheque:    cheque,
+		Status:    CashoutRetrying,
+		Attempts:  1,
+		LastError: errCashing.Error(),
+	})
+	if depth, err := swap.CashoutQueueDepth(); err != nil || depth != 1 {
+		t.Fatalf("expected cashout queue depth 1, got %d (err: %v)", depth, err)
+	}
+
+	// the cheque is not retried before the backoff passed
+	items, err := swap.CashoutQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backoff := items[0].NextAttempt.Sub(clock.Now())
+	if backoff <= 0 || backoff > cashoutRetryInitialBackoff {
+		t.Fatalf("expected next attempt within %v, got %v", cashoutRetryInitialBackoff, backoff)
+	}
+	clock.Advance(backoff - cashoutQueueInterval)
+	select {
+	case <-attempts:
+		t.Fatal("cheque retried before the backoff passed")
+	default:
+	}
+
+	go clock.Advance(cashoutQueueInterval)
+	waitForCashout(t, attempts)
+	syncCashoutQueue(clock)
+
+	if depth, err := swap.CashoutQueueDepth(); err != nil || depth != 0 {
+		t.Fatalf("expected empty cashout queue, got depth %d (err: %v)", depth, err)
+	}
+	cashed, err := swap.loadCashedPayout(cheque.Contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cashed == nil || !cashed.Equals(cheque.CumulativePayout) {
+		t.Fatalf("expected cashed payout %v, got %v", cheque.CumulativePayout, cashed)
+	}
+}
+
+// TestCashoutQueueDrop tests that a cheque whose payout was already cashed is dropped without an attempt
+// and that a newer cheque of the same chequebook replaces it
+func TestCashoutQueueDrop(t *testing.T) {
+	swap, clock, cheque, attempts, clean := newCashoutQueueTest(t)
+	defer clean()
+
+	if err := swap.store.Put(cashedPayoutKey(cheque.Contract), cheque.CumulativePayout); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.enqueueCashout(cheque); err != nil {
+		t.Fatal(err)
+	}
+	clock.waitForTicker(t)
+	syncCashoutQueue(clock)
+
+	items, err := swap.CashoutQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Status != CashoutDropped || items[0].LastError == "" {
+		t.Fatalf("expected the cheque to be dropped with a reason, got %+v", items)
+	}
+	if depth, err := swap.CashoutQueueDepth(); err != nil || depth != 0 {
+		t.Fatalf("expected dropped cheques not to count, got depth %d (err: %v)", depth, err)
+	}
+
+	newerCheque, err := newSignedTestCheque(cheque.Contract, swap.owner.address, int256.Uint256From(DefaultPaymentThreshold+1), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.enqueueCashout(newerCheque); err != nil {
+		t.Fatal(err)
+	}
+	if got := waitForCashout(t, attempts); !got.Equal(newerCheque) {
+		t.Fatalf("expected newer cheque %v to be cashed, got %v", newerCheque, got)
+	}
+}
+
+// TestCashoutQueueRestart tests that cheques queued before a restart are cashed when swap is started
+func TestCashoutQueueRestart(t *testing.T) {
+	swap, clock, cheque, attempts, clean := newCashoutQueueTest(t)
+	defer clean()
+
+	// the item as it was left by a previous run
+	if err := swap.store.Put(cashoutQueueKey(cheque.Contract), &CashoutQueueItem{
+		Cheque:      cheque,
+		Status:      CashoutRetrying,
+		Attempts:    1,
+		NextAttempt: clock.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := swap.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := waitForCashout(t, attempts); !got.Equal(cheque) {
+		t.Fatalf("expected cheque %v to be cashed, got %v", cheque, got)
+	}
+}
+
+// TestCancelCashIn tests that pending cash-ins are listed with the peer of the cheque
+// and that a cancelled cash-in is not retried anymore
+func TestCancelCashIn(t *testing.T) {
+	errCashing := errors.New("gas price too high")
+	swap, clock, cheque, attempts, clean := newCashoutQueueTest(t, errCashing)
+	defer clean()
+
+	peer := newDummyPeer().ID()
+	if err := swap.store.Put(receivedChequeKey(peer), cheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.enqueueCashout(cheque); err != nil {
+		t.Fatal(err)
+	}
+	clock.waitForTicker(t)
+	waitForCashout(t, attempts)
+	syncCashoutQueue(clock)
+
+	pending, err := swap.PendingCashIns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := swap.CashoutQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 pending cash-in, got %v", pending)
+	}
+	if p := pending[0]; p.Peer != peer || p.Chequebook != cheque.Contract || !p.CumulativePayout.Equals(cheque.CumulativePayout) || p.Attempts != 1 || !p.ScheduledAt.Equal(items[0].NextAttempt) {
+		t.Fatalf("unexpected pending cash-in %+v", p)
+	}
+
+	if err := swap.CancelCashIn(peer); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := swap.PendingCashIns(); err != nil || len(pending) != 0 {
+		t.Fatalf("expected no pending cash-ins, got %v (err: %v)", pending, err)
+	}
+	if err := swap.CancelCashIn(peer); err != ErrNoPendingCashIn {
+		t.Fatalf("expected error %v cancelling again, got %v", ErrNoPendingCashIn, err)
+	}
+	if err := swap.CancelCashIn(newDummyPeer().ID()); err != ErrNoPendingCashIn {
+		t.Fatalf("expected error %v for a peer without cheques, got %v", ErrNoPendingCashIn, err)
+	}
+
+	// the worker would block on an attempt, so the clock is advanced in the background
+	done := make(chan struct{})
+	go func() {
+		clock.Advance(cashoutRetryInitialBackoff)
+		syncCashoutQueue(clock)
+		close(done)
+	}()
+	select {
+	case <-attempts:
+		t.Fatal("cancelled cheque was cashed")
+	case <-done:
+	}
+	expectCashoutQueue(t, swap, &CashoutQueueItem{
+		Cheque:    cheque,
+		Status:    CashoutCancelled,
+		Attempts:  1,
+		LastError: errCashing.Error(),
+	})
+}
+
+// TestCashChequeManually tests that the last cheque received from a peer is cashed on chain by CashCheque,
+// that its cancelled cash-in is completed and that cashing it again is refused
+func TestCashChequeManually(t *testing.T) {
+	swap, _, cheque, _, clean := newCashoutQueueTest(t)
+	defer clean()
+	ctx := context.Background()
+
+	peer := newDummyPeer().ID()
+	if _, err := swap.CashCheque(ctx, peer); err != ErrNoCheque {
+		t.Fatalf("expected error %v for a peer without cheques, got %v", ErrNoCheque, err)
+	}
+	if err := swap.store.Put(receivedChequeKey(peer), cheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.store.Put(cashoutQueueKey(cheque.Contract), &CashoutQueueItem{Cheque: cheque, Status: CashoutCancelled}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := swap.CashCheque(ctx, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx == nil {
+		t.Fatal("expected the cashing transaction")
+	}
+	chequebook, err := contract.InstanceAt(cheque.Contract, swap.backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paidOut, err := chequebook.PaidOut(nil, cheque.Beneficiary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paidOut.Cmp(cheque.CumulativePayout.Value()) != 0 {
+		t.Fatalf("expected paid out %v, got %v", cheque.CumulativePayout, paidOut)
+	}
+	cashed, err := swap.loadCashedPayout(cheque.Contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cashed == nil || !cashed.Equals(cheque.CumulativePayout) {
+		t.Fatalf("expected cashed payout %v, got %v", cheque.CumulativePayout, cashed)
+	}
+	if items, err := swap.CashoutQueue(); err != nil || len(items) != 0 {
+		t.Fatalf("expected an empty cashout queue, got %v (err: %v)", items, err)
+	}
+
+	if _, err := swap.CashCheque(ctx, peer); !errors.Is(err, ErrChequeAlreadyCashed) {
+		t.Fatalf("expected error %v cashing again, got %v", ErrChequeAlreadyCashed, err)
+	}
+}
+
+// TestFreezeBalanceWhileCashing tests that the balance with a peer does not change while its cheque is being cashed
+// and that the amounts accounted concurrently are merged into it once cashing completes
+func TestFreezeBalanceWhileCashing(t *testing.T) {
+	swap, clock, cheque, _, clean := newCashoutQueueTest(t)
+	defer clean()
+
+	cashing, release := make(chan struct{}), make(chan struct{})
+	defaultCashCheque = func(ctx context.Context, s *Swap, cheque *Cheque) error {
+		close(cashing)
+		<-release
+		return nil
+	}
+
+	peer, err := swap.addPeer(newDummyPeer().Peer, common.Address{}, cheque.Contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setBalance(t, peer, 100)
+
+	const adders, adds = 10, 100
+	addConcurrently := func() *sync.WaitGroup {
+		var wg sync.WaitGroup
+		for i := 0; i < adders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < adds; j++ {
+					if err := swap.Add(1, peer.Peer); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		return &wg
+	}
+	expectBalance := func(balance, accounted int64) {
+		t.Helper()
+		peer.lock.RLock()
+		defer peer.lock.RUnlock()
+		if peer.getBalance() != balance || peer.getAccountedBalance() != accounted {
+			t.Fatalf("expected balance %d and accounted balance %d, got %d and %d", balance, accounted, peer.getBalance(), peer.getAccountedBalance())
+		}
+	}
+
+	if err := swap.enqueueCashout(cheque); err != nil {
+		t.Fatal(err)
+	}
+	clock.waitForTicker(t)
+	select {
+	case <-cashing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for cashing attempt")
+	}
+
+	addConcurrently().Wait()
+	expectBalance(100, 100+adders*adds)
+
+	// cashing completes while amounts are accounted
+	wg := addConcurrently()
+	close(release)
+	wg.Wait()
+	syncCashoutQueue(clock)
+	expectBalance(100+2*adders*adds, 100+2*adders*adds)
+	peer.lock.RLock()
+	defer peer.lock.RUnlock()
+	if peer.cashing {
+		t.Fatal("expected the balance not to be frozen after cashing")
+	}
+}
+
+// TestReceiveChequeWhileCashing tests that a cheque received while the balance is frozen is checked against the accounted balance,
+// which the peer decided to pay on, and credited once cashing completes
+func TestReceiveChequeWhileCashing(t *testing.T) {
+	swap, clock, cheque, _, clean := newCashoutQueueTest(t)
+	defer clean()
+	ctx := context.Background()
+
+	cashing, release := make(chan struct{}, 1), make(chan struct{})
+	defaultCashCheque = func(ctx context.Context, s *Swap, cheque *Cheque) error {
+		select {
+		case cashing <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	}
+	// cashing is released if the test fails, so that the cashout worker can stop
+	var once sync.Once
+	releaseCashing := func() { once.Do(func() { close(release) }) }
+	defer releaseCashing()
+
+	peer, err := swap.addPeer(newDummyPeerWithSpec(Spec).Peer, ownerAddress, cheque.Contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.lock.Lock()
+	err = peer.setLastReceivedCheque(cheque)
+	peer.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBalance := func(balance, accounted int64) {
+		t.Helper()
+		peer.lock.RLock()
+		defer peer.lock.RUnlock()
+		if peer.getBalance() != balance || peer.getAccountedBalance() != accounted {
+			t.Fatalf("expected balance %d and accounted balance %d, got %d and %d", balance, accounted, peer.getBalance(), peer.getAccountedBalance())
+		}
+	}
+
+	if err := swap.enqueueCashout(cheque); err != nil {
+		t.Fatal(err)
+	}
+	clock.waitForTicker(t)
+	select {
+	case <-cashing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for cashing attempt")
+	}
+
+	// the peer accrues a debt while its cheque is being cashed and pays it
+	debt := int64(DefaultPaymentThreshold)
+	if err := swap.Add(debt, peer.Peer); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(0, debt)
+	next, err := newSignedTestCheque(cheque.Contract, swap.owner.address, int256.Uint256From(2*DefaultPaymentThreshold), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Honey = DefaultPaymentThreshold
+	if err := swap.handleEmitChequeMsg(ctx, peer, &EmitChequeMsg{Cheque: next}); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(0, 0)
+
+	releaseCashing()
+	syncCashoutQueue(clock)
+	expectBalance(0, 0)
+}
@@ -0,0 +1,310 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ErrBackendUnavailable is given when the backend connection was lost and is being reestablished
+// the operation did not reach the backend and can be retried later
+var ErrBackendUnavailable = errors.New("backend unavailable")
+
+// DialFunc establishes a new connection to a backend
+type DialFunc func(ctx context.Context) (Backend, error)
+
+// ReconnectPolicy configures how a ReconnectingBackend reestablishes a lost connection
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration        // time to wait before the first reconnection attempt
+	MaxBackoff     time.Duration        // upper bound of the doubling wait time between attempts
+	MaxAttempts    int                  // attempts before giving up until the next call, 0 means unlimited
+	DialTimeout    time.Duration        // timeout of a single reconnection attempt
+	IsConnErr      func(err error) bool // reports whether an error means the connection was lost, defaults to IsConnectionError
+}
+
+// DefaultReconnectPolicy is used for all fields of a ReconnectPolicy which are not set
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialBackoff: 1 * time.Second,
+	MaxBackoff:     1 * time.Minute,
+	DialTimeout:    10 * time.Second,
+	IsConnErr:      IsConnectionError,
+}
+
+// withDefaults returns the policy with all unset fields taken from DefaultReconnectPolicy
+func (p ReconnectPolicy) withDefaults() ReconnectPolicy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultReconnectPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultReconnectPolicy.MaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.DialTimeout <= 0 {
+		p.DialTimeout = DefaultReconnectPolicy.DialTimeout
+	}
+	if p.IsConnErr == nil {
+		p.IsConnErr = DefaultReconnectPolicy.IsConnErr
+	}
+	return p
+}
+
+// IsConnectionError reports whether err indicates that the connection to the backend was lost
+// errors returned by the backend itself, like a reverted call, are not connection errors
+func IsConnectionError(err error) bool {
+	// a cancelled or expired call context says nothing about the connection
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, rpc.ErrClientQuit)
+}
+
+// ReconnectingBackend is a Backend which reestablishes the connection to the underlying backend when it is lost
+// calls made while the connection is being reestablished fail with ErrBackendUnavailable
+type ReconnectingBackend struct {
+	dial         DialFunc
+	policy       ReconnectPolicy
+	lock         sync.Mutex
+	backend      Backend       // current backend, nil while reconnecting
+	reconnecting bool          // whether a reconnection loop is running
+	quit         chan struct{} // closed on Close to stop the reconnection loop
+	closed       bool
+}
+
+// NewReconnectingBackend returns a ReconnectingBackend using the already connected backend
+// dial is only used to reestablish the connection once it is lost
+func NewReconnectingBackend(backend Backend, dial DialFunc, policy ReconnectPolicy) *ReconnectingBackend {
+	return &ReconnectingBackend{
+		dial:    dial,
+		policy:  policy.withDefaults(),
+		backend: backend,
+		quit:    make(chan struct{}),
+	}
+}
+
+// current returns the connected backend or starts reconnecting if there is none
+func (b *ReconnectingBackend) current() (Backend, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, fmt.Errorf("%w: backend closed", ErrBackendUnavailable)
+	}
+	if b.backend == nil {
+		b.startReconnect()
+		return nil, fmt.Errorf("%w: reconnecting", ErrBackendUnavailable)
+	}
+	return b.backend, nil
+}
+
+// check inspects the error of a call made with backend and starts reconnecting if the connection was lost
+func (b *ReconnectingBackend) check(backend Backend, err error) error {
+	if !b.policy.IsConnErr(err) {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// another call might have noticed the lost connection already
+	if b.backend == backend && !b.closed {
+		log.Warn("lost connection to backend, reconnecting", "err", err)
+		closeBackend(backend)
+		b.backend = nil
+		b.startReconnect()
+	}
+	return fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+}
+
+// startReconnect starts the reconnection loop unless it is already running
+// the caller is expected to hold b.lock
+func (b *ReconnectingBackend) startReconnect() {
+	if b.reconnecting {
+		return
+	}
+	b.reconnecting = true
+	go b.reconnect()
+}
+
+// reconnect dials the backend with exponential backoff until it succeeds, the attempts are exhausted or b is closed
+func (b *ReconnectingBackend) reconnect() {
+	backoff := b.policy.InitialBackoff
+	for attempt := 1; b.policy.MaxAttempts == 0 || attempt <= b.policy.MaxAttempts; attempt++ {
+		select {
+		case <-b.quit:
+			return
+		case <-time.After(backoff):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.policy.DialTimeout)
+		backend, err := b.dial(ctx)
+		cancel()
+		if err == nil {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			b.reconnecting = false
+			if b.closed {
+				closeBackend(backend)
+				return
+			}
+			b.backend = backend
+			log.Info("reconnected to backend", "attempt", attempt)
+			return
+		}
+		log.Warn("reconnecting to backend failed", "attempt", attempt, "err", err)
+
+		if backoff *= 2; backoff > b.policy.MaxBackoff {
+			backoff = b.policy.MaxBackoff
+		}
+	}
+
+	log.Error("giving up reconnecting to backend until the next call", "attempts", b.policy.MaxAttempts)
+	b.lock.Lock()
+	b.reconnecting = false
+	b.lock.Unlock()
+}
+
+// Close stops reconnecting and closes the underlying backend
+func (b *ReconnectingBackend) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.quit)
+	if b.backend != nil {
+		closeBackend(b.backend)
+		b.backend = nil
+	}
+}
+
+// closeBackend closes the backend if it supports it
+func closeBackend(backend Backend) {
+	if closer, ok := backend.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+// CodeAt implements bind.ContractCaller
+func (b *ReconnectingBackend) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	backend, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	code, err := backend.CodeAt(ctx, contract, blockNumber)
+	return code, b.check(backend, err)
+}
+
+// CallContract implements bind.ContractCaller
+func (b *ReconnectingBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	backend, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	result, err := backend.CallContract(ctx, call, blockNumber)
+	return result, b.check(backend, err)
+}
+
+// PendingCodeAt implements bind.ContractTransactor
+func (b *ReconnectingBackend) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
+	backend, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	code, err := backend.PendingCodeAt(ctx, account)
+	return code, b.check(backend, err)
+}
+
+// PendingNonceAt implements bind.ContractTransactor
+func (b *ReconnectingBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	backend, err := b.current()
+	if err != nil {
+		return 0, err
+	}
+	nonce, err := backend.PendingNonceAt(ctx, account)
+	return nonce, b.check(backend, err)
+}
+
+// SuggestGasPrice implements bind.ContractTransactor
+func (b *ReconnectingBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	backend, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	price, err := backend.SuggestGasPrice(ctx)
+	return price, b.check(backend, err)
+}
+
+// EstimateGas implements bind.ContractTransactor
+func (b *ReconnectingBackend) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	backend, err := b.current()
+	if err != nil {
+		return 0, err
+	}
+	gas, err := backend.EstimateGas(ctx, call)
+	return gas, b.check(backend, err)
+}
+
+// SendTransaction implements bind.ContractTransactor
+func (b *ReconnectingBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	backend, err := b.current()
+	if err != nil {
+		return err
+	}
+	return b.check(backend, backend.SendTransaction(ctx, tx))
+}
+
+// FilterLogs implements bind.ContractFilterer
+func (b *ReconnectingBackend) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	backend, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	logs, err := backend.FilterLogs(ctx, query)
+	return logs, b.check(backend, err)
+}
+
+// SubscribeFilterLogs implements bind.ContractFilterer
+// an established subscription is not moved to a new connection, it fails with the old one
+func (b *ReconnectingBackend) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	backend, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	sub, err := backend.SubscribeFilterLogs(ctx, query, ch)
+	return sub, b.check(backend, err)
+}
+
+// TransactionReceipt implements Backend
+func (b *ReconnectingBackend) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	backend, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := backend.TransactionReceipt(ctx, txHash)
+	return receipt, b.check(backend, err)
+}
+
+// TransactionByHash implements Backend
+func (b *ReconnectingBackend) TransactionByHash(ctx context.Context, txHash common.Hash) (*types.Transaction, bool, error) {
+	backend, err := b.current()
+	if err != nil {
+		return nil, false, err
+	}
+	tx, isPending, err := backend.TransactionByHash(ctx, txHash)
+	return tx, isPending, b.check(backend, err)
+}
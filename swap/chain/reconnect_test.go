@@ -0,0 +1,98 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// fakeBackend is a Backend whose CodeAt returns a fixed error
+// all other methods are not implemented
+type fakeBackend struct {
+	Backend
+	err    error
+	closed bool
+}
+
+func (b *fakeBackend) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return nil, b.err
+}
+
+func (b *fakeBackend) Close() {
+	b.closed = true
+}
+
+// TestReconnectingBackend tests that a lost connection is reestablished in the background
+// and that calls fail with ErrBackendUnavailable in the meantime
+func TestReconnectingBackend(t *testing.T) {
+	lost := &fakeBackend{err: io.EOF}
+	reconnected := &fakeBackend{}
+	dialed := make(chan struct{})
+	// the first attempt fails, the second one succeeds
+	attempts := 0
+	dial := func(ctx context.Context) (Backend, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("connection refused")
+		}
+		defer close(dialed)
+		return reconnected, nil
+	}
+	backend := NewReconnectingBackend(lost, dial, ReconnectPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer backend.Close()
+
+	if _, err := backend.CodeAt(context.Background(), common.Address{}, nil); !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("expected error %v on lost connection, got %v", ErrBackendUnavailable, err)
+	}
+	if !lost.closed {
+		t.Fatal("expected lost backend to be closed")
+	}
+
+	select {
+	case <-dialed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for reconnection")
+	}
+	// the dial function returns before the new backend is set
+	var err error
+	for i := 0; i < 100; i++ {
+		if _, err = backend.CodeAt(context.Background(), common.Address{}, nil); !errors.Is(err, ErrBackendUnavailable) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected call to succeed after reconnection, got %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 reconnection attempts, got %d", attempts)
+	}
+}
+
+// TestReconnectingBackendKeepsConnection tests that errors which are not connection errors are passed through
+// without reconnecting
+func TestReconnectingBackendKeepsConnection(t *testing.T) {
+	errReverted := errors.New("execution reverted")
+	connected := &fakeBackend{err: errReverted}
+	dial := func(ctx context.Context) (Backend, error) {
+		t.Error("unexpected reconnection attempt")
+		return nil, errors.New("unexpected dial")
+	}
+	backend := NewReconnectingBackend(connected, dial, ReconnectPolicy{InitialBackoff: time.Millisecond})
+	defer backend.Close()
+
+	for _, callErr := range []error{errReverted, context.DeadlineExceeded} {
+		connected.err = callErr
+		if _, err := backend.CodeAt(context.Background(), common.Address{}, nil); err != callErr {
+			t.Fatalf("expected error %v, got %v", callErr, err)
+		}
+	}
+	if connected.closed {
+		t.Fatal("expected backend to stay connected")
+	}
+}
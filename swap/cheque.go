@@ -19,13 +19,28 @@ package swap
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
+	"math"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethersphere/swarm/swap/int256"
 )
 
+// ErrHoneyOverflow indicates that the honey of a cheque is too large to be accounted in a balance
+var ErrHoneyOverflow = errors.New("cheque honey overflows balance")
+
+// ErrChequeRegression indicates that a received cheque does not pay out more than the last cheque received from the peer
+var ErrChequeRegression = errors.New("cheque cumulative payout not above the last received cheque")
+
+// ErrInvalidChequeDomain indicates that a cheque was not signed for the domain of the verifier, e.g. by a node of another deployment
+var ErrInvalidChequeDomain = errors.New("cheque not signed for this domain")
+
+// chequeDomainVersion is the version of the domain signature scheme, it is signed together with the domain
+// so that a verifier knows how the domain was mixed into the signed content
+const chequeDomainVersion = 1
+
 // encodeForSignature encodes the cheque params in the format used in the signing procedure
 func (cheque *ChequeParams) encodeForSignature() []byte {
 	cumulativePayoutBytes := make([]byte, 32)
@@ -50,6 +65,20 @@ func (cheque *ChequeParams) sigHash() []byte {
 	return crypto.Keccak256([]byte(withPrefix))
 }
 
+// domainSigHash hashes the cheque params together with the domain separator and the version of the domain signature scheme
+// the signature of sigHash is checked by the chequebook contract and cannot include the domain, so it is signed separately
+func (cheque *ChequeParams) domainSigHash(domain string) []byte {
+	input := []byte{chequeDomainVersion}
+	input = append(input, crypto.Keccak256([]byte(domain))...)
+	input = append(input, cheque.sigHash()...)
+	return crypto.Keccak256(input)
+}
+
+// signDomainWith returns the signature of the cheque params for domain created by signer
+func (cheque *ChequeParams) signDomainWith(signer Signer, domain string) ([]byte, error) {
+	return signer.Sign(cheque.domainSigHash(domain))
+}
+
 // VerifySig verifies the signature on the cheque
 func (cheque *Cheque) VerifySig(expectedSigner common.Address) error {
 	sigHash := cheque.sigHash()
@@ -80,7 +109,12 @@ func (cheque *Cheque) VerifySig(expectedSigner common.Address) error {
 
 // Sign returns the cheque's signature with supplied private key
 func (cheque *ChequeParams) Sign(prv *ecdsa.PrivateKey) ([]byte, error) {
-	sig, err := crypto.Sign(cheque.sigHash(), prv)
+	return cheque.signWith(NewLocalSigner(prv))
+}
+
+// signWith returns the cheque's signature created by signer
+func (cheque *ChequeParams) signWith(signer Signer) ([]byte, error) {
+	sig, err := signer.Sign(cheque.sigHash())
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +125,16 @@ func (cheque *ChequeParams) Sign(prv *ecdsa.PrivateKey) ([]byte, error) {
 }
 
 // Equal checks if other has the same fields
+// two nil cheques are equal, a nil cheque is not equal to any other cheque
 func (cheque *Cheque) Equal(other *Cheque) bool {
+	if cheque == nil || other == nil {
+		return cheque == other
+	}
+
+	if cheque.Contract != other.Contract {
+		return false
+	}
+
 	if cheque.Beneficiary != other.Beneficiary {
 		return false
 	}
@@ -108,18 +151,40 @@ func (cheque *Cheque) Equal(other *Cheque) bool {
 		return false
 	}
 
+	if !bytes.Equal(cheque.DomainSignature, other.DomainSignature) {
+		return false
+	}
+
 	return true
 }
 
-// verifyChequeProperties verifies the signature and if the cheque fields are appropriate for this peer
-// it does not verify anything that requires knowing the previous cheque
-func (cheque *Cheque) verifyChequeProperties(p *Peer, expectedBeneficiary common.Address) error {
-	if cheque.Contract != p.contractAddress {
-		return fmt.Errorf("wrong cheque parameters: expected contract: %x, was: %x", p.contractAddress, cheque.Contract)
+// Copy returns a deep copy of the cheque, so that it can be kept without being affected by changes to the original
+func (cheque *Cheque) Copy() *Cheque {
+	if cheque == nil {
+		return nil
+	}
+	c := *cheque
+	if cheque.CumulativePayout != nil {
+		c.CumulativePayout = cheque.CumulativePayout.Copy()
 	}
+	if cheque.Signature != nil {
+		c.Signature = make([]byte, len(cheque.Signature))
+		copy(c.Signature, cheque.Signature)
+	}
+	if cheque.DomainSignature != nil {
+		c.DomainSignature = make([]byte, len(cheque.DomainSignature))
+		copy(c.DomainSignature, cheque.DomainSignature)
+	}
+	return &c
+}
 
-	// the beneficiary is the owner of the counterparty swap contract
-	if err := cheque.VerifySig(p.beneficiary); err != nil {
+// VerifyCheque verifies that the cheque was signed by expectedIssuer and is made out to expectedBeneficiary
+// it only checks the cheque itself and does not access any state, so it can be used to validate cheques offline
+// a cheque does not name its issuer and the issuer of its chequebook can only be read from the chain,
+// so the caller passes it, e.g. as read by the Issuer method of the chequebook
+// returns ErrInvalidChequeSignature if the signature does not match the issuer
+func VerifyCheque(cheque *Cheque, expectedIssuer common.Address, expectedBeneficiary common.Address) error {
+	if err := cheque.VerifySig(expectedIssuer); err != nil {
 		return err
 	}
 
@@ -130,14 +195,46 @@ func (cheque *Cheque) verifyChequeProperties(p *Peer, expectedBeneficiary common
 	return nil
 }
 
+// VerifyChequeDomain verifies that the cheque was signed by expectedIssuer for domain, see Params.ChequeDomain
+// cheques of an issuer without a domain are only accepted with an empty domain
+// returns ErrInvalidChequeDomain if the cheque was not signed for domain
+func VerifyChequeDomain(cheque *Cheque, expectedIssuer common.Address, domain string) error {
+	if domain == "" {
+		return nil
+	}
+	if len(cheque.DomainSignature) != 65 {
+		return fmt.Errorf("%w: missing domain signature", ErrInvalidChequeDomain)
+	}
+	pubKey, err := crypto.SigToPub(cheque.domainSigHash(domain), cheque.DomainSignature)
+	if err != nil || crypto.PubkeyToAddress(*pubKey) != expectedIssuer {
+		return fmt.Errorf("%w: %s", ErrInvalidChequeDomain, domain)
+	}
+	return nil
+}
+
+// verifyChequeProperties verifies the signature and if the cheque fields are appropriate for this peer
+// it does not verify anything that requires knowing the previous cheque
+func (cheque *Cheque) verifyChequeProperties(p *Peer, expectedBeneficiary common.Address) error {
+	if cheque.Contract != p.contractAddress {
+		return fmt.Errorf("wrong cheque parameters: expected contract: %x, was: %x", p.contractAddress, cheque.Contract)
+	}
+
+	// the issuer is the owner of the counterparty swap contract
+	if err := VerifyCheque(cheque, p.beneficiary, expectedBeneficiary); err != nil {
+		return err
+	}
+	return VerifyChequeDomain(cheque, p.beneficiary, p.swap.params.ChequeDomain)
+}
+
 // verifyChequeAgainstLast verifies that the amount is higher than in the previous cheque and the increase is as expected
-// returns the actual amount received in this cheque
+// lastCheque has to be the last cheque drawn on the same chequebook
+// returns the actual amount received in this cheque, ErrChequeRegression if the amount is not higher
 func (cheque *Cheque) verifyChequeAgainstLast(lastCheque *Cheque, expectedAmount *int256.Uint256) (*int256.Uint256, error) {
 	actualAmount := cheque.CumulativePayout.Copy()
 
 	if lastCheque != nil {
 		if cheque.CumulativePayout.Cmp(lastCheque.CumulativePayout) < 1 {
-			return nil, fmt.Errorf("wrong cheque parameters: expected cumulative payout larger than %v, was: %v", lastCheque.CumulativePayout, cheque.CumulativePayout)
+			return nil, fmt.Errorf("%w: expected cumulative payout larger than %v, was: %v", ErrChequeRegression, lastCheque.CumulativePayout, cheque.CumulativePayout)
 		}
 
 		actualAmount.Sub(actualAmount, lastCheque.CumulativePayout)
@@ -150,6 +247,16 @@ func (cheque *Cheque) verifyChequeAgainstLast(lastCheque *Cheque, expectedAmount
 	return actualAmount, nil
 }
 
+// honeyAmount returns the honey of the cheque as an amount to update a balance with
+// the honey is the difference to the previous cheque, not the cumulative amount
+// it is received from peers, so it has to be checked before the conversion to a signed value
+func (cheque *Cheque) honeyAmount() (int64, error) {
+	if cheque.Honey > math.MaxInt64 {
+		return 0, fmt.Errorf("%w: %d", ErrHoneyOverflow, cheque.Honey)
+	}
+	return int64(cheque.Honey), nil
+}
+
 func (cheque *Cheque) String() string {
 	return fmt.Sprintf("Contract: %x Beneficiary: %x CumulativePayout: %v Honey: %d", cheque.Contract, cheque.Beneficiary, cheque.CumulativePayout, cheque.Honey)
 }
@@ -0,0 +1,480 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	contract "github.com/ethersphere/swarm/contracts/swap"
+	"github.com/ethersphere/swarm/p2p/protocols"
+	"github.com/ethersphere/swarm/state"
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// ErrInvalidChequebookUpdate indicates that a peer announced a chequebook it did not prove to own or which cannot start settling with us
+var ErrInvalidChequebookUpdate = errors.New("invalid chequebook update")
+
+// ErrUnconfirmedCheque indicates that the beneficiary of a peer cannot change while a cheque to the previous one is not confirmed yet
+var ErrUnconfirmedCheque = errors.New("cheque to the previous beneficiary not confirmed")
+
+// ErrChequebookUpdatePending indicates that no cheque is sent to a peer while it did not confirm the switch to our new chequebook
+var ErrChequebookUpdatePending = errors.New("switch of chequebook not confirmed by peer")
+
+// ErrChequesPending indicates that our chequebook cannot be switched while cheques to peers which are not connected are not confirmed,
+// as the peers would refuse them once they learned about the new chequebook
+var ErrChequesPending = errors.New("cheques to disconnected peers not confirmed")
+
+// chequebookUpdateTimeout limits the time waiting for a peer to confirm the switch to our new chequebook
+var chequebookUpdateTimeout = time.Minute
+
+// chequebookUpdateSigHash returns the hash the issuer of chequebook signs to announce it to the node owned by recipient
+func chequebookUpdateSigHash(chequebook, recipient common.Address) []byte {
+	return crypto.Keccak256(chequebook.Bytes(), recipient.Bytes())
+}
+
+// signedBy reports whether sig is a signature of hash by address
+func signedBy(hash, sig []byte, address common.Address) bool {
+	pubKey, err := crypto.SigToPub(hash, sig)
+	return err == nil && crypto.PubkeyToAddress(*pubKey) == address
+}
+
+// newChequebookUpdateMsg creates the message announcing chequebook to the node owned by recipient
+// signer has to be the issuer of chequebook
+func newChequebookUpdateMsg(chequebook, recipient common.Address, signer Signer) (*ChequebookUpdateMsg, error) {
+	sig, err := signer.Sign(chequebookUpdateSigHash(chequebook, recipient))
+	if err != nil {
+		return nil, fmt.Errorf("signing chequebook update: %w", err)
+	}
+	return &ChequebookUpdateMsg{
+		ContractAddress: chequebook,
+		Signature:       sig,
+	}, nil
+}
+
+// peerChequebook is the chequebook of a peer, saved when it connects first and whenever it switches to another one, see updateChequebook
+type peerChequebook struct {
+	Contract    common.Address // chequebook of the peer
+	Beneficiary common.Address // issuer of the chequebook, cheques to the peer are made out to it
+}
+
+// loadPeerChequebook loads the chequebook of peer and returns nil if it was never saved
+func (s *Swap) loadPeerChequebook(peer enode.ID) (chequebook *peerChequebook, err error) {
+	err = s.getOrQuarantine(peerChequebookKey(peer), &chequebook)
+	if err == state.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chequebook, nil
+}
+
+// handleChequebookUpdateMsg switches the peer to the chequebook it announced and confirms the switch
+// the update has to be signed by the issuer of the chequebook, which has to be the key of the peer, the issuer of its current chequebook.
+// If the peer moves to another key, the update has to be signed with its current key as well
+// the peer is switched by switchPeerChequebook, an update which is refused can be sent again later
+func (s *Swap) handleChequebookUpdateMsg(ctx context.Context, p *Peer, msg *ChequebookUpdateMsg) error {
+	p.lock.RLock()
+	current := p.contractAddress
+	key := p.beneficiary
+	p.lock.RUnlock()
+	// the confirmation of an earlier update may have been lost
+	if msg.ContractAddress == current {
+		return p.sendWithTimeout(&ConfirmChequebookUpdateMsg{ContractAddress: current})
+	}
+	if msg.ContractAddress == (common.Address{}) {
+		return protocols.Break(ErrEmptyAddressInSignature)
+	}
+	if err := s.chequebookFactory.VerifyContract(msg.ContractAddress); err != nil {
+		return protocols.Break(fmt.Errorf("contract validation for %v: %w", msg.ContractAddress.Hex(), err))
+	}
+	issuer, err := s.getContractOwner(ctx, msg.ContractAddress)
+	if err != nil {
+		return err
+	}
+	sigHash := chequebookUpdateSigHash(msg.ContractAddress, s.owner.address)
+	if !signedBy(sigHash, msg.Signature, issuer) {
+		return protocols.Break(fmt.Errorf("%w: not signed by issuer %v of chequebook %v", ErrInvalidChequebookUpdate, issuer.Hex(), msg.ContractAddress.Hex()))
+	}
+	if issuer != key && !signedBy(sigHash, msg.PeerSignature, key) {
+		return protocols.Break(fmt.Errorf("%w: issuer %v of chequebook %v is not the key %v of the peer", ErrInvalidChequebookUpdate, issuer.Hex(), msg.ContractAddress.Hex(), key.Hex()))
+	}
+
+	if err := s.switchPeerChequebook(ctx, p, current, msg.ContractAddress, issuer); err != nil {
+		return err
+	}
+	return p.sendWithTimeout(&ConfirmChequebookUpdateMsg{ContractAddress: msg.ContractAddress})
+}
+
+// switchPeerChequebook switches the peer from the chequebook at current to the one at contractAddress issued by issuer,
+// either because the peer announced it or because it connected with it, see updateChequebook
+// nothing may have been paid out to us from the chequebook beyond the last cheque we received from it,
+// so that the cheques we receive from it build on that cheque or start from zero
+// the chain is read before the lock of the peer is taken, so that a slow backend does not block the accounting with it,
+// the switch is refused if the chequebook of the peer changed meanwhile
+func (s *Swap) switchPeerChequebook(ctx context.Context, p *Peer, current, contractAddress, issuer common.Address) error {
+	chequebook, err := contract.InstanceAt(contractAddress, s.backend)
+	if err != nil {
+		return fmt.Errorf("instantiating chequebook at %v: %w", contractAddress.Hex(), err)
+	}
+	opts := &bind.CallOpts{Context: ctx}
+	paidOut, err := chequebook.PaidOut(opts, s.owner.address)
+	if err != nil {
+		return fmt.Errorf("reading paid out amount: %w", err)
+	}
+	// a chequebook the peer used before may have paid out the cheques we received from it
+	last, err := s.loadLastChequebookCheque(p.ID(), contractAddress)
+	if err != nil {
+		return fmt.Errorf("loading last cheque received from chequebook %v: %w", contractAddress.Hex(), err)
+	}
+	received := int256.Uint256From(0)
+	if last != nil {
+		received = last.CumulativePayout
+	}
+	if paidOut.Cmp(received.Value()) > 0 {
+		return protocols.Break(fmt.Errorf("%w: chequebook %v already paid out %v to us, more than the %v we received from it", ErrInvalidChequebookUpdate, contractAddress.Hex(), paidOut, received))
+	}
+	// only needed if the issuer is a new beneficiary, but read anyway so that the lock is not held while reading it
+	seed, err := s.paidOutTo(ctx, s.GetParams().ContractAddress, issuer)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.contractAddress != current {
+		return fmt.Errorf("%w: chequebook of the peer changed from %v to %v meanwhile", ErrInvalidChequebookUpdate, current.Hex(), p.contractAddress.Hex())
+	}
+	return p.updateChequebook(contractAddress, issuer, seed)
+}
+
+// paidOutTo returns what our chequebook at address paid out to beneficiary so far
+func (s *Swap) paidOutTo(ctx context.Context, address, beneficiary common.Address) (*int256.Uint256, error) {
+	chequebook, err := contract.InstanceAt(address, s.backend)
+	if err != nil {
+		return nil, fmt.Errorf("instantiating chequebook at %v: %w", address.Hex(), err)
+	}
+	paidOut, err := chequebook.PaidOut(&bind.CallOpts{Context: ctx}, beneficiary)
+	if err != nil {
+		return nil, fmt.Errorf("reading paid out amount: %w", err)
+	}
+	seed, err := int256.NewUint256(paidOut)
+	if err != nil {
+		return nil, fmt.Errorf("converting paid out amount: %w", err)
+	}
+	return seed, nil
+}
+
+// updateChequebook switches the peer to the chequebook at contractAddress issued by issuer
+// the last cheque received from the previous chequebook is queued for cashing, later cheques are from the new one
+// and build on the last cheque we received from it, if the peer used it before
+// if the issuer changes, our cheques to it start from seed, what our chequebook already paid out to it,
+// instead of building on the cheques to the previous beneficiary
+// the switch is saved before the cheque is queued, so that a cheque is never cashed for a switch which was not saved
+// the caller is expected to hold p.lock
+func (p *Peer) updateChequebook(contractAddress, issuer common.Address, seed *int256.Uint256) error {
+	newBeneficiary := issuer != p.beneficiary
+	if newBeneficiary && p.getPendingCheque() != nil {
+		return ErrUnconfirmedCheque
+	}
+
+	batch := new(state.StoreBatch)
+	if newBeneficiary {
+		batch.Delete(sentChequeKey(p.ID()))
+		if err := p.swap.batchPut(batch, payoutSeedKey(p.ID()), seed); err != nil {
+			return fmt.Errorf("encoding cumulative payout seed: %w", err)
+		}
+	}
+	next, err := p.swap.loadLastChequebookCheque(p.ID(), contractAddress)
+	if err != nil {
+		return fmt.Errorf("loading last cheque received from chequebook %v: %w", contractAddress.Hex(), err)
+	}
+	if err := p.swap.batchPut(batch, peerChequebookKey(p.ID()), &peerChequebook{Contract: contractAddress, Beneficiary: issuer}); err != nil {
+		return fmt.Errorf("encoding chequebook of peer: %w", err)
+	}
+	if err := p.swap.store.WriteBatch(batch); err != nil {
+		return fmt.Errorf("saving chequebook of peer: %w", err)
+	}
+
+	last := p.getLastReceivedCheque()
+	if newBeneficiary {
+		p.lastSentCheque = nil
+		p.cumulativePayoutSeed = seed
+	}
+	p.lastReceivedCheque = next
+	p.logger.Info(InitAction, "peer switched chequebook", "previous", p.contractAddress.Hex(), "chequebook", contractAddress.Hex(), "previous beneficiary", p.beneficiary.Hex(), "beneficiary", issuer.Hex())
+	p.contractAddress = contractAddress
+	p.beneficiary = issuer
+	p.beneficiarySetAt = p.swap.clock.Now()
+
+	if last != nil {
+		if err := p.swap.enqueueCashout(last); err != nil {
+			return fmt.Errorf("queueing last cheque of previous chequebook for cashing: %w", err)
+		}
+	}
+	return nil
+}
+
+// startPeerChequebooks reconciles the chequebooks of a connecting peer with the ones exchanged in the handshake
+// the peer may have connected with another chequebook than the one saved for it, then it is switched to it like on an update,
+// ours is the chequebook we sent in the handshake, if we switched to another one meanwhile it is announced to the peer
+// the caller is expected to call it before the messages of the peer are handled
+func (s *Swap) startPeerChequebooks(ctx context.Context, p *Peer, saved *peerChequebook, contractAddress, issuer, ours common.Address) error {
+	switch {
+	case saved == nil:
+		if err := s.store.Put(peerChequebookKey(p.ID()), &peerChequebook{Contract: contractAddress, Beneficiary: issuer}); err != nil {
+			return fmt.Errorf("saving chequebook of peer: %w", err)
+		}
+	case saved.Contract != contractAddress:
+		p.logger.Info(InitAction, "peer connected with another chequebook", "previous", saved.Contract.Hex(), "chequebook", contractAddress.Hex())
+		if err := s.switchPeerChequebook(ctx, p, saved.Contract, contractAddress, issuer); err != nil {
+			return err
+		}
+	}
+
+	// we switched our chequebook while the peer was not connected, cheques build on the last one sent from ours
+	p.lock.RLock()
+	last := p.getLastSentCheque()
+	p.lock.RUnlock()
+	if last != nil && last.Contract != ours && last.Beneficiary == issuer {
+		seed, err := s.paidOutTo(ctx, ours, issuer)
+		if err != nil {
+			return err
+		}
+		p.lock.Lock()
+		err = p.useChequebook(ours, seed)
+		p.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	// announced in the background, as the peer does not read our messages before it is set up itself
+	s.runBackground(func(ctx context.Context) {
+		s.switchLock.Lock()
+		defer s.switchLock.Unlock()
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if ours == s.GetParams().ContractAddress || p.chequebook != (common.Address{}) {
+			return
+		}
+		p.chequebook = ours
+		if err := p.announceChequebook(); err != nil {
+			p.logger.Warn(InitAction, "error while announcing chequebook", "err", err)
+		}
+	})
+	return nil
+}
+
+// SwitchChequebook makes the chequebook at address the one new cheques are drawn on, e.g. after the previous one was drained
+// the chequebook has to be deployed by the factory and issued by the owner. It is announced to the connected peers,
+// which are paid from the previous chequebook until they confirmed the switch, see announceChequebook,
+// the other peers learn about it in the handshake when they connect
+// the switch is refused with ErrChequesPending while a cheque to a peer which is not connected is pending
+func (s *Swap) SwitchChequebook(ctx context.Context, address common.Address) error {
+	if err := s.checkBackend(); err != nil {
+		return fmt.Errorf("switching chequebook: %w", err)
+	}
+	if err := s.verifyChequebook(ctx, address); err != nil {
+		return err
+	}
+	instance, err := contract.InstanceAt(address, s.backend)
+	if err != nil {
+		return fmt.Errorf("instantiating chequebook at %v: %w", address.Hex(), err)
+	}
+
+	s.switchLock.Lock()
+	defer s.switchLock.Unlock()
+	previous := s.GetParams().ContractAddress
+	if address == previous {
+		return nil
+	}
+	s.peersLock.RLock()
+	defer s.peersLock.RUnlock()
+	err = s.store.Iterate(pendingChequePrefix, func(key []byte, value []byte) (stop bool, err error) {
+		if _, connected := s.peers[keyToID(string(key), pendingChequePrefix)]; connected {
+			return false, nil
+		}
+		var cheque *Cheque
+		if err := s.codec.Decode(value, &cheque); err != nil {
+			return true, fmt.Errorf("decoding pending cheque %s: %w", key, err)
+		}
+		if cheque != nil {
+			return true, ErrChequesPending
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := new(state.StoreBatch)
+	if err := s.batchPut(batch, connectedChequebookKey, address); err != nil {
+		return fmt.Errorf("encoding chequebook address: %w", err)
+	}
+	if err := s.batchPut(batch, previousChequebookKey(previous), s.clock.Now()); err != nil {
+		return fmt.Errorf("encoding previous chequebook: %w", err)
+	}
+	if err := s.store.WriteBatch(batch); err != nil {
+		return fmt.Errorf("saving chequebook address: %w", err)
+	}
+
+	// the connected peers are paid from the previous chequebook until they confirmed the switch
+	for _, p := range s.peers {
+		p.lock.Lock()
+		if p.chequebook == (common.Address{}) {
+			p.chequebook = previous
+		}
+		p.lock.Unlock()
+	}
+	s.contractLock.Lock()
+	s.contract = instance
+	s.contractLock.Unlock()
+	s.logger.Info(InitAction, "switched chequebook", "previous", previous.Hex(), "chequebook", address.Hex())
+
+	for _, p := range s.peers {
+		p.lock.Lock()
+		if err := p.announceChequebook(); err != nil {
+			p.logger.Warn(InitAction, "error while announcing chequebook", "err", err)
+		}
+		p.lock.Unlock()
+	}
+	return nil
+}
+
+// announceChequebook announces our chequebook to the peer if its cheques are still drawn on a previous one
+// it is not announced while a cheque is pending, as the peer refuses the cheque once it switched, but once the cheque is confirmed.
+// No cheques are sent to the peer until it confirmed the switch. If it does not confirm it in time it is dropped,
+// and it learns about the chequebook in the handshake when it connects again
+// the caller is expected to hold p.lock
+func (p *Peer) announceChequebook() error {
+	chequebook := p.swap.GetParams().ContractAddress
+	if p.chequebook == (common.Address{}) || p.announcedChequebook != (common.Address{}) || p.getPendingCheque() != nil {
+		return nil
+	}
+	if p.chequebook == chequebook {
+		p.chequebook = common.Address{}
+		return nil
+	}
+	// without a beneficiary no cheques are sent to the peer, it learns about the chequebook when it connects again
+	if p.beneficiary == (common.Address{}) {
+		return nil
+	}
+	msg, err := newChequebookUpdateMsg(chequebook, p.beneficiary, p.swap.owner.signer)
+	if err != nil {
+		return err
+	}
+	p.announcedChequebook = chequebook
+	p.logger.Info(InitAction, "announcing chequebook to peer", "previous", p.chequebook.Hex(), "chequebook", chequebook.Hex())
+	if err := p.sendWithTimeout(msg); err != nil {
+		p.announcedChequebook = common.Address{}
+		return fmt.Errorf("sending chequebook update: %w", err)
+	}
+	p.swap.runBackground(func(ctx context.Context) {
+		select {
+		case <-time.After(chequebookUpdateTimeout):
+		case <-ctx.Done():
+			return
+		}
+		p.lock.RLock()
+		unconfirmed := p.announcedChequebook == chequebook
+		p.lock.RUnlock()
+		if unconfirmed {
+			p.Drop(fmt.Sprintf("switch to chequebook %v not confirmed", chequebook.Hex()))
+		}
+	})
+	return nil
+}
+
+// handleConfirmChequebookUpdateMsg completes the switch of the peer to the chequebook we announced, see announceChequebook
+// the cheques to the peer are drawn on it from now on and the debt accrued meanwhile is settled
+func (s *Swap) handleConfirmChequebookUpdateMsg(ctx context.Context, p *Peer, msg *ConfirmChequebookUpdateMsg) error {
+	p.lock.RLock()
+	announced := p.announcedChequebook
+	beneficiary := p.beneficiary
+	p.lock.RUnlock()
+	if announced == (common.Address{}) || msg.ContractAddress != announced {
+		p.logger.Debug(InitAction, "ignoring confirmation of chequebook which was not announced", "chequebook", msg.ContractAddress.Hex())
+		return nil
+	}
+	// read before the lock is taken, so that a slow backend does not block the accounting with the peer
+	seed, err := s.paidOutTo(ctx, announced, beneficiary)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.announcedChequebook != announced {
+		return nil
+	}
+	if err := p.useChequebook(announced, seed); err != nil {
+		return err
+	}
+	p.logger.Info(InitAction, "peer confirmed chequebook", "previous", p.chequebook.Hex(), "chequebook", announced.Hex())
+	p.announcedChequebook = common.Address{}
+	p.chequebook = announced
+	// we may have switched again meanwhile
+	if err := p.announceChequebook(); err != nil {
+		return err
+	}
+	return s.checkPaymentThresholdAndSendCheque(p)
+}
+
+// useChequebook draws the cheques to the peer on our chequebook at address from now on
+// the last cheque sent from the previous chequebook is kept, so that the cheques build on it if we switch back to it,
+// the cheques from the new one build on the last cheque sent to the peer from it or on seed, what it paid out to the peer so far
+// the caller is expected to hold p.lock
+func (p *Peer) useChequebook(address common.Address, seed *int256.Uint256) error {
+	batch := new(state.StoreBatch)
+	if last := p.getLastSentCheque(); last != nil {
+		if err := p.swap.batchPut(batch, sentChequebookChequeKey(p.ID(), last.Contract), last); err != nil {
+			return fmt.Errorf("encoding last sent cheque: %w", err)
+		}
+	}
+	next, err := p.swap.loadLastSentChequebookCheque(p.ID(), address)
+	if err != nil {
+		return fmt.Errorf("loading last cheque sent from chequebook %v: %w", address.Hex(), err)
+	}
+	// cheques to a previous beneficiary of the peer are not the base of the ones to the current one
+	if next != nil && next.Beneficiary != p.beneficiary {
+		next = nil
+	}
+	if next != nil {
+		if err := p.swap.batchPut(batch, sentChequeKey(p.ID()), next); err != nil {
+			return fmt.Errorf("encoding last sent cheque: %w", err)
+		}
+	} else {
+		batch.Delete(sentChequeKey(p.ID()))
+	}
+	if err := p.swap.batchPut(batch, payoutSeedKey(p.ID()), seed); err != nil {
+		return fmt.Errorf("encoding cumulative payout seed: %w", err)
+	}
+	if err := p.swap.store.WriteBatch(batch); err != nil {
+		return fmt.Errorf("saving chequebook of cheques to peer: %w", err)
+	}
+	p.lastSentCheque = next
+	p.cumulativePayoutSeed = seed
+	return nil
+}
@@ -0,0 +1,491 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// TestChequebookUpdate tests that a peer can switch to a new chequebook with another issuer during the session,
+// that the update has to be signed by the new issuer and the current key of the peer and is refused while a cheque
+// to the previous beneficiary is pending, that the switch is confirmed and that cheques to and from the peer start over with the new chequebook
+func TestChequebookUpdate(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+	ctx := context.Background()
+
+	cashed := make(chan *Cheque, 1)
+	currentCashCheque := defaultCashCheque
+	defaultCashCheque = func(ctx context.Context, s *Swap, cheque *Cheque) error {
+		select {
+		case cashed <- cheque:
+		case <-ctx.Done():
+		}
+		return nil
+	}
+	defer func() { defaultCashCheque = currentCashCheque }()
+
+	// the swap is closed before the cashing is restored, so that no cashing runs meanwhile
+	swap, clean := newTestSwap(t, beneficiaryKey, backend)
+	defer clean()
+
+	if err := testDeploy(ctx, swap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+	oldChequebook, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := crypto.PubkeyToAddress(issuerKey.PublicKey)
+	newChequebook, err := testDeployWithPrivateKey(ctx, backend, ownerKey, issuer, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAddress := newChequebook.ContractParams().ContractAddress
+
+	rw, peerRW := newBufferedMsgPipe()
+	defer rw.Close()
+	peer, err := swap.addPeer(newDummyPeerWithRW(Spec, rw).Peer, ownerAddress, oldChequebook.ContractParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := newSignedTestCheque(oldChequebook.ContractParams().ContractAddress, beneficiaryAddress, int256.Uint256From(100), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, err := newSignedTestCheque(swap.GetParams().ContractAddress, ownerAddress, int256.Uint256From(200), beneficiaryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.lastReceivedCheque = received
+	peer.lastSentCheque = sent
+	if err := swap.saveLastReceivedCheque(peer.ID(), received); err != nil {
+		t.Fatal(err)
+	}
+
+	// the update has to be signed by the issuer of the new chequebook
+	forged, err := newChequebookUpdateMsg(newAddress, beneficiaryAddress, NewLocalSigner(ownerKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.handleChequebookUpdateMsg(ctx, peer, forged); !errors.Is(err, ErrInvalidChequebookUpdate) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidChequebookUpdate, err)
+	}
+	// and for us, so that it cannot be replayed to other nodes
+	replayed, err := newChequebookUpdateMsg(newAddress, ownerAddress, NewLocalSigner(issuerKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.handleChequebookUpdateMsg(ctx, peer, replayed); !errors.Is(err, ErrInvalidChequebookUpdate) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidChequebookUpdate, err)
+	}
+
+	// and, as the issuer is not the key of the peer, by the key of the peer as well
+	msg, err := newChequebookUpdateMsg(newAddress, beneficiaryAddress, NewLocalSigner(issuerKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.handleChequebookUpdateMsg(ctx, peer, msg); !errors.Is(err, ErrInvalidChequebookUpdate) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidChequebookUpdate, err)
+	}
+	if msg.PeerSignature, err = NewLocalSigner(ownerKey).Sign(chequebookUpdateSigHash(newAddress, beneficiaryAddress)); err != nil {
+		t.Fatal(err)
+	}
+
+	peer.pendingCheque = sent
+	if err := swap.handleChequebookUpdateMsg(ctx, peer, msg); err != ErrUnconfirmedCheque {
+		t.Fatalf("expected error %v, got %v", ErrUnconfirmedCheque, err)
+	}
+	if peer.Beneficiary() != ownerAddress {
+		t.Fatalf("expected beneficiary %x to be kept, got %x", ownerAddress, peer.Beneficiary())
+	}
+
+	peer.pendingCheque = nil
+	if err := swap.handleChequebookUpdateMsg(ctx, peer, msg); err != nil {
+		t.Fatal(err)
+	}
+	confirmation, err := peerRW.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := Spec.GetCode(&ConfirmChequebookUpdateMsg{}); confirmation.Code != code {
+		t.Fatalf("expected the switch to be confirmed with message code %d, got %d", code, confirmation.Code)
+	}
+	if peer.contractAddress != newAddress {
+		t.Fatalf("expected chequebook %x, got %x", newAddress, peer.contractAddress)
+	}
+	if peer.Beneficiary() != issuer {
+		t.Fatalf("expected beneficiary %x, got %x", issuer, peer.Beneficiary())
+	}
+	if payout := peer.getLastSentCumulativePayout(); !payout.Equals(int256.Uint256From(0)) {
+		t.Fatalf("expected cheques to the new beneficiary to start from 0, got %v", payout)
+	}
+	if peer.getLastReceivedCheque() != nil {
+		t.Fatalf("expected cheques from the new chequebook to start from 0, got last received cheque %v", peer.getLastReceivedCheque())
+	}
+	// the last cheque of the previous chequebook is cashed
+	if cheque := <-cashed; !cheque.Equal(received) {
+		t.Fatalf("expected cheque %v to be cashed, got %v", received, cheque)
+	}
+
+	// the switch is saved, so that the cheques from the new chequebook are accepted after a reconnect
+	swap.removePeer(peer)
+	info, err := swap.PeerInfo(peer.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Beneficiary != issuer {
+		t.Fatalf("expected saved beneficiary %x, got %x", issuer, info.Beneficiary)
+	}
+	reconnected, err := swap.addPeer(peer.Peer, issuer, newAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconnected.lock.Lock()
+	defer reconnected.lock.Unlock()
+	if reconnected.getLastReceivedCheque() != nil {
+		t.Fatalf("expected no last received cheque from the new chequebook, got %v", reconnected.getLastReceivedCheque())
+	}
+	first, err := newSignedTestCheque(newAddress, beneficiaryAddress, int256.Uint256From(50), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := swap.processAndVerifyCheque(first, reconnected); err != nil {
+		t.Fatalf("expected the first cheque from the new chequebook to be accepted, got %v", err)
+	}
+}
+
+// TestChequebookUpdateReplay tests that a peer switching back to a chequebook it used before
+// cannot send the cheques it already sent from it again
+func TestChequebookUpdateReplay(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+	ctx := context.Background()
+
+	currentCashCheque := defaultCashCheque
+	defaultCashCheque = func(ctx context.Context, s *Swap, cheque *Cheque) error {
+		return nil
+	}
+	defer func() { defaultCashCheque = currentCashCheque }()
+
+	swap, clean := newTestSwap(t, beneficiaryKey, backend)
+	defer clean()
+
+	if err := testDeploy(ctx, swap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+	chequebookA, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chequebookB, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addressA := chequebookA.ContractParams().ContractAddress
+	addressB := chequebookB.ContractParams().ContractAddress
+
+	peer, err := swap.addPeer(newDummyPeerWithSpec(Spec).Peer, ownerAddress, addressA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.balance = 1000
+
+	// the peer pays with a cheque from A, switches to B, pays with a cheque from B and switches back to A
+	chequeA, err := newSignedTestCheque(addressA, beneficiaryAddress, int256.Uint256From(100), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chequeB, err := newSignedTestCheque(addressB, beneficiaryAddress, int256.Uint256From(50), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		chequebook common.Address
+		cheque     *Cheque
+	}{
+		{addressA, chequeA},
+		{addressB, chequeB},
+		{addressA, nil},
+	} {
+		msg, err := newChequebookUpdateMsg(step.chequebook, beneficiaryAddress, NewLocalSigner(ownerKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := swap.handleChequebookUpdateMsg(ctx, peer, msg); err != nil {
+			t.Fatal(err)
+		}
+		if step.cheque == nil {
+			continue
+		}
+		peer.lock.Lock()
+		_, err = swap.processAndVerifyCheque(step.cheque, peer)
+		peer.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the cheque from A was accepted before, so it is refused now
+	peer.lock.Lock()
+	if last := peer.getLastReceivedCheque(); !last.Equal(chequeA) {
+		t.Fatalf("expected the last cheque from chequebook %x to be %v, got %v", addressA, chequeA, last)
+	}
+	balance := peer.getBalance()
+	if _, err := swap.processAndVerifyCheque(chequeA, peer); !errors.Is(err, ErrChequeRegression) {
+		t.Fatalf("expected error %v, got %v", ErrChequeRegression, err)
+	}
+	if peer.getBalance() != balance {
+		t.Fatalf("expected balance %d to be kept, got %d", balance, peer.getBalance())
+	}
+	peer.lock.Unlock()
+
+	// the same holds after a reconnect, although the cheque from B is the last one received
+	swap.removePeer(peer)
+	reconnected, err := swap.addPeer(peer.Peer, ownerAddress, addressA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconnected.lock.Lock()
+	defer reconnected.lock.Unlock()
+	if last := reconnected.getLastReceivedCheque(); !last.Equal(chequeA) {
+		t.Fatalf("expected the last cheque from chequebook %x to be %v, got %v", addressA, chequeA, last)
+	}
+	if _, err := swap.processAndVerifyCheque(chequeA, reconnected); !errors.Is(err, ErrChequeRegression) {
+		t.Fatalf("expected error %v, got %v", ErrChequeRegression, err)
+	}
+}
+
+// TestReconnectWithAnotherChequebook tests that a peer which connects with another chequebook than the one saved for it
+// is switched to it like on an update
+func TestReconnectWithAnotherChequebook(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+	ctx := context.Background()
+
+	currentCashCheque := defaultCashCheque
+	defaultCashCheque = func(ctx context.Context, s *Swap, cheque *Cheque) error {
+		return nil
+	}
+	defer func() { defaultCashCheque = currentCashCheque }()
+
+	swap, clean := newTestSwap(t, beneficiaryKey, backend)
+	defer clean()
+
+	if err := testDeploy(ctx, swap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+	chequebookA, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chequebookB, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addressA := chequebookA.ContractParams().ContractAddress
+	addressB := chequebookB.ContractParams().ContractAddress
+
+	dummy := newDummyPeerWithSpec(Spec)
+	chequeA, err := newSignedTestCheque(addressA, beneficiaryAddress, int256.Uint256From(100), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.saveLastReceivedCheque(dummy.ID(), chequeA); err != nil {
+		t.Fatal(err)
+	}
+	saved := &peerChequebook{Contract: addressA, Beneficiary: ownerAddress}
+	if err := swap.store.Put(peerChequebookKey(dummy.ID()), saved); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := swap.addPeer(dummy.Peer, saved.Beneficiary, saved.Contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.startPeerChequebooks(ctx, peer, saved, addressB, ownerAddress, swap.GetParams().ContractAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	peer.lock.RLock()
+	defer peer.lock.RUnlock()
+	if peer.contractAddress != addressB {
+		t.Fatalf("expected chequebook %x, got %x", addressB, peer.contractAddress)
+	}
+	if peer.getLastReceivedCheque() != nil {
+		t.Fatalf("expected cheques from chequebook %x to start from 0, got last received cheque %v", addressB, peer.getLastReceivedCheque())
+	}
+	chequebook, err := swap.loadPeerChequebook(peer.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chequebook.Contract != addressB {
+		t.Fatalf("expected saved chequebook %x, got %x", addressB, chequebook.Contract)
+	}
+}
+
+// TestChequebookUpdatePending tests that the cheque to a peer which did not confirm our new chequebook yet is deferred
+func TestChequebookUpdatePending(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+
+	peer, err := swap.addPeer(newDummyPeerWithSpec(Spec).Peer, beneficiaryAddress, testChequeContract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	peer.announcedChequebook = testChequeContract
+	peer.balance = -int64(DefaultPaymentThreshold)
+
+	if err := swap.checkPaymentThresholdAndSendCheque(peer); err != nil {
+		t.Fatal(err)
+	}
+	if peer.getPendingCheque() != nil {
+		t.Fatalf("expected no cheque to be sent, got %v", peer.getPendingCheque())
+	}
+	if peer.getBalance() != -int64(DefaultPaymentThreshold) {
+		t.Fatalf("expected balance %d to be kept, got %d", -int64(DefaultPaymentThreshold), peer.getBalance())
+	}
+}
+
+// TestSwitchChequebook tests that our switch to another chequebook is announced to a connected peer
+// and that the cheques to it are drawn on the new chequebook once it confirmed the switch
+func TestSwitchChequebook(t *testing.T) {
+	pair, clean := newSwapPair(t, int256.Uint256From(DefaultPaymentThreshold*2))
+	defer clean()
+	ctx := context.Background()
+
+	// waitFor waits until cond holds
+	waitFor := func(what string, cond func() bool) {
+		for i := 0; !cond(); i++ {
+			if i == 200 {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	lastSentCheque := func() *Cheque {
+		pair.leftPeer.lock.RLock()
+		defer pair.leftPeer.lock.RUnlock()
+		return pair.leftPeer.getLastSentCheque()
+	}
+
+	previous := pair.left.GetParams().ContractAddress
+	pair.serveLeft(t, int64(DefaultPaymentThreshold))
+	waitFor("the cheque to be confirmed", func() bool { return lastSentCheque() != nil })
+
+	if err := pair.left.SwitchChequebook(ctx, previous); err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := testDeployWithPrivateKey(ctx, pair.left.backend, ownerKey, beneficiaryAddress, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pair.left.SwitchChequebook(ctx, foreign.ContractParams().ContractAddress); !errors.Is(err, ErrChequebookOwnerMismatch) {
+		t.Fatalf("expected error %v, got %v", ErrChequebookOwnerMismatch, err)
+	}
+
+	chequebook, err := testDeployWithPrivateKey(ctx, pair.left.backend, ownerKey, ownerAddress, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := chequebook.ContractParams().ContractAddress
+	if err := pair.left.SwitchChequebook(ctx, address); err != nil {
+		t.Fatal(err)
+	}
+	if pair.left.GetParams().ContractAddress != address {
+		t.Fatalf("expected chequebook %x, got %x", address, pair.left.GetParams().ContractAddress)
+	}
+	waitFor("the switch to be confirmed", func() bool {
+		pair.leftPeer.lock.RLock()
+		defer pair.leftPeer.lock.RUnlock()
+		return pair.leftPeer.chequebook == (common.Address{}) && pair.leftPeer.announcedChequebook == (common.Address{})
+	})
+	pair.rightPeer.lock.RLock()
+	contractAddress := pair.rightPeer.contractAddress
+	pair.rightPeer.lock.RUnlock()
+	if contractAddress != address {
+		t.Fatalf("expected the peer to switch to chequebook %x, got %x", address, contractAddress)
+	}
+
+	pair.serveLeft(t, int64(DefaultPaymentThreshold))
+	waitFor("the cheque from the new chequebook to be confirmed", func() bool {
+		sent := lastSentCheque()
+		return sent != nil && sent.Contract == address
+	})
+	sent := lastSentCheque()
+	if !sent.CumulativePayout.Equals(int256.Uint256From(DefaultPaymentThreshold)) {
+		t.Fatalf("expected the cheques from the new chequebook to start from 0, got cumulative payout %v", sent.CumulativePayout)
+	}
+	pair.rightPeer.lock.RLock()
+	received := pair.rightPeer.getLastReceivedCheque()
+	pair.rightPeer.lock.RUnlock()
+	if !received.Equal(sent) {
+		t.Fatalf("expected the sent cheque %v to be received, got %v", sent, received)
+	}
+	// the last cheque from the previous chequebook is kept
+	last, err := pair.left.loadLastSentChequebookCheque(pair.leftPeer.ID(), previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last == nil || !last.CumulativePayout.Equals(int256.Uint256From(DefaultPaymentThreshold)) {
+		t.Fatalf("expected the last cheque from chequebook %x to be kept, got %v", previous, last)
+	}
+}
+
+// TestMigrateChequebookCheques tests that the last received cheque saved before the last cheques were kept per chequebook
+// becomes the last cheque of its chequebook
+func TestMigrateChequebookCheques(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+
+	peer := newDummyPeer().ID()
+	cheque := newTestCheque()
+	if err := swap.store.Put(receivedChequeKey(peer), cheque); err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := swap.migrateChequebookCheques()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Fatalf("expected 1 migrated cheque, got %d", migrated)
+	}
+	last, err := swap.loadLastChequebookCheque(peer, cheque.Contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !last.Equal(cheque) {
+		t.Fatalf("expected last cheque of chequebook %x to be %v, got %v", cheque.Contract, cheque, last)
+	}
+	// cheques which are the last of their chequebook already are not migrated again
+	if migrated, err = swap.migrateChequebookCheques(); err != nil || migrated != 0 {
+		t.Fatalf("expected no migrated cheque, got %d (err: %v)", migrated, err)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import "time"
+
+// Clock is the source of time for all time dependent features of Swap
+// it allows tests to move time forward without waiting
+type Clock interface {
+	Now() time.Time                   // returns the current time
+	NewTicker(d time.Duration) Ticker // returns a ticker which ticks every d
+}
+
+// Ticker delivers ticks of a Clock at intervals
+type Ticker interface {
+	C() <-chan time.Time // channel on which the ticks are delivered
+	Stop()               // turns off the ticker
+}
+
+// realClock is the Clock used in production, based on the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker is a Ticker based on time.Ticker
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
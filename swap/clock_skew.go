@@ -0,0 +1,55 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// newEmitChequeMsg creates the message sending cheque to the peer, with the time of sending if Params.ChequeSendTime is set
+func (p *Peer) newEmitChequeMsg(cheque *Cheque) *EmitChequeMsg {
+	msg := &EmitChequeMsg{
+		Cheque: cheque,
+	}
+	if p.swap.params.ChequeSendTime {
+		msg.SentAt = uint64(p.swap.clock.Now().Unix())
+	}
+	return msg
+}
+
+// checkClockSkew compares the time a received cheque was sent at according to the peer with our time
+// a difference beyond the clock skew tolerance is logged and counted, but the cheque is not refused for it,
+// as clocks legitimately differ and the time is not signed
+// it returns the difference and whether it is beyond the tolerance, nothing is checked if the peer did not include the time
+func (s *Swap) checkClockSkew(p *Peer, msg *EmitChequeMsg) (skew time.Duration, skewed bool) {
+	if msg.SentAt == 0 {
+		return 0, false
+	}
+	tolerance := s.params.ClockSkewTolerance
+	if tolerance == 0 {
+		tolerance = DefaultClockSkewTolerance
+	}
+	skew = s.clock.Now().Sub(time.Unix(int64(msg.SentAt), 0))
+	if skew <= tolerance && skew >= -tolerance {
+		return skew, false
+	}
+	metrics.GetOrRegisterCounter("swap/cheques/received/clock_skew", nil).Inc(1)
+	p.logger.Warn(HandleChequeAction, "time the cheque was sent at differs from our time, the clocks may be skewed", "skew", skew, "tolerance", tolerance)
+	return skew, true
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"testing"
+	"time"
+)
+
+// TestClockSkew tests that the time of sending is only included in cheque messages if configured,
+// and that a received send time is reported as skewed only beyond the tolerance
+func TestClockSkew(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	now := time.Unix(1600000000, 0)
+	swap.clock = newTestClock(now)
+	peer := addPeer(t, swap)
+	cheque := newTestCheque()
+
+	if msg := peer.newEmitChequeMsg(cheque); msg.SentAt != 0 {
+		t.Fatalf("expected no send time, got %d", msg.SentAt)
+	}
+	swap.params.ChequeSendTime = true
+	msg := peer.newEmitChequeMsg(cheque)
+	if msg.SentAt != uint64(now.Unix()) {
+		t.Fatalf("expected send time %d, got %d", now.Unix(), msg.SentAt)
+	}
+
+	swap.params.ClockSkewTolerance = time.Minute
+	for _, c := range []struct {
+		sentAt time.Time
+		skew   time.Duration
+		skewed bool
+	}{
+		{now.Add(-30 * time.Second), 30 * time.Second, false},
+		{now.Add(30 * time.Second), -30 * time.Second, false},
+		{now.Add(-time.Hour), time.Hour, true},
+		{now.Add(time.Hour), -time.Hour, true},
+	} {
+		skew, skewed := swap.checkClockSkew(peer, &EmitChequeMsg{Cheque: cheque, SentAt: uint64(c.sentAt.Unix())})
+		if skew != c.skew || skewed != c.skewed {
+			t.Fatalf("sent at %v: got skew %v (skewed %t), want %v (skewed %t)", c.sentAt, skew, skewed, c.skew, c.skewed)
+		}
+	}
+	// peers which do not include the time are not checked
+	if _, skewed := swap.checkClockSkew(peer, &EmitChequeMsg{Cheque: cheque}); skewed {
+		t.Fatal("expected a cheque without send time not to be reported as skewed")
+	}
+}
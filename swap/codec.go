@@ -0,0 +1,222 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethersphere/swarm/state"
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// ErrCorruptEntry indicates that an entry of the swap store could not be decoded
+var ErrCorruptEntry = errors.New("corrupt store entry")
+
+// corruptEntryPrefix is prepended to the key of corrupt entries which were moved aside, see getOrQuarantine
+const corruptEntryPrefix = "corrupt_"
+
+// Codec serializes the values swap keeps in its state store
+type Codec interface {
+	// Encode returns the serialized form of v
+	Encode(v interface{}) ([]byte, error)
+	// Decode deserializes data into v, which must be a pointer
+	Decode(data []byte, v interface{}) error
+}
+
+// JSONCodec is the default Codec
+// it encodes values like state.DBStore does: binary marshalers as binary, everything else as JSON
+type JSONCodec struct{}
+
+// Encode is from the Codec interface
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+	if marshaler, ok := v.(encoding.BinaryMarshaler); ok {
+		return marshaler.MarshalBinary()
+	}
+	return json.Marshal(v)
+}
+
+// Decode is from the Codec interface
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	if unmarshaler, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return unmarshaler.UnmarshalBinary(data)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// encodedValue is a value which was already encoded by a Codec and is stored as is
+type encodedValue []byte
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface
+func (v encodedValue) MarshalBinary() ([]byte, error) {
+	return v, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface
+func (v *encodedValue) UnmarshalBinary(data []byte) error {
+	*v = append((*v)[:0], data...)
+	return nil
+}
+
+// codecStore is a state.Store which encodes the values with a Codec
+// keys, deletions and iteration are passed through, iterated values have to be decoded with the codec
+type codecStore struct {
+	state.Store
+	codec Codec
+}
+
+// newCodecStore wraps store so that its values are encoded with codec, or with JSONCodec if codec is nil
+// a store which is already wrapped is returned as is
+func newCodecStore(store state.Store, codec Codec) *codecStore {
+	if s, ok := store.(*codecStore); ok {
+		return s
+	}
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &codecStore{
+		Store: store,
+		codec: codec,
+	}
+}
+
+// Get decodes the value stored under key into i
+func (s *codecStore) Get(key string, i interface{}) error {
+	var data encodedValue
+	if err := s.Store.Get(key, &data); err != nil {
+		return err
+	}
+	if err := s.codec.Decode(data, i); err != nil {
+		return fmt.Errorf("%w %s: %v", ErrCorruptEntry, key, err)
+	}
+	return nil
+}
+
+// Put encodes i and stores it under key
+func (s *codecStore) Put(key string, i interface{}) error {
+	data, err := s.codec.Encode(i)
+	if err != nil {
+		return err
+	}
+	return s.Store.Put(key, encodedValue(data))
+}
+
+// moveAside moves the value stored under key to corruptEntryPrefix+key as it is, so that it can be inspected later
+func (s *codecStore) moveAside(key string) error {
+	var data encodedValue
+	if err := s.Store.Get(key, &data); err != nil {
+		return err
+	}
+	batch := new(state.StoreBatch)
+	batch.Batch.Put([]byte(corruptEntryPrefix+key), data)
+	batch.Batch.Delete([]byte(key))
+	return s.Store.WriteBatch(batch)
+}
+
+// getOrQuarantine gets the value stored under key like Get, but an entry which cannot be decoded is moved aside
+// and state.ErrNotFound is returned for it, so that the caller continues as if there was no entry
+// otherwise a single corrupt entry, e.g. the balance with a peer, would keep the peer from ever connecting again
+func (s *Swap) getOrQuarantine(key string, i interface{}) error {
+	err := s.store.Get(key, i)
+	if !errors.Is(err, ErrCorruptEntry) {
+		return err
+	}
+	metrics.GetOrRegisterCounter("swap/store/corrupt", nil).Inc(1)
+	s.logger.Error(InitAction, "moving corrupt store entry aside", "key", key, "err", err)
+	store, ok := s.store.(*codecStore)
+	if !ok {
+		return err
+	}
+	if err := store.moveAside(key); err != nil {
+		return fmt.Errorf("moving corrupt entry %s aside: %w", key, err)
+	}
+	return state.ErrNotFound
+}
+
+// batchPut encodes i with the codec of the swap store and adds it to batch
+func (s *Swap) batchPut(batch *state.StoreBatch, key string, i interface{}) error {
+	data, err := s.codec.Encode(i)
+	if err != nil {
+		return err
+	}
+	batch.Batch.Put([]byte(key), data)
+	return nil
+}
+
+// storeEntryTypes returns a new value of the type stored under each key prefix of the swap store
+// entries under a prefix missing here are not known to swap and not migrated
+var storeEntryTypes = map[string]func() interface{}{
+	balancePrefix:               func() interface{} { return new(int64) },
+	sentChequePrefix:            func() interface{} { return new(*Cheque) },
+	receivedChequePrefix:        func() interface{} { return new(*Cheque) },
+	pendingChequePrefix:         func() interface{} { return new(*Cheque) },
+	lastSeenPrefix:              func() interface{} { return new(time.Time) },
+	blacklistPrefix:             func() interface{} { return new(bool) },
+	payoutSeedPrefix:            func() interface{} { return new(*int256.Uint256) },
+	thresholdWeightPrefix:       func() interface{} { return new(float64) },
+	cashoutQueuePrefix:          func() interface{} { return new(*CashoutQueueItem) },
+	cashedPayoutPrefix:          func() interface{} { return new(*int256.Uint256) },
+	chequeEventPrefix:           func() interface{} { return new(ChequeEvent) },
+	lastChequeEventKey:          func() interface{} { return new(uint64) },
+	chequeTotalsKey:             func() interface{} { return new(ChequeTotals) },
+	connectedChequebookKey:      func() interface{} { return new(common.Address) },
+	connectedBlockchainKey:      func() interface{} { return new(uint64) },
+	receivedChequeHistoryPrefix: func() interface{} { return new(*Cheque) },
+	lastReceivedSerialPrefix:    func() interface{} { return new(uint64) },
+	receivedChequeSummaryPrefix: func() interface{} { return new(ChequeHistorySummary) },
+	priceTableKey:               func() interface{} { return new(PriceTable) },
+	chequeConversionPrefix:      func() interface{} { return new(*ChequeConversion) },
+	peerChequebookPrefix:        func() interface{} { return new(*peerChequebook) },
+	chequebookChequePrefix:      func() interface{} { return new(*Cheque) },
+	sentChequebookChequePrefix:  func() interface{} { return new(*Cheque) },
+	previousChequebookPrefix:    func() interface{} { return new(time.Time) },
+}
+
+// MigrateStoreCodec re-encodes all swap entries of store which were encoded with from, so that they are encoded with to
+// store must be the raw store, e.g. a state.DBStore opened on swap.db, and must not be used by a running swap meanwhile
+// it returns the number of migrated entries, all of them are written at once so a failed migration leaves the store unchanged
+func MigrateStoreCodec(store state.Store, from, to Codec) (migrated int, err error) {
+	batch := new(state.StoreBatch)
+	for prefix, newValue := range storeEntryTypes {
+		newValue := newValue
+		err := store.Iterate(prefix, func(key []byte, value []byte) (stop bool, err error) {
+			v := newValue()
+			if err := from.Decode(value, v); err != nil {
+				return true, fmt.Errorf("decoding %s: %w", key, err)
+			}
+			data, err := to.Encode(v)
+			if err != nil {
+				return true, fmt.Errorf("encoding %s: %w", key, err)
+			}
+			batch.Batch.Put(key, data)
+			migrated++
+			return false, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := store.WriteBatch(batch); err != nil {
+		return 0, fmt.Errorf("writing migrated entries: %w", err)
+	}
+	return migrated, nil
+}
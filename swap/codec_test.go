@@ -0,0 +1,213 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethersphere/swarm/state"
+)
+
+// hexCodec is a Codec which hex encodes the values encoded by JSONCodec
+type hexCodec struct{}
+
+func (hexCodec) Encode(v interface{}) ([]byte, error) {
+	data, err := JSONCodec{}.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(data)), nil
+}
+
+func (hexCodec) Decode(data []byte, v interface{}) error {
+	decoded, err := hex.DecodeString(string(data))
+	if err != nil {
+		return err
+	}
+	return JSONCodec{}.Decode(decoded, v)
+}
+
+// TestStoreCodec tests that entries are written and read with the configured codec
+func TestStoreCodec(t *testing.T) {
+	params := newDefaultParams(t)
+	params.StoreCodec = hexCodec{}
+	swap, dir := newBaseTestSwapWithParams(t, ownerKey, params, newTestBackend(t))
+	defer os.RemoveAll(dir)
+	defer swap.Close()
+
+	peer := enode.HexID("f6876a1f73947b0495d36e648aeb74f952220c3b03e66a1cc786863f6104fa56")
+	if err := swap.store.Put(balanceKey(peer), int64(42)); err != nil {
+		t.Fatal(err)
+	}
+	cheque := newTestCheque()
+	if err := swap.appendChequeEvent(ChequeSentEvent, peer, cheque); err != nil {
+		t.Fatal(err)
+	}
+
+	// both single entries and batches are encoded with the codec
+	rawStore := swap.store.(*codecStore).Store
+	for _, key := range []string{balanceKey(peer), chequeEventKey(1), chequeTotalsKey} {
+		var raw encodedValue
+		if err := rawStore.Get(key, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := hex.DecodeString(string(raw)); err != nil {
+			t.Fatalf("expected entry %s to be hex encoded, got %s", key, raw)
+		}
+	}
+
+	balances, err := swap.Balances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balances[peer] != 42 {
+		t.Fatalf("expected balance 42, got %d", balances[peer])
+	}
+	events, err := swap.ChequeEventsSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || !events[0].Cheque.Equal(cheque) {
+		t.Fatalf("expected the sent cheque event, got %v", events)
+	}
+}
+
+// TestMigrateStoreCodec tests that entries written with the default codec can be read with another codec after the migration
+func TestMigrateStoreCodec(t *testing.T) {
+	swap, dir := newBaseTestSwap(t, ownerKey, newTestBackend(t))
+	defer os.RemoveAll(dir)
+
+	peer := enode.HexID("f6876a1f73947b0495d36e648aeb74f952220c3b03e66a1cc786863f6104fa56")
+	lastSeen := time.Unix(1600000000, 0)
+	cheque := newTestCheque()
+	if err := swap.store.Put(balanceKey(peer), int64(-42)); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.saveLastSeen(peer, lastSeen); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.store.Put(sentChequeKey(peer), cheque); err != nil {
+		t.Fatal(err)
+	}
+	// adds the event, the last sequence number and the totals
+	if err := swap.appendChequeEvent(ChequeSentEvent, peer, cheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stateStore, err := state.NewDBStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stateStore.Close()
+	migrated, err := MigrateStoreCodec(stateStore, JSONCodec{}, hexCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 6 {
+		t.Fatalf("expected 6 migrated entries, got %d", migrated)
+	}
+
+	store := newCodecStore(stateStore, hexCodec{})
+	var balance int64
+	if err := store.Get(balanceKey(peer), &balance); err != nil || balance != -42 {
+		t.Fatalf("expected balance -42, got %d (err: %v)", balance, err)
+	}
+	var storedLastSeen time.Time
+	if err := store.Get(lastSeenKey(peer), &storedLastSeen); err != nil || !storedLastSeen.Equal(lastSeen) {
+		t.Fatalf("expected last seen %v, got %v (err: %v)", lastSeen, storedLastSeen, err)
+	}
+	var sentCheque *Cheque
+	if err := store.Get(sentChequeKey(peer), &sentCheque); err != nil || !sentCheque.Equal(cheque) {
+		t.Fatalf("expected sent cheque %v, got %v (err: %v)", cheque, sentCheque, err)
+	}
+	var totals ChequeTotals
+	if err := store.Get(chequeTotalsKey, &totals); err != nil || totals.ChequesSent != 1 {
+		t.Fatalf("expected 1 sent cheque in the totals, got %+v (err: %v)", totals, err)
+	}
+
+	// entries which are not encoded with from fail the migration without changing the store
+	if _, err := MigrateStoreCodec(stateStore, JSONCodec{}, hexCodec{}); err == nil {
+		t.Fatal("expected migrating already migrated entries to fail")
+	}
+	if err := store.Get(balanceKey(peer), &balance); err != nil || balance != -42 {
+		t.Fatalf("expected balance -42 after the failed migration, got %d (err: %v)", balance, err)
+	}
+}
+
+// TestCorruptEntries tests that entries which cannot be decoded are moved aside when a peer is loaded,
+// so that the peer connects as if it had no balance or cheques
+func TestCorruptEntries(t *testing.T) {
+	params := newDefaultParams(t)
+	params.ReceivedChequeHistory = true
+	swap, dir := newBaseTestSwapWithParams(t, ownerKey, params, newTestBackend(t))
+	defer os.RemoveAll(dir)
+	defer swap.Close()
+
+	protoPeer := newDummyPeer().Peer
+	peer := protoPeer.ID()
+	cheque := newTestCheque()
+	if err := swap.saveLastReceivedCheque(peer, cheque); err != nil {
+		t.Fatal(err)
+	}
+	store := swap.store.(*codecStore)
+	corrupt := []string{balanceKey(peer), sentChequeKey(peer), receivedChequeHistoryKey(peer, 1)}
+	for _, key := range corrupt {
+		if err := store.Store.Put(key, encodedValue("{corrupt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var balance int64
+	if err := swap.store.Get(balanceKey(peer), &balance); !errors.Is(err, ErrCorruptEntry) {
+		t.Fatalf("expected error %v, got %v", ErrCorruptEntry, err)
+	}
+
+	p, err := swap.addPeer(protoPeer, ownerAddress, testChequeContract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.getBalance() != 0 {
+		t.Fatalf("expected balance 0, got %d", p.getBalance())
+	}
+	if p.getLastSentCheque() != nil {
+		t.Fatalf("expected no last sent cheque, got %v", p.getLastSentCheque())
+	}
+	// the cheque is still saved as the last received cheque outside of the history
+	if !p.getLastReceivedCheque().Equal(cheque) {
+		t.Fatalf("expected last received cheque %v, got %v", cheque, p.getLastReceivedCheque())
+	}
+
+	for _, key := range corrupt {
+		var data encodedValue
+		if err := store.Store.Get(key, &data); err != state.ErrNotFound {
+			t.Fatalf("expected corrupt entry %s to be removed, got %v", key, err)
+		}
+		if err := store.Store.Get(corruptEntryPrefix+key, &data); err != nil {
+			t.Fatalf("expected corrupt entry %s to be moved aside: %v", key, err)
+		}
+		if string(data) != "{corrupt" {
+			t.Fatalf("expected corrupt entry %s to be kept as it is, got %s", key, data)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package swap
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
@@ -9,7 +10,10 @@ import (
 	"math/big"
 	mrand "math/rand"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
@@ -17,6 +21,7 @@ import (
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
 	contractFactory "github.com/ethersphere/go-sw3/contracts-v0-2-0/simpleswapfactory"
 	cswap "github.com/ethersphere/swarm/contracts/swap"
@@ -44,7 +49,7 @@ var defaultBackend = backends.NewSimulatedBackend(core.GenesisAlloc{
 }, 8000000)
 
 // newTestBackend creates a new test backend instance
-func newTestBackend(t *testing.T) *swapTestBackend {
+func newTestBackend(t testing.TB) *swapTestBackend {
 	t.Helper()
 
 	backend := mock.NewTestBackend(defaultBackend)
@@ -72,7 +77,7 @@ func newTestBackend(t *testing.T) *swapTestBackend {
 }
 
 // newDefaultParams creates a set of default params for tests
-func newDefaultParams(t *testing.T) *Params {
+func newDefaultParams(t testing.TB) *Params {
 	t.Helper()
 	baseKey := make([]byte, 32)
 	_, err := rand.Read(baseKey)
@@ -89,7 +94,7 @@ func newDefaultParams(t *testing.T) *Params {
 }
 
 // newBaseTestSwapWithParams creates a swap with the given params
-func newBaseTestSwapWithParams(t *testing.T, key *ecdsa.PrivateKey, params *Params, backend *swapTestBackend) (*Swap, string) {
+func newBaseTestSwapWithParams(t testing.TB, key *ecdsa.PrivateKey, params *Params, backend *swapTestBackend) (*Swap, string) {
 	t.Helper()
 	dir, err := ioutil.TempDir("", "swap_test_store")
 	if err != nil {
@@ -100,7 +105,7 @@ func newBaseTestSwapWithParams(t *testing.T, key *ecdsa.PrivateKey, params *Para
 		t.Fatal(err)
 	}
 	log.Debug("creating simulated backend")
-	owner := createOwner(key)
+	owner := createOwner(NewLocalSigner(key))
 	swapLogger := newSwapLogger(params.LogPath, params.LogLevel, params.BaseAddrs)
 	factory, err := cswap.FactoryAt(backend.factoryAddress, backend)
 	if err != nil {
@@ -112,7 +117,7 @@ func newBaseTestSwapWithParams(t *testing.T, key *ecdsa.PrivateKey, params *Para
 
 // create a test swap account with a backend
 // creates a stateStore for persistence and a Swap account
-func newBaseTestSwap(t *testing.T, key *ecdsa.PrivateKey, backend *swapTestBackend) (*Swap, string) {
+func newBaseTestSwap(t testing.TB, key *ecdsa.PrivateKey, backend *swapTestBackend) (*Swap, string) {
 	params := newDefaultParams(t)
 	return newBaseTestSwapWithParams(t, key, params, backend)
 }
@@ -120,7 +125,7 @@ func newBaseTestSwap(t *testing.T, key *ecdsa.PrivateKey, backend *swapTestBacke
 // create a test swap account with a backend
 // creates a stateStore for persistence and a Swap account
 // returns a cleanup function
-func newTestSwap(t *testing.T, key *ecdsa.PrivateKey, backend *swapTestBackend) (*Swap, func()) {
+func newTestSwap(t testing.TB, key *ecdsa.PrivateKey, backend *swapTestBackend) (*Swap, func()) {
 	t.Helper()
 	usedBackend := backend
 	if backend == nil {
@@ -144,8 +149,12 @@ type dummyPeer struct {
 
 // creates a dummy protocols.Peer with dummy MsgReadWriter
 func newDummyPeerWithSpec(spec *protocols.Spec) *dummyPeer {
+	return newDummyPeerWithRW(spec, &dummyMsgRW{})
+}
+
+// creates a dummy protocols.Peer which communicates through rw
+func newDummyPeerWithRW(spec *protocols.Spec, rw p2p.MsgReadWriter) *dummyPeer {
 	id := adapters.RandomNodeConfig().ID
-	rw := &dummyMsgRW{}
 	protoPeer := protocols.NewPeer(p2p.NewPeer(id, "testPeer", nil), rw, spec)
 	dummy := &dummyPeer{
 		Peer: protoPeer,
@@ -210,14 +219,38 @@ func newRandomTestCheque() *Cheque {
 // During tests, because the cashing in of cheques is async, we should wait for the function to be returned
 // Otherwise if we call `handleEmitChequeMsg` manually, it will return before the TX has been committed to the `SimulatedBackend`,
 // causing subsequent TX to possibly fail due to nonce mismatch
-func testCashCheque(s *Swap, cheque *Cheque) {
-	cashCheque(s, cheque)
+func testCashCheque(ctx context.Context, s *Swap, cheque *Cheque) error {
+	err := cashCheque(ctx, s, cheque)
 	// send to the channel, signals to clients that this function actually finished
 	if stb, ok := s.backend.(*swapTestBackend); ok {
 		if stb.cashDone != nil {
-			stb.cashDone <- struct{}{}
+			select {
+			case stb.cashDone <- struct{}{}:
+			case <-ctx.Done():
+			}
 		}
 	}
+	return err
+}
+
+// waitForEmptyCashoutQueue waits until the cashout worker processed all queued cheques
+// testCashCheque signals before the worker unfreezes the balance, a cheque is only removed from the queue afterwards
+func waitForEmptyCashoutQueue(t *testing.T, s *Swap) {
+	t.Helper()
+	deadline := time.Now().Add(4 * time.Second)
+	for {
+		depth, err := s.CashoutQueueDepth()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for the cashout queue to be processed, %d cheques left", depth)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
 // setupContractTest is a helper function for setting up the
@@ -235,7 +268,12 @@ func setupContractTest() func() {
 
 // deploy for testing (needs simulated backend commit)
 func testDeployWithPrivateKey(ctx context.Context, backend chain.Backend, privateKey *ecdsa.PrivateKey, ownerAddress common.Address, depositAmount *int256.Uint256) (cswap.Contract, error) {
-	opts := bind.NewKeyedTransactor(privateKey)
+	return testDeployWithSigner(ctx, backend, NewLocalSigner(privateKey), ownerAddress, depositAmount)
+}
+
+// testDeployWithSigner deploys a chequebook for ownerAddress with a transaction signed by signer and deposits depositAmount into it
+func testDeployWithSigner(ctx context.Context, backend chain.Backend, signer Signer, ownerAddress common.Address, depositAmount *int256.Uint256) (cswap.Contract, error) {
+	opts := newTransactor(signer)
 	opts.Context = ctx
 
 	var stb *swapTestBackend
@@ -283,7 +321,7 @@ func testDeployWithPrivateKey(ctx context.Context, backend chain.Backend, privat
 
 // deploy for testing (needs simulated backend commit)
 func testDeploy(ctx context.Context, swap *Swap, depositAmount *int256.Uint256) (err error) {
-	swap.contract, err = testDeployWithPrivateKey(ctx, swap.backend, swap.owner.privateKey, swap.owner.address, depositAmount)
+	swap.contract, err = testDeployWithSigner(ctx, swap.backend, swap.owner.signer, swap.owner.address, depositAmount)
 	return err
 }
 
@@ -316,3 +354,247 @@ func (d *dummyMsgRW) ReadMsg() (p2p.Msg, error) {
 func (d *dummyMsgRW) WriteMsg(msg p2p.Msg) error {
 	return nil
 }
+
+// blockingMsgRW is a MsgReadWriter whose writes block until it is released, like a peer which stopped reading
+type blockingMsgRW struct {
+	dummyMsgRW
+	release chan struct{}
+}
+
+// WriteMsg is from the MessageWriter interface
+func (b *blockingMsgRW) WriteMsg(msg p2p.Msg) error {
+	<-b.release
+	return nil
+}
+
+// bufferedMsgRW is one end of an in-memory message pipe whose writes do not wait for the other end to read
+// unlike p2p.MsgPipe, both ends can send their handshake before receiving the one of the other end
+type bufferedMsgRW struct {
+	r         <-chan p2p.Msg
+	w         chan<- p2p.Msg
+	closing   chan struct{}
+	closeOnce *sync.Once
+}
+
+// newBufferedMsgPipe creates both ends of a buffered message pipe
+func newBufferedMsgPipe() (*bufferedMsgRW, *bufferedMsgRW) {
+	c1, c2 := make(chan p2p.Msg, 64), make(chan p2p.Msg, 64)
+	closing := make(chan struct{})
+	closeOnce := new(sync.Once)
+	return &bufferedMsgRW{r: c1, w: c2, closing: closing, closeOnce: closeOnce},
+		&bufferedMsgRW{r: c2, w: c1, closing: closing, closeOnce: closeOnce}
+}
+
+// ReadMsg is from the MessageReader interface
+func (rw *bufferedMsgRW) ReadMsg() (p2p.Msg, error) {
+	select {
+	case msg := <-rw.r:
+		return msg, nil
+	case <-rw.closing:
+		return p2p.Msg{}, p2p.ErrPipeClosed
+	}
+}
+
+// WriteMsg is from the MessageWriter interface
+func (rw *bufferedMsgRW) WriteMsg(msg p2p.Msg) error {
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	msg.Payload = bytes.NewReader(payload)
+	select {
+	case rw.w <- msg:
+		return nil
+	case <-rw.closing:
+		return p2p.ErrPipeClosed
+	}
+}
+
+// Close closes both ends of the pipe
+func (rw *bufferedMsgRW) Close() {
+	rw.closeOnce.Do(func() {
+		close(rw.closing)
+	})
+}
+
+// selfdestructBackend is a backend on which all contracts can lose their code, as if they were selfdestructed
+type selfdestructBackend struct {
+	chain.Backend
+	selfdestructed int32 // set atomically to 1 to remove the code
+}
+
+// CodeAt is from the chain.Backend interface
+func (b *selfdestructBackend) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	if atomic.LoadInt32(&b.selfdestructed) == 1 {
+		return nil, nil
+	}
+	return b.Backend.CodeAt(ctx, contract, blockNumber)
+}
+
+// testClock is a Clock whose time only moves when it is advanced
+type testClock struct {
+	lock    sync.Mutex
+	advance sync.Mutex // serializes concurrent calls to Advance
+	now     time.Time
+	tickers []*testTicker
+	created chan struct{} // receives a value whenever a ticker is created
+}
+
+// newTestClock creates a testClock starting at now
+func newTestClock(now time.Time) *testClock {
+	return &testClock{
+		now:     now,
+		created: make(chan struct{}, 16),
+	}
+}
+
+// Now is from the Clock interface
+func (c *testClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// NewTicker is from the Clock interface
+func (c *testClock) NewTicker(d time.Duration) Ticker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ticker := &testTicker{
+		interval: d,
+		next:     c.now.Add(d),
+		c:        make(chan time.Time),
+		stop:     make(chan struct{}),
+	}
+	c.tickers = append(c.tickers, ticker)
+	c.created <- struct{}{}
+	return ticker
+}
+
+// Advance moves the time forward by d and delivers every tick which became due on the way
+// unlike time.Ticker, ticks are not dropped: Advance blocks until each tick is received or the ticker is stopped
+func (c *testClock) Advance(d time.Duration) {
+	c.advance.Lock()
+	defer c.advance.Unlock()
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	tickers := c.tickers
+	c.lock.Unlock()
+
+tickers:
+	for _, ticker := range tickers {
+		for !ticker.next.After(now) {
+			select {
+			case ticker.c <- ticker.next:
+			case <-ticker.stop:
+				continue tickers
+			}
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+	}
+}
+
+// waitForTicker waits until a ticker is created on the clock
+func (c *testClock) waitForTicker(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for ticker")
+	}
+}
+
+// testTicker is a Ticker of a testClock
+type testTicker struct {
+	interval time.Duration
+	next     time.Time // time of the next tick
+	c        chan time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// C is from the Ticker interface
+func (t *testTicker) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop is from the Ticker interface
+func (t *testTicker) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+// swapPair is a pair of fully initialized Swap instances with deployed chequebooks,
+// which share a simulated backend and run the swap protocol with each other over a buffered in-memory message pipe
+type swapPair struct {
+	left      *Swap // owned by ownerKey
+	right     *Swap // owned by beneficiaryKey
+	leftPeer  *Peer // right as peer of left
+	rightPeer *Peer // left as peer of right
+}
+
+// newSwapPair creates a swapPair whose chequebooks are deposited with depositAmount
+// it returns once both swaps added the other one as peer
+func newSwapPair(t *testing.T, depositAmount *int256.Uint256) (*swapPair, func()) {
+	t.Helper()
+	backend := newTestBackend(t)
+	left, cleanLeft := newTestSwap(t, ownerKey, backend)
+	right, cleanRight := newTestSwap(t, beneficiaryKey, backend)
+	clean := func() {
+		cleanLeft()
+		cleanRight()
+	}
+	for _, s := range []*Swap{left, right} {
+		if err := testDeploy(context.Background(), s, depositAmount); err != nil {
+			clean()
+			t.Fatal(err)
+		}
+	}
+
+	leftRW, rightRW := newBufferedMsgPipe()
+	leftID := enode.PubkeyToIDV4(&ownerKey.PublicKey)
+	rightID := enode.PubkeyToIDV4(&beneficiaryKey.PublicKey)
+	errc := make(chan error, 2)
+	var running sync.WaitGroup
+	running.Add(2)
+	go func() {
+		defer running.Done()
+		errc <- left.run(p2p.NewPeer(rightID, "right", nil), leftRW)
+	}()
+	go func() {
+		defer running.Done()
+		errc <- right.run(p2p.NewPeer(leftID, "left", nil), rightRW)
+	}()
+	cleanPair := func() {
+		leftRW.Close()
+		running.Wait()
+		clean()
+	}
+
+	pair := &swapPair{left: left, right: right}
+	for i := 0; pair.leftPeer == nil || pair.rightPeer == nil; i++ {
+		if i == 200 {
+			cleanPair()
+			t.Fatal("timeout waiting for the swap handshake")
+		}
+		select {
+		case err := <-errc:
+			cleanPair()
+			t.Fatalf("swap protocol ended before the peers were added: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		pair.leftPeer = left.getPeer(rightID)
+		pair.rightPeer = right.getPeer(leftID)
+	}
+	return pair, cleanPair
+}
+
+// serveLeft books honey for a service right provided to left on both sides, as the accounting of the protocols would
+func (p *swapPair) serveLeft(t *testing.T, honey int64) {
+	t.Helper()
+	if err := p.right.Add(honey, p.rightPeer.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.left.Add(-honey, p.leftPeer.Peer); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -39,4 +39,16 @@ const (
 	// Until we deploy swap officially, it's only allowed to be enabled under a specific network ID (use the --bzznetworkid flag to set it)
 	AllowedNetworkID          = 5
 	DefaultTransactionTimeout = 10 * time.Minute
+	// DefaultSendTimeout is the time after which sending a cheque to a peer is given up
+	DefaultSendTimeout = 30 * time.Second
+	// DefaultChequebookCheckInterval is how often the chequebook is checked to still be usable, e.g. not selfdestructed
+	DefaultChequebookCheckInterval = 1 * time.Hour
+	// DefaultBalanceChallengeInterval is how often our view of the balance is sent to every peer for reconciliation
+	DefaultBalanceChallengeInterval = 10 * time.Minute
+	// DefaultBalanceChallengeTolerance is the difference between the views of a balance which is not considered a discrepancy,
+	// as the views also differ by the messages which are accounted by one peer but not yet by the other
+	DefaultBalanceChallengeTolerance = DefaultPaymentThreshold / 100
+	// DefaultClockSkewTolerance is the difference between the time a cheque was sent at and the time it was received at
+	// which is not reported as clock skew, as it also includes the time the message was in transit
+	DefaultClockSkewTolerance = 5 * time.Minute
 )
@@ -0,0 +1,59 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethersphere/swarm/state"
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// chequeConversion returns the record of how the honey of cheque, which was just created for the peer, was converted into its payout
+// the oracle is described after it priced the cheque, so that the price of oracles like SmoothedOracle is the one which was used
+// the caller is expected to hold p.lock
+func (p *Peer) chequeConversion(cheque *Cheque) (*ChequeConversion, error) {
+	payout, err := new(int256.Uint256).Sub(cheque.CumulativePayout, p.getLastSentCumulativePayout())
+	if err != nil {
+		return nil, fmt.Errorf("computing payout: %w", err)
+	}
+	oracle, err := describeOracle(p.swap.honeyPriceOracle)
+	if err != nil {
+		return nil, fmt.Errorf("describing oracle: %w", err)
+	}
+	return &ChequeConversion{
+		Honey:    cheque.Honey,
+		Payout:   payout,
+		Oracle:   oracle,
+		SignedAt: p.swap.clock.Now(),
+	}, nil
+}
+
+// SentChequeConversion returns how the honey of the cheque with cumulativePayout sent to peer was converted into its payout
+// it returns nil if there is no record, e.g. for cheques sent before conversions were recorded
+func (s *Swap) SentChequeConversion(peer enode.ID, cumulativePayout *int256.Uint256) (*ChequeConversion, error) {
+	var conversion *ChequeConversion
+	err := s.getOrQuarantine(chequeConversionKey(peer, cumulativePayout), &conversion)
+	if err == state.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conversion, nil
+}
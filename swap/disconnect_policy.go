@@ -0,0 +1,94 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import "fmt"
+
+// DisconnectPolicy decides what happens when a peer owes us more than the disconnect threshold and a message would increase its debt further.
+// With every policy the debt cannot grow beyond the threshold, the policies differ in whether the peer is kept and its messages served.
+type DisconnectPolicy int
+
+const (
+	// Disconnect refuses the amount and drops the peer
+	Disconnect DisconnectPolicy = iota
+	// Throttle refuses the amount and does not serve the message, but keeps the peer so that it can settle its debt with a cheque
+	Throttle
+	// SuspendAccounting serves the message for free and keeps the peer, only the amount is refused,
+	// e.g. for trusted peers which are expected to settle late
+	SuspendAccounting
+)
+
+// DefaultDisconnectPolicy is what always happened at the disconnect threshold
+const DefaultDisconnectPolicy = Disconnect
+
+var disconnectPolicyNames = map[DisconnectPolicy]string{
+	Disconnect:        "disconnect",
+	Throttle:          "throttle",
+	SuspendAccounting: "suspend-accounting",
+}
+
+// String returns the name of the policy as accepted by ParseDisconnectPolicy
+func (d DisconnectPolicy) String() string {
+	if name, ok := disconnectPolicyNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("DisconnectPolicy(%d)", int(d))
+}
+
+// valid reports whether d is a known policy
+func (d DisconnectPolicy) valid() bool {
+	_, ok := disconnectPolicyNames[d]
+	return ok
+}
+
+// ParseDisconnectPolicy returns the policy with the given name, DefaultDisconnectPolicy for an empty name
+func ParseDisconnectPolicy(name string) (DisconnectPolicy, error) {
+	if name == "" {
+		return DefaultDisconnectPolicy, nil
+	}
+	for d, n := range disconnectPolicyNames {
+		if n == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown disconnect policy %q", name)
+}
+
+// DisconnectPolicy returns what happens when a peer reaches the disconnect threshold
+func (s *Swap) DisconnectPolicy() (DisconnectPolicy, error) {
+	return s.getDisconnectPolicy(), nil
+}
+
+// SetDisconnectPolicy sets what happens when a peer reaches the disconnect threshold from now on
+// by default, and after a restart, the policy of Params.DisconnectPolicy applies
+func (s *Swap) SetDisconnectPolicy(policy DisconnectPolicy) error {
+	if !policy.valid() {
+		return fmt.Errorf("unknown disconnect policy %d", policy)
+	}
+	s.atThresholdLock.Lock()
+	defer s.atThresholdLock.Unlock()
+	s.atThreshold = policy
+	s.logger.Info(UpdateBalanceAction, "disconnect policy updated", "policy", policy)
+	return nil
+}
+
+// getDisconnectPolicy returns what happens when a peer reaches the disconnect threshold
+func (s *Swap) getDisconnectPolicy() DisconnectPolicy {
+	s.atThresholdLock.RLock()
+	defer s.atThresholdLock.RUnlock()
+	return s.atThreshold
+}
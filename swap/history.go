@@ -0,0 +1,294 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	contract "github.com/ethersphere/swarm/contracts/swap"
+	"github.com/ethersphere/swarm/state"
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// The received cheque history keeps every cheque received from a peer under its own serial, starting at 1.
+// Entries are never overwritten, the serial of the last one is kept as the index of the history.
+// The last received cheque is still saved under receivedChequeKey as well, so that it can be found without the index.
+
+// loadLastReceivedSerial loads the serial of the last cheque in the received cheque history of peer
+// and returns 0 if the history is empty
+func (s *Swap) loadLastReceivedSerial(peer enode.ID) (serial uint64, err error) {
+	err = s.store.Get(lastReceivedSerialKey(peer), &serial)
+	if err == state.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("loading last received cheque serial: %w", err)
+	}
+	return serial, nil
+}
+
+// batchAppendReceivedCheque adds cheque with the next serial to the received cheque history of peer
+// and saves it as the last received cheque, all in batch
+// the caller is expected to hold the lock of the peer, or to be the only one accessing its history
+func (s *Swap) batchAppendReceivedCheque(batch *state.StoreBatch, peer enode.ID, cheque *Cheque) error {
+	serial, err := s.loadLastReceivedSerial(peer)
+	if err != nil {
+		return err
+	}
+	serial++
+
+	if err := s.batchPut(batch, receivedChequeHistoryKey(peer, serial), cheque); err != nil {
+		return fmt.Errorf("encoding received cheque: %w", err)
+	}
+	if err := s.batchPut(batch, lastReceivedSerialKey(peer), serial); err != nil {
+		return fmt.Errorf("encoding received cheque serial: %w", err)
+	}
+	if err := s.batchPut(batch, receivedChequeKey(peer), cheque); err != nil {
+		return fmt.Errorf("encoding received cheque: %w", err)
+	}
+	return nil
+}
+
+// migrateReceivedChequeHistory starts the received cheque history of every peer which has a last received cheque but no history
+// with that cheque as serial 1, and returns the number of histories started
+func (s *Swap) migrateReceivedChequeHistory() (migrated int, err error) {
+	batch := new(state.StoreBatch)
+	err = s.store.Iterate(receivedChequePrefix, func(key []byte, value []byte) (stop bool, err error) {
+		peer := keyToID(string(key), receivedChequePrefix)
+		serial, err := s.loadLastReceivedSerial(peer)
+		if err != nil {
+			return true, err
+		}
+		if serial > 0 {
+			return false, nil
+		}
+		// the cheque is stored as is, it was encoded with the same codec
+		batch.Batch.Put([]byte(receivedChequeHistoryKey(peer, 1)), value)
+		if err := s.batchPut(batch, lastReceivedSerialKey(peer), uint64(1)); err != nil {
+			return true, fmt.Errorf("encoding received cheque serial: %w", err)
+		}
+		migrated++
+		return false, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if migrated == 0 {
+		return 0, nil
+	}
+	if err := s.store.WriteBatch(batch); err != nil {
+		return 0, fmt.Errorf("writing received cheque history: %w", err)
+	}
+	return migrated, nil
+}
+
+// ReceivedCheques returns all cheques received from peer in the order they were received, nil if there are none
+// only the last received cheque is kept unless Params.ReceivedChequeHistory is set, so then it is the only one returned
+func (s *Swap) ReceivedCheques(peer enode.ID) ([]*Cheque, error) {
+	if !s.params.ReceivedChequeHistory {
+		cheque, err := s.loadLastReceivedCheque(peer)
+		if err != nil || cheque == nil {
+			return nil, err
+		}
+		return []*Cheque{cheque}, nil
+	}
+
+	var cheques []*Cheque
+	err := s.store.Iterate(receivedChequeHistoryPrefix+peer.String()+"_", func(key []byte, value []byte) (stop bool, err error) {
+		var cheque *Cheque
+		if err := s.codec.Decode(value, &cheque); err != nil {
+			return true, fmt.Errorf("decoding received cheque %s: %w", key, err)
+		}
+		cheques = append(cheques, cheque)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cheques, nil
+}
+
+// ReceivedChequeSummary returns the summary of the cheques pruned from the received cheque history of peer
+// the summary is empty if none were pruned
+func (s *Swap) ReceivedChequeSummary(peer enode.ID) (*ChequeHistorySummary, error) {
+	summary := &ChequeHistorySummary{
+		CumulativePayout: int256.Uint256From(0),
+	}
+	err := s.store.Get(receivedChequeSummaryKey(peer), summary)
+	if err != nil && err != state.ErrNotFound {
+		return nil, fmt.Errorf("loading received cheque summary: %w", err)
+	}
+	return summary, nil
+}
+
+// PruneChequeHistory bounds the received cheque history of every peer to the last keep cheques and the cheques not cashed yet
+// cheques are pruned from the oldest up to the first one not cashed yet, and are added to the summary of the peer, see ReceivedChequeSummary
+// keep has to be at least 1, as the last received cheque and the serial index are needed to continue the history
+func (s *Swap) PruneChequeHistory(keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("cannot keep %d cheques, the last received cheque is always kept", keep)
+	}
+	s.chequeHistoryLock.Lock()
+	defer s.chequeHistoryLock.Unlock()
+
+	var peers []enode.ID
+	err := s.store.Iterate(lastReceivedSerialPrefix, func(key []byte, value []byte) (stop bool, err error) {
+		peers = append(peers, keyToID(string(key), lastReceivedSerialPrefix))
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("loading received cheque histories: %w", err)
+	}
+	for _, peer := range peers {
+		pruned, err := s.pruneReceivedChequeHistory(peer, uint64(keep))
+		if err != nil {
+			return fmt.Errorf("pruning received cheque history of peer %s: %w", peer, err)
+		}
+		if pruned > 0 {
+			s.logger.Debug(HandleChequeAction, "pruned received cheque history", peerCtx(peer, "pruned", pruned)...)
+		}
+	}
+	return nil
+}
+
+// pruneReceivedChequeHistory prunes the cashed cheques of the received cheque history of peer except the last keep ones
+// and returns the number of pruned cheques
+// the caller is expected to hold s.chequeHistoryLock
+func (s *Swap) pruneReceivedChequeHistory(peer enode.ID, keep uint64) (pruned int, err error) {
+	last, err := s.loadLastReceivedSerial(peer)
+	if err != nil {
+		return 0, err
+	}
+	summary, err := s.ReceivedChequeSummary(peer)
+	if err != nil {
+		return 0, err
+	}
+
+	batch := new(state.StoreBatch)
+	for serial := summary.LastSerial + 1; serial+keep <= last; serial++ {
+		var cheque *Cheque
+		if err := s.store.Get(receivedChequeHistoryKey(peer, serial), &cheque); err != nil {
+			return 0, fmt.Errorf("loading received cheque %d: %w", serial, err)
+		}
+		cashed, err := s.loadCashedPayout(cheque.Contract)
+		if err != nil {
+			return 0, fmt.Errorf("loading cashed payout: %w", err)
+		}
+		// cheques are cashed cumulatively, the cheques after one which is not cashed are not either
+		if cashed == nil || cheque.CumulativePayout.Cmp(cashed) > 0 {
+			break
+		}
+		batch.Batch.Delete([]byte(receivedChequeHistoryKey(peer, serial)))
+		summary.Cheques++
+		summary.Honey += cheque.Honey
+		summary.LastSerial = serial
+		summary.CumulativePayout = cheque.CumulativePayout
+		pruned++
+	}
+	if pruned == 0 {
+		return 0, nil
+	}
+	if err := s.batchPut(batch, receivedChequeSummaryKey(peer), summary); err != nil {
+		return 0, fmt.Errorf("encoding received cheque summary: %w", err)
+	}
+	return pruned, s.store.WriteBatch(batch)
+}
+
+// LastCashedSerial returns the serial of the last cheque received from peer up to which all of its cheques are cashed on chain,
+// 0 if none is. The chequebook only keeps the cumulative amount paid out to us, so a cheque counts as cashed
+// if its cumulative payout is not above the amount its chequebook paid out. Cheques pruned from the history are cashed.
+// Without Params.ReceivedChequeHistory only the last received cheque is known, which is serial 1 like after migrating to the history.
+func (s *Swap) LastCashedSerial(ctx context.Context, peer enode.ID) (uint64, error) {
+	if err := s.checkBackend(); err != nil {
+		return 0, fmt.Errorf("reading cashed cheques: %w", err)
+	}
+	first, cheques, err := s.unprunedReceivedCheques(peer)
+	if err != nil {
+		return 0, err
+	}
+
+	// the chain is read without holding chequeHistoryLock, so that a slow backend does not block the history of other peers
+	// the peer may have switched chequebooks, so the paid out amount is read for each of them
+	paidOut := make(map[common.Address]*int256.Uint256)
+	for i, cheque := range cheques {
+		payout, ok := paidOut[cheque.Contract]
+		if !ok {
+			if payout, err = s.paidOut(ctx, cheque.Contract); err != nil {
+				return 0, err
+			}
+			paidOut[cheque.Contract] = payout
+		}
+		if cheque.CumulativePayout.Cmp(payout) > 0 {
+			return first + uint64(i), nil
+		}
+	}
+	return first + uint64(len(cheques)), nil
+}
+
+// unprunedReceivedCheques returns the cheques received from peer which were not pruned from the history in the order of their serials,
+// and the serial of the last pruned cheque, 0 if none was pruned
+// without Params.ReceivedChequeHistory it is only the last received cheque
+func (s *Swap) unprunedReceivedCheques(peer enode.ID) (pruned uint64, cheques []*Cheque, err error) {
+	s.chequeHistoryLock.Lock()
+	defer s.chequeHistoryLock.Unlock()
+
+	if !s.params.ReceivedChequeHistory {
+		cheque, err := s.loadLastReceivedCheque(peer)
+		if err != nil || cheque == nil {
+			return 0, nil, err
+		}
+		return 0, []*Cheque{cheque}, nil
+	}
+
+	summary, err := s.ReceivedChequeSummary(peer)
+	if err != nil {
+		return 0, nil, err
+	}
+	last, err := s.loadLastReceivedSerial(peer)
+	if err != nil {
+		return 0, nil, err
+	}
+	for serial := summary.LastSerial + 1; serial <= last; serial++ {
+		var cheque *Cheque
+		if err := s.store.Get(receivedChequeHistoryKey(peer, serial), &cheque); err != nil {
+			return 0, nil, fmt.Errorf("loading received cheque %d: %w", serial, err)
+		}
+		cheques = append(cheques, cheque)
+	}
+	return summary.LastSerial, cheques, nil
+}
+
+// paidOut reads the cumulative amount the chequebook paid out to us from the blockchain
+func (s *Swap) paidOut(ctx context.Context, chequebook common.Address) (*int256.Uint256, error) {
+	instance, err := contract.InstanceAt(chequebook, s.backend)
+	if err != nil {
+		return nil, fmt.Errorf("instantiating chequebook at %v: %w", chequebook.Hex(), err)
+	}
+	po, err := instance.PaidOut(&bind.CallOpts{Context: ctx}, s.owner.address)
+	if err != nil {
+		return nil, fmt.Errorf("reading paid out amount: %w", err)
+	}
+	paidOut, err := int256.NewUint256(po)
+	if err != nil {
+		return nil, fmt.Errorf("converting paid out amount: %w", err)
+	}
+	return paidOut, nil
+}
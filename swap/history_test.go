@@ -0,0 +1,267 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethersphere/swarm/swap/chain"
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// TestReceivedChequeHistory tests that received cheques are appended to the history of the peer,
+// that the last one is loaded from it and that a last received cheque saved before is migrated
+func TestReceivedChequeHistory(t *testing.T) {
+	params := newDefaultParams(t)
+	params.ReceivedChequeHistory = true
+	swap, dir := newBaseTestSwapWithParams(t, ownerKey, params, newTestBackend(t))
+	defer os.RemoveAll(dir)
+	defer swap.Close()
+
+	peer := newDummyPeer().ID()
+	cheques := make([]*Cheque, 3)
+	for i := range cheques {
+		cheques[i] = newTestCheque()
+		cheques[i].CumulativePayout = int256.Uint256From(uint64(100 * (i + 1)))
+	}
+
+	// saved before the history was enabled
+	if err := swap.store.Put(receivedChequeKey(peer), cheques[0]); err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := swap.migrateReceivedChequeHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Fatalf("expected 1 migrated history, got %d", migrated)
+	}
+	// peers which have a history are not migrated again
+	if migrated, err = swap.migrateReceivedChequeHistory(); err != nil || migrated != 0 {
+		t.Fatalf("expected no migrated history, got %d (err: %v)", migrated, err)
+	}
+
+	for _, cheque := range cheques[1:] {
+		if err := swap.saveLastReceivedCheque(peer, cheque); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := swap.ReceivedCheques(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != len(cheques) {
+		t.Fatalf("expected %d received cheques, got %d", len(cheques), len(history))
+	}
+	for i, cheque := range cheques {
+		if !history[i].Equal(cheque) {
+			t.Fatalf("expected received cheque %d to be %v, got %v", i+1, cheque, history[i])
+		}
+	}
+
+	last, err := swap.loadLastReceivedCheque(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !last.Equal(cheques[2]) {
+		t.Fatalf("expected last received cheque %v, got %v", cheques[2], last)
+	}
+	if serial, err := swap.loadLastReceivedSerial(peer); err != nil || serial != 3 {
+		t.Fatalf("expected last received serial 3, got %d (err: %v)", serial, err)
+	}
+
+	// other peers have no history
+	if history, err := swap.ReceivedCheques(newDummyPeer().ID()); err != nil || len(history) != 0 {
+		t.Fatalf("expected no received cheques, got %v (err: %v)", history, err)
+	}
+}
+
+// TestReceivedChequesWithoutHistory tests that only the last received cheque is kept without the history
+func TestReceivedChequesWithoutHistory(t *testing.T) {
+	swap, dir := newBaseTestSwap(t, ownerKey, newTestBackend(t))
+	defer os.RemoveAll(dir)
+	defer swap.Close()
+
+	peer := newDummyPeer().ID()
+	first := newTestCheque()
+	second := newTestCheque()
+	second.CumulativePayout = int256.Uint256From(100)
+	for _, cheque := range []*Cheque{first, second} {
+		if err := swap.saveLastReceivedCheque(peer, cheque); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := swap.ReceivedCheques(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || !history[0].Equal(second) {
+		t.Fatalf("expected only the last received cheque %v, got %v", second, history)
+	}
+	if serial, err := swap.loadLastReceivedSerial(peer); err != nil || serial != 0 {
+		t.Fatalf("expected no received cheque history, got serial %d (err: %v)", serial, err)
+	}
+}
+
+// TestPruneChequeHistory tests that only cashed cheques are pruned from the received cheque history,
+// that the last ones are kept and that the pruned ones are added to the summary
+func TestPruneChequeHistory(t *testing.T) {
+	params := newDefaultParams(t)
+	params.ReceivedChequeHistory = true
+	swap, dir := newBaseTestSwapWithParams(t, ownerKey, params, newTestBackend(t))
+	defer os.RemoveAll(dir)
+	defer swap.Close()
+
+	peer := newDummyPeer().ID()
+	cheques := make([]*Cheque, 5)
+	for i := range cheques {
+		cheques[i] = newTestCheque()
+		cheques[i].CumulativePayout = int256.Uint256From(uint64(100 * (i + 1)))
+		cheques[i].Honey = uint64(10 * (i + 1))
+		if err := swap.saveLastReceivedCheque(peer, cheques[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setCashed := func(payout uint64) {
+		if err := swap.store.Put(cashedPayoutKey(cheques[0].Contract), int256.Uint256From(payout)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectHistory := func(expected []*Cheque) {
+		history, err := swap.ReceivedCheques(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != len(expected) {
+			t.Fatalf("expected %d received cheques, got %d", len(expected), len(history))
+		}
+		for i, cheque := range expected {
+			if !history[i].Equal(cheque) {
+				t.Fatalf("expected received cheque %v, got %v", cheque, history[i])
+			}
+		}
+	}
+
+	if err := swap.PruneChequeHistory(0); err == nil {
+		t.Fatal("expected pruning the last received cheque to fail")
+	}
+
+	// nothing is cashed yet
+	if err := swap.PruneChequeHistory(1); err != nil {
+		t.Fatal(err)
+	}
+	expectHistory(cheques)
+
+	// the cheques which are not cashed are kept
+	setCashed(300)
+	if err := swap.PruneChequeHistory(1); err != nil {
+		t.Fatal(err)
+	}
+	expectHistory(cheques[3:])
+	summary, err := swap.ReceivedChequeSummary(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Cheques != 3 || summary.Honey != 60 || summary.LastSerial != 3 || !summary.CumulativePayout.Equals(cheques[2].CumulativePayout) {
+		t.Fatalf("expected a summary of the first 3 cheques, got %+v", summary)
+	}
+
+	// the last keep cheques are kept even when cashed
+	setCashed(500)
+	if err := swap.PruneChequeHistory(2); err != nil {
+		t.Fatal(err)
+	}
+	expectHistory(cheques[3:])
+	if err := swap.PruneChequeHistory(1); err != nil {
+		t.Fatal(err)
+	}
+	expectHistory(cheques[4:])
+	if summary, err = swap.ReceivedChequeSummary(peer); err != nil || summary.Cheques != 4 || summary.Honey != 100 || summary.LastSerial != 4 {
+		t.Fatalf("expected a summary of the first 4 cheques, got %+v (err: %v)", summary, err)
+	}
+
+	// the history continues after the pruned cheques
+	last, err := swap.loadLastReceivedCheque(peer)
+	if err != nil || !last.Equal(cheques[4]) {
+		t.Fatalf("expected last received cheque %v, got %v (err: %v)", cheques[4], last, err)
+	}
+	next := newTestCheque()
+	next.CumulativePayout = int256.Uint256From(600)
+	if err := swap.saveLastReceivedCheque(peer, next); err != nil {
+		t.Fatal(err)
+	}
+	expectHistory([]*Cheque{cheques[4], next})
+	if serial, err := swap.loadLastReceivedSerial(peer); err != nil || serial != 6 {
+		t.Fatalf("expected last received serial 6, got %d (err: %v)", serial, err)
+	}
+}
+
+// TestLastCashedSerial tests that the last cashed serial of the received cheque history follows the amount paid out by the chequebook
+func TestLastCashedSerial(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+	params := newDefaultParams(t)
+	params.ReceivedChequeHistory = true
+	swap, dir := newBaseTestSwapWithParams(t, beneficiaryKey, params, backend)
+	defer os.RemoveAll(dir)
+	defer swap.Close()
+	ctx := context.Background()
+
+	chequebook, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, int256.Uint256From(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := newDummyPeer().ID()
+	cheques := make([]*Cheque, 3)
+	for i := range cheques {
+		if cheques[i], err = newSignedTestCheque(chequebook.ContractParams().ContractAddress, beneficiaryAddress, int256.Uint256From(uint64(100*(i+1))), ownerKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := swap.saveLastReceivedCheque(peer, cheques[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectSerial := func(peer enode.ID, expected uint64) {
+		t.Helper()
+		serial, err := swap.LastCashedSerial(ctx, peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial != expected {
+			t.Fatalf("expected last cashed serial %d, got %d", expected, serial)
+		}
+	}
+	expectSerial(peer, 0)
+	expectSerial(newDummyPeer().ID(), 0)
+
+	// cashing the second cheque cashes the first one as well
+	tx, err := chequebook.CashChequeBeneficiaryStart(bind.NewKeyedTransactor(beneficiaryKey), beneficiaryAddress, cheques[1].CumulativePayout, cheques[1].Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.WaitMined(ctx, backend, tx.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	expectSerial(peer, 2)
+}
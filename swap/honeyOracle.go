@@ -16,11 +16,48 @@
 
 package swap
 
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
 // HoneyOracle is the interface through which Oracles will deliver prices
 type HoneyOracle interface {
 	GetPrice(honey uint64) (uint64, error)
 }
 
+// OraclePriceInfo describes the price per honey an oracle returns and where it comes from
+type OraclePriceInfo struct {
+	Price   uint64            // price of one honey in Wei
+	Source  string            // the source which produced the price
+	AsOf    time.Time         // when the price was produced, zero if the source has no notion of time and the price is current
+	Sources []OraclePriceInfo // prices of the oracles the price is derived from, if the oracle wraps or combines others
+}
+
+// PriceDescriber is an optional interface of a HoneyOracle which describes its current price
+// it must not change the state of the oracle, e.g. it does not tick a SmoothedOracle
+type PriceDescriber interface {
+	DescribePrice() (OraclePriceInfo, error)
+}
+
+// describeOracle describes the current price per honey of oracle
+// oracles which do not implement PriceDescriber are asked for the price of one honey and named by their type
+func describeOracle(oracle HoneyOracle) (OraclePriceInfo, error) {
+	if d, ok := oracle.(PriceDescriber); ok {
+		return d.DescribePrice()
+	}
+	price, err := oracle.GetPrice(1)
+	if err != nil {
+		return OraclePriceInfo{}, err
+	}
+	return OraclePriceInfo{
+		Price:  price,
+		Source: fmt.Sprintf("%T", oracle),
+	}, nil
+}
+
 // NewHoneyPriceOracle returns the actual oracle to be used for discovering the price
 // It will return a default one
 func NewHoneyPriceOracle() HoneyOracle {
@@ -39,3 +76,96 @@ type fixedPriceOracle struct {
 func (cpo *fixedPriceOracle) GetPrice(honey uint64) (uint64, error) {
 	return honey * cpo.honeyPrice, nil
 }
+
+// DescribePrice is from the PriceDescriber interface
+func (cpo *fixedPriceOracle) DescribePrice() (OraclePriceInfo, error) {
+	return OraclePriceInfo{
+		Price:  cpo.honeyPrice,
+		Source: "fixed",
+	}, nil
+}
+
+// SmoothedOracle wraps a HoneyOracle and smooths its price with an exponential moving average
+// every call to GetPrice is a tick which updates the average with the price per honey of the wrapped oracle
+// as the price depends on the history of calls, both sides of a cheque exchange must see the same prices
+// for cheques to be accepted, so it should only be used with oracles that change slowly
+type SmoothedOracle struct {
+	oracle    HoneyOracle // the wrapped oracle
+	alpha     float64     // weight of the latest price in the average, in (0, 1]
+	maxChange float64     // maximum relative change of the price per tick, 0 disables the clamp
+	lock      sync.Mutex  // protects the average, GetPrice is called concurrently for different peers
+	average   float64     // current average price per honey
+	started   bool        // whether the average was initialised
+	updated   time.Time   // time of the last tick
+}
+
+// NewSmoothedOracle creates a SmoothedOracle around oracle
+// alpha is the weight of the latest price in the average and must be in (0, 1]
+// maxChange limits how much the price the average is updated with may differ from it, relative to the average
+// e.g. 0.1 allows a change of 10% per tick, 0 disables the limit
+func NewSmoothedOracle(oracle HoneyOracle, alpha float64, maxChange float64) (*SmoothedOracle, error) {
+	if alpha <= 0 || alpha > 1 {
+		return nil, fmt.Errorf("alpha must be in (0, 1], was %v", alpha)
+	}
+	if maxChange < 0 {
+		return nil, fmt.Errorf("max change must not be negative, was %v", maxChange)
+	}
+	return &SmoothedOracle{
+		oracle:    oracle,
+		alpha:     alpha,
+		maxChange: maxChange,
+	}, nil
+}
+
+// GetPrice returns the price for honey based on the smoothed price per honey
+func (so *SmoothedOracle) GetPrice(honey uint64) (uint64, error) {
+	price, err := so.oracle.GetPrice(honey)
+	if err != nil {
+		return 0, err
+	}
+	// no price per honey can be derived from a zero amount
+	if honey == 0 {
+		return price, nil
+	}
+	spot := float64(price) / float64(honey)
+
+	so.lock.Lock()
+	defer so.lock.Unlock()
+
+	if !so.started {
+		so.average = spot
+		so.started = true
+	} else {
+		if so.maxChange > 0 {
+			spot = math.Max(spot, so.average*(1-so.maxChange))
+			spot = math.Min(spot, so.average*(1+so.maxChange))
+		}
+		so.average = so.alpha*spot + (1-so.alpha)*so.average
+	}
+	so.updated = time.Now()
+
+	return uint64(math.Round(so.average * float64(honey))), nil
+}
+
+// DescribePrice is from the PriceDescriber interface
+// the price is the current average, or the one of the wrapped oracle before the first tick, which is listed as the source
+func (so *SmoothedOracle) DescribePrice() (OraclePriceInfo, error) {
+	source, err := describeOracle(so.oracle)
+	if err != nil {
+		return OraclePriceInfo{}, err
+	}
+	info := OraclePriceInfo{
+		Price:   source.Price,
+		Source:  "smoothed",
+		AsOf:    source.AsOf,
+		Sources: []OraclePriceInfo{source},
+	}
+
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	if so.started {
+		info.Price = uint64(math.Round(so.average))
+		info.AsOf = so.updated
+	}
+	return info, nil
+}
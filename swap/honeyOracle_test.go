@@ -0,0 +1,209 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOracle is a HoneyOracle with a settable price per honey
+type testOracle struct {
+	lock  sync.Mutex
+	price uint64
+	err   error
+}
+
+func (o *testOracle) GetPrice(honey uint64) (uint64, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return honey * o.price, o.err
+}
+
+func (o *testOracle) setPrice(price uint64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.price = price
+}
+
+// TestSmoothedOracle tests that the smoothed oracle averages and clamps the price of the wrapped oracle
+func TestSmoothedOracle(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		alpha     float64
+		maxChange float64
+		prices    []uint64 // prices per honey of the wrapped oracle on every tick
+		expected  []uint64 // expected prices for 10 honey on every tick
+	}{
+		{
+			name:     "no smoothing",
+			alpha:    1,
+			prices:   []uint64{1000, 2000, 500},
+			expected: []uint64{10000, 20000, 5000},
+		},
+		{
+			name:     "average",
+			alpha:    0.5,
+			prices:   []uint64{1000, 2000, 2000},
+			expected: []uint64{10000, 15000, 17500},
+		},
+		{
+			name:      "clamped increase",
+			alpha:     0.5,
+			maxChange: 0.1,
+			prices:    []uint64{1000, 2000},
+			expected:  []uint64{10000, 10500},
+		},
+		{
+			name:      "clamped decrease",
+			alpha:     1,
+			maxChange: 0.1,
+			prices:    []uint64{1000, 0},
+			expected:  []uint64{10000, 9000},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			oracle := &testOracle{}
+			smoothed, err := NewSmoothedOracle(oracle, tc.alpha, tc.maxChange)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, price := range tc.prices {
+				oracle.setPrice(price)
+				result, err := smoothed.GetPrice(10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result != tc.expected[i] {
+					t.Fatalf("tick %d: expected price %d, got %d", i, tc.expected[i], result)
+				}
+			}
+		})
+	}
+}
+
+// TestSmoothedOracleErrors tests that invalid parameters and errors of the wrapped oracle are reported
+func TestSmoothedOracleErrors(t *testing.T) {
+	for _, alpha := range []float64{0, -0.5, 1.5} {
+		if _, err := NewSmoothedOracle(&testOracle{}, alpha, 0); err == nil {
+			t.Fatalf("expected alpha %v to be rejected", alpha)
+		}
+	}
+	if _, err := NewSmoothedOracle(&testOracle{}, 0.5, -1); err == nil {
+		t.Fatal("expected negative max change to be rejected")
+	}
+
+	oracleErr := errors.New("oracle error")
+	smoothed, err := NewSmoothedOracle(&testOracle{err: oracleErr}, 0.5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := smoothed.GetPrice(10); err != oracleErr {
+		t.Fatalf("expected error %v, got %v", oracleErr, err)
+	}
+}
+
+// TestSmoothedOracleConcurrent calls the smoothed oracle concurrently, run with -race
+func TestSmoothedOracleConcurrent(t *testing.T) {
+	oracle := &testOracle{price: 1000}
+	smoothed, err := NewSmoothedOracle(oracle, 0.5, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				oracle.setPrice(uint64(1000 + i*j))
+				if _, err := smoothed.GetPrice(10); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestOracleInfo tests that the price of the oracle is described with its source without updating the oracle
+func TestOracleInfo(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	now := time.Unix(1600000000, 0)
+	swap.clock = newTestClock(now)
+
+	expectInfo := func(price uint64, source string, asOf time.Time) *OraclePriceInfo {
+		t.Helper()
+		info, err := swap.OracleInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Price != price || info.Source != source || !info.AsOf.Equal(asOf) {
+			t.Fatalf("expected price %d from %s as of %v, got %d from %s as of %v", price, source, asOf, info.Price, info.Source, info.AsOf)
+		}
+		if p, s, a, err := swap.OraclePrice(); err != nil || p != info.Price || s != info.Source || !a.Equal(info.AsOf) {
+			t.Fatalf("expected oracle price to match %+v, got %d, %s, %v (err: %v)", info, p, s, a, err)
+		}
+		return info
+	}
+
+	// the default oracle has a fixed price which is current
+	expectInfo(defaultHoneyPrice, "fixed", now)
+
+	// oracles which do not describe their price are named by their type
+	oracle := &testOracle{price: 1000}
+	swap.honeyPriceOracle = oracle
+	expectInfo(1000, "*swap.testOracle", now)
+
+	smoothed, err := NewSmoothedOracle(oracle, 0.5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap.honeyPriceOracle = smoothed
+	// before the first tick the price is the one of the wrapped oracle
+	info := expectInfo(1000, "smoothed", now)
+	if len(info.Sources) != 1 || info.Sources[0].Price != 1000 {
+		t.Fatalf("expected the wrapped oracle as the source, got %+v", info.Sources)
+	}
+
+	for _, price := range []uint64{1000, 2000} {
+		oracle.setPrice(price)
+		if _, err := smoothed.GetPrice(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// describing the price does not tick the average, the wrapped oracle shows its own price
+	oracle.setPrice(3000)
+	for i := 0; i < 2; i++ {
+		info, err = swap.OracleInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Price != 1500 || info.AsOf.IsZero() || info.Sources[0].Price != 3000 {
+			t.Fatalf("expected the average price 1500 of a source priced at 3000, got %+v", info)
+		}
+	}
+
+	oracle.err = errors.New("oracle error")
+	if _, err := swap.OracleInfo(); !errors.Is(err, oracle.err) {
+		t.Fatalf("expected the oracle error, got %v", err)
+	}
+}
@@ -19,6 +19,7 @@ package swap
 import (
 	log "github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	swarmlog "github.com/ethersphere/swarm/log"
 	"github.com/ethersphere/swarm/network"
 )
 
@@ -143,6 +144,11 @@ func newSwapLogger(logPath string, swapLogLevel int, baseAddress *network.BzzAdd
 
 // newPeerLogger returns a new logger for swap logs with peer info
 func newPeerLogger(s *Swap, peerID enode.ID) Logger {
-	ctx := []interface{}{"base", s.params.BaseAddrs.ShortString(), "peer", peerID.String()[:16]}
+	ctx := append([]interface{}{"base", s.params.BaseAddrs.ShortString()}, swarmlog.PeerCtx(peerID.String())...)
 	return newLogger(s.params.LogPath, s.params.LogLevel, ctx)
 }
+
+// peerCtx returns the log context identifying peer, followed by ctx
+func peerCtx(peer enode.ID, ctx ...interface{}) []interface{} {
+	return append(swarmlog.PeerCtx(peer.String()), ctx...)
+}
@@ -20,30 +20,50 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strconv"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/metrics"
+	swarmlog "github.com/ethersphere/swarm/log"
 	"github.com/ethersphere/swarm/p2p/protocols"
+	"github.com/ethersphere/swarm/state"
 	"github.com/ethersphere/swarm/swap/int256"
 )
 
 // ErrDontOwe indictates that no balance is actially owned
 var ErrDontOwe = errors.New("no negative balance")
 
+// ErrZeroBeneficiary indicates that a beneficiary was the zero address, cheques to it could never be cashed
+var ErrZeroBeneficiary = errors.New("beneficiary is the zero address")
+
+// ErrZeroPrice indicates that the oracle priced the honey of a cheque at zero, so the cheque would settle the debt without paying anything
+var ErrZeroPrice = errors.New("zero price for honey")
+
 // Peer is a devp2p peer for the Swap protocol
 type Peer struct {
 	*protocols.Peer
-	lock               sync.RWMutex
-	swap               *Swap
-	beneficiary        common.Address // address of the peers chequebook owner
-	contractAddress    common.Address // address of the peers chequebook
-	lastReceivedCheque *Cheque        // last cheque we received from the peer
-	lastSentCheque     *Cheque        // last cheque that was sent to peer that was confirmed
-	pendingCheque      *Cheque        // last cheque that was sent to peer but is not yet confirmed
-	balance            int64          // current balance of the peer
-	logger             Logger         // logger for swap related messages and audit trail with peer identifier
+	lock                 sync.RWMutex
+	swap                 *Swap
+	beneficiary          common.Address  // address of the peers chequebook owner
+	beneficiarySetAt     time.Time       // time the beneficiary was set
+	contractAddress      common.Address  // address of the peers chequebook
+	chequebook           common.Address  // our chequebook cheques to the peer are drawn on until it confirmed our switch, zero for the current one
+	announcedChequebook  common.Address  // our chequebook announced to the peer but not confirmed yet, no cheques are sent meanwhile
+	lastReceivedCheque   *Cheque         // last cheque we received from the peer
+	lastSentCheque       *Cheque         // last cheque that was sent to peer that was confirmed
+	pendingCheque        *Cheque         // last cheque that was sent to peer but is not yet confirmed
+	balance              int64           // current balance of the peer
+	savedBalance         int64           // balance of the peer as last saved to the store
+	blacklisted          bool            // whether accounting with the peer is refused
+	thresholdWeight      float64         // multiplier applied to the payment and disconnect thresholds with the peer
+	cumulativePayoutSeed *int256.Uint256 // cumulative payout the next cheque builds upon if above the last sent cheque
+	cashing              bool            // whether a cheque of the peer is being cashed, which freezes the balance
+	frozenAmount         int64           // amount accounted while the balance was frozen, merged into the balance after cashing
+	subHoney             int64           // amounts below Params.MinChargeableHoney which do not add up to it yet, not in the balance
+	contractCheck        *contractCheck  // last result of verifying the chequebook, see Params.RequireVerifiedPeerContract
+	logger               Logger          // logger for swap related messages and audit trail with peer identifier
 }
 
 // NewPeer creates a new swap Peer instance
@@ -51,30 +71,76 @@ func NewPeer(p *protocols.Peer, s *Swap, beneficiary common.Address, contractAdd
 	peer = &Peer{
 		Peer:            p,
 		swap:            s,
-		beneficiary:     beneficiary,
 		contractAddress: contractAddress,
 		logger:          newPeerLogger(s, p.ID()),
 	}
 
+	// peers without a known chequebook owner are allowed, but we cannot send cheques to them
+	if beneficiary != (common.Address{}) {
+		if err = peer.SetBeneficiary(beneficiary); err != nil {
+			return nil, err
+		}
+	}
+
 	if peer.lastReceivedCheque, err = s.loadLastReceivedCheque(p.ID()); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("loading last received cheque: %w", err)
+	}
+	// cheques build on the last cheque drawn on the same chequebook, which is not the last one received if the peer switched chequebooks
+	if peer.lastReceivedCheque != nil && contractAddress != (common.Address{}) && peer.lastReceivedCheque.Contract != contractAddress {
+		if peer.lastReceivedCheque, err = s.loadLastChequebookCheque(p.ID(), contractAddress); err != nil {
+			return nil, fmt.Errorf("loading last received cheque of chequebook: %w", err)
+		}
 	}
 
 	if peer.lastSentCheque, err = s.loadLastSentCheque(p.ID()); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("loading last sent cheque: %w", err)
 	}
 
 	if peer.balance, err = s.loadBalance(p.ID()); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("loading balance: %w", err)
 	}
+	peer.savedBalance = peer.balance
 
 	if peer.pendingCheque, err = s.loadPendingCheque(p.ID()); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("loading pending cheque: %w", err)
+	}
+
+	if peer.blacklisted, err = s.loadBlacklisted(p.ID()); err != nil {
+		return nil, fmt.Errorf("loading blacklist entry: %w", err)
+	}
+
+	if peer.thresholdWeight, err = s.loadThresholdWeight(p.ID()); err != nil {
+		return nil, fmt.Errorf("loading threshold weight: %w", err)
+	}
+
+	if peer.cumulativePayoutSeed, err = s.loadCumulativePayoutSeed(p.ID()); err != nil {
+		return nil, fmt.Errorf("loading cumulative payout seed: %w", err)
 	}
 
 	return peer, nil
 }
 
+// SetBeneficiary sets the address cheques for this peer are made out to
+// it rejects the zero address and records the time the beneficiary was set
+func (p *Peer) SetBeneficiary(beneficiary common.Address) error {
+	if beneficiary == (common.Address{}) {
+		return ErrZeroBeneficiary
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.beneficiary = beneficiary
+	p.beneficiarySetAt = p.swap.clock.Now()
+	return nil
+}
+
+// Beneficiary returns the address cheques for this peer are made out to
+// it is the zero address if the beneficiary was never set
+func (p *Peer) Beneficiary() common.Address {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.beneficiary
+}
+
 // getLastReceivedCheque returns the last cheque we received for this peer
 // the caller is expected to hold p.lock
 func (p *Peer) getLastReceivedCheque() *Cheque {
@@ -100,6 +166,38 @@ func (p *Peer) setLastReceivedCheque(cheque *Cheque) error {
 	return p.swap.saveLastReceivedCheque(p.ID(), cheque)
 }
 
+// setLastReceivedChequeWithBalance sets cheque as the last one received from this peer and accounts amount, the honey it settled
+// both are saved in one batch, so that the store never holds a received cheque without the balance it settled or the other way round
+// while a cheque of the peer is being cashed, the amount is merged into the frozen balance once cashing completes like any other amount
+// the caller is expected to hold p.lock
+func (p *Peer) setLastReceivedChequeWithBalance(cheque *Cheque, amount int64) error {
+	batch := new(state.StoreBatch)
+	if err := p.swap.batchLastReceivedCheque(batch, p.ID(), cheque); err != nil {
+		return err
+	}
+	if p.cashing {
+		if err := p.swap.store.WriteBatch(batch); err != nil {
+			return err
+		}
+		p.lastReceivedCheque = cheque
+		return p.addFrozenAmount(amount)
+	}
+
+	balance := p.getBalance() + amount
+	if (amount > 0 && balance < p.getBalance()) || (amount < 0 && balance > p.getBalance()) {
+		return fmt.Errorf("balance %d overflows when updated by %d", p.getBalance(), amount)
+	}
+	if err := p.swap.batchPut(batch, balanceKey(p.ID()), balance); err != nil {
+		return fmt.Errorf("encoding balance: %w", err)
+	}
+	if err := p.swap.store.WriteBatch(batch); err != nil {
+		return err
+	}
+	p.lastReceivedCheque = cheque
+	p.savedBalance = balance
+	return p.updateBalance(amount)
+}
+
 // setLastReceivedCheque sets the given cheque as the last sent cheque for this peer
 // the caller is expected to hold p.lock
 func (p *Peer) setLastSentCheque(cheque *Cheque) error {
@@ -114,20 +212,94 @@ func (p *Peer) setPendingCheque(cheque *Cheque) error {
 	return p.swap.savePendingCheque(p.ID(), cheque)
 }
 
+// setPendingChequeWithBalance sets cheque as the pending cheque and accounts its honey amount
+// both are saved in one batch, so that the store never holds a pending cheque without the balance it settled or the other way round
+// the record of how the honey of the cheque was converted into its payout is saved with them
+// the caller is expected to hold p.lock
+func (p *Peer) setPendingChequeWithBalance(cheque *Cheque, amount int64, conversion *ChequeConversion) error {
+	// the cheque settles a debt, so the balance is negative and adding the amount cannot overflow
+	balance := p.getBalance() + amount
+	batch := new(state.StoreBatch)
+	if err := p.swap.batchPut(batch, pendingChequeKey(p.ID()), cheque); err != nil {
+		return fmt.Errorf("encoding pending cheque: %w", err)
+	}
+	if err := p.swap.batchPut(batch, balanceKey(p.ID()), balance); err != nil {
+		return fmt.Errorf("encoding balance: %w", err)
+	}
+	if err := p.swap.batchPut(batch, chequeConversionKey(p.ID(), cheque.CumulativePayout), conversion); err != nil {
+		return fmt.Errorf("encoding cheque conversion: %w", err)
+	}
+	if err := p.swap.store.WriteBatch(batch); err != nil {
+		return err
+	}
+	p.pendingCheque = cheque
+	p.savedBalance = balance
+	return p.updateBalance(amount)
+}
+
+// resendPendingCheque resends the pending cheque as it is, if there is one
+// a cheque is saved as pending before it is sent, so it may not have reached the peer before a restart or a disconnect
+func (p *Peer) resendPendingCheque() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pending := p.getPendingCheque()
+	if pending == nil {
+		return nil
+	}
+	p.logger.Info(SendChequeAction, "resending pending cheque after connecting", "pending cheque", pending)
+	return p.sendWithTimeout(p.newEmitChequeMsg(pending))
+}
+
 // getLastSentCumulativePayout returns the cumulative payout of the last sent cheque or 0 if there is none
+// if a cumulative payout seed above it was set, the seed is returned instead
 // the caller is expected to hold p.lock
 func (p *Peer) getLastSentCumulativePayout() *int256.Uint256 {
-	lastCheque := p.getLastSentCheque()
-	if lastCheque != nil {
-		return lastCheque.CumulativePayout
+	payout := int256.Uint256From(0)
+	if lastCheque := p.getLastSentCheque(); lastCheque != nil {
+		payout = lastCheque.CumulativePayout
+	}
+	if p.cumulativePayoutSeed != nil && p.cumulativePayoutSeed.Cmp(payout) > 0 {
+		return p.cumulativePayoutSeed
+	}
+	return payout
+}
+
+// getChequebook returns our chequebook cheques to the peer are drawn on
+// the caller is expected to hold p.lock
+func (p *Peer) getChequebook() common.Address {
+	if p.chequebook != (common.Address{}) {
+		return p.chequebook
 	}
-	return int256.Uint256From(0)
+	return p.swap.GetParams().ContractAddress
 }
 
 // the caller is expected to hold p.lock
 func (p *Peer) setBalance(balance int64) error {
 	p.balance = balance
-	return p.swap.saveBalance(p.ID(), balance)
+	if err := p.swap.saveBalance(p.ID(), balance); err != nil {
+		return err
+	}
+	p.savedBalance = balance
+	return nil
+}
+
+// flushBalance saves the current balance if it changed since it was last saved
+// the caller is expected to hold p.lock
+func (p *Peer) flushBalance() error {
+	if p.balance == p.savedBalance {
+		return nil
+	}
+	return p.setBalance(p.balance)
+}
+
+// unsavedBalanceChange returns the absolute difference between the current and the last saved balance
+// the caller is expected to hold p.lock
+func (p *Peer) unsavedBalanceChange() uint64 {
+	// the unsigned subtraction cannot overflow, as the true difference always fits into an uint64
+	if p.balance >= p.savedBalance {
+		return uint64(p.balance) - uint64(p.savedBalance)
+	}
+	return uint64(p.savedBalance) - uint64(p.balance)
 }
 
 // getBalance returns the current balance for this peer
@@ -136,15 +308,91 @@ func (p *Peer) getBalance() int64 {
 	return p.balance
 }
 
+// getAccountedBalance returns the balance including the amount accounted while it is frozen
+// it is the balance the peer will have once the cheque being cashed is cashed
+// the caller is expected to hold p.lock
+func (p *Peer) getAccountedBalance() int64 {
+	return p.balance + p.frozenAmount
+}
+
+// freezeBalance freezes the balance while a cheque of the peer is being cashed
+// amounts accounted meanwhile are collected by addFrozenAmount and merged into the balance by unfreezeBalance
+// the caller is expected to hold p.lock
+func (p *Peer) freezeBalance() {
+	p.cashing = true
+}
+
+// addFrozenAmount collects amount to be merged into the frozen balance once cashing completes
+// the caller is expected to hold p.lock
+func (p *Peer) addFrozenAmount(amount int64) error {
+	frozenAmount := p.frozenAmount + amount
+	if (amount > 0 && frozenAmount < p.frozenAmount) || (amount < 0 && frozenAmount > p.frozenAmount) {
+		return fmt.Errorf("frozen amount %d overflows when updated by %d", p.frozenAmount, amount)
+	}
+	p.frozenAmount = frozenAmount
+	return nil
+}
+
+// unfreezeBalance merges the amount accounted while the balance was frozen into it
+// the caller is expected to hold p.lock
+func (p *Peer) unfreezeBalance() error {
+	p.cashing = false
+	amount := p.frozenAmount
+	p.frozenAmount = 0
+	return p.updateBalance(amount)
+}
+
+// chargeableAmount returns the amount to account now and whether there is one
+// an amount below Params.MinChargeableHoney is accumulated instead, until the accumulated amounts add up to the minimum
+// and are returned all at once. debits and credits offset each other
+// the caller is expected to hold p.lock
+func (p *Peer) chargeableAmount(amount int64) (int64, bool) {
+	min := p.swap.params.MinChargeableHoney
+	if min == 0 || amount >= min || amount <= -min {
+		return amount, true
+	}
+	// both are below the minimum, so the sum cannot overflow
+	p.subHoney += amount
+	if p.subHoney < min && p.subHoney > -min {
+		return 0, false
+	}
+	amount = p.subHoney
+	p.subHoney = 0
+	return amount, true
+}
+
+// getPaymentThreshold returns the payment threshold with this peer, weighted by its threshold weight
+// the caller is expected to hold p.lock
+func (p *Peer) getPaymentThreshold() int64 {
+	return weightThreshold(p.swap.params.PaymentThreshold, p.thresholdWeight)
+}
+
+// getDisconnectThreshold returns the disconnect threshold with this peer, weighted by its threshold weight
+// the caller is expected to hold p.lock
+func (p *Peer) getDisconnectThreshold() int64 {
+	return weightThreshold(p.swap.params.DisconnectThreshold, p.thresholdWeight)
+}
+
 // the caller is expected to hold p.lock
 func (p *Peer) updateBalance(amount int64) error {
 	//adjust the balance
 	//if amount is negative, it will decrease, otherwise increase
 	newBalance := p.getBalance() + amount
-	if err := p.setBalance(newBalance); err != nil {
-		return err
+	// a wrapped around balance would silently turn a debt into a credit or vice versa
+	if (amount > 0 && newBalance < p.getBalance()) || (amount < 0 && newBalance > p.getBalance()) {
+		return fmt.Errorf("balance %d overflows when updated by %d", p.getBalance(), amount)
+	}
+	p.balance = newBalance
+	// small changes are only saved once they add up to the persist threshold, see Params.BalancePersistThreshold
+	if p.unsavedBalanceChange() >= uint64(p.swap.params.BalancePersistThreshold) {
+		if err := p.flushBalance(); err != nil {
+			return fmt.Errorf("saving balance: %w", err)
+		}
+	}
+	if swarmlog.PeerMetricsEnabled() {
+		metrics.GetOrRegisterGauge(swarmlog.PeerMetricName("swap/peer", p.ID().String(), "balance"), nil).Update(newBalance)
 	}
-	p.logger.Debug(UpdateBalanceAction, "balance", strconv.FormatInt(newBalance, 10))
+	p.logger.Debug(UpdateBalanceAction, "balance", FormatHoney(newBalance))
 	return nil
 }
 
@@ -156,68 +404,136 @@ func (p *Peer) createCheque() (*Cheque, error) {
 	var cheque *Cheque
 	var err error
 
-	if p.getBalance() >= 0 {
-		return nil, fmt.Errorf("expected negative balance, found: %d", p.getBalance())
+	balance := p.getBalance()
+	if balance >= 0 {
+		return nil, fmt.Errorf("expected negative balance, found: %d", balance)
+	}
+	// negating math.MinInt64 overflows, and a cheque for it could not be added back to the balance either
+	if balance == math.MinInt64 {
+		return nil, fmt.Errorf("%w: balance %d", ErrHoneyOverflow, balance)
+	}
+
+	if p.beneficiary == (common.Address{}) {
+		return nil, ErrZeroBeneficiary
+	}
+	if err := p.swap.getChequebookErr(); err != nil {
+		return nil, err
 	}
 	// the balance should be negative here, we take the absolute value:
-	honey := uint64(-p.getBalance())
+	debt := uint64(-balance)
+	// the rest of the debt which is not rounded into the cheque stays in the balance
+	honey := p.swap.params.ChequeRounding.round(debt, p.swap.params.ChequeIncrement)
+	if honey == 0 {
+		return nil, fmt.Errorf("%w: debt %d", ErrBelowChequeIncrement, debt)
+	}
 
 	oraclePrice, err := p.swap.honeyPriceOracle.GetPrice(honey)
 	if err != nil {
-		return nil, fmt.Errorf("error getting price from oracle: %v", err)
+		return nil, fmt.Errorf("getting price from oracle: %w", err)
+	}
+	if oraclePrice == 0 {
+		return nil, fmt.Errorf("%w: %d honey", ErrZeroPrice, honey)
 	}
 	price := int256.Uint256From(oraclePrice)
 
 	cumulativePayout := p.getLastSentCumulativePayout()
 	newCumulativePayout, err := new(int256.Uint256).Add(cumulativePayout, price)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("computing cumulative payout: %w", err)
 	}
 
 	cheque = &Cheque{
 		ChequeParams: ChequeParams{
 			CumulativePayout: newCumulativePayout,
-			Contract:         p.swap.GetParams().ContractAddress,
+			Contract:         p.getChequebook(),
 			Beneficiary:      p.beneficiary,
 		},
 		Honey: honey,
 	}
-	cheque.Signature, err = cheque.Sign(p.swap.owner.privateKey)
+	cheque.Signature, err = cheque.signWith(p.swap.owner.signer)
+	if err != nil {
+		return nil, fmt.Errorf("signing cheque: %w", err)
+	}
+	if domain := p.swap.params.ChequeDomain; domain != "" {
+		if cheque.DomainSignature, err = cheque.signDomainWith(p.swap.owner.signer, domain); err != nil {
+			return nil, fmt.Errorf("signing cheque for domain %s: %w", domain, err)
+		}
+	}
 
-	return cheque, err
+	return cheque, nil
 }
 
 // sendCheque creates and sends a cheque to peer
 // if there is already a pending cheque it will resend that one
 // otherwise it will create a new cheque and save it as the pending cheque
+// it returns the cheque which was sent
 // the caller is expected to hold p.lock
-func (p *Peer) sendCheque() error {
-	if p.getPendingCheque() != nil {
-		p.logger.Info(SendChequeAction, "previous cheque still pending, resending cheque", "pending cheque", p.getPendingCheque())
-		return p.Send(context.Background(), &EmitChequeMsg{
-			Cheque: p.getPendingCheque(),
-		})
+func (p *Peer) sendCheque() (*Cheque, error) {
+	if pending := p.getPendingCheque(); pending != nil {
+		p.logger.Info(SendChequeAction, "previous cheque still pending, resending cheque", "pending cheque", pending)
+		if err := p.sendWithTimeout(p.newEmitChequeMsg(pending)); err != nil {
+			return nil, fmt.Errorf("resending pending cheque to peer: %w", err)
+		}
+		return pending, nil
+	}
+	if p.announcedChequebook != (common.Address{}) {
+		return nil, ErrChequebookUpdatePending
 	}
 	cheque, err := p.createCheque()
 	if err != nil {
-		return fmt.Errorf("error while creating cheque: %v", err)
+		return nil, fmt.Errorf("creating cheque: %w", err)
 	}
 
-	err = p.setPendingCheque(cheque)
+	honeyAmount, err := cheque.honeyAmount()
 	if err != nil {
-		return fmt.Errorf("error while saving pending cheque: %v", err)
+		return nil, err
 	}
-
-	honeyAmount := int64(cheque.Honey)
-	err = p.updateBalance(honeyAmount)
+	conversion, err := p.chequeConversion(cheque)
 	if err != nil {
-		return fmt.Errorf("error while updating balance: %v", err)
+		return nil, fmt.Errorf("recording conversion of cheque: %w", err)
+	}
+	// the cheque is saved before it is sent, so that after a crash it is resent as it is
+	// instead of creating another cheque with the same cumulative payout for a different amount
+	if err = p.setPendingChequeWithBalance(cheque, honeyAmount, conversion); err != nil {
+		return nil, fmt.Errorf("saving pending cheque: %w", err)
+	}
+	// the cheque covers the debt rounded to the cheque increment, so the balance has to be settled up to the increment now
+	if residual := p.getBalance(); residual != 0 && (residual <= -int64(p.swap.params.ChequeIncrement) || residual >= int64(p.swap.params.ChequeIncrement)) {
+		p.logger.Error(SendChequeAction, "balance not settled after sending cheque", "balance", FormatHoney(p.getBalance()), "honey", cheque.Honey)
 	}
 
 	metrics.GetOrRegisterCounter("swap/cheques/emitted/num", nil).Inc(1)
 	metrics.GetOrRegisterCounter("swap/cheques/emitted/honey", nil).Inc(honeyAmount)
 	p.logger.Info(SendChequeAction, "sending cheque to peer", "cheque", cheque)
-	return p.Send(context.Background(), &EmitChequeMsg{
-		Cheque: cheque,
-	})
+	if err := p.sendWithTimeout(p.newEmitChequeMsg(cheque)); err != nil {
+		return nil, fmt.Errorf("sending cheque to peer: %w", err)
+	}
+	return cheque, nil
+}
+
+// sendWithTimeout sends msg to the peer and gives up after the send timeout of Params
+// sendCheque is called while holding p.lock, so a peer which stops reading must not block the accounting with it forever
+// the write to the peer itself cannot be interrupted, it only ends when the peer reads or is disconnected,
+// so the peer is dropped on a timeout, which ends the write
+func (p *Peer) sendWithTimeout(msg interface{}) error {
+	timeout := p.swap.params.SendTimeout
+	if timeout == 0 {
+		timeout = DefaultSendTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- p.Send(ctx, msg)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		metrics.GetOrRegisterCounter("swap/cheques/send/timeout", nil).Inc(1)
+		err := fmt.Errorf("sending %T: %w", msg, ctx.Err())
+		p.Drop(err.Error())
+		return err
+	}
 }
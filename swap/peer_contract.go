@@ -0,0 +1,158 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	contract "github.com/ethersphere/swarm/contracts/swap"
+)
+
+// ErrUnverifiedPeerContract indicates that accounting a debt of a peer was refused because its chequebook could not be verified,
+// see Params.RequireVerifiedPeerContract
+var ErrUnverifiedPeerContract = errors.New("peer chequebook not verified")
+
+// peerContractVerificationTTL is how long the result of verifying the chequebook of a peer is reused
+// the deposit of a chequebook changes over time, so it is verified again afterwards
+const peerContractVerificationTTL = 10 * time.Minute
+
+// peerContractRetryBackoff is how long a chequebook which could not be read from the chain is refused before it is read again
+const peerContractRetryBackoff = 30 * time.Second
+
+// peerContractVerificationTimeout bounds reading the chequebook of a peer from the chain
+const peerContractVerificationTimeout = 30 * time.Second
+
+// contractCheck is the result of verifying the chequebook of a peer
+// it is only accessed under the lock of the peer
+type contractCheck struct {
+	contract common.Address // chequebook which is verified
+	pending  bool           // whether a verification is running
+	checked  bool           // whether a verification completed, only then err holds its result
+	err      error          // why the chequebook is not usable, nil if it is
+	expires  time.Time      // time after which the chequebook is verified again
+}
+
+// checkContract returns why the chequebook of the peer cannot pay the debt the peer may accrue with us, see verifyPeerContract
+// the chequebook is verified in the background, so that the accounting with the peer is never blocked by the chain.
+// until the first result is known the debt of the peer is refused, an expired result is used until it is renewed.
+// a chequebook which could not be read, e.g. because the backend is down, is refused for peerContractRetryBackoff
+// the returned error wraps ErrUnverifiedPeerContract
+// the caller is expected to hold p.lock
+func (p *Peer) checkContract() error {
+	c := p.contractCheck
+	if c == nil || c.contract != p.contractAddress || (!c.pending && !p.swap.clock.Now().Before(c.expires)) {
+		p.startContractVerification()
+		c = p.contractCheck
+	}
+	if !c.checked {
+		return fmt.Errorf("%w: verification of chequebook %v pending", ErrUnverifiedPeerContract, c.contract.Hex())
+	}
+	return c.err
+}
+
+// startContractVerification verifies the chequebook of the peer in the background, unless it is already being verified
+// it is started when the peer connects, so that the result is usually known by the time the peer accrues a debt
+// the caller is expected to hold p.lock
+func (p *Peer) startContractVerification() {
+	c := p.contractCheck
+	if c != nil && c.contract == p.contractAddress {
+		if c.pending {
+			return
+		}
+		c.pending = true
+	} else {
+		c = &contractCheck{
+			contract: p.contractAddress,
+			pending:  true,
+		}
+		p.contractCheck = c
+	}
+	contractAddress, beneficiary, disconnectThreshold := p.contractAddress, p.beneficiary, p.getDisconnectThreshold()
+	p.swap.runBackground(func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, peerContractVerificationTimeout)
+		defer cancel()
+		verified, err := p.swap.verifyPeerContract(ctx, contractAddress, beneficiary, disconnectThreshold)
+		ttl := peerContractVerificationTTL
+		if err != nil {
+			verified = fmt.Errorf("%w: %v", ErrUnverifiedPeerContract, err)
+			ttl = peerContractRetryBackoff
+		}
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		// the result is dropped if the peer switched chequebooks meanwhile
+		if p.contractCheck != c {
+			return
+		}
+		c.pending = false
+		c.checked = true
+		c.err = verified
+		c.expires = p.swap.clock.Now().Add(ttl)
+		if verified != nil {
+			p.logger.Warn(InitAction, "chequebook of peer not verified, refusing to accrue its debt", "chequebook", contractAddress.Hex(), "err", verified)
+		}
+	})
+}
+
+// verifyPeerContract verifies the chequebook of a peer:
+// it has to be deployed by the factory, issued by beneficiary and able to pay out the price of a debt of disconnectThreshold to us
+// verified is the reason why the chequebook is not usable, wrapping ErrUnverifiedPeerContract, and nil if it is,
+// err is returned if the chequebook could not be read
+func (s *Swap) verifyPeerContract(ctx context.Context, address, beneficiary common.Address, disconnectThreshold int64) (verified error, err error) {
+	if address == (common.Address{}) {
+		return fmt.Errorf("%w: peer has no chequebook", ErrUnverifiedPeerContract), nil
+	}
+	if err := s.checkBackend(); err != nil {
+		return nil, err
+	}
+	if err := s.chequebookFactory.VerifyContract(address); err != nil {
+		if errors.Is(err, contract.ErrNotDeployedByFactory) {
+			return fmt.Errorf("%w: chequebook %v %v", ErrUnverifiedPeerContract, address.Hex(), err), nil
+		}
+		return nil, fmt.Errorf("verifying chequebook at %v: %w", address.Hex(), err)
+	}
+	chequebook, err := contract.InstanceAt(address, s.backend)
+	if err != nil {
+		return nil, fmt.Errorf("instantiating chequebook at %v: %w", address.Hex(), err)
+	}
+	opts := &bind.CallOpts{Context: ctx}
+	issuer, err := chequebook.Issuer(opts)
+	if err != nil {
+		return nil, fmt.Errorf("reading issuer of chequebook at %v: %w", address.Hex(), err)
+	}
+	if issuer != beneficiary {
+		return fmt.Errorf("%w: chequebook %v issued by %v, not by the peer %v", ErrUnverifiedPeerContract, address.Hex(), issuer.Hex(), beneficiary.Hex()), nil
+	}
+	liquid, err := chequebook.LiquidBalanceFor(opts, s.owner.address)
+	if err != nil {
+		return nil, fmt.Errorf("reading liquid balance of chequebook at %v: %w", address.Hex(), err)
+	}
+	price, err := s.honeyPriceOracle.GetPrice(uint64(disconnectThreshold))
+	if err != nil {
+		return nil, fmt.Errorf("pricing disconnect threshold: %w", err)
+	}
+	if required := new(big.Int).SetUint64(price); liquid.Cmp(required) < 0 {
+		return fmt.Errorf("%w: chequebook %v can pay out %v, less than %v for a debt at the disconnect threshold", ErrUnverifiedPeerContract, address.Hex(), liquid, required), nil
+	}
+	return nil, nil
+}
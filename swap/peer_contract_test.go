@@ -0,0 +1,179 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	contract "github.com/ethersphere/swarm/contracts/swap"
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// countingFactory counts the chequebooks verified by the factory and fails to verify them while failing is set
+type countingFactory struct {
+	contract.SimpleSwapFactory
+	verified int32
+	failing  int32
+}
+
+func (f *countingFactory) VerifyContract(address common.Address) error {
+	atomic.AddInt32(&f.verified, 1)
+	if atomic.LoadInt32(&f.failing) != 0 {
+		return errors.New("backend unavailable")
+	}
+	return f.SimpleSwapFactory.VerifyContract(address)
+}
+
+// waitForContractCheck waits until the verification of the chequebook of peer is completed
+func waitForContractCheck(t *testing.T, peer *Peer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		peer.lock.RLock()
+		done := peer.contractCheck != nil && !peer.contractCheck.pending
+		peer.lock.RUnlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the chequebook of the peer to be verified")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRequireVerifiedPeerContract tests that with RequireVerifiedPeerContract the debt of peers is only accrued
+// if their chequebook is deployed by the factory, issued by them and can pay out a debt at the disconnect threshold,
+// that we can still accrue debt with the other peers, and that the verification runs in the background and is cached
+func TestRequireVerifiedPeerContract(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+	swap, clean := newTestSwap(t, beneficiaryKey, backend)
+	defer clean()
+	ctx := context.Background()
+	clock := newTestClock(time.Now())
+	swap.clock = clock
+	factory := &countingFactory{SimpleSwapFactory: swap.chequebookFactory}
+	swap.chequebookFactory = factory
+	swap.params.RequireVerifiedPeerContract = true
+	swap.params.DisconnectThreshold = 100
+
+	required, err := swap.honeyPriceOracle.GetPrice(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funded, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, int256.Uint256From(required))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unfunded, err := testDeployWithPrivateKey(ctx, backend, ownerKey, ownerAddress, int256.Uint256From(required-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := swap.addPeer(newDummyPeer().Peer, ownerAddress, funded.ContractParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the debt is refused while the chequebook is verified
+	if err := swap.Add(1, verified.Peer); !errors.Is(err, ErrUnverifiedPeerContract) {
+		t.Fatalf("expected error %v while verifying, got %v", ErrUnverifiedPeerContract, err)
+	}
+	waitForContractCheck(t, verified)
+	for i := 0; i < 2; i++ {
+		if err := swap.Add(1, verified.Peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&factory.verified); n != 1 {
+		t.Fatalf("expected the chequebook to be verified once, got %d verifications", n)
+	}
+	// an expired result is used until the chequebook is verified again
+	clock.Advance(peerContractVerificationTTL)
+	if err := swap.Add(1, verified.Peer); err != nil {
+		t.Fatal(err)
+	}
+	waitForContractCheck(t, verified)
+	if n := atomic.LoadInt32(&factory.verified); n != 2 {
+		t.Fatalf("expected the chequebook to be verified again after the ttl, got %d verifications", n)
+	}
+
+	for _, c := range []struct {
+		name        string
+		beneficiary common.Address
+		chequebook  common.Address
+	}{
+		{"no chequebook", common.Address{}, common.Address{}},
+		{"not issued by peer", beneficiaryAddress, funded.ContractParams().ContractAddress},
+		{"insufficient deposit", ownerAddress, unfunded.ContractParams().ContractAddress},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			peer, err := swap.addPeer(newDummyPeer().Peer, c.beneficiary, c.chequebook)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := swap.Check(1, peer.Peer); !errors.Is(err, ErrUnverifiedPeerContract) {
+				t.Fatalf("expected error %v, got %v", ErrUnverifiedPeerContract, err)
+			}
+			waitForContractCheck(t, peer)
+			if err := swap.Add(1, peer.Peer); !errors.Is(err, ErrUnverifiedPeerContract) {
+				t.Fatalf("expected error %v, got %v", ErrUnverifiedPeerContract, err)
+			}
+			// our debt to the peer is still accrued, as we pay with our own chequebook
+			if err := swap.Add(-1, peer.Peer); err != nil {
+				t.Fatal(err)
+			}
+			peer.lock.RLock()
+			defer peer.lock.RUnlock()
+			if balance := peer.getBalance(); balance != -1 {
+				t.Fatalf("expected balance -1, got %d", balance)
+			}
+		})
+	}
+
+	// a chequebook which cannot be read is refused and only read again after a backoff
+	atomic.StoreInt32(&factory.failing, 1)
+	unreadable, err := swap.addPeer(newDummyPeer().Peer, ownerAddress, funded.ContractParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.Add(1, unreadable.Peer); !errors.Is(err, ErrUnverifiedPeerContract) {
+		t.Fatalf("expected error %v, got %v", ErrUnverifiedPeerContract, err)
+	}
+	waitForContractCheck(t, unreadable)
+	before := atomic.LoadInt32(&factory.verified)
+	atomic.StoreInt32(&factory.failing, 0)
+	if err := swap.Add(1, unreadable.Peer); !errors.Is(err, ErrUnverifiedPeerContract) {
+		t.Fatalf("expected error %v during the backoff, got %v", ErrUnverifiedPeerContract, err)
+	}
+	if n := atomic.LoadInt32(&factory.verified); n != before {
+		t.Fatalf("expected no verification during the backoff, got %d more", n-before)
+	}
+	clock.Advance(peerContractRetryBackoff)
+	if err := swap.Add(1, unreadable.Peer); !errors.Is(err, ErrUnverifiedPeerContract) {
+		t.Fatalf("expected error %v until the chequebook is read again, got %v", ErrUnverifiedPeerContract, err)
+	}
+	waitForContractCheck(t, unreadable)
+	if err := swap.Add(1, unreadable.Peer); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ethersphere/swarm/p2p/protocols"
+	"github.com/ethersphere/swarm/state"
+)
+
+// ErrUnknownMessagePrice indicates that a message type was charged which has no price in the price table
+var ErrUnknownMessagePrice = errors.New("no price for message type")
+
+// PriceTable maps the names of message types to the honey charged for a message of the type, see Charge
+type PriceTable map[string]uint64
+
+// copy returns a copy of the table which can be modified independently
+func (t PriceTable) copy() PriceTable {
+	c := make(PriceTable, len(t))
+	for msgType, price := range t {
+		c[msgType] = price
+	}
+	return c
+}
+
+// validate checks that every price in the table can be accounted
+func (t PriceTable) validate() error {
+	for msgType, price := range t {
+		if msgType == "" {
+			return errors.New("price for an empty message type")
+		}
+		if price > math.MaxInt64 {
+			return fmt.Errorf("%w: price %d of message type %s", ErrHoneyOverflow, price, msgType)
+		}
+	}
+	return nil
+}
+
+// getPriceTable returns the current price table
+// it is loaded from the store on first use, Params.PriceTable is used until a table is set
+// the returned table must not be modified
+func (s *Swap) getPriceTable() (PriceTable, error) {
+	s.priceTableLock.RLock()
+	table := s.priceTable
+	s.priceTableLock.RUnlock()
+	if table != nil {
+		return table, nil
+	}
+
+	s.priceTableLock.Lock()
+	defer s.priceTableLock.Unlock()
+	if s.priceTable != nil {
+		return s.priceTable, nil
+	}
+	err := s.store.Get(priceTableKey, &table)
+	switch {
+	case err == state.ErrNotFound:
+		table = s.params.PriceTable.copy()
+	case err != nil:
+		return nil, fmt.Errorf("loading price table: %w", err)
+	case table == nil:
+		table = make(PriceTable)
+	}
+	s.priceTable = table
+	return table, nil
+}
+
+// PriceTable returns a copy of the prices charged by Charge
+func (s *Swap) PriceTable() (PriceTable, error) {
+	table, err := s.getPriceTable()
+	if err != nil {
+		return nil, err
+	}
+	return table.copy(), nil
+}
+
+// SetPriceTable replaces the prices charged by Charge and saves them, so that they are kept after a restart
+// message types missing from table are not charged anymore
+func (s *Swap) SetPriceTable(table PriceTable) error {
+	if err := table.validate(); err != nil {
+		return err
+	}
+	table = table.copy()
+
+	s.priceTableLock.Lock()
+	defer s.priceTableLock.Unlock()
+	if err := s.store.Put(priceTableKey, table); err != nil {
+		return fmt.Errorf("saving price table: %w", err)
+	}
+	s.priceTable = table
+	s.logger.Info(UpdateBalanceAction, "price table updated", "message types", len(table))
+	return nil
+}
+
+// SetMessagePrice sets the price charged by Charge for a message of msgType and saves it
+func (s *Swap) SetMessagePrice(msgType string, price uint64) error {
+	table, err := s.PriceTable()
+	if err != nil {
+		return err
+	}
+	table[msgType] = price
+	return s.SetPriceTable(table)
+}
+
+// Charge accounts the price of a message of msgType from the price table as owed to us by peer
+// it returns ErrUnknownMessagePrice if the message type has no price, callers which price their messages themselves use Add
+func (s *Swap) Charge(peer *protocols.Peer, msgType string) error {
+	table, err := s.getPriceTable()
+	if err != nil {
+		return err
+	}
+	price, ok := table[msgType]
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownMessagePrice, msgType)
+	}
+	return s.Add(int64(price), peer)
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"errors"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TestCharge tests that Charge accounts the price of the message type from the price table
+// and that a price table set at runtime replaces the configured one, also after a restart
+func TestCharge(t *testing.T) {
+	params := newDefaultParams(t)
+	params.PriceTable = PriceTable{"RetrieveRequest": 10}
+	swap, dir := newBaseTestSwapWithParams(t, ownerKey, params, newTestBackend(t))
+	defer os.RemoveAll(dir)
+	defer swap.Close()
+
+	peer, err := swap.addPeer(newDummyPeer().Peer, common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBalance := func(expected int64) {
+		t.Helper()
+		if balance, err := swap.PeerBalance(peer.ID()); err != nil || balance != expected {
+			t.Fatalf("expected balance %d, got %d (err: %v)", expected, balance, err)
+		}
+	}
+
+	if err := swap.Charge(peer.Peer, "RetrieveRequest"); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(10)
+	if err := swap.Charge(peer.Peer, "ChunkDelivery"); !errors.Is(err, ErrUnknownMessagePrice) {
+		t.Fatalf("expected error %v, got %v", ErrUnknownMessagePrice, err)
+	}
+	expectBalance(10)
+
+	if err := swap.SetMessagePrice("ChunkDelivery", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.Charge(peer.Peer, "ChunkDelivery"); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.Charge(peer.Peer, "RetrieveRequest"); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(25)
+
+	// the returned table is a copy
+	table, err := swap.PriceTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table["ChunkDelivery"] = 1000
+	if err := swap.Charge(peer.Peer, "ChunkDelivery"); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(30)
+
+	if err := swap.SetPriceTable(PriceTable{"ChunkDelivery": math.MaxInt64 + 1}); !errors.Is(err, ErrHoneyOverflow) {
+		t.Fatalf("expected error %v, got %v", ErrHoneyOverflow, err)
+	}
+	if err := swap.SetPriceTable(PriceTable{"ChunkDelivery": 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the table set at runtime is loaded instead of the configured one
+	restarted := newSwapInstance(swap.store, swap.owner, swap.backend, swap.chainID, params, nil, swap.logger)
+	table, err = restarted.PriceTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 1 || table["ChunkDelivery"] != 7 {
+		t.Fatalf("expected the saved price table, got %v", table)
+	}
+}
@@ -16,6 +16,14 @@
 
 package swap
 
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/params"
+)
+
 /*
 This module contains the pricing for message types as constants.
 
@@ -30,6 +38,10 @@ for which the oracle would return the price in a given currency.
 Currently the expected currency from the oracle would be wei,
 but it could potentially be any currency the oracle and Swarm support,
 allowing for a multi-currency design.
+
+Balances are kept in honey (signed, from the perspective of the local node),
+while the cumulative payout of cheques is kept in the oracle currency.
+FormatHoney and FormatCheque render these amounts with their units.
 */
 
 //TODO: this calculations make little sense now, after update to ERC20-enabled chequebook
@@ -47,3 +59,28 @@ const (
 	// default conversion of honey into output currency - currently ETH in Wei
 	defaultHoneyPrice = uint64(1)
 )
+
+// HoneyUnit is the name of the internal accounting unit
+const HoneyUnit = "honey"
+
+// FormatHoney renders an amount of honey, e.g. a balance, with its unit
+func FormatHoney(honey int64) string {
+	return fmt.Sprintf("%d %s", honey, HoneyUnit)
+}
+
+// FormatCheque renders the amounts of a cheque with their units
+// the cumulative payout was converted from honey by the oracle when the cheque was issued,
+// so it is rendered in wei and in ETH without querying the oracle again
+func FormatCheque(cheque *Cheque) string {
+	if cheque == nil || cheque.CumulativePayout == nil {
+		return "<nil>"
+	}
+	payout := cheque.CumulativePayout.Value()
+	return fmt.Sprintf("%d %s, cumulative payout %v wei (%s ETH)", cheque.Honey, HoneyUnit, payout, formatEther(payout))
+}
+
+// formatEther renders an amount in wei as ETH without trailing zeros
+func formatEther(wei *big.Int) string {
+	eth := new(big.Rat).SetFrac(wei, big.NewInt(params.Ether)).FloatString(18)
+	return strings.TrimRight(strings.TrimRight(eth, "0"), ".")
+}
@@ -19,6 +19,7 @@ package swap
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
@@ -42,12 +43,15 @@ var (
 	// Spec is the swap protocol specification
 	Spec = &protocols.Spec{
 		Name:       "swap",
-		Version:    1,
+		Version:    5,
 		MaxMsgSize: 10 * 1024 * 1024,
 		Messages: []interface{}{
 			HandshakeMsg{},
 			EmitChequeMsg{},
 			ConfirmChequeMsg{},
+			BalanceChallengeMsg{},
+			ChequebookUpdateMsg{},
+			ConfirmChequebookUpdateMsg{},
 		},
 	}
 )
@@ -66,6 +70,24 @@ func (s *Swap) Protocols() []p2p.Protocol {
 
 // Start is a node.Service interface method
 func (s *Swap) Start(server *p2p.Server) error {
+	// cheques queued before a restart are cashed again
+	s.startCashoutQueue()
+	if s.params.BalancePersistInterval > 0 {
+		s.runBackground(func(ctx context.Context) {
+			s.flushBalancesPeriodically(ctx, s.params.BalancePersistInterval)
+		})
+	}
+	if s.params.BalanceChallengeInterval > 0 {
+		s.runBackground(func(ctx context.Context) {
+			s.challengeBalancesPeriodically(ctx, s.params.BalanceChallengeInterval)
+		})
+	}
+	// the chequebook can only be checked with a backend
+	if s.params.ChequebookCheckInterval > 0 && s.backend != nil {
+		s.runBackground(func(ctx context.Context) {
+			s.checkChequebookPeriodically(ctx, s.params.ChequebookCheckInterval)
+		})
+	}
 	log.Info(InitAction, "Swap service started")
 	return nil
 }
@@ -98,8 +120,10 @@ func (s *Swap) verifyHandshake(msg interface{}) error {
 func (s *Swap) run(p *p2p.Peer, rw p2p.MsgReadWriter) error {
 	protoPeer := protocols.NewPeer(p, rw, Spec)
 
+	// we may switch our chequebook during the handshake, then the peer has to be told about it
+	ours := s.GetParams().ContractAddress
 	handshake, err := protoPeer.Handshake(context.Background(), &HandshakeMsg{
-		ContractAddress: s.GetParams().ContractAddress,
+		ContractAddress: ours,
 		ChainID:         s.chainID,
 	}, s.verifyHandshake)
 	if err != nil {
@@ -111,17 +135,46 @@ func (s *Swap) run(p *p2p.Peer, rw p2p.MsgReadWriter) error {
 		return ErrInvalidHandshakeMsg
 	}
 
-	beneficiary, err := s.getContractOwner(context.Background(), response.ContractAddress)
+	issuer, err := s.getContractOwner(context.Background(), response.ContractAddress)
 	if err != nil {
 		return err
 	}
+	beneficiary := issuer
+
+	// the peer may have switched its chequebook while it was not connected, then it starts from the one saved for it
+	saved, err := s.loadPeerChequebook(protoPeer.ID())
+	if err != nil {
+		return fmt.Errorf("loading chequebook of peer: %w", err)
+	}
+	contractAddress := response.ContractAddress
+	if saved != nil {
+		beneficiary, contractAddress = saved.Beneficiary, saved.Contract
+	}
 
-	swapPeer, err := s.addPeer(protoPeer, beneficiary, response.ContractAddress)
+	swapPeer, err := s.addPeer(protoPeer, beneficiary, contractAddress)
 	if err != nil {
 		return err
 	}
 	defer s.removePeer(swapPeer)
 
+	if err := s.startPeerChequebooks(context.Background(), swapPeer, saved, response.ContractAddress, issuer, ours); err != nil {
+		return err
+	}
+
+	// the chequebook is verified right away, so that the debt of the peer is not refused while it is verified later
+	if s.params.RequireVerifiedPeerContract {
+		swapPeer.lock.Lock()
+		swapPeer.startContractVerification()
+		swapPeer.lock.Unlock()
+	}
+
+	// a cheque which was pending when the peer disconnected or we restarted may not have reached it
+	s.runBackground(func(ctx context.Context) {
+		if err := swapPeer.resendPendingCheque(); err != nil {
+			swapPeer.logger.Warn(SendChequeAction, "error while resending pending cheque", "err", err)
+		}
+	})
+
 	return swapPeer.Run(s.handleMsg(swapPeer))
 }
 
@@ -129,6 +182,14 @@ func (s *Swap) removePeer(p *Peer) {
 	s.peersLock.Lock()
 	defer s.peersLock.Unlock()
 	delete(s.peers, p.ID())
+	p.lock.Lock()
+	if err := p.flushBalance(); err != nil {
+		p.logger.Warn(StopAction, "error while saving balance", "err", err)
+	}
+	p.lock.Unlock()
+	if err := s.saveLastSeen(p.ID(), s.clock.Now()); err != nil {
+		p.logger.Warn(StopAction, "error while saving last seen time", "err", err)
+	}
 }
 
 func (s *Swap) addPeer(protoPeer *protocols.Peer, beneficiary common.Address, contractAddress common.Address) (*Peer, error) {
@@ -139,6 +200,9 @@ func (s *Swap) addPeer(protoPeer *protocols.Peer, beneficiary common.Address, co
 		return nil, err
 	}
 	s.peers[p.ID()] = p
+	if err := s.saveLastSeen(p.ID(), s.clock.Now()); err != nil {
+		return nil, fmt.Errorf("saving last seen time: %w", err)
+	}
 	return p, nil
 }
 
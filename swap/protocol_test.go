@@ -59,7 +59,7 @@ func newSwapTester(t *testing.T, backend *swapTestBackend, depositAmount *int256
 	}
 
 	// setup the protocolTester, which will allow protocol testing by sending messages
-	protocolTester := p2ptest.NewProtocolTester(swap.owner.privateKey, 1, swap.run)
+	protocolTester := p2ptest.NewProtocolTester(ownerKey, 1, swap.run)
 	return &swapTester{
 		ProtocolTester: protocolTester,
 		swap:           swap,
@@ -276,7 +276,7 @@ func TestEmitCheque(t *testing.T) {
 		},
 		Honey: balanceValue.Uint64(),
 	}
-	cheque.Signature, err = cheque.Sign(debitorSwap.owner.privateKey)
+	cheque.Signature, err = cheque.signWith(debitorSwap.owner.signer)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -477,6 +477,196 @@ loop:
 	}
 }
 
+// TestBalanceChallenge tests that a balance challenge resends an unconfirmed cheque without changing the balance
+// and that our view of the accounting is sent to the peer
+func TestBalanceChallenge(t *testing.T) {
+	testBackend := newTestBackend(t)
+	protocolTester, clean, err := newSwapTester(t, testBackend, int256.Uint256From(DefaultPaymentThreshold*2))
+	defer clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	debitorSwap := protocolTester.swap
+
+	if err = protocolTester.testHandshake(
+		correctSwapHandshakeMsg(debitorSwap),
+		correctSwapHandshakeMsg(debitorSwap),
+	); err != nil {
+		t.Fatal(err)
+	}
+	peerID := protocolTester.Nodes[0].ID()
+	creditor := debitorSwap.getPeer(peerID)
+
+	// send a cheque which the creditor does not confirm
+	if err = debitorSwap.Add(-int64(DefaultPaymentThreshold), creditor.Peer); err != nil {
+		t.Fatal(err)
+	}
+	creditor.lock.Lock()
+	pending := creditor.getPendingCheque()
+	creditor.lock.Unlock()
+	if pending == nil {
+		t.Fatal("expected a pending cheque")
+	}
+	err = protocolTester.TestExchanges(p2ptest.Exchange{
+		Expects: []p2ptest.Expect{
+			{
+				Code: 1,
+				Msg:  &EmitChequeMsg{Cheque: pending},
+				Peer: peerID,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the creditor claims a diverging balance and no received cheque, so the pending cheque is resent
+	err = protocolTester.TestExchanges(p2ptest.Exchange{
+		Triggers: []p2ptest.Trigger{
+			{
+				Code: 3,
+				Msg:  newBalanceChallengeMsg(12345, int256.Uint256From(0), int256.Uint256From(0)),
+				Peer: peerID,
+			},
+		},
+		Expects: []p2ptest.Expect{
+			{
+				Code: 1,
+				Msg:  &EmitChequeMsg{Cheque: pending},
+				Peer: peerID,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the challenge does not change the balance
+	if balance, err := debitorSwap.PeerBalance(peerID); err != nil || balance != 0 {
+		t.Fatalf("expected balance 0, got %d (err: %v)", balance, err)
+	}
+
+	// our view is sent to the creditor
+	if err = debitorSwap.Add(-42, creditor.Peer); err != nil {
+		t.Fatal(err)
+	}
+	debitorSwap.challengeBalances()
+	err = protocolTester.TestExchanges(p2ptest.Exchange{
+		Expects: []p2ptest.Expect{
+			{
+				Code: 3,
+				Msg:  newBalanceChallengeMsg(-42, int256.Uint256From(0), int256.Uint256From(0)),
+				Peer: peerID,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSwapPair tests that a cheque sent for debt at the payment threshold settles the balances of both swaps
+func TestSwapPair(t *testing.T) {
+	pair, clean := newSwapPair(t, int256.Uint256From(DefaultPaymentThreshold*2))
+	defer clean()
+
+	pair.serveLeft(t, int64(DefaultPaymentThreshold))
+
+	// the cheque is sent, received and confirmed
+	for i := 0; ; i++ {
+		if i == 200 {
+			t.Fatal("timeout waiting for the cheque to be confirmed")
+		}
+		pair.leftPeer.lock.RLock()
+		sent := pair.leftPeer.getLastSentCheque()
+		pair.leftPeer.lock.RUnlock()
+		if sent != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pair.leftPeer.lock.RLock()
+	sent := pair.leftPeer.getLastSentCheque()
+	leftBalance := pair.leftPeer.getBalance()
+	pair.leftPeer.lock.RUnlock()
+	pair.rightPeer.lock.RLock()
+	received := pair.rightPeer.getLastReceivedCheque()
+	rightBalance := pair.rightPeer.getBalance()
+	pair.rightPeer.lock.RUnlock()
+
+	if sent.Honey != DefaultPaymentThreshold {
+		t.Fatalf("expected a cheque for %d honey, got %d", DefaultPaymentThreshold, sent.Honey)
+	}
+	if !received.Equal(sent) {
+		t.Fatalf("expected the sent cheque %v to be received, got %v", sent, received)
+	}
+	if leftBalance != 0 || rightBalance != 0 {
+		t.Fatalf("expected settled balances, got %d and %d", leftBalance, rightBalance)
+	}
+}
+
+// TestResendLastCheque tests that the last sent cheque is resent unchanged, without disturbing the cheques after it
+func TestResendLastCheque(t *testing.T) {
+	pair, clean := newSwapPair(t, int256.Uint256From(DefaultPaymentThreshold*3))
+	defer clean()
+
+	rightID := pair.leftPeer.ID()
+	if err := pair.left.ResendLastCheque(rightID); err != ErrNoCheque {
+		t.Fatalf("expected error %v, got %v", ErrNoCheque, err)
+	}
+	if err := pair.left.ResendLastCheque(newDummyPeer().ID()); err == nil {
+		t.Fatal("expected resending to a peer which is not connected to fail")
+	}
+
+	// waitForSentCheque waits until the cheque confirmed by right is not previous anymore
+	waitForSentCheque := func(previous *Cheque) *Cheque {
+		for i := 0; ; i++ {
+			if i == 200 {
+				t.Fatal("timeout waiting for the cheque to be confirmed")
+			}
+			pair.leftPeer.lock.RLock()
+			sent := pair.leftPeer.getLastSentCheque()
+			pair.leftPeer.lock.RUnlock()
+			if sent != nil && !sent.Equal(previous) {
+				return sent
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	pair.serveLeft(t, int64(DefaultPaymentThreshold))
+	first := waitForSentCheque(nil)
+
+	// right credits the resent cheque only once, and its confirmation is accepted by left
+	if err := pair.left.ResendLastCheque(rightID); err != nil {
+		t.Fatal(err)
+	}
+	pair.serveLeft(t, int64(DefaultPaymentThreshold))
+	second := waitForSentCheque(first)
+
+	pair.leftPeer.lock.RLock()
+	pending := pair.leftPeer.getPendingCheque()
+	leftBalance := pair.leftPeer.getBalance()
+	pair.leftPeer.lock.RUnlock()
+	pair.rightPeer.lock.RLock()
+	received := pair.rightPeer.getLastReceivedCheque()
+	rightBalance := pair.rightPeer.getBalance()
+	pair.rightPeer.lock.RUnlock()
+
+	if pending != nil {
+		t.Fatalf("expected no pending cheque, got %v", pending)
+	}
+	if second.Honey != DefaultPaymentThreshold || !second.CumulativePayout.Equals(int256.Uint256From(DefaultPaymentThreshold*2)) {
+		t.Fatalf("expected a second cheque for %d honey, got %v", DefaultPaymentThreshold, second)
+	}
+	if !received.Equal(second) {
+		t.Fatalf("expected the sent cheque %v to be received, got %v", second, received)
+	}
+	if leftBalance != 0 || rightBalance != 0 {
+		t.Fatalf("expected settled balances, got %d and %d", leftBalance, rightBalance)
+	}
+}
+
 // TestTriggerDisconnectThreshold is to test that no further accounting takes place
 // when we reach the disconnect threshold
 // It is the creditor who triggers the disconnect from a overdraft creditor
@@ -0,0 +1,62 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrBelowChequeIncrement indicates that the debt with a peer rounds to no honey with the cheque rounding policy, so no cheque is sent yet
+var ErrBelowChequeIncrement = errors.New("debt below the cheque increment")
+
+// RoundingPolicy decides how the debt with a peer is rounded to the honey of a cheque, a multiple of Params.ChequeIncrement.
+// The receiver verifies the payout of a cheque against the price of its honey, so rounding the honey keeps cheques valid.
+// The difference between the debt and the honey is not lost but carried in the balance:
+// if less is paid, the rest is still owed and paid with the next cheque,
+// if more is paid, the peer owes it back and it is settled by the next services we provide.
+// The balance after sending a cheque is therefore within one increment of zero instead of zero.
+type RoundingPolicy int
+
+const (
+	// RoundFloor pays the largest multiple of the increment not above the debt, so a debtor never overpays
+	RoundFloor RoundingPolicy = iota
+	// RoundCeil pays the smallest multiple of the increment not below the debt, so a debt is always fully settled
+	RoundCeil
+	// RoundNearest pays the multiple of the increment closest to the debt, rounding half up, so the residual is at most half an increment
+	RoundNearest
+)
+
+// valid reports whether r is a known policy
+func (r RoundingPolicy) valid() bool {
+	return r == RoundFloor || r == RoundCeil || r == RoundNearest
+}
+
+// round returns the honey to pay for debt with the policy, a multiple of increment
+// an increment of 0 or 1 pays the debt exactly, and the honey is never rounded up beyond what a cheque can hold
+func (r RoundingPolicy) round(debt, increment uint64) uint64 {
+	if increment <= 1 {
+		return debt
+	}
+	floor := debt - debt%increment
+	rest := debt - floor
+	up := rest > 0 && (r == RoundCeil || (r == RoundNearest && rest >= increment-rest))
+	if up && floor <= math.MaxInt64-increment {
+		return floor + increment
+	}
+	return floor
+}
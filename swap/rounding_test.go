@@ -0,0 +1,94 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/ethersphere/swarm/swap/int256"
+)
+
+// TestRoundingPolicy tests the rounding of debts to the cheque increment
+func TestRoundingPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy    RoundingPolicy
+		debt      uint64
+		increment uint64
+		want      uint64
+	}{
+		{policy: RoundFloor, debt: 149, increment: 0, want: 149},
+		{policy: RoundCeil, debt: 149, increment: 1, want: 149},
+		{policy: RoundFloor, debt: 149, increment: 100, want: 100},
+		{policy: RoundFloor, debt: 99, increment: 100, want: 0},
+		{policy: RoundCeil, debt: 101, increment: 100, want: 200},
+		{policy: RoundCeil, debt: 200, increment: 100, want: 200},
+		{policy: RoundNearest, debt: 149, increment: 100, want: 100},
+		{policy: RoundNearest, debt: 150, increment: 100, want: 200},
+		{policy: RoundNearest, debt: 49, increment: 100, want: 0},
+		// rounding up beyond what a cheque can hold rounds down instead
+		{policy: RoundCeil, debt: math.MaxInt64, increment: 100, want: math.MaxInt64 - math.MaxInt64%100},
+	} {
+		if got := tc.policy.round(tc.debt, tc.increment); got != tc.want {
+			t.Errorf("policy %d: rounding %d to increment %d: got %d, want %d", tc.policy, tc.debt, tc.increment, got, tc.want)
+		}
+	}
+}
+
+// TestChequeRounding tests that the honey of sent cheques is rounded with the policy
+// and that the rest of the debt is carried in the balance
+func TestChequeRounding(t *testing.T) {
+	const increment = 1000
+	debt := int64(DefaultPaymentThreshold + 300)
+	for _, policy := range []RoundingPolicy{RoundFloor, RoundCeil, RoundNearest} {
+		t.Run(fmt.Sprintf("policy=%d", policy), func(t *testing.T) {
+			swap, clean := newTestSwap(t, ownerKey, nil)
+			defer clean()
+			if err := testDeploy(context.Background(), swap, int256.Uint256From(DefaultPaymentThreshold*2)); err != nil {
+				t.Fatal(err)
+			}
+			swap.params.ChequeIncrement = increment
+			swap.params.ChequeRounding = policy
+			want := policy.round(uint64(debt), increment)
+
+			testPeer := newDummyPeerWithSpec(Spec)
+			if _, err := swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
+				t.Fatal(err)
+			}
+			if err := swap.Add(-debt, testPeer.Peer); err != nil {
+				t.Fatal(err)
+			}
+
+			pending, err := swap.loadPendingCheque(testPeer.ID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pending == nil || pending.Honey != want {
+				t.Fatalf("expected a cheque for %d honey, got %v", want, pending)
+			}
+			if !pending.CumulativePayout.Equals(int256.Uint256From(want)) {
+				t.Fatalf("expected the cheque to pay the price of %d honey, got %v", want, pending.CumulativePayout)
+			}
+			// the difference is still owed, or owed back by the peer
+			if balance, err := swap.PeerBalance(testPeer.ID()); err != nil || balance != int64(want)-debt {
+				t.Fatalf("expected balance %d, got %d (err: %v)", int64(want)-debt, balance, err)
+			}
+		})
+	}
+}
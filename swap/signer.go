@@ -0,0 +1,79 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"crypto/ecdsa"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Signer creates all signatures of the chequebook owner, for cheques as well as for transactions
+// implementations can keep the private key outside of the process, e.g. in a HSM or KMS
+type Signer interface {
+	// Sign signs the 32 byte hash and returns the signature in the [R || S || V] format of crypto.Sign, with V being 0 or 1
+	Sign(hash []byte) ([]byte, error)
+	// Address returns the address of the signing key
+	Address() common.Address
+}
+
+// localSigner is a Signer with the private key in memory
+type localSigner struct {
+	privateKey *ecdsa.PrivateKey
+	address    common.Address
+}
+
+// NewLocalSigner creates a Signer which signs with privateKey
+func NewLocalSigner(privateKey *ecdsa.PrivateKey) Signer {
+	return &localSigner{
+		privateKey: privateKey,
+		address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+	}
+}
+
+// Sign is from the Signer interface
+func (s *localSigner) Sign(hash []byte) ([]byte, error) {
+	return crypto.Sign(hash, s.privateKey)
+}
+
+// Address is from the Signer interface
+func (s *localSigner) Address() common.Address {
+	return s.address
+}
+
+// newTransactor creates the options for transactions signed by signer
+// it is the equivalent of bind.NewKeyedTransactor for a Signer
+func newTransactor(signer Signer) *bind.TransactOpts {
+	from := signer.Address()
+	return &bind.TransactOpts{
+		From: from,
+		Signer: func(txSigner types.Signer, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != from {
+				return nil, errors.New("not authorized to sign this account")
+			}
+			signature, err := signer.Sign(txSigner.Hash(tx).Bytes())
+			if err != nil {
+				return nil, err
+			}
+			return tx.WithSignature(txSigner, signature)
+		},
+	}
+}
@@ -244,7 +244,7 @@ func newSharedBackendSwaps(t *testing.T, nodeCount int) (*swapSimulationParams,
 	var owner *Owner
 	defParams := newDefaultParams(t)
 	for i := 0; i < nodeCount; i++ {
-		owner = createOwner(keys[i])
+		owner = createOwner(NewLocalSigner(keys[i]))
 		factory, err := cswap.FactoryAt(testBackend.factoryAddress, testBackend)
 		if err != nil {
 			t.Fatal(err)
@@ -0,0 +1,122 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethersphere/swarm/state"
+)
+
+// ErrStaleSnapshot indicates that a balance changed after a snapshot of the balances was taken, so the snapshot cannot be committed
+var ErrStaleSnapshot = errors.New("balance changed since the snapshot")
+
+// SnapshotBalances returns the balances with all peers, connected or not, as of a single moment
+// no balance changes while the snapshot is taken, but all locks are released before it is returned,
+// so that the caller can e.g. compute a settlement plan against it while the accounting goes on
+// commit saves the balances of the snapshot in one batch, so that the store holds either all or none of them
+// if a balance changed since the snapshot was taken, commit saves nothing and returns ErrStaleSnapshot
+func (s *Swap) SnapshotBalances() (balances map[enode.ID]int64, commit func() error, err error) {
+	s.peersLock.RLock()
+	defer s.peersLock.RUnlock()
+	unlock := s.lockPeers()
+	defer unlock()
+
+	balances = make(map[enode.ID]int64)
+	for id, p := range s.peers {
+		balances[id] = p.getBalance()
+	}
+	// the balances of peers which are not connected only change once they connect
+	err = s.store.Iterate(balancePrefix, func(key []byte, value []byte) (stop bool, err error) {
+		peer, err := parseKeyID(string(key), balancePrefix)
+		if err != nil {
+			return true, err
+		}
+		if _, connected := balances[peer]; connected {
+			return false, nil
+		}
+		var balance int64
+		if err = s.codec.Decode(value, &balance); err != nil {
+			return true, fmt.Errorf("decoding balance of peer %s: %w", peer, err)
+		}
+		balances[peer] = balance
+		return false, nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading balances: %w", err)
+	}
+
+	snapshot := make(map[enode.ID]int64, len(balances))
+	for id, balance := range balances {
+		snapshot[id] = balance
+	}
+	return balances, func() error {
+		return s.commitBalances(snapshot)
+	}, nil
+}
+
+// commitBalances saves the balances of snapshot in one batch unless a balance changed since the snapshot was taken
+// peers which were not connected then may have connected and even disconnected again, so their saved balances are checked as well
+func (s *Swap) commitBalances(snapshot map[enode.ID]int64) error {
+	s.peersLock.RLock()
+	defer s.peersLock.RUnlock()
+	unlock := s.lockPeers()
+	defer unlock()
+
+	for id, balance := range snapshot {
+		var current int64
+		if p, connected := s.peers[id]; connected {
+			current = p.getBalance()
+		} else if err := s.store.Get(balanceKey(id), &current); err != nil && err != state.ErrNotFound {
+			return fmt.Errorf("loading balance of peer %s: %w", id, err)
+		}
+		if current != balance {
+			return fmt.Errorf("%w: peer %s", ErrStaleSnapshot, id)
+		}
+	}
+
+	batch := new(state.StoreBatch)
+	for id, balance := range snapshot {
+		if err := s.batchPut(batch, balanceKey(id), balance); err != nil {
+			return fmt.Errorf("encoding balance of peer %s: %w", id, err)
+		}
+	}
+	if err := s.store.WriteBatch(batch); err != nil {
+		return fmt.Errorf("saving balances: %w", err)
+	}
+	for id, p := range s.peers {
+		if _, ok := snapshot[id]; ok {
+			p.savedBalance = p.balance
+		}
+	}
+	return nil
+}
+
+// lockPeers locks all connected peers and returns the function which unlocks them
+// the caller is expected to hold s.peersLock, so that no peer is added or removed meanwhile
+func (s *Swap) lockPeers() (unlock func()) {
+	for _, p := range s.peers {
+		p.lock.Lock()
+	}
+	return func() {
+		for _, p := range s.peers {
+			p.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package swap
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// TestSnapshotBalances tests that a snapshot holds the balances of connected and disconnected peers,
+// that committing it saves the balances which were only held in memory
+// and that a snapshot is not committed once a balance changed
+func TestSnapshotBalances(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+
+	connected := addPeer(t, swap)
+	setBalance(t, connected, 100)
+	// a change below the persist threshold which is not saved yet
+	connected.balance = 150
+	disconnected := newDummyPeer().ID()
+	if err := swap.saveBalance(disconnected, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	balances, commit, err := swap.SnapshotBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[enode.ID]int64{connected.ID(): 150, disconnected: 42}
+	if !reflect.DeepEqual(balances, expected) {
+		t.Fatalf("expected balances %v, got %v", expected, balances)
+	}
+	// the caller may change the returned map without affecting the commit
+	balances[disconnected] = 0
+
+	if err := commit(); err != nil {
+		t.Fatal(err)
+	}
+	var saved int64
+	if err := swap.store.Get(balanceKey(connected.ID()), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved != 150 {
+		t.Fatalf("expected saved balance 150, got %d", saved)
+	}
+	if err := swap.store.Get(balanceKey(disconnected), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved != 42 {
+		t.Fatalf("expected saved balance 42, got %d", saved)
+	}
+
+	// a connected peer accounted more
+	_, commit, err = swap.SnapshotBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected.balance = 200
+	if err := commit(); !errors.Is(err, ErrStaleSnapshot) {
+		t.Fatalf("expected error %v, got %v", ErrStaleSnapshot, err)
+	}
+
+	// a disconnected peer connected and disconnected again meanwhile
+	_, commit, err = swap.SnapshotBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.saveBalance(disconnected, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(); !errors.Is(err, ErrStaleSnapshot) {
+		t.Fatalf("expected error %v, got %v", ErrStaleSnapshot, err)
+	}
+}
@@ -18,18 +18,20 @@ package swap
 
 import (
 	"context"
-	"crypto/ecdsa"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"math/big"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/console"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p/enode"
@@ -45,57 +47,152 @@ import (
 // ErrInvalidChequeSignature indicates the signature on the cheque was invalid
 var ErrInvalidChequeSignature = errors.New("invalid cheque signature")
 
+// ErrChequebookOwnerMismatch indicates that the issuer of the chequebook is not the owner of the private key of this node,
+// so that all cheques signed by this node would be rejected when cashed
+var ErrChequebookOwnerMismatch = errors.New("chequebook issuer does not match owner")
+
+// ErrChequebookUnusable indicates that the chequebook failed verification, e.g. because it was selfdestructed,
+// so that no cheques are issued from it anymore
+var ErrChequebookUnusable = errors.New("chequebook unusable")
+
+// ErrNoCheque indicates that no cheque was exchanged with a peer
+var ErrNoCheque = errors.New("no cheque exchanged with peer")
+
+// ErrNoBackend indicates that an operation needs the blockchain backend, but Swap was created without one
+var ErrNoBackend = errors.New("no blockchain backend")
+
+// ErrPeerBlacklisted indicates that accounting with a peer was refused because the peer is blacklisted
+var ErrPeerBlacklisted = errors.New("peer is blacklisted")
+
+// ErrDisconnectThreshold indicates that accounting with a peer was refused because it would increase a debt over the disconnect threshold
+var ErrDisconnectThreshold = errors.New("balance is over the disconnect threshold")
+
 // ErrSkipDeposit indicates that the user has specified an amount to deposit (swap-deposit-amount) but also indicated that depositing should be skipped (swap-skip-deposit)
 var ErrSkipDeposit = errors.New("swap-deposit-amount non-zero, but swap-skip-deposit true")
 
+// ErrZeroCashoutRecipient indicates that cashed cheques were to be paid out to the zero address, which would burn the payout
+var ErrZeroCashoutRecipient = errors.New("cashout recipient is the zero address")
+
 // Swap represents the Swarm Accounting Protocol
 // a peer to peer micropayment system
 // A node maintains an individual balance with every peer
 // Only messages which have a price will be accounted for
 type Swap struct {
-	store             state.Store                // store is needed in order to keep balances and cheques across sessions
-	peers             map[enode.ID]*Peer         // map of all swap Peers
-	peersLock         sync.RWMutex               // lock for peers map
-	owner             *Owner                     // contract access
-	backend           chain.Backend              // the backend (blockchain) used
-	chainID           uint64                     // id of the chain the backend is connected to
-	params            *Params                    // economic and operational parameters
-	contract          contract.Contract          // reference to the smart contract
-	chequebookFactory contract.SimpleSwapFactory // the chequebook factory used
-	honeyPriceOracle  HoneyOracle                // oracle which resolves the price of honey (in Wei)
-	cashoutProcessor  *CashoutProcessor          // processor for cashing out
-	logger            Logger                     //Swap Logger
+	store              state.Store                // store is needed in order to keep balances and cheques across sessions
+	codec              Codec                      // serialization of the store entries, for batches and iterated values
+	peers              map[enode.ID]*Peer         // map of all swap Peers
+	peersLock          sync.RWMutex               // lock for peers map
+	owner              *Owner                     // contract access
+	backend            chain.Backend              // the backend (blockchain) used
+	chainID            uint64                     // id of the chain the backend is connected to
+	params             *Params                    // economic and operational parameters
+	contract           contract.Contract          // reference to the smart contract
+	contractLock       sync.RWMutex               // lock for contract, which is replaced by SwitchChequebook
+	switchLock         sync.Mutex                 // serializes switching the chequebook with connecting peers
+	chequebookFactory  contract.SimpleSwapFactory // the chequebook factory used
+	deploying          *deployment                // deployment of a chequebook in progress, nil if there is none
+	deployLock         sync.Mutex                 // lock for deploying
+	honeyPriceOracle   HoneyOracle                // oracle which resolves the price of honey (in Wei)
+	clock              Clock                      // source of time, replaced in tests
+	hooks              AccountingHooks            // optional hooks called by Add
+	hooksLock          sync.RWMutex               // lock for hooks
+	priceTable         PriceTable                 // prices charged by Charge, loaded from the store on first use
+	priceTableLock     sync.RWMutex               // lock for priceTable
+	chequebookErr      error                      // reason why the chequebook failed verification, nil if it is usable
+	chequebookErrLock  sync.RWMutex               // lock for chequebookErr
+	cashoutProcessor   *CashoutProcessor          // processor for cashing out
+	cashoutTo          common.Address             // address cashed cheques pay out to, the chequebook if zero
+	cashoutToLock      sync.RWMutex               // lock for cashoutTo
+	atThreshold        DisconnectPolicy           // what happens when a peer reaches the disconnect threshold
+	atThresholdLock    sync.RWMutex               // lock for atThreshold
+	chequeEventsLock   sync.Mutex                 // serializes appending to the cheque event journal
+	chequeHistoryLock  sync.Mutex                 // serializes pruning of the received cheque history
+	cashoutLock        sync.Mutex                 // serializes cashing cheques, by the cashout worker or manually
+	cashoutQueueLock   sync.Mutex                 // serializes updates of the cashout queue
+	cashoutQueueOnce   sync.Once                  // starts the cashout worker once
+	cashoutQueueSignal chan struct{}              // wakes up the cashout worker when a cheque is queued
+	ctx                context.Context            // root context of background goroutines, cancelled on Close
+	cancel             context.CancelFunc         // cancels ctx
+	backgroundLock     sync.Mutex                 // serializes starting background goroutines with Close
+	background         sync.WaitGroup             // background goroutines which Close waits for
+	closeOnce          sync.Once                  // makes Close idempotent
+	closeErr           error                      // result of the first Close
+	logger             Logger                     //Swap Logger
 }
 
 // Owner encapsulates information related to accessing the contract
 type Owner struct {
-	address    common.Address    // owner address
-	privateKey *ecdsa.PrivateKey // private key
-	publicKey  *ecdsa.PublicKey  // public key
+	address common.Address // owner address
+	signer  Signer         // signs cheques and transactions of the owner
 }
 
 // Params encapsulates economic and operational parameters
 type Params struct {
-	BaseAddrs           *network.BzzAddr // this node's base address
-	LogPath             string           // optional audit log path
-	LogLevel            int              // optional indicates audit filter level of swap log messages
-	PaymentThreshold    int64            // honey amount at which a payment is triggered
-	DisconnectThreshold int64            // honey amount at which a peer disconnects
+	BaseAddrs           *network.BzzAddr      // this node's base address
+	LogPath             string                // optional audit log path
+	LogLevel            int                   // optional indicates audit filter level of swap log messages
+	PaymentThreshold    int64                 // honey amount at which a payment is triggered
+	DisconnectThreshold int64                 // honey amount at which a peer disconnects
+	BackendReconnect    chain.ReconnectPolicy // optional policy for reestablishing a lost backend connection
+	// BalancePersistThreshold is the optional absolute balance change which is accumulated in memory before a balance is saved,
+	// 0 saves every change. Balances are always saved together with cheques, when a peer disconnects and on Close,
+	// but if the node crashes, up to this amount per peer, plus whatever accrued since the last BalancePersistInterval, is lost.
+	BalancePersistThreshold int64
+	BalancePersistInterval  time.Duration // optional interval at which balance changes below the threshold are saved
+	SendTimeout             time.Duration // optional timeout for sending a cheque to a peer, DefaultSendTimeout if 0
+	ChequebookCheckInterval time.Duration // optional interval at which the chequebook is verified to still be usable, see VerifyContract
+	StoreCodec              Codec         // optional serialization of the state store entries, JSONCodec if nil, see MigrateStoreCodec to switch
+	ReceivedChequeHistory   bool          // optional, keeps every received cheque instead of only the last one, see ReceivedCheques
+	// FailOnZeroPrice optionally fails the accounting if the oracle prices the debt at the payment threshold at zero.
+	// By default no cheque is sent then and the debt keeps accruing until it is worth something.
+	FailOnZeroPrice bool
+	// BalanceChallengeInterval is the optional interval at which our view of the balance is sent to every peer, see BalanceChallengeMsg
+	BalanceChallengeInterval  time.Duration
+	BalanceChallengeTolerance int64 // difference between our view of a balance and the one of the peer which is not reported as a discrepancy
+	// ChequeIncrement is the optional amount of honey the honey of sent cheques is a multiple of, 1 if 0.
+	// It must not be above the payment threshold, see ChequeRounding.
+	ChequeIncrement uint64
+	ChequeRounding  RoundingPolicy // optional rounding of the debt to the cheque increment, RoundFloor by default
+	PriceTable      PriceTable     // optional prices charged by Charge until a price table is set at runtime, see SetPriceTable
+	// ChequeDomain is the optional domain separator, e.g. the name of the network, which sent cheques are signed for
+	// and received cheques have to be signed for, so that nodes of deployments with different domains reject each other's cheques.
+	ChequeDomain string
+	// MinChargeableHoney is the optional smallest amount which is accounted right away, 0 accounts every amount.
+	// Smaller amounts are accumulated per peer in memory and only accounted once they add up to it,
+	// so that very cheap messages do not change the balance on every message. Up to this amount per peer is lost on a disconnect.
+	MinChargeableHoney int64
+	// DisconnectPolicy is the optional policy applied when a peer reaches the disconnect threshold, Disconnect by default,
+	// it can be changed at runtime with SetDisconnectPolicy
+	DisconnectPolicy DisconnectPolicy
+	// ChequeSendTime optionally includes the time of sending in the messages carrying our cheques, so that peers can detect clock skew
+	ChequeSendTime     bool
+	ClockSkewTolerance time.Duration // optional difference to the send time of received cheques reported as clock skew, DefaultClockSkewTolerance if 0
+	// RequireVerifiedPeerContract optionally refuses to accrue the debt of a peer whose chequebook is not deployed by the factory,
+	// not issued by the peer or cannot pay out a debt at the disconnect threshold, as its cheques would be worthless
+	RequireVerifiedPeerContract bool
 }
 
 // newSwapInstance is a swap constructor function without integrity checks
 func newSwapInstance(stateStore state.Store, owner *Owner, backend chain.Backend, chainID uint64, params *Params, chequebookFactory contract.SimpleSwapFactory, logger Logger) *Swap {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := newCodecStore(stateStore, params.StoreCodec)
 	return &Swap{
-		store:             stateStore,
-		peers:             make(map[enode.ID]*Peer),
-		backend:           backend,
-		owner:             owner,
-		params:            params,
-		chequebookFactory: chequebookFactory,
-		honeyPriceOracle:  NewHoneyPriceOracle(),
-		chainID:           chainID,
-		cashoutProcessor:  newCashoutProcessor(backend, owner.privateKey),
-		logger:            logger,
+		ctx:                ctx,
+		cancel:             cancel,
+		store:              store,
+		codec:              store.codec,
+		peers:              make(map[enode.ID]*Peer),
+		backend:            backend,
+		owner:              owner,
+		params:             params,
+		chequebookFactory:  chequebookFactory,
+		honeyPriceOracle:   NewHoneyPriceOracle(),
+		clock:              realClock{},
+		chainID:            chainID,
+		cashoutProcessor:   newCashoutProcessor(backend, owner.signer),
+		cashoutQueueSignal: make(chan struct{}, 1),
+		atThreshold:        params.DisconnectPolicy,
+		logger:             logger,
 	}
 }
 
@@ -105,7 +202,8 @@ func newSwapInstance(stateStore state.Store, owner *Owner, backend chain.Backend
 // - connects to the blockchain backend;
 // - verifies that we have not connected SWAP before on a different blockchain backend;
 // - starts the chequebook; creates the swap instance
-func New(dbPath string, prvkey *ecdsa.PrivateKey, backendURL string, params *Params, chequebookAddressFlag common.Address, skipDepositFlag bool, depositAmountFlag uint64, factoryAddress common.Address) (swap *Swap, err error) {
+// all signatures of the owner are created by signer, see NewLocalSigner for a private key in memory
+func New(dbPath string, signer Signer, backendURL string, params *Params, chequebookAddressFlag common.Address, skipDepositFlag bool, depositAmountFlag uint64, factoryAddress common.Address) (swap *Swap, err error) {
 	// swap log for auditing purposes
 	swapLogger := newSwapLogger(params.LogPath, params.LogLevel, params.BaseAddrs)
 	// verify that backendURL is not empty
@@ -122,19 +220,48 @@ func New(dbPath string, prvkey *ecdsa.PrivateKey, backendURL string, params *Par
 	if stateStore, err = state.NewDBStore(filepath.Join(dbPath, "swap.db")); err != nil {
 		return nil, fmt.Errorf("initializing statestore: %w", err)
 	}
+	stateStore = newCodecStore(stateStore, params.StoreCodec)
 	if params.DisconnectThreshold <= params.PaymentThreshold {
 		return nil, fmt.Errorf("disconnect threshold lower or at payment threshold. DisconnectThreshold: %d, PaymentThreshold: %d", params.DisconnectThreshold, params.PaymentThreshold)
 	}
+	if params.BalancePersistThreshold < 0 {
+		return nil, fmt.Errorf("balance persist threshold must not be negative, was %d", params.BalancePersistThreshold)
+	}
+	if params.BalanceChallengeTolerance < 0 {
+		return nil, fmt.Errorf("balance challenge tolerance must not be negative, was %d", params.BalanceChallengeTolerance)
+	}
+	if params.ClockSkewTolerance < 0 {
+		return nil, fmt.Errorf("clock skew tolerance must not be negative, was %v", params.ClockSkewTolerance)
+	}
+	if params.MinChargeableHoney < 0 || params.MinChargeableHoney > params.PaymentThreshold {
+		return nil, fmt.Errorf("minimum chargeable honey must be between 0 and the payment threshold. MinChargeableHoney: %d, PaymentThreshold: %d", params.MinChargeableHoney, params.PaymentThreshold)
+	}
+	if params.ChequeIncrement > uint64(params.PaymentThreshold) {
+		return nil, fmt.Errorf("cheque increment above payment threshold. ChequeIncrement: %d, PaymentThreshold: %d", params.ChequeIncrement, params.PaymentThreshold)
+	}
+	if !params.ChequeRounding.valid() {
+		return nil, fmt.Errorf("unknown cheque rounding policy %d", params.ChequeRounding)
+	}
+	if err := params.PriceTable.validate(); err != nil {
+		return nil, fmt.Errorf("invalid price table: %w", err)
+	}
+	if !params.DisconnectPolicy.valid() {
+		return nil, fmt.Errorf("unknown disconnect policy %d", params.DisconnectPolicy)
+	}
 	// connect to the backend
-	backend, err := ethclient.Dial(backendURL)
+	client, err := ethclient.Dial(backendURL)
 	if err != nil {
 		return nil, fmt.Errorf("connecting to Ethereum API, url %s: %w", backendURL, err)
 	}
 	// get the chainID of the backend
 	var chainID *big.Int
-	if chainID, err = backend.ChainID(context.TODO()); err != nil {
-		return nil, fmt.Errorf("retrieving chainID from backendURL: %v", err)
+	if chainID, err = client.ChainID(context.TODO()); err != nil {
+		return nil, fmt.Errorf("retrieving chainID from backendURL: %w", err)
 	}
+	// reconnect to the same chain if the connection is lost
+	backend := chain.NewReconnectingBackend(client, func(ctx context.Context) (chain.Backend, error) {
+		return dialBackend(ctx, backendURL, chainID.Uint64())
+	}, params.BackendReconnect)
 	// verify that we have not used SWAP before on a different chainID
 	if err := checkChainID(chainID.Uint64(), stateStore, swapLogger); err != nil {
 		return nil, err
@@ -142,7 +269,7 @@ func New(dbPath string, prvkey *ecdsa.PrivateKey, backendURL string, params *Par
 	swapLogger.Info(InitAction, "Using backend network ID", "ID", chainID.Uint64())
 
 	// create the owner of SWAP
-	owner := createOwner(prvkey)
+	owner := createOwner(signer)
 
 	// initialize the factory
 	factory, err := createFactory(factoryAddress, chainID, backend, swapLogger)
@@ -160,6 +287,16 @@ func New(dbPath string, prvkey *ecdsa.PrivateKey, backendURL string, params *Par
 		factory,
 		swapLogger,
 	)
+	// the last received cheques saved before they were kept per chequebook are the last ones of their chequebooks
+	if _, err := swap.migrateChequebookCheques(); err != nil {
+		return nil, fmt.Errorf("migrating received cheques: %w", err)
+	}
+	// the last received cheques saved before the history was enabled start the history
+	if params.ReceivedChequeHistory {
+		if _, err := swap.migrateReceivedChequeHistory(); err != nil {
+			return nil, fmt.Errorf("migrating received cheques to the history: %w", err)
+		}
+	}
 	// start the chequebook
 	if swap.contract, err = swap.StartChequebook(chequebookAddressFlag); err != nil {
 		return nil, err
@@ -185,6 +322,11 @@ func New(dbPath string, prvkey *ecdsa.PrivateKey, backendURL string, params *Par
 		}
 	}
 
+	// report inconsistent state for investigation, but do not refuse to start
+	for _, inconsistency := range swap.VerifyConsistency() {
+		swapLogger.Warn(InitAction, "inconsistent swap state", peerCtx(inconsistency.Peer, "reason", inconsistency.Reason)...)
+	}
+
 	return swap, nil
 }
 
@@ -193,25 +335,62 @@ const (
 	sentChequePrefix       = "sent_cheque_"
 	receivedChequePrefix   = "received_cheque_"
 	pendingChequePrefix    = "pending_cheque_"
+	lastSeenPrefix         = "last_seen_"
+	blacklistPrefix        = "blacklist_"
+	payoutSeedPrefix       = "payout_seed_"
+	thresholdWeightPrefix  = "threshold_weight_"
+	cashoutQueuePrefix     = "cashout_queue_"
+	cashedPayoutPrefix     = "cashed_payout_"
+	chequeEventPrefix      = "cheque_event_"
+	lastChequeEventKey     = "last_cheque_event"
+	chequeTotalsKey        = "cheque_totals"
 	connectedChequebookKey = "connected_chequebook"
 	connectedBlockchainKey = "connected_blockchain"
+	// the received cheque history must not share a prefix with receivedChequePrefix, which is iterated as one entry per peer
+	receivedChequeHistoryPrefix = "received_cheques_"
+	lastReceivedSerialPrefix    = "last_received_serial_"
+	receivedChequeSummaryPrefix = "received_summary_"
+	priceTableKey               = "price_table"
+	chequeConversionPrefix      = "cheque_conversion_"
+	peerChequebookPrefix        = "peer_chequebook_"
+	chequebookChequePrefix      = "chequebook_cheque_"
+	sentChequebookChequePrefix  = "chequebook_sent_cheque_"
+	previousChequebookPrefix    = "previous_chequebook_"
 )
 
+// dialBackend connects to the backend at backendURL and verifies that it is on the chain with the expected chainID
+func dialBackend(ctx context.Context, backendURL string, expectedChainID uint64) (chain.Backend, error) {
+	client, err := ethclient.DialContext(ctx, backendURL)
+	if err != nil {
+		return nil, err
+	}
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("retrieving chainID: %w", err)
+	}
+	if chainID.Uint64() != expectedChainID {
+		client.Close()
+		return nil, fmt.Errorf("backend switched from chain %d to chain %d", expectedChainID, chainID.Uint64())
+	}
+	return client, nil
+}
+
 // createFactory determines the factory address and returns and error if no factory address has been specified or is unknown for the network
 func createFactory(factoryAddress common.Address, chainID *big.Int, backend chain.Backend, logger Logger) (factory swap.SimpleSwapFactory, err error) {
 	if (factoryAddress == common.Address{}) {
 		if factoryAddress, err = contract.FactoryAddressForNetwork(chainID.Uint64()); err != nil {
-			return nil, err
+			return nil, fmt.Errorf("determining factory address: %w", err)
 		}
 	}
 	logger.Info(InitAction, "Using chequebook factory", "address", factoryAddress)
 	// instantiate an object representing the factory and verify it's bytecode
 	factory, err = contract.FactoryAt(factoryAddress, backend)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("instantiating factory at %v: %w", factoryAddress.Hex(), err)
 	}
 	if err := factory.VerifySelf(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("verifying factory at %v: %w", factoryAddress.Hex(), err)
 	}
 	return factory, nil
 }
@@ -231,7 +410,9 @@ func checkChainID(currentChainID uint64, s state.Store, logger Logger) (err erro
 	}
 	if err == state.ErrNotFound {
 		logger.Info(InitAction, "First time connected to SWAP. Storing chain ID", "ID", currentChainID)
-		return s.Put(connectedBlockchainKey, currentChainID)
+		if err := s.Put(connectedBlockchainKey, currentChainID); err != nil {
+			return fmt.Errorf("storing chain ID: %w", err)
+		}
 	}
 	return nil
 }
@@ -251,30 +432,127 @@ func receivedChequeKey(peer enode.ID) string {
 	return receivedChequePrefix + peer.String()
 }
 
+// returns the store key for the conversion record of the cheque with cumulativePayout sent to a peer
+func chequeConversionKey(peer enode.ID, cumulativePayout *int256.Uint256) string {
+	return fmt.Sprintf("%s%s_%s", chequeConversionPrefix, peer.String(), cumulativePayout)
+}
+
+// returns the store key of the cheque with serial in the received cheque history of a peer
+// serials are zero padded, so that the history of a peer is iterated in the order the cheques were received
+func receivedChequeHistoryKey(peer enode.ID, serial uint64) string {
+	return fmt.Sprintf("%s%s_%020d", receivedChequeHistoryPrefix, peer.String(), serial)
+}
+
+// returns the store key for the serial of the last cheque in the received cheque history of a peer
+func lastReceivedSerialKey(peer enode.ID) string {
+	return lastReceivedSerialPrefix + peer.String()
+}
+
+// returns the store key for the summary of the cheques pruned from the received cheque history of a peer
+func receivedChequeSummaryKey(peer enode.ID) string {
+	return receivedChequeSummaryPrefix + peer.String()
+}
+
 func pendingChequeKey(peer enode.ID) string {
 	return pendingChequePrefix + peer.String()
 }
 
+// returns the store key for retrieving the last time a peer was connected
+func lastSeenKey(peer enode.ID) string {
+	return lastSeenPrefix + peer.String()
+}
+
+// returns the store key for the blacklist entry of a peer
+func blacklistKey(peer enode.ID) string {
+	return blacklistPrefix + peer.String()
+}
+
+// returns the store key for the cumulative payout seed of a peer
+func payoutSeedKey(peer enode.ID) string {
+	return payoutSeedPrefix + peer.String()
+}
+
+// returns the store key for the chequebook a peer switched to
+func peerChequebookKey(peer enode.ID) string {
+	return peerChequebookPrefix + peer.String()
+}
+
+// returns the store key for the last cheque received from a peer drawn on chequebook
+// it is kept for every chequebook of the peer, so that cheques are never accepted twice if the peer switches back to a chequebook
+func chequebookChequeKey(peer enode.ID, chequebook common.Address) string {
+	return fmt.Sprintf("%s%s_%s", chequebookChequePrefix, peer.String(), chequebook.Hex())
+}
+
+// returns the store key for the last cheque sent to a peer drawn on our chequebook
+// it is kept for every chequebook we switched from, so that cheques build on it if we switch back to the chequebook
+func sentChequebookChequeKey(peer enode.ID, chequebook common.Address) string {
+	return fmt.Sprintf("%s%s_%s", sentChequebookChequePrefix, peer.String(), chequebook.Hex())
+}
+
+// returns the store key for a chequebook we switched from
+func previousChequebookKey(chequebook common.Address) string {
+	return previousChequebookPrefix + chequebook.Hex()
+}
+
+// returns the store key for the cheque event with the given sequence number
+// the sequence number is zero padded so that events are iterated in order
+func chequeEventKey(seq uint64) string {
+	return fmt.Sprintf("%s%020d", chequeEventPrefix, seq)
+}
+
+// returns the store key for the threshold weight of a peer
+func thresholdWeightKey(peer enode.ID) string {
+	return thresholdWeightPrefix + peer.String()
+}
+
 func keyToID(key string, prefix string) enode.ID {
 	return enode.HexID(key[len(prefix):])
 }
 
-// createOwner assigns keys and addresses
-func createOwner(prvkey *ecdsa.PrivateKey) *Owner {
-	pubkey := &prvkey.PublicKey
+// parseKeyID returns the peer of a store key with prefix, or an error if the key does not end with a peer
+func parseKeyID(key string, prefix string) (id enode.ID, err error) {
+	if !strings.HasPrefix(key, prefix) {
+		return id, fmt.Errorf("key %s does not start with %s", key, prefix)
+	}
+	b, err := hex.DecodeString(key[len(prefix):])
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("key %s does not end with a peer", key)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// createOwner creates the owner which signs with signer
+func createOwner(signer Signer) *Owner {
 	return &Owner{
-		address:    crypto.PubkeyToAddress(*pubkey),
-		privateKey: prvkey,
-		publicKey:  pubkey,
+		address: signer.Address(),
+		signer:  signer,
 	}
 }
 
 // modifyBalanceOk checks that the amount would not result in crossing the disconnection threshold
 func (s *Swap) modifyBalanceOk(amount int64, swapPeer *Peer) (err error) {
+	// blacklisted peers are treated as if they were over the disconnect threshold in both directions
+	if swapPeer.blacklisted {
+		return fmt.Errorf("%w: %s", ErrPeerBlacklisted, swapPeer.ID().String())
+	}
+
+	// a peer whose cheques we could not cash is not served on credit, but stays connected and can still be paid by us
+	if amount > 0 && s.params.RequireVerifiedPeerContract {
+		if err := swapPeer.checkContract(); err != nil {
+			return protocols.Refuse(err)
+		}
+	}
+
 	// check if balance with peer is over the disconnect threshold and if the message would increase the existing debt
-	balance := swapPeer.getBalance()
-	if balance >= s.params.DisconnectThreshold && amount > 0 {
-		return fmt.Errorf("balance for peer %s is over the disconnect threshold %d and cannot incur more debt, disconnecting", swapPeer.ID().String(), s.params.DisconnectThreshold)
+	balance := swapPeer.getAccountedBalance()
+	disconnectThreshold := swapPeer.getDisconnectThreshold()
+	if balance >= disconnectThreshold && amount > 0 {
+		// unless the policy is to disconnect, the amount is refused without dropping the peer
+		if policy := s.getDisconnectPolicy(); policy != Disconnect {
+			return protocols.Refuse(fmt.Errorf("%w %d with peer %s and cannot incur more debt, policy %s", ErrDisconnectThreshold, disconnectThreshold, swapPeer.ID().String(), policy))
+		}
+		return fmt.Errorf("%w %d with peer %s and cannot incur more debt, disconnecting", ErrDisconnectThreshold, disconnectThreshold, swapPeer.ID().String())
 	}
 
 	return nil
@@ -292,29 +570,106 @@ func (s *Swap) Check(amount int64, peer *protocols.Peer) (err error) {
 	swapPeer.lock.Lock()
 	defer swapPeer.lock.Unlock()
 	// currently this is the only real check needed:
-	return s.modifyBalanceOk(amount, swapPeer)
+	err = s.modifyBalanceOk(amount, swapPeer)
+	// with SuspendAccounting the message is still served, only its amount is refused by Add
+	if errors.Is(err, ErrDisconnectThreshold) && s.getDisconnectPolicy() == SuspendAccounting {
+		return nil
+	}
+	return err
 }
 
 // Add is the (sole) accounting function
 // Swap implements the protocols.Balance interface
+// the accounting hooks are called without holding the lock of the peer
 func (s *Swap) Add(amount int64, peer *protocols.Peer) (err error) {
 	swapPeer := s.getPeer(peer.ID())
 	if swapPeer == nil {
 		return fmt.Errorf("peer %s not a swap enabled peer", peer.ID().String())
 	}
 
+	hooks := s.getAccountingHooks()
+	if hooks.PreAdd != nil {
+		if err = hooks.PreAdd(peer.ID(), amount); err != nil {
+			return err
+		}
+	}
+
+	newBalance, updated, err := s.add(amount, swapPeer)
+	if updated && hooks.PostAdd != nil {
+		hooks.PostAdd(peer.ID(), newBalance)
+	}
+	if errors.Is(err, ErrDisconnectThreshold) && hooks.OnDisconnectThreshold != nil {
+		hooks.OnDisconnectThreshold(peer.ID(), newBalance)
+	}
+	return err
+}
+
+// AddNet accounts a credit and a debit with the peer in one operation, e.g. for a request which both consumes and provides value
+// credit is owed to us and debit is owed by us, neither may be negative
+// only the net amount is applied, so the thresholds are checked once on the resulting balance
+// and a debit which is offset by the credit cannot trigger a cheque or a disconnect on its own
+func (s *Swap) AddNet(credit, debit int64, peer *protocols.Peer) error {
+	if credit < 0 || debit < 0 {
+		return fmt.Errorf("credit %d and debit %d must not be negative", credit, debit)
+	}
+	return s.Add(credit-debit, peer)
+}
+
+// add does the accounting of Add while holding the lock of the peer
+// it returns the balance with the peer afterwards and whether the balance was updated, even if the payment failed
+// if the amount is refused, the unchanged balance is returned
+func (s *Swap) add(amount int64, swapPeer *Peer) (newBalance int64, updated bool, err error) {
 	swapPeer.lock.Lock()
 	defer swapPeer.lock.Unlock()
 	// we should probably check here again:
 	if err = s.modifyBalanceOk(amount, swapPeer); err != nil {
-		return err
+		return swapPeer.getAccountedBalance(), false, err
+	}
+
+	// amounts below Params.MinChargeableHoney are only accounted once they add up to it
+	amount, chargeable := swapPeer.chargeableAmount(amount)
+	if !chargeable {
+		return swapPeer.getAccountedBalance(), false, nil
+	}
+
+	// the balance is not changed while a cheque of the peer is being cashed, see freezeBalance
+	if swapPeer.cashing {
+		if err = swapPeer.addFrozenAmount(amount); err != nil {
+			return 0, false, err
+		}
+		return swapPeer.getAccountedBalance(), true, nil
 	}
 
 	if err = swapPeer.updateBalance(amount); err != nil {
-		return err
+		return 0, false, err
 	}
 
-	return s.checkPaymentThresholdAndSendCheque(swapPeer)
+	err = s.checkPaymentThresholdAndSendCheque(swapPeer)
+	return swapPeer.getBalance(), true, err
+}
+
+// AccountingHooks lets embedders observe or veto the accounting of Swap
+// both hooks are optional and may be called concurrently for different peers
+type AccountingHooks struct {
+	PreAdd  func(peer enode.ID, amount int64) error // called before an amount is accounted, a non-nil error aborts the accounting
+	PostAdd func(peer enode.ID, newBalance int64)   // called after an amount was accounted with the resulting balance
+	// OnDisconnectThreshold is called when an amount is refused because the balance with the peer is over the disconnect threshold,
+	// before Add returns the error which, with the Disconnect policy, makes the protocol drop the peer
+	OnDisconnectThreshold func(peer enode.ID, balance int64)
+}
+
+// SetAccountingHooks replaces the accounting hooks, the zero value removes them
+func (s *Swap) SetAccountingHooks(hooks AccountingHooks) {
+	s.hooksLock.Lock()
+	defer s.hooksLock.Unlock()
+	s.hooks = hooks
+}
+
+// getAccountingHooks returns the current accounting hooks
+func (s *Swap) getAccountingHooks() AccountingHooks {
+	s.hooksLock.RLock()
+	defer s.hooksLock.RUnlock()
+	return s.hooks
 }
 
 // checkPaymentThresholdAndSendCheque checks if balance with peer crosses the payment threshold and attempts to send a cheque if so
@@ -322,9 +677,29 @@ func (s *Swap) Add(amount int64, peer *protocols.Peer) (err error) {
 // that the balance is *below* the threshold
 // the caller is expected to hold swapPeer.lock
 func (s *Swap) checkPaymentThresholdAndSendCheque(swapPeer *Peer) error {
-	if swapPeer.getBalance() <= -s.params.PaymentThreshold {
-		swapPeer.logger.Info(SendChequeAction, "balance for peer went over the payment threshold, sending cheque", "payment threshold", s.params.PaymentThreshold)
-		return swapPeer.sendCheque()
+	paymentThreshold := swapPeer.getPaymentThreshold()
+	if swapPeer.getBalance() <= -paymentThreshold {
+		swapPeer.logger.Info(SendChequeAction, "balance for peer went over the payment threshold, sending cheque", "payment threshold", paymentThreshold)
+		_, err := swapPeer.sendCheque()
+		// a cheque worth nothing would settle the debt for free, so it is deferred until the debt has a price
+		if errors.Is(err, ErrZeroPrice) && !s.params.FailOnZeroPrice {
+			metrics.GetOrRegisterCounter("swap/cheques/deferred/zeroprice", nil).Inc(1)
+			swapPeer.logger.Warn(SendChequeAction, "debt has no price yet, deferring cheque", "balance", FormatHoney(swapPeer.getBalance()))
+			return nil
+		}
+		// the debt is settled once the peer confirmed our new chequebook
+		if errors.Is(err, ErrChequebookUpdatePending) {
+			metrics.GetOrRegisterCounter("swap/cheques/deferred/chequebookupdate", nil).Inc(1)
+			swapPeer.logger.Info(SendChequeAction, "switch of chequebook not confirmed yet, deferring cheque", "balance", FormatHoney(swapPeer.getBalance()))
+			return nil
+		}
+		// a debt which rounds to no honey is carried until it reaches the increment
+		if errors.Is(err, ErrBelowChequeIncrement) {
+			metrics.GetOrRegisterCounter("swap/cheques/deferred/increment", nil).Inc(1)
+			swapPeer.logger.Warn(SendChequeAction, "debt below the cheque increment, deferring cheque", "balance", FormatHoney(swapPeer.getBalance()))
+			return nil
+		}
+		return err
 	}
 	return nil
 }
@@ -337,6 +712,12 @@ func (s *Swap) handleMsg(p *Peer) func(ctx context.Context, msg interface{}) err
 			return s.handleEmitChequeMsg(ctx, p, msg)
 		case *ConfirmChequeMsg:
 			return s.handleConfirmChequeMsg(ctx, p, msg)
+		case *BalanceChallengeMsg:
+			return s.handleBalanceChallengeMsg(ctx, p, msg)
+		case *ChequebookUpdateMsg:
+			return s.handleChequebookUpdateMsg(ctx, p, msg)
+		case *ConfirmChequebookUpdateMsg:
+			return s.handleConfirmChequebookUpdateMsg(ctx, p, msg)
 		}
 		return nil
 	}
@@ -352,9 +733,13 @@ func (s *Swap) handleEmitChequeMsg(ctx context.Context, p *Peer, msg *EmitCheque
 
 	cheque := msg.Cheque
 	p.logger.Info(HandleChequeAction, "received cheque from peer", "honey", cheque.Honey)
+	s.checkClockSkew(p, msg)
 
+	// a cheque equal to the last received one is a redelivery, e.g. after the peer resent its pending cheque
+	// it was already credited, so we only confirm it again without touching the balance
 	if p.getLastReceivedCheque() != nil && cheque.Equal(p.getLastReceivedCheque()) {
-		p.logger.Warn(HandleChequeAction, "cheque sent by peer has already been received in the past", "cumulativePayout", cheque.CumulativePayout)
+		p.logger.Debug(HandleChequeAction, "cheque sent by peer has already been received in the past, not crediting it again", "cumulativePayout", cheque.CumulativePayout)
+		metrics.GetOrRegisterCounter("swap/cheques/received/duplicate", nil).Inc(1)
 		return p.Send(ctx, &ConfirmChequeMsg{
 			Cheque: cheque,
 		})
@@ -365,15 +750,16 @@ func (s *Swap) handleEmitChequeMsg(ctx context.Context, p *Peer, msg *EmitCheque
 		return protocols.Break(fmt.Errorf("processing and verifying received cheque: %w", err))
 	}
 
+	if err := s.appendChequeEvent(ChequeReceivedEvent, p.ID(), cheque); err != nil {
+		p.logger.Error(HandleChequeAction, "error while journaling received cheque", "err", err)
+	}
+
 	p.logger.Debug(HandleChequeAction, "processed and verified received cheque", "beneficiary", cheque.Beneficiary, "cumulative payout", cheque.CumulativePayout)
 
-	// reset balance by amount
-	// as this is done by the creditor, receiving the cheque, the amount should be negative,
-	// so that updateBalance will calculate balance + amount which result in reducing the peer's balance
-	honeyAmount := int64(cheque.Honey)
-	err = p.updateBalance(-honeyAmount)
+	// the cheque was credited to the balance by processAndVerifyCheque
+	honeyAmount, err := cheque.honeyAmount()
 	if err != nil {
-		return protocols.Break(fmt.Errorf("updating balance: %w", err))
+		return protocols.Break(err)
 	}
 
 	metrics.GetOrRegisterCounter("swap/cheques/received/num", nil).Inc(1)
@@ -383,23 +769,25 @@ func (s *Swap) handleEmitChequeMsg(ctx context.Context, p *Peer, msg *EmitCheque
 		Cheque: cheque,
 	})
 	if err != nil {
-		return protocols.Break(err)
+		return protocols.Break(fmt.Errorf("sending confirm cheque msg: %w", err))
 	}
 
 	expectedPayout, transactionCosts, err := s.cashoutProcessor.estimatePayout(context.TODO(), cheque)
 	if err != nil {
-		return protocols.Break(err)
+		return protocols.Break(fmt.Errorf("estimating payout: %w", err))
 	}
 
 	costsMultiplier := int256.Uint256From(2)
 	costThreshold, err := new(int256.Uint256).Mul(transactionCosts, costsMultiplier)
 	if err != nil {
-		return err
+		return fmt.Errorf("computing cost threshold: %w", err)
 	}
 
 	// do a payout transaction if we get 2 times the gas costs
 	if expectedPayout.Cmp(costThreshold) == 1 {
-		go defaultCashCheque(s, cheque)
+		if err := s.enqueueCashout(cheque); err != nil {
+			return fmt.Errorf("queueing cheque for cashing: %w", err)
+		}
 	}
 
 	return nil
@@ -410,6 +798,13 @@ func (s *Swap) handleConfirmChequeMsg(ctx context.Context, p *Peer, msg *Confirm
 	defer p.lock.Unlock()
 	cheque := msg.Cheque
 
+	// the last sent cheque is confirmed again when it was resent, see ResendLastCheque
+	// the confirmation can arrive after the next cheque was sent, so it is ignored whether a cheque is pending or not
+	if p.getLastSentCheque() != nil && cheque.Equal(p.getLastSentCheque()) {
+		p.logger.Debug(SendChequeAction, "resent cheque confirmed again by peer", "cumulativePayout", cheque.CumulativePayout)
+		return nil
+	}
+
 	if p.getPendingCheque() == nil {
 		return fmt.Errorf("ignoring confirm msg, no pending cheque, confirm message cheque %s", cheque)
 	}
@@ -419,12 +814,12 @@ func (s *Swap) handleConfirmChequeMsg(ctx context.Context, p *Peer, msg *Confirm
 	}
 
 	batch := new(state.StoreBatch)
-	err := batch.Put(sentChequeKey(p.ID()), cheque)
+	err := s.batchPut(batch, sentChequeKey(p.ID()), cheque)
 	if err != nil {
 		return protocols.Break(fmt.Errorf("encoding cheque failed: %w", err))
 	}
 
-	err = batch.Put(pendingChequeKey(p.ID()), nil)
+	err = s.batchPut(batch, pendingChequeKey(p.ID()), nil)
 	if err != nil {
 		return protocols.Break(fmt.Errorf("encoding pending cheque failed: %w", err))
 	}
@@ -437,38 +832,213 @@ func (s *Swap) handleConfirmChequeMsg(ctx context.Context, p *Peer, msg *Confirm
 	p.lastSentCheque = cheque
 	p.pendingCheque = nil
 
+	if err := s.appendChequeEvent(ChequeSentEvent, p.ID(), cheque); err != nil {
+		p.logger.Error(SendChequeAction, "error while journaling sent cheque", "err", err)
+	}
+
+	// a switch of our chequebook is only announced once no cheque is pending
+	if err := p.announceChequebook(); err != nil {
+		p.logger.Warn(SendChequeAction, "error while announcing chequebook", "err", err)
+	}
 	return nil
 }
 
+// handleBalanceChallengeMsg compares the view of the peer on the accounting with ours
+// the peer cannot change our balance or cheques with it, discrepancies are only logged
+// if we have a pending cheque, it is resent, as either the cheque or its confirmation got lost
+func (s *Swap) handleBalanceChallengeMsg(ctx context.Context, p *Peer, msg *BalanceChallengeMsg) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// the balance of the peer with us is the negation of ours with the peer
+	balance := p.getBalance()
+	peerBalance := msg.balance()
+	difference := new(big.Int).Add(big.NewInt(balance), peerBalance)
+	if difference.CmpAbs(big.NewInt(s.params.BalanceChallengeTolerance)) > 0 {
+		metrics.GetOrRegisterCounter("swap/balance/challenge/discrepancy", nil).Inc(1)
+		p.logger.Warn(UpdateBalanceAction, "balance of peer differs from ours", "balance", FormatHoney(balance), "peer balance", peerBalance)
+	}
+
+	if !payoutEquals(msg.LastSentPayout, p.getLastReceivedCheque()) {
+		metrics.GetOrRegisterCounter("swap/balance/challenge/discrepancy", nil).Inc(1)
+		p.logger.Warn(HandleChequeAction, "last cheque sent by peer differs from the last one received", "peer payout", msg.LastSentPayout, "last received cheque", p.getLastReceivedCheque())
+	}
+
+	if pending := p.getPendingCheque(); pending != nil {
+		p.logger.Info(SendChequeAction, "resending pending cheque after balance challenge", "pending cheque", pending, "peer payout", msg.LastReceivedPayout)
+		metrics.GetOrRegisterCounter("swap/balance/challenge/resent", nil).Inc(1)
+		if err := p.sendWithTimeout(p.newEmitChequeMsg(pending)); err != nil {
+			return fmt.Errorf("resending pending cheque to peer: %w", err)
+		}
+	} else if !payoutEquals(msg.LastReceivedPayout, p.getLastSentCheque()) {
+		metrics.GetOrRegisterCounter("swap/balance/challenge/discrepancy", nil).Inc(1)
+		p.logger.Warn(SendChequeAction, "last cheque received by peer differs from the last one sent", "peer payout", msg.LastReceivedPayout, "last sent cheque", p.getLastSentCheque())
+	}
+	return nil
+}
+
+// payoutEquals tells whether payout is the cumulative payout of cheque, treating a missing payout and cheque as 0
+func payoutEquals(payout *int256.Uint256, cheque *Cheque) bool {
+	if payout == nil {
+		payout = int256.Uint256From(0)
+	}
+	return payout.Equals(chequePayout(cheque))
+}
+
+// chequePayout returns the cumulative payout of cheque, or 0 if it is nil
+func chequePayout(cheque *Cheque) *int256.Uint256 {
+	if cheque == nil {
+		return int256.Uint256From(0)
+	}
+	return cheque.CumulativePayout
+}
+
+// appendChequeEvent appends an event for the given cheque to the cheque event journal
+// the event gets the next sequence number, which is persisted together with the event
+func (s *Swap) appendChequeEvent(eventType ChequeEventType, peer enode.ID, cheque *Cheque) error {
+	s.chequeEventsLock.Lock()
+	defer s.chequeEventsLock.Unlock()
+
+	var seq uint64
+	err := s.store.Get(lastChequeEventKey, &seq)
+	if err != nil && err != state.ErrNotFound {
+		return fmt.Errorf("loading last cheque event sequence: %w", err)
+	}
+	seq++
+
+	batch := new(state.StoreBatch)
+	err = s.batchPut(batch, chequeEventKey(seq), &ChequeEvent{
+		Seq:    seq,
+		Type:   eventType,
+		Peer:   peer,
+		Cheque: cheque,
+		Time:   s.clock.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("encoding cheque event: %w", err)
+	}
+	err = s.batchPut(batch, lastChequeEventKey, seq)
+	if err != nil {
+		return fmt.Errorf("encoding cheque event sequence: %w", err)
+	}
+	totals, err := s.loadChequeTotals()
+	if err != nil {
+		return err
+	}
+	totals.add(eventType, cheque)
+	err = s.batchPut(batch, chequeTotalsKey, totals)
+	if err != nil {
+		return fmt.Errorf("encoding cheque totals: %w", err)
+	}
+	return s.store.WriteBatch(batch)
+}
+
+// loadChequeTotals loads the totals of the cheque event journal
+// journals written before the totals were kept are counted once
+// the caller is expected to hold s.chequeEventsLock
+func (s *Swap) loadChequeTotals() (totals ChequeTotals, err error) {
+	err = s.store.Get(chequeTotalsKey, &totals)
+	if err != state.ErrNotFound {
+		if err != nil {
+			return totals, fmt.Errorf("loading cheque totals: %w", err)
+		}
+		return totals, nil
+	}
+	err = s.store.Iterate(chequeEventPrefix, func(key []byte, value []byte) (stop bool, err error) {
+		var event ChequeEvent
+		if err := s.codec.Decode(value, &event); err != nil {
+			return true, fmt.Errorf("decoding cheque event %s: %w", key, err)
+		}
+		totals.add(event.Type, event.Cheque)
+		return false, nil
+	})
+	return totals, err
+}
+
 // cashCheque should be called async as it blocks until the transaction(s) are mined
 // The function cashes the cheque by sending it to the blockchain
-func cashCheque(s *Swap, cheque *Cheque) {
-	err := s.cashoutProcessor.cashCheque(context.Background(), &CashoutRequest{
+// it is called by the cashout worker, which retries the cheque if it fails
+func cashCheque(ctx context.Context, s *Swap, cheque *Cheque) error {
+	return s.cashoutProcessor.cashCheque(ctx, &CashoutRequest{
 		Cheque:      *cheque,
-		Destination: s.GetParams().ContractAddress,
+		Destination: s.getCashoutRecipient(),
 		Logger:      s.logger,
 	})
+}
+
+// SetCashoutRecipient sets the address the payout of cheques cashed from now on is sent to, e.g. a cold wallet
+// the chequebook contract pays the recipient given by the beneficiary, so any address can receive the payout
+// by default, and after a restart, it is sent to our own chequebook
+func (s *Swap) SetCashoutRecipient(recipient common.Address) error {
+	if recipient == (common.Address{}) {
+		return ErrZeroCashoutRecipient
+	}
+	s.cashoutToLock.Lock()
+	defer s.cashoutToLock.Unlock()
+	s.cashoutTo = recipient
+	return nil
+}
+
+// getCashoutRecipient returns the address the payout of cashed cheques is sent to
+func (s *Swap) getCashoutRecipient() common.Address {
+	s.cashoutToLock.RLock()
+	defer s.cashoutToLock.RUnlock()
+	if s.cashoutTo == (common.Address{}) {
+		return s.GetParams().ContractAddress
+	}
+	return s.cashoutTo
+}
+
+// TestCashable simulates cashing the last cheque received from peer, or if there is none, the last cheque sent to it.
+// It runs against the current state of the chain without sending a transaction, so no gas is spent.
+// A cheque is cashable if cashing it would neither fail nor bounce, the reason why it is not is logged
+func (s *Swap) TestCashable(ctx context.Context, peer enode.ID) (bool, error) {
+	if err := s.checkBackend(); err != nil {
+		return false, fmt.Errorf("testing cheque: %w", err)
+	}
+	cheque, err := s.loadLastReceivedCheque(peer)
+	if err != nil {
+		return false, fmt.Errorf("loading last received cheque: %w", err)
+	}
+	if cheque == nil {
+		if cheque, err = s.loadLastSentCheque(peer); err != nil {
+			return false, fmt.Errorf("loading last sent cheque: %w", err)
+		}
+	}
+	if cheque == nil {
+		return false, ErrNoCheque
+	}
 
+	reason, err := s.cashoutProcessor.simulateCashCheque(ctx, cheque)
 	if err != nil {
-		metrics.GetOrRegisterCounter("swap/cheques/cashed/errors", nil).Inc(1)
-		s.logger.Error(CashChequeAction, "cashing cheque:", err)
+		return false, err
+	}
+	if reason != "" {
+		s.logger.Info(CashChequeAction, "cheque is not cashable", peerCtx(peer, "chequebook", cheque.Contract, "reason", reason)...)
+		return false, nil
 	}
+	return true, nil
 }
 
 // processAndVerifyCheque verifies the cheque and compares it with the last received cheque
-// if the cheque is valid it will also be saved as the new last cheque
+// if the cheque is valid it will also be saved as the new last cheque and credited to the balance with the peer
 // the caller is expected to hold p.lock
 func (s *Swap) processAndVerifyCheque(cheque *Cheque, p *Peer) (*int256.Uint256, error) {
 	if err := cheque.verifyChequeProperties(p, s.owner.address); err != nil {
 		return nil, err
 	}
 
+	honeyAmount, err := cheque.honeyAmount()
+	if err != nil {
+		return nil, err
+	}
+
 	lastCheque := p.getLastReceivedCheque()
 
 	// TODO: there should probably be a lock here?
 	expectedAmount, err := s.honeyPriceOracle.GetPrice(cheque.Honey)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("getting price from oracle: %w", err)
 	}
 
 	actualAmount, err := cheque.verifyChequeAgainstLast(lastCheque, int256.Uint256From(expectedAmount))
@@ -477,15 +1047,15 @@ func (s *Swap) processAndVerifyCheque(cheque *Cheque, p *Peer) (*int256.Uint256,
 	}
 
 	// calculate tentative new balance after cheque is processed
-	newBalance := p.getBalance() - int64(cheque.Honey)
+	// the peer decides to pay on the accounted balance, so the amount accounted while cashing counts as well
+	newBalance := p.getAccountedBalance() - honeyAmount
 	// check if this new balance would put creditor into debt
 	if newBalance < -int64(ChequeDebtTolerance) {
 		return nil, fmt.Errorf("received cheque would result in balance %d which exceeds tolerance %d and would cause debt", newBalance, ChequeDebtTolerance)
 	}
 
-	if err := p.setLastReceivedCheque(cheque); err != nil {
-		p.logger.Error(HandleChequeAction, "error while saving last received cheque", "err", err.Error())
-		// TODO: what do we do here? Related issue: https://github.com/ethersphere/swarm/issues/1515
+	if err := p.setLastReceivedChequeWithBalance(cheque, -honeyAmount); err != nil {
+		return nil, fmt.Errorf("saving received cheque: %w", err)
 	}
 
 	return actualAmount, nil
@@ -493,8 +1063,25 @@ func (s *Swap) processAndVerifyCheque(cheque *Cheque, p *Peer) (*int256.Uint256,
 
 // loadLastReceivedCheque loads the last received cheque for the peer from the store
 // and returns nil when there never was a cheque saved
+// with the received cheque history it is the cheque with the highest serial
 func (s *Swap) loadLastReceivedCheque(p enode.ID) (cheque *Cheque, err error) {
-	err = s.store.Get(receivedChequeKey(p), &cheque)
+	if s.params.ReceivedChequeHistory {
+		serial, err := s.loadLastReceivedSerial(p)
+		if err != nil {
+			return nil, err
+		}
+		if serial > 0 {
+			err := s.getOrQuarantine(receivedChequeHistoryKey(p, serial), &cheque)
+			if err == nil {
+				return cheque, nil
+			}
+			// if the entry was corrupt, the cheque is still saved as the last received cheque
+			if err != state.ErrNotFound {
+				return nil, err
+			}
+		}
+	}
+	err = s.getOrQuarantine(receivedChequeKey(p), &cheque)
 	if err == state.ErrNotFound {
 		return nil, nil
 	}
@@ -504,10 +1091,71 @@ func (s *Swap) loadLastReceivedCheque(p enode.ID) (cheque *Cheque, err error) {
 	return cheque, nil
 }
 
+// loadLastChequebookCheque loads the last cheque received from the peer which is drawn on chequebook
+// and returns nil when there never was such a cheque
+func (s *Swap) loadLastChequebookCheque(p enode.ID, chequebook common.Address) (cheque *Cheque, err error) {
+	err = s.getOrQuarantine(chequebookChequeKey(p, chequebook), &cheque)
+	if err == state.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cheque, nil
+}
+
+// loadLastSentChequebookCheque loads the last cheque sent to the peer which is drawn on our chequebook
+// and returns nil when there never was such a cheque or it is still the last sent cheque
+func (s *Swap) loadLastSentChequebookCheque(p enode.ID, chequebook common.Address) (cheque *Cheque, err error) {
+	err = s.getOrQuarantine(sentChequebookChequeKey(p, chequebook), &cheque)
+	if err == state.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cheque, nil
+}
+
+// migrateChequebookCheques saves the last received cheque of every peer as the last one of its chequebook, unless there is one already,
+// and returns the number of cheques saved
+func (s *Swap) migrateChequebookCheques() (migrated int, err error) {
+	batch := new(state.StoreBatch)
+	err = s.store.Iterate(receivedChequePrefix, func(key []byte, value []byte) (stop bool, err error) {
+		peer := keyToID(string(key), receivedChequePrefix)
+		var cheque *Cheque
+		// corrupt entries are quarantined once they are loaded
+		if err := s.codec.Decode(value, &cheque); err != nil || cheque == nil {
+			return false, nil
+		}
+		last, err := s.loadLastChequebookCheque(peer, cheque.Contract)
+		if err != nil {
+			return true, err
+		}
+		if last != nil {
+			return false, nil
+		}
+		// the cheque is stored as is, it was encoded with the same codec
+		batch.Batch.Put([]byte(chequebookChequeKey(peer, cheque.Contract)), value)
+		migrated++
+		return false, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if migrated == 0 {
+		return 0, nil
+	}
+	if err := s.store.WriteBatch(batch); err != nil {
+		return 0, fmt.Errorf("writing last received cheques of chequebooks: %w", err)
+	}
+	return migrated, nil
+}
+
 // loadLastSentCheque loads the last sent cheque for the peer from the store
 // and returns nil when there never was a cheque saved
 func (s *Swap) loadLastSentCheque(p enode.ID) (cheque *Cheque, err error) {
-	err = s.store.Get(sentChequeKey(p), &cheque)
+	err = s.getOrQuarantine(sentChequeKey(p), &cheque)
 	if err == state.ErrNotFound {
 		return nil, nil
 	}
@@ -520,7 +1168,7 @@ func (s *Swap) loadLastSentCheque(p enode.ID) (cheque *Cheque, err error) {
 // loadPendingCheque loads the current pending cheque for the peer from the store
 // and returns nil when there never was a pending cheque saved
 func (s *Swap) loadPendingCheque(p enode.ID) (cheque *Cheque, err error) {
-	err = s.store.Get(pendingChequeKey(p), &cheque)
+	err = s.getOrQuarantine(pendingChequeKey(p), &cheque)
 	if err == state.ErrNotFound {
 		return nil, nil
 	}
@@ -533,7 +1181,7 @@ func (s *Swap) loadPendingCheque(p enode.ID) (cheque *Cheque, err error) {
 // loadBalance loads the current balance for the peer from the store
 // and returns 0 if there was no prior balance saved
 func (s *Swap) loadBalance(p enode.ID) (balance int64, err error) {
-	err = s.store.Get(balanceKey(p), &balance)
+	err = s.getOrQuarantine(balanceKey(p), &balance)
 	if err == state.ErrNotFound {
 		return 0, nil
 	}
@@ -543,9 +1191,41 @@ func (s *Swap) loadBalance(p enode.ID) (balance int64, err error) {
 	return balance, nil
 }
 
+// loadLastSeen loads the last time the peer was connected from the store
+// and returns state.ErrNotFound if it was never recorded
+func (s *Swap) loadLastSeen(p enode.ID) (lastSeen time.Time, err error) {
+	err = s.store.Get(lastSeenKey(p), &lastSeen)
+	return lastSeen, err
+}
+
+// saveLastSeen saves t as the last time the peer was connected
+func (s *Swap) saveLastSeen(p enode.ID, t time.Time) error {
+	return s.store.Put(lastSeenKey(p), t)
+}
+
 // saveLastReceivedCheque saves cheque as the last received cheque for peer
+// with the received cheque history it is also appended to the history
 func (s *Swap) saveLastReceivedCheque(p enode.ID, cheque *Cheque) error {
-	return s.store.Put(receivedChequeKey(p), cheque)
+	batch := new(state.StoreBatch)
+	if err := s.batchLastReceivedCheque(batch, p, cheque); err != nil {
+		return err
+	}
+	return s.store.WriteBatch(batch)
+}
+
+// batchLastReceivedCheque adds saving cheque as the last received cheque for peer to batch, see saveLastReceivedCheque
+// it is saved as the last cheque of its chequebook as well
+func (s *Swap) batchLastReceivedCheque(batch *state.StoreBatch, p enode.ID, cheque *Cheque) error {
+	if err := s.batchPut(batch, chequebookChequeKey(p, cheque.Contract), cheque); err != nil {
+		return fmt.Errorf("encoding received cheque: %w", err)
+	}
+	if s.params.ReceivedChequeHistory {
+		return s.batchAppendReceivedCheque(batch, p, cheque)
+	}
+	if err := s.batchPut(batch, receivedChequeKey(p), cheque); err != nil {
+		return fmt.Errorf("encoding received cheque: %w", err)
+	}
+	return nil
 }
 
 // saveLastSentCheque saves cheque as the last received cheque for peer
@@ -563,24 +1243,492 @@ func (s *Swap) saveBalance(p enode.ID, balance int64) error {
 	return s.store.Put(balanceKey(p), balance)
 }
 
+// loadBlacklisted returns whether the peer is blacklisted
+func (s *Swap) loadBlacklisted(p enode.ID) (bool, error) {
+	var blacklisted bool
+	err := s.store.Get(blacklistKey(p), &blacklisted)
+	if err == state.ErrNotFound {
+		return false, nil
+	}
+	return blacklisted, err
+}
+
+// Blacklist refuses all further accounting with the peer, Add and Check fail with ErrPeerBlacklisted for it
+// the blacklist is persisted and applies to the peer whether it is connected or not
+func (s *Swap) Blacklist(peer enode.ID) error {
+	return s.setBlacklisted(peer, true)
+}
+
+// Unblacklist allows accounting with a previously blacklisted peer again
+func (s *Swap) Unblacklist(peer enode.ID) error {
+	return s.setBlacklisted(peer, false)
+}
+
+// setBlacklisted persists the blacklist entry of the peer and applies it to the peer if it is connected
+func (s *Swap) setBlacklisted(peer enode.ID, blacklisted bool) error {
+	// hold the peers lock so that a connecting peer does not load a stale entry
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+
+	var err error
+	if blacklisted {
+		err = s.store.Put(blacklistKey(peer), true)
+	} else {
+		err = s.store.Delete(blacklistKey(peer))
+	}
+	if err != nil {
+		return fmt.Errorf("saving blacklist entry of peer %v: %w", peer, err)
+	}
+
+	if swapPeer, ok := s.peers[peer]; ok {
+		swapPeer.lock.Lock()
+		swapPeer.blacklisted = blacklisted
+		swapPeer.lock.Unlock()
+	}
+	s.logger.Info(UpdateBalanceAction, "updated blacklist", peerCtx(peer, "blacklisted", blacklisted)...)
+	return nil
+}
+
+// loadThresholdWeight loads the threshold weight of the peer from the store
+// and returns the default weight 1 when no weight was saved
+func (s *Swap) loadThresholdWeight(p enode.ID) (float64, error) {
+	weight := 1.0
+	err := s.store.Get(thresholdWeightKey(p), &weight)
+	if err == state.ErrNotFound {
+		return 1, nil
+	}
+	return weight, err
+}
+
+// SetThresholdWeight sets the multiplier applied to the payment and disconnect thresholds with the peer
+// a weight above 1 gives a trusted peer more headroom before it is paid or disconnected, a weight below 1 gives it less
+// the weight is persisted and applies to the peer whether it is connected or not, it must be positive and finite
+func (s *Swap) SetThresholdWeight(peer enode.ID, weight float64) error {
+	if !(weight > 0) || math.IsInf(weight, 1) {
+		return fmt.Errorf("threshold weight must be positive and finite, was %v", weight)
+	}
+
+	// hold the peers lock so that a connecting peer does not load a stale weight
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+
+	var err error
+	if weight == 1 {
+		err = s.store.Delete(thresholdWeightKey(peer))
+	} else {
+		err = s.store.Put(thresholdWeightKey(peer), weight)
+	}
+	if err != nil {
+		return fmt.Errorf("saving threshold weight of peer %v: %w", peer, err)
+	}
+
+	if swapPeer, ok := s.peers[peer]; ok {
+		swapPeer.lock.Lock()
+		swapPeer.thresholdWeight = weight
+		swapPeer.lock.Unlock()
+	}
+	s.logger.Info(UpdateBalanceAction, "updated threshold weight", peerCtx(peer, "weight", weight)...)
+	return nil
+}
+
+// weightThreshold applies a threshold weight to a threshold
+// the result saturates at the largest int64 so that a large weight cannot overflow it
+func weightThreshold(threshold int64, weight float64) int64 {
+	weighted := float64(threshold) * weight
+	if weighted >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(weighted)
+}
+
+// loadCumulativePayoutSeed loads the cumulative payout seed for the peer from the store
+// and returns nil when no seed was saved
+func (s *Swap) loadCumulativePayoutSeed(p enode.ID) (seed *int256.Uint256, err error) {
+	err = s.store.Get(payoutSeedKey(p), &seed)
+	if err == state.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// SeedCumulativePayout sets the cumulative payout the next cheque to the peer builds upon
+// this allows a node restored from a backup to continue settling with a peer which already received
+// cheques with a higher cumulative payout than the ones this node knows about
+// the seed has to be greater than the cumulative payout of any known sent or pending cheque and any previous seed
+func (s *Swap) SeedCumulativePayout(peer enode.ID, seed *int256.Uint256) error {
+	if seed == nil {
+		return errors.New("cumulative payout seed must not be nil")
+	}
+
+	// hold the peers lock so that a connecting peer does not load a stale seed
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+
+	swapPeer, connected := s.peers[peer]
+	var known []*int256.Uint256
+	if connected {
+		swapPeer.lock.Lock()
+		defer swapPeer.lock.Unlock()
+		known = append(known, swapPeer.getLastSentCumulativePayout())
+		if pending := swapPeer.getPendingCheque(); pending != nil {
+			known = append(known, pending.CumulativePayout)
+		}
+	} else {
+		for _, load := range []func(enode.ID) (*Cheque, error){s.loadLastSentCheque, s.loadPendingCheque} {
+			cheque, err := load(peer)
+			if err != nil {
+				return fmt.Errorf("loading cheque of peer %v: %w", peer, err)
+			}
+			if cheque != nil {
+				known = append(known, cheque.CumulativePayout)
+			}
+		}
+		previous, err := s.loadCumulativePayoutSeed(peer)
+		if err != nil {
+			return fmt.Errorf("loading cumulative payout seed of peer %v: %w", peer, err)
+		}
+		if previous != nil {
+			known = append(known, previous)
+		}
+	}
+	for _, payout := range known {
+		if seed.Cmp(payout) <= 0 {
+			return fmt.Errorf("cumulative payout seed %v is not greater than known cumulative payout %v", seed, payout)
+		}
+	}
+
+	if err := s.store.Put(payoutSeedKey(peer), seed); err != nil {
+		return fmt.Errorf("saving cumulative payout seed of peer %v: %w", peer, err)
+	}
+	if connected {
+		swapPeer.cumulativePayoutSeed = seed
+	}
+	s.logger.Info(UpdateBalanceAction, "seeded cumulative payout", peerCtx(peer, "seed", seed)...)
+	return nil
+}
+
+// ResendLastCheque sends the last cheque sent to the connected peer once more, unchanged
+// this is the pending cheque if the peer did not confirm it yet, otherwise the last confirmed one
+// no new cheque is created and the balance does not change, as the peer credits a cheque it already received only once
+func (s *Swap) ResendLastCheque(peer enode.ID) error {
+	swapPeer := s.getPeer(peer)
+	if swapPeer == nil {
+		return fmt.Errorf("peer %v not connected", peer)
+	}
+	swapPeer.lock.Lock()
+	defer swapPeer.lock.Unlock()
+
+	cheque := swapPeer.getPendingCheque()
+	if cheque == nil {
+		cheque = swapPeer.getLastSentCheque()
+	}
+	if cheque == nil {
+		return ErrNoCheque
+	}
+	s.logger.Info(SendChequeAction, "resending last cheque", peerCtx(peer, "cheque", cheque)...)
+	if err := swapPeer.sendWithTimeout(swapPeer.newEmitChequeMsg(cheque)); err != nil {
+		return fmt.Errorf("resending cheque to peer: %w", err)
+	}
+	metrics.GetOrRegisterCounter("swap/cheques/resent", nil).Inc(1)
+	return nil
+}
+
+// flushBalances saves the balances of all connected peers which changed since they were last saved
+func (s *Swap) flushBalances() {
+	s.peersLock.RLock()
+	defer s.peersLock.RUnlock()
+	for _, p := range s.peers {
+		p.lock.Lock()
+		if err := p.flushBalance(); err != nil {
+			p.logger.Error(UpdateBalanceAction, "error while saving balance", "err", err)
+		}
+		p.lock.Unlock()
+	}
+}
+
+// flushBalancesPeriodically saves changed balances every interval until ctx is done
+func (s *Swap) flushBalancesPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			s.flushBalances()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// challengeBalances sends our view of the accounting to every connected peer, see BalanceChallengeMsg
+func (s *Swap) challengeBalances() {
+	s.peersLock.RLock()
+	peers := make([]*Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.peersLock.RUnlock()
+
+	for _, p := range peers {
+		p.lock.RLock()
+		msg := newBalanceChallengeMsg(p.getBalance(), chequePayout(p.getLastSentCheque()), chequePayout(p.getLastReceivedCheque()))
+		p.lock.RUnlock()
+		if err := p.sendWithTimeout(msg); err != nil {
+			p.logger.Warn(UpdateBalanceAction, "error while sending balance challenge", "err", err)
+		}
+	}
+}
+
+// challengeBalancesPeriodically sends our view of the accounting to every peer every interval until ctx is done
+func (s *Swap) challengeBalancesPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			s.challengeBalances()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// PruneBalances removes the stored balances of peers which are not connected, have not been seen within olderThan
+// and whose absolute balance is at most maxAbsBalance, so that meaningful debts are never discarded.
+// Cheques are kept, as they are cumulative and needed to keep settling with a peer which comes back.
+// Peers without a recorded last seen time get one recorded now and are considered on a later call.
+func (s *Swap) PruneBalances(olderThan time.Duration, maxAbsBalance int64) (pruned int, err error) {
+	if maxAbsBalance < 0 {
+		return 0, fmt.Errorf("max absolute balance must not be negative, was %d", maxAbsBalance)
+	}
+	cutoff := s.clock.Now().Add(-olderThan)
+
+	// hold the peers lock for the whole operation so that no peer connects and loads a balance we are about to remove
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+
+	var candidates []enode.ID
+	err = s.store.Iterate(balancePrefix, func(key []byte, value []byte) (stop bool, err error) {
+		peer := keyToID(string(key), balancePrefix)
+		if _, connected := s.peers[peer]; connected {
+			return false, nil
+		}
+		var balance int64
+		if err := s.codec.Decode(value, &balance); err != nil {
+			return true, fmt.Errorf("decoding balance of peer %v: %w", peer, err)
+		}
+		if balance > maxAbsBalance || balance < -maxAbsBalance {
+			return false, nil
+		}
+		candidates = append(candidates, peer)
+		return false, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("iterating balances: %w", err)
+	}
+
+	batch := new(state.StoreBatch)
+	for _, peer := range candidates {
+		lastSeen, err := s.loadLastSeen(peer)
+		if err == state.ErrNotFound {
+			if err := s.saveLastSeen(peer, s.clock.Now()); err != nil {
+				return 0, fmt.Errorf("saving last seen time of peer %v: %w", peer, err)
+			}
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("loading last seen time of peer %v: %w", peer, err)
+		}
+		if lastSeen.After(cutoff) {
+			continue
+		}
+		batch.Delete(balanceKey(peer))
+		batch.Delete(lastSeenKey(peer))
+		pruned++
+	}
+	if err := s.store.WriteBatch(batch); err != nil {
+		return 0, fmt.Errorf("removing pruned balances: %w", err)
+	}
+	s.logger.Info(UpdateBalanceAction, "pruned balances of long gone peers", "pruned", pruned)
+	return pruned, nil
+}
+
+// VerifyConsistency cross-checks the stored balances and cheques of all known peers and reports what does not add up.
+// It only reads from the store and can be run at any time, but as balances and cheques of connected peers are not
+// read atomically, an inconsistency reported for a connected peer can be transient and should be rechecked.
+func (s *Swap) VerifyConsistency() []Inconsistency {
+	var inconsistencies []Inconsistency
+	report := func(peer enode.ID, format string, args ...interface{}) {
+		inconsistencies = append(inconsistencies, Inconsistency{Peer: peer, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	// collect all peers we have any state for
+	peers := make(map[enode.ID]struct{})
+	for _, prefix := range []string{balancePrefix, sentChequePrefix, receivedChequePrefix, pendingChequePrefix} {
+		prefix := prefix
+		err := s.store.Iterate(prefix, func(key []byte, value []byte) (stop bool, err error) {
+			peers[keyToID(string(key), prefix)] = struct{}{}
+			return false, nil
+		})
+		if err != nil {
+			report(enode.ID{}, "iterating %s: %v", prefix, err)
+		}
+	}
+
+	for peer := range peers {
+		// the balance is only loaded to find corrupt entries, a balance beyond the payment threshold is normal
+		// as the cheque settling it can be deferred, e.g. while the debt is priced at zero or the balance is frozen for cashing
+		if _, err := s.loadBalance(peer); err != nil {
+			report(peer, "loading balance: %v", err)
+		}
+		sentCheque, err := s.loadLastSentCheque(peer)
+		if err != nil {
+			report(peer, "loading last sent cheque: %v", err)
+		}
+		pendingCheque, err := s.loadPendingCheque(peer)
+		if err != nil {
+			report(peer, "loading pending cheque: %v", err)
+		}
+		receivedCheque, err := s.loadLastReceivedCheque(peer)
+		if err != nil {
+			report(peer, "loading last received cheque: %v", err)
+		}
+
+		if sentCheque != nil && pendingCheque != nil && pendingCheque.CumulativePayout.Cmp(sentCheque.CumulativePayout) < 1 {
+			report(peer, "pending cheque cumulative payout %v is not larger than the last sent cheque cumulative payout %v", pendingCheque.CumulativePayout, sentCheque.CumulativePayout)
+		}
+
+		for _, c := range []struct {
+			name   string
+			cheque *Cheque
+			sent   bool
+		}{
+			{"last sent cheque", sentCheque, true},
+			{"pending cheque", pendingCheque, true},
+			{"last received cheque", receivedCheque, false},
+		} {
+			if c.cheque == nil {
+				continue
+			}
+			// sent cheques are checked against the conversion recorded when they were signed, as the price may have changed since
+			if c.sent {
+				conversion, err := s.SentChequeConversion(peer, c.cheque.CumulativePayout)
+				if err != nil {
+					report(peer, "loading conversion of %s: %v", c.name, err)
+				}
+				if conversion != nil {
+					if conversion.Honey != c.cheque.Honey {
+						report(peer, "%s honey %d differs from the honey %d it was converted from", c.name, c.cheque.Honey, conversion.Honey)
+					}
+					if conversion.Payout.Cmp(c.cheque.CumulativePayout) == 1 {
+						report(peer, "%s honey %d was converted into %v, more than its cumulative payout %v", c.name, c.cheque.Honey, conversion.Payout, c.cheque.CumulativePayout)
+					}
+					continue
+				}
+			}
+			// the honey of a cheque is the increase since the previous cheque, so its price can never exceed the cumulative payout
+			price, err := s.honeyPriceOracle.GetPrice(c.cheque.Honey)
+			if err != nil {
+				report(peer, "getting price of %s honey: %v", c.name, err)
+			} else if int256.Uint256From(price).Cmp(c.cheque.CumulativePayout) == 1 {
+				report(peer, "%s honey %d is worth %d, more than its cumulative payout %v", c.name, c.cheque.Honey, price, c.cheque.CumulativePayout)
+			}
+		}
+
+		if receivedCheque != nil && receivedCheque.Beneficiary != s.owner.address {
+			report(peer, "last received cheque is made out to %x instead of us", receivedCheque.Beneficiary)
+		}
+		// peers which did not confirm our switch of chequebook yet are still paid from the previous one
+		if s.getContract() != nil {
+			for _, cheque := range []*Cheque{sentCheque, pendingCheque} {
+				if cheque != nil && cheque.Contract != s.GetParams().ContractAddress && !s.isPreviousChequebook(cheque.Contract) {
+					report(peer, "sent cheque is drawn on chequebook %x instead of ours", cheque.Contract)
+				}
+			}
+		}
+	}
+
+	return inconsistencies
+}
+
 // Close cleans up swap
+// it cancels all background goroutines and blocks until they have exited, then saves all balances
+// it is safe to call Close more than once, later calls return the result of the first one
 func (s *Swap) Close() error {
-	return s.store.Close()
+	s.closeOnce.Do(func() {
+		s.backgroundLock.Lock()
+		s.cancel()
+		s.backgroundLock.Unlock()
+		s.background.Wait()
+
+		s.flushBalances()
+		if backend, ok := s.backend.(*chain.ReconnectingBackend); ok {
+			backend.Close()
+		}
+		s.closeErr = s.store.Close()
+	})
+	return s.closeErr
+}
+
+// runBackground runs f in a goroutine which Close waits for
+// f has to return once ctx is done. it is not run at all if s is already closed
+func (s *Swap) runBackground(f func(ctx context.Context)) {
+	s.backgroundLock.Lock()
+	defer s.backgroundLock.Unlock()
+	if s.ctx.Err() != nil {
+		return
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		f(s.ctx)
+	}()
+}
+
+// ChainID returns the ID of the chain the backend is connected to
+func (s *Swap) ChainID() uint64 {
+	return s.chainID
 }
 
 // GetParams returns contract parameters (Bin, ABI, contractAddress) from the contract
 func (s *Swap) GetParams() *contract.Params {
-	return s.contract.ContractParams()
+	return s.getContract().ContractParams()
+}
+
+// getContract returns our chequebook
+func (s *Swap) getContract() contract.Contract {
+	s.contractLock.RLock()
+	defer s.contractLock.RUnlock()
+	return s.contract
+}
+
+// checkBackend returns ErrNoBackend if Swap was created without a blockchain backend
+// it guards operations which would otherwise panic deep inside the contract bindings
+func (s *Swap) checkBackend() error {
+	if s.backend == nil {
+		return ErrNoBackend
+	}
+	return nil
 }
 
 // getContractOwner retrieve the owner of the chequebook at address from the blockchain
 func (s *Swap) getContractOwner(ctx context.Context, address common.Address) (common.Address, error) {
+	if err := s.checkBackend(); err != nil {
+		return common.Address{}, fmt.Errorf("reading issuer of chequebook at %v: %w", address.Hex(), err)
+	}
 	contr, err := contract.InstanceAt(address, s.backend)
 	if err != nil {
-		return common.Address{}, err
+		return common.Address{}, fmt.Errorf("instantiating chequebook at %v: %w", address.Hex(), err)
 	}
 
-	return contr.Issuer(nil)
+	issuer, err := contr.Issuer(&bind.CallOpts{Context: ctx})
+	if err != nil {
+		return common.Address{}, fmt.Errorf("reading issuer of chequebook at %v: %w", address.Hex(), err)
+	}
+	return issuer, nil
 }
 
 // promptDepositAmount blocks and asks the user how much ERC20 he wants to deposit
@@ -588,11 +1736,11 @@ func (s *Swap) promptDepositAmount() (*big.Int, error) {
 	// retrieve available balance
 	availableBalance, err := s.AvailableBalance()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("getting available balance: %w", err)
 	}
-	balance, err := s.contract.BalanceAtTokenContract(nil, s.owner.address)
+	balance, err := s.getContract().BalanceAtTokenContract(nil, s.owner.address)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("getting ERC20 balance: %w", err)
 	}
 	// log available balance and ERC20 balance
 	s.logger.Info(InitAction, "Balance information", "chequebook available balance", availableBalance, "ERC20 balance", balance)
@@ -602,7 +1750,7 @@ func (s *Swap) promptDepositAmount() (*big.Int, error) {
 	// ask user for input
 	input, err := prompter.PromptInput(promptMessage)
 	if err != nil {
-		return &big.Int{}, err
+		return &big.Int{}, fmt.Errorf("reading user input: %w", err)
 	}
 	// check input
 	val, err := strconv.ParseInt(input, 10, 64)
@@ -631,7 +1779,7 @@ func (s *Swap) StartChequebook(chequebookAddrFlag common.Address) (contract cont
 			return nil, err
 		}
 		if err := s.saveChequebook(contract.ContractParams().ContractAddress); err != nil {
-			return nil, err
+			return nil, fmt.Errorf("saving chequebook address: %w", err)
 		}
 		s.logger.Info(InitAction, "Deployed chequebook", "contract address", contract.ContractParams().ContractAddress.Hex(), "owner", s.owner.address)
 		return contract, nil
@@ -646,35 +1794,155 @@ func (s *Swap) StartChequebook(chequebookAddrFlag common.Address) (contract cont
 
 // BindToContractAt binds to an instance of an already existing chequebook contract at address
 func (s *Swap) bindToContractAt(address common.Address) (contract.Contract, error) {
-	// validate whether address is a chequebook
-	if err := s.chequebookFactory.VerifyContract(address); err != nil {
+	if err := s.checkBackend(); err != nil {
 		return nil, fmt.Errorf("contract validation for %v: %w", address.Hex(), err)
 	}
+	if err := s.verifyChequebook(context.Background(), address); err != nil {
+		return nil, err
+	}
 	s.logger.Info(InitAction, "bound to chequebook", "chequebookAddr", address)
 	// get the instance
-	return contract.InstanceAt(address, s.backend)
+	instance, err := contract.InstanceAt(address, s.backend)
+	if err != nil {
+		return nil, fmt.Errorf("instantiating chequebook at %v: %w", address.Hex(), err)
+	}
+	return instance, nil
+}
+
+// verifyChequebook checks that address is a chequebook deployed by the factory and issued by the owner
+func (s *Swap) verifyChequebook(ctx context.Context, address common.Address) error {
+	// validate whether address is a chequebook
+	if err := s.chequebookFactory.VerifyContract(address); err != nil {
+		return fmt.Errorf("contract validation for %v: %w", address.Hex(), err)
+	}
+	// the chequebook must be issued by our own key, otherwise none of our cheques could be cashed
+	issuer, err := s.getContractOwner(ctx, address)
+	if err != nil {
+		return err
+	}
+	if issuer != s.owner.address {
+		return fmt.Errorf("%w: chequebook %v is issued by %v, but owner is %v", ErrChequebookOwnerMismatch, address.Hex(), issuer.Hex(), s.owner.address.Hex())
+	}
+	return nil
+}
+
+// VerifyContract verifies the chequebook again, e.g. after the node was migrated or if the chequebook is suspected to be tampered with
+// if the chequebook has no code anymore or fails verification, it is marked unusable and no more cheques are issued from it
+// if it passes, it is usable again. Errors of the backend leave the state of the chequebook unchanged
+func (s *Swap) VerifyContract(ctx context.Context) error {
+	if err := s.checkBackend(); err != nil {
+		return fmt.Errorf("verifying chequebook: %w", err)
+	}
+	address := s.GetParams().ContractAddress
+	code, err := s.backend.CodeAt(ctx, address, nil)
+	if err != nil {
+		return fmt.Errorf("reading code of chequebook at %v: %w", address.Hex(), err)
+	}
+	if len(code) == 0 {
+		err = fmt.Errorf("no code at chequebook %v", address.Hex())
+	} else {
+		err = s.verifyChequebook(ctx, address)
+		if err != nil && !errors.Is(err, contract.ErrNotDeployedByFactory) && !errors.Is(err, ErrChequebookOwnerMismatch) {
+			return err
+		}
+	}
+
+	s.chequebookErrLock.Lock()
+	defer s.chequebookErrLock.Unlock()
+	if err != nil {
+		s.chequebookErr = fmt.Errorf("%w: %v", ErrChequebookUnusable, err)
+		metrics.GetOrRegisterGauge("swap/chequebook/unusable", nil).Update(1)
+		s.logger.Error(InitAction, "chequebook failed verification, no more cheques are issued", "err", err)
+		return s.chequebookErr
+	}
+	if s.chequebookErr != nil {
+		s.logger.Info(InitAction, "chequebook passed verification again", "chequebookAddr", address)
+	}
+	s.chequebookErr = nil
+	metrics.GetOrRegisterGauge("swap/chequebook/unusable", nil).Update(0)
+	return nil
+}
+
+// checkChequebookPeriodically verifies the chequebook every interval until ctx is done
+// a chequebook which was selfdestructed has no code anymore, so no more uncashable cheques are issued from it once this is detected
+func (s *Swap) checkChequebookPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if err := s.VerifyContract(ctx); err != nil && !errors.Is(err, ErrChequebookUnusable) {
+				s.logger.Warn(InitAction, "error while checking chequebook", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getChequebookErr returns the reason why the chequebook is unusable, or nil if it is usable
+func (s *Swap) getChequebookErr() error {
+	s.chequebookErrLock.RLock()
+	defer s.chequebookErrLock.RUnlock()
+	return s.chequebookErr
+}
+
+// deployment is a deployment of a chequebook by Deploy, whose result is shared with the callers waiting for it
+type deployment struct {
+	done       chan struct{}     // closed once the deployment finished
+	chequebook contract.Contract // deployed chequebook, nil if the deployment failed
+	err        error             // reason why the deployment failed
 }
 
 // Deploy deploys the Swap contract
+// deployments are serialized, concurrent callers wait for the deployment in progress and get its result instead of deploying another chequebook
+// a call after the deployment finished deploys a new chequebook
 func (s *Swap) Deploy(ctx context.Context) (contract.Contract, error) {
-	opts := bind.NewKeyedTransactor(s.owner.privateKey)
+	if err := s.checkBackend(); err != nil {
+		return nil, fmt.Errorf("failed to deploy chequebook: %w", err)
+	}
+	s.deployLock.Lock()
+	if d := s.deploying; d != nil {
+		s.deployLock.Unlock()
+		s.logger.Info(DeployChequebookAction, "waiting for chequebook deployment in progress")
+		select {
+		case <-d.done:
+			return d.chequebook, d.err
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to deploy chequebook: %w", ctx.Err())
+		}
+	}
+	d := &deployment{done: make(chan struct{})}
+	s.deploying = d
+	s.deployLock.Unlock()
+	defer func() {
+		s.deployLock.Lock()
+		s.deploying = nil
+		s.deployLock.Unlock()
+		close(d.done)
+	}()
+
+	opts := newTransactor(s.owner.signer)
 	opts.Context = ctx
 	s.logger.Info(DeployChequebookAction, "Deploying new swap", "owner", opts.From.Hex())
-	chequebook, err := s.chequebookFactory.DeploySimpleSwap(opts, s.owner.address, big.NewInt(int64(defaultHarddepositTimeoutDuration)))
-	if err != nil {
-		return nil, fmt.Errorf("failed to deploy chequebook: %w", err)
+	d.chequebook, d.err = s.chequebookFactory.DeploySimpleSwap(opts, s.owner.address, big.NewInt(int64(defaultHarddepositTimeoutDuration)))
+	if d.err != nil {
+		d.err = fmt.Errorf("failed to deploy chequebook: %w", d.err)
 	}
-	return chequebook, nil
+	return d.chequebook, d.err
 }
 
 // Deposit deposits ERC20 into the chequebook contract
 func (s *Swap) Deposit(ctx context.Context, amount *big.Int) error {
-	opts := bind.NewKeyedTransactor(s.owner.privateKey)
+	if err := s.checkBackend(); err != nil {
+		return fmt.Errorf("depositing into chequebook: %w", err)
+	}
+	opts := newTransactor(s.owner.signer)
 	opts.Context = ctx
 	s.logger.Info(InitAction, "Depositing ERC20 into chequebook", "amount", amount)
-	rec, err := s.contract.Deposit(opts, amount)
+	rec, err := s.getContract().Deposit(opts, amount)
 	if err != nil {
-		return err
+		return fmt.Errorf("depositing into chequebook: %w", err)
 	}
 	s.logger.Info(InitAction, "Deposited ERC20 into chequebook", "amount", amount, "transaction", rec.TxHash)
 	return nil
@@ -689,3 +1957,9 @@ func (s *Swap) loadChequebook() (common.Address, error) {
 func (s *Swap) saveChequebook(chequebook common.Address) error {
 	return s.store.Put(connectedChequebookKey, chequebook)
 }
+
+// isPreviousChequebook reports whether chequebook is one we switched from, see SwitchChequebook
+func (s *Swap) isPreviousChequebook(chequebook common.Address) bool {
+	var switchedAt time.Time
+	return s.store.Get(previousChequebookKey(chequebook), &switchedAt) == nil
+}
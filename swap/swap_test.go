@@ -23,9 +23,11 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/big"
 	mrand "math/rand"
 	"os"
@@ -33,6 +35,8 @@ import (
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -179,6 +183,71 @@ func TestStoreBalances(t *testing.T) {
 	comparePeerBalance(t, s, testPeer2ID, peer2Balance)
 }
 
+// TestBalancePersistThreshold tests that balance changes are only saved once they add up to the persist threshold
+// and that the balance is saved when the peer disconnects
+func TestBalancePersistThreshold(t *testing.T) {
+	s, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	s.params.BalancePersistThreshold = 100
+
+	testPeer, err := s.addPeer(newDummyPeer().Peer, common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPeerID := testPeer.ID()
+
+	for _, booking := range []struct {
+		amount        int64
+		storedBalance int64
+	}{
+		{10, 0},
+		{89, 0},
+		{1, 100},
+		{-50, 100},
+		{-50, 0},
+		{-99, 0},
+	} {
+		if err := s.Add(booking.amount, testPeer.Peer); err != nil {
+			t.Fatal(err)
+		}
+		comparePeerBalance(t, s, testPeerID, booking.storedBalance)
+	}
+
+	s.removePeer(testPeer)
+	comparePeerBalance(t, s, testPeerID, -99)
+}
+
+// TestBalancePersistInterval tests that balance changes below the persist threshold are saved every persist interval
+func TestBalancePersistInterval(t *testing.T) {
+	s, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	s.params.BalancePersistThreshold = 100
+	s.params.BalancePersistInterval = time.Minute
+	clock := newTestClock(time.Now())
+	s.clock = clock
+
+	testPeer, err := s.addPeer(newDummyPeer().Peer, common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	// tickers of the balance flushing and the cashout queue
+	clock.waitForTicker(t)
+	clock.waitForTicker(t)
+
+	if err := s.Add(10, testPeer.Peer); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute - time.Second)
+	comparePeerBalance(t, s, testPeer.ID(), 0)
+
+	// the tick after the next one is only received once the balances were flushed on the first one
+	clock.Advance(time.Minute + time.Second)
+	comparePeerBalance(t, s, testPeer.ID(), 10)
+}
+
 func comparePeerBalance(t *testing.T, s *Swap, peer enode.ID, expectedPeerBalance int64) {
 	t.Helper()
 	var peerBalance int64
@@ -294,7 +363,7 @@ func TestNewSwapFailure(t *testing.T) {
 			check: func(t *testing.T, config *testSwapConfig) {
 				_, err := New(
 					config.dbPath,
-					config.prvkey,
+					NewLocalSigner(config.prvkey),
 					config.backendURL,
 					config.params,
 					config.chequebookAddress,
@@ -319,7 +388,7 @@ func TestNewSwapFailure(t *testing.T) {
 			check: func(t *testing.T, config *testSwapConfig) {
 				_, err := New(
 					config.dbPath,
-					config.prvkey,
+					NewLocalSigner(config.prvkey),
 					config.backendURL,
 					config.params,
 					config.chequebookAddress,
@@ -345,7 +414,7 @@ func TestNewSwapFailure(t *testing.T) {
 				defer os.RemoveAll(config.dbPath)
 				_, err := New(
 					config.dbPath,
-					config.prvkey,
+					NewLocalSigner(config.prvkey),
 					config.backendURL,
 					config.params,
 					config.chequebookAddress,
@@ -371,7 +440,7 @@ func TestNewSwapFailure(t *testing.T) {
 				defer os.RemoveAll(config.dbPath)
 				_, err := New(
 					config.dbPath,
-					config.prvkey,
+					NewLocalSigner(config.prvkey),
 					config.backendURL,
 					config.params,
 					config.chequebookAddress,
@@ -466,6 +535,29 @@ func TestStartChequebookFailure(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:      "with pass in issued by another owner",
+			configure: func(config *chequebookConfig) {},
+			check: func(t *testing.T, config *chequebookConfig) {
+				// deploy a chequebook issued by the owner
+				ownerSwap, clean := newTestSwap(t, ownerKey, config.testBackend)
+				defer clean()
+				err := testDeploy(context.TODO(), ownerSwap, int256.Uint256From(0))
+				if err != nil {
+					t.Fatal(err)
+				}
+				passIn := ownerSwap.GetParams().ContractAddress
+
+				// try to connect to it with the key of the beneficiary
+				swap, clean := newTestSwap(t, beneficiaryKey, config.testBackend)
+				defer clean()
+				_, err = swap.StartChequebook(passIn)
+				expectedError := fmt.Errorf("%w: chequebook %v is issued by %v, but owner is %v", ErrChequebookOwnerMismatch, passIn.Hex(), ownerAddress.Hex(), beneficiaryAddress.Hex())
+				if err == nil || err.Error() != expectedError.Error() {
+					t.Fatal(fmt.Errorf("expected error not equal to actual error. Expected: %v. Actual: %v", expectedError, err))
+				}
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			testBackend := newTestBackend(t)
@@ -546,7 +638,116 @@ func TestStartChequebookSuccess(t *testing.T) {
 	}
 }
 
+// TestNilBackend tests that operations which need the blockchain fail with ErrNoBackend
+// on a Swap created without a backend instead of panicking
+func TestNilBackend(t *testing.T) {
+	params := newDefaultParams(t)
+	swap := newSwapInstance(state.NewInmemoryStore(), createOwner(NewLocalSigner(ownerKey)), nil, 10, params, nil, newSwapLogger(params.LogPath, params.LogLevel, params.BaseAddrs))
+	defer swap.Close()
+
+	if _, err := swap.Deploy(context.Background()); !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("expected deploy to fail with %v, got %v", ErrNoBackend, err)
+	}
+	if _, err := swap.StartChequebook(testChequeContract); !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("expected starting a chequebook to fail with %v, got %v", ErrNoBackend, err)
+	}
+	if _, err := swap.getContractOwner(context.Background(), testChequeContract); !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("expected reading the chequebook owner to fail with %v, got %v", ErrNoBackend, err)
+	}
+	if _, err := swap.AvailableBalance(); !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("expected available balance to fail with %v, got %v", ErrNoBackend, err)
+	}
+	if err := swap.Deposit(context.Background(), big.NewInt(1)); !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("expected deposit to fail with %v, got %v", ErrNoBackend, err)
+	}
+
+	// accounting does not need the backend
+	testPeer := newDummyPeer()
+	if _, err := swap.addPeer(testPeer.Peer, common.Address{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.Add(1, testPeer.Peer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingDeployFactory is a chequebook factory whose deployments wait until released and are counted
+type blockingDeployFactory struct {
+	cswap.SimpleSwapFactory
+	started     chan struct{}
+	release     chan struct{}
+	deployments int32
+}
+
+// DeploySimpleSwap deploys the chequebook once the deployment is released
+func (f *blockingDeployFactory) DeploySimpleSwap(auth *bind.TransactOpts, issuer common.Address, defaultHardDepositTimeoutDuration *big.Int) (cswap.Contract, error) {
+	if atomic.AddInt32(&f.deployments, 1) == 1 {
+		close(f.started)
+	}
+	<-f.release
+	return f.SimpleSwapFactory.DeploySimpleSwap(auth, issuer, defaultHardDepositTimeoutDuration)
+}
+
+// TestDeploySerialized tests that concurrent deployments result in a single chequebook
+// and that a deployment after it finished deploys a new one
+func TestDeploySerialized(t *testing.T) {
+	swap, dir := newBaseTestSwap(t, ownerKey, newTestBackend(t))
+	defer os.RemoveAll(dir)
+	defer swap.Close()
+	cleanup := setupContractTest()
+	defer cleanup()
+	factory := &blockingDeployFactory{SimpleSwapFactory: swap.chequebookFactory, started: make(chan struct{}), release: make(chan struct{})}
+	swap.chequebookFactory = factory
+
+	const deployers = 4
+	addresses := make([]common.Address, deployers)
+	errs := make([]error, deployers)
+	var wg sync.WaitGroup
+	deploy := func(i int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			chequebook, err := swap.Deploy(context.Background())
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			addresses[i] = chequebook.ContractParams().ContractAddress
+		}()
+	}
+	// the other callers start while the first deployment is in progress
+	deploy(0)
+	<-factory.started
+	for i := 1; i < deployers; i++ {
+		deploy(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(factory.release)
+	wg.Wait()
+
+	for i := 0; i < deployers; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if addresses[i] != addresses[0] {
+			t.Fatalf("expected all deployments to return chequebook %x, got %x", addresses[0], addresses[i])
+		}
+	}
+	if deployments := atomic.LoadInt32(&factory.deployments); deployments != 1 {
+		t.Fatalf("expected 1 deployment, got %d", deployments)
+	}
+
+	chequebook, err := swap.Deploy(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chequebook.ContractParams().ContractAddress == addresses[0] {
+		t.Fatalf("expected a later deployment to deploy a new chequebook, got %x again", addresses[0])
+	}
+}
+
 //TestDisconnectThreshold tests that the disconnect threshold is reached when adding the DefaultDisconnectThreshold amount to the peers balance
+// and that the OnDisconnectThreshold hook is called when it is crossed
 func TestDisconnectThreshold(t *testing.T) {
 	swap, clean := newTestSwap(t, ownerKey, nil)
 	defer clean()
@@ -555,16 +756,36 @@ func TestDisconnectThreshold(t *testing.T) {
 	testPeer := newDummyPeer()
 	swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress)
 
+	var disconnectBalances []int64
+	swap.SetAccountingHooks(AccountingHooks{
+		OnDisconnectThreshold: func(peer enode.ID, balance int64) {
+			// the hook is called without holding the lock of the peer, so it may call back into swap
+			if _, err := swap.PeerBalance(peer); err != nil {
+				t.Error(err)
+			}
+			if peer != testPeer.ID() {
+				t.Errorf("expected hook to be called for peer %v, got %v", testPeer.ID(), peer)
+			}
+			disconnectBalances = append(disconnectBalances, balance)
+		},
+	})
+
 	// leave balance exactly at disconnect threshold
 	swap.Add(int64(DefaultDisconnectThreshold), testPeer.Peer)
+	if len(disconnectBalances) != 0 {
+		t.Fatalf("expected no disconnect at the threshold, got %v", disconnectBalances)
+	}
 	// account for traffic which increases debt
 	err := swap.Add(1, testPeer.Peer)
 	if err == nil {
 		t.Fatal("expected accounting operation to fail, but it didn't")
 	}
-	if !strings.Contains(err.Error(), "disconnect threshold") {
+	if !errors.Is(err, ErrDisconnectThreshold) {
 		t.Fatal(err)
 	}
+	if !reflect.DeepEqual(disconnectBalances, []int64{int64(DefaultDisconnectThreshold)}) {
+		t.Fatalf("expected the hook to be called with balance %d, got %v", DefaultDisconnectThreshold, disconnectBalances)
+	}
 	// account for traffic which reduces debt, which should be allowed even when over the threshold
 	err = swap.Add(-1, testPeer.Peer)
 	if err != nil {
@@ -572,171 +793,639 @@ func TestDisconnectThreshold(t *testing.T) {
 	}
 }
 
-//TestPaymentThreshold tests that the payment threshold is reached when subtracting the DefaultPaymentThreshold amount from the peers balance
-func TestPaymentThreshold(t *testing.T) {
+// TestDisconnectPolicy tests that, unless the policy is to disconnect, an amount over the disconnect threshold is refused
+// without signaling a drop, that with Throttle the message is not served while with SuspendAccounting it is,
+// and that the balance is not changed either way
+func TestDisconnectPolicy(t *testing.T) {
 	swap, clean := newTestSwap(t, ownerKey, nil)
 	defer clean()
-	testDeploy(context.Background(), swap, int256.Uint256From(DefaultPaymentThreshold))
-	testPeer := newDummyPeerWithSpec(Spec)
-	swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress)
-	if err := swap.Add(-int64(DefaultPaymentThreshold), testPeer.Peer); err != nil {
-		t.Fatal()
+	testDeploy(context.Background(), swap, int256.Uint256From(0))
+
+	testPeer := newDummyPeer()
+	if _, err := swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.Add(int64(DefaultDisconnectThreshold), testPeer.Peer); err != nil {
+		t.Fatal(err)
 	}
 
-	var cheque *Cheque
-	_ = swap.store.Get(pendingChequeKey(testPeer.Peer.ID()), &cheque)
-	if !cheque.CumulativePayout.Equals(int256.Uint256From(DefaultPaymentThreshold)) {
-		t.Fatal()
+	if err := swap.SetDisconnectPolicy(DisconnectPolicy(len(disconnectPolicyNames))); err == nil {
+		t.Fatal("expected an unknown policy to be refused")
+	}
+	for _, tc := range []struct {
+		policy   DisconnectPolicy
+		checkErr bool
+	}{
+		{Throttle, true},
+		{SuspendAccounting, false},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			if err := swap.SetDisconnectPolicy(tc.policy); err != nil {
+				t.Fatal(err)
+			}
+			if policy, _ := swap.DisconnectPolicy(); policy != tc.policy {
+				t.Fatalf("expected policy %v, got %v", tc.policy, policy)
+			}
+			if err := swap.Check(1, testPeer.Peer); (err != nil) != tc.checkErr {
+				t.Fatalf("expected check to fail: %v, got error %v", tc.checkErr, err)
+			}
+			err := swap.Add(1, testPeer.Peer)
+			if !errors.Is(err, ErrDisconnectThreshold) {
+				t.Fatalf("expected error %v, got %v", ErrDisconnectThreshold, err)
+			}
+			balance, err := swap.PeerBalance(testPeer.ID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if balance != int64(DefaultDisconnectThreshold) {
+				t.Fatalf("expected balance %d, got %d", DefaultDisconnectThreshold, balance)
+			}
+		})
 	}
 }
 
-// TestResetBalance tests that balances are correctly reset
-// The test deploys creates swap instances for each node,
-// deploys simulated contracts, sets the balance of each
-// other node to some arbitrary number above thresholds,
-// and then calls both `sendCheque` on one side and
-// `handleEmitChequeMsg` in order to simulate a roundtrip
-// and see that both have reset the balance correctly
-func TestResetBalance(t *testing.T) {
-	testBackend := newTestBackend(t)
-	defer testBackend.Close()
-	// create both test swap accounts
-	creditorSwap, clean1 := newTestSwap(t, beneficiaryKey, testBackend)
-	debitorSwap, clean2 := newTestSwap(t, ownerKey, testBackend)
-	defer clean1()
-	defer clean2()
-
-	testAmount := DefaultPaymentThreshold + 42
+// TestBlacklist tests that accounting with a blacklisted peer is refused
+// and that the blacklist entry is kept while the peer is disconnected
+func TestBlacklist(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	testDeploy(context.Background(), swap, int256.Uint256From(0))
 
-	ctx := context.Background()
-	err := testDeploy(ctx, creditorSwap, int256.Uint256From(0))
+	testPeer := newDummyPeer()
+	swapPeer, err := swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = testDeploy(ctx, debitorSwap, int256.Uint256From(testAmount))
-	if err != nil {
+
+	if err := swap.Blacklist(testPeer.ID()); err != nil {
 		t.Fatal(err)
 	}
+	// both increasing and reducing debt must be refused
+	for _, amount := range []int64{1, -1} {
+		if err := swap.Check(amount, testPeer.Peer); !errors.Is(err, ErrPeerBlacklisted) {
+			t.Fatalf("expected check of %d to fail with %v, but got %v", amount, ErrPeerBlacklisted, err)
+		}
+		if err := swap.Add(amount, testPeer.Peer); !errors.Is(err, ErrPeerBlacklisted) {
+			t.Fatalf("expected booking of %d to fail with %v, but got %v", amount, ErrPeerBlacklisted, err)
+		}
+	}
+	if swapPeer.getBalance() != 0 {
+		t.Fatalf("expected balance to be unchanged, but is %d", swapPeer.getBalance())
+	}
 
-	// create Peer instances
-	// NOTE: remember that these are peer instances representing each **a model of the remote peer** for every local node
-	// so creditor is the model of the remote mode for the debitor! (and vice versa)
-	cPeer := newDummyPeerWithSpec(Spec)
-	dPeer := newDummyPeerWithSpec(Spec)
-	creditor, err := debitorSwap.addPeer(cPeer.Peer, creditorSwap.owner.address, debitorSwap.GetParams().ContractAddress)
-	if err != nil {
+	// the entry must be restored when the peer connects again
+	swap.removePeer(swapPeer)
+	if _, err = swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
 		t.Fatal(err)
 	}
-	debitor, err := creditorSwap.addPeer(dPeer.Peer, debitorSwap.owner.address, debitorSwap.GetParams().ContractAddress)
-	if err != nil {
-		t.Fatal(err)
+	if err := swap.Add(1, testPeer.Peer); !errors.Is(err, ErrPeerBlacklisted) {
+		t.Fatalf("expected booking after reconnect to fail with %v, but got %v", ErrPeerBlacklisted, err)
 	}
 
-	// set balances arbitrarily
-	if err = debitor.setBalance(int64(testAmount)); err != nil {
+	if err := swap.Unblacklist(testPeer.ID()); err != nil {
 		t.Fatal(err)
 	}
-	if err = creditor.setBalance(int64(-testAmount)); err != nil {
-		t.Fatal(err)
+	if err := swap.Add(1, testPeer.Peer); err != nil {
+		t.Fatalf("expected booking after unblacklisting to succeed, but it failed with %v", err)
 	}
+	if blacklisted, err := swap.loadBlacklisted(testPeer.ID()); err != nil || blacklisted {
+		t.Fatalf("expected no stored blacklist entry, got %t (err: %v)", blacklisted, err)
+	}
+}
 
-	// setup the wait for mined transaction function for testing
-	cleanup := setupContractTest()
-	defer cleanup()
+// TestThresholdWeight tests that the threshold weight of a peer scales its disconnect threshold,
+// that invalid weights are rejected and that the weight is kept while the peer is disconnected
+func TestThresholdWeight(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	testDeploy(context.Background(), swap, int256.Uint256From(0))
 
-	// now simulate sending the cheque to the creditor from the debitor
-	if err = creditor.sendCheque(); err != nil {
+	testPeer := newDummyPeer()
+	swapPeer, err := swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	debitorSwap.handleConfirmChequeMsg(ctx, creditor, &ConfirmChequeMsg{
-		Cheque: creditor.getPendingCheque(),
-	})
-	// the debitor should have already reset its balance
-	if creditor.getBalance() != 0 {
-		t.Fatalf("unexpected balance to be 0, but it is %d", creditor.getBalance())
+	for _, weight := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		if err := swap.SetThresholdWeight(testPeer.ID(), weight); err == nil {
+			t.Fatalf("expected weight %v to be rejected", weight)
+		}
 	}
 
-	// now load the cheque that the debitor created...
-	cheque := creditor.getLastSentCheque()
-	if cheque == nil {
-		t.Fatal("expected to find a cheque, but it was empty")
+	if err := swap.SetThresholdWeight(testPeer.ID(), 2); err != nil {
+		t.Fatal(err)
 	}
-	// ...create a message...
-	msg := &EmitChequeMsg{
-		Cheque: cheque,
+	// the default disconnect threshold no longer applies to the peer
+	if err := swap.Add(int64(DefaultDisconnectThreshold)+1, testPeer.Peer); err != nil {
+		t.Fatalf("expected booking within the weighted disconnect threshold to succeed, but it failed with %v", err)
 	}
 
-	// ...and trigger message handling on the receiver side (creditor)
-	// remember that debitor is the model of the remote node for the creditor...
-	err = creditorSwap.handleEmitChequeMsg(ctx, debitor, msg)
-	if err != nil {
+	// the weight must be restored when the peer connects again
+	swap.removePeer(swapPeer)
+	if swapPeer, err = swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
 		t.Fatal(err)
 	}
-	// ...on which we wait until the cashCheque is actually terminated (ensures proper nonce count)
-	select {
-	case <-testBackend.cashDone:
-		creditorSwap.logger.Debug(CashChequeAction, "cash transaction completed and committed")
-	case <-time.After(4 * time.Second):
-		t.Fatalf("Timeout waiting for cash transactions to complete")
+	if err := swap.Add(int64(DefaultDisconnectThreshold)-1, testPeer.Peer); err != nil {
+		t.Fatalf("expected booking up to the weighted disconnect threshold to succeed, but it failed with %v", err)
 	}
-	// finally check that the creditor also successfully reset the balances
-	if debitor.getBalance() != 0 {
-		t.Fatalf("unexpected balance to be 0, but it is %d", debitor.getBalance())
+	if err := swap.Add(1, testPeer.Peer); err == nil || !strings.Contains(err.Error(), "disconnect threshold") {
+		t.Fatalf("expected booking over the weighted disconnect threshold to fail, but got %v", err)
 	}
-}
-
-// TestDebtCheques verifies that cheques that would put a node in debt past the defined tolerance are rejected
-// and that ones within the tolerance are accepted
-func TestDebtCheques(t *testing.T) {
-	testBackend := newTestBackend(t)
-	defer testBackend.Close()
-	cleanup := setupContractTest()
-	defer cleanup()
 
-	creditorSwap, cleanup := newTestSwap(t, beneficiaryKey, testBackend)
-	defer cleanup()
-
-	ctx := context.Background()
-	if err := testDeploy(ctx, creditorSwap, int256.Uint256From(0)); err != nil {
+	// resetting to the default weight removes the stored entry
+	if err := swap.SetThresholdWeight(testPeer.ID(), 1); err != nil {
 		t.Fatal(err)
 	}
+	if weight, err := swap.loadThresholdWeight(testPeer.ID()); err != nil || weight != 1 {
+		t.Fatalf("expected default threshold weight 1, got %v (err: %v)", weight, err)
+	}
+	if err := swap.store.Get(thresholdWeightKey(testPeer.ID()), new(float64)); err != state.ErrNotFound {
+		t.Fatalf("expected no stored threshold weight, got %v", err)
+	}
+	if got := swapPeer.getDisconnectThreshold(); got != int64(DefaultDisconnectThreshold) {
+		t.Fatalf("expected disconnect threshold %d, got %d", DefaultDisconnectThreshold, got)
+	}
+}
 
-	debitorChequebook, err := testDeployWithPrivateKey(ctx, testBackend, ownerKey, ownerAddress, int256.Uint256From((DefaultPaymentThreshold * 2)))
-	if err != nil {
+// TestAccountingHooks tests that PreAdd can veto an accounting and PostAdd observes the resulting balance
+func TestAccountingHooks(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	testDeploy(context.Background(), swap, int256.Uint256From(0))
+
+	testPeer := newDummyPeer()
+	if _, err := swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
 		t.Fatal(err)
 	}
 
-	debitorDummyPeer := newDummyPeerWithSpec(Spec)
-	debitorPeer, err := creditorSwap.addPeer(debitorDummyPeer.Peer, ownerAddress, debitorChequebook.ContractParams().ContractAddress)
-	if err != nil {
+	errVetoed := errors.New("vetoed")
+	var observed []int64
+	swap.SetAccountingHooks(AccountingHooks{
+		PreAdd: func(peer enode.ID, amount int64) error {
+			// the hooks are called without holding the lock of the peer, so they may call back into swap
+			if err := swap.Check(amount, testPeer.Peer); err != nil {
+				t.Error(err)
+			}
+			if amount > 100 {
+				return errVetoed
+			}
+			return nil
+		},
+		PostAdd: func(peer enode.ID, newBalance int64) {
+			if err := swap.Check(0, testPeer.Peer); err != nil {
+				t.Error(err)
+			}
+			if peer != testPeer.ID() {
+				t.Errorf("expected hook to be called for peer %v, got %v", testPeer.ID(), peer)
+			}
+			observed = append(observed, newBalance)
+		},
+	})
+
+	if err := swap.Add(10, testPeer.Peer); err != nil {
 		t.Fatal(err)
 	}
-
-	// create debt cheque
-	chequeAmount := int256.Uint256From(ChequeDebtTolerance * 2)
-	cheque, err := newSignedTestCheque(debitorChequebook.ContractParams().ContractAddress, creditorSwap.owner.address, chequeAmount, ownerKey)
-	if err != nil {
+	if err := swap.Add(101, testPeer.Peer); err != errVetoed {
+		t.Fatalf("expected error %v, got %v", errVetoed, err)
+	}
+	if err := swap.Add(20, testPeer.Peer); err != nil {
 		t.Fatal(err)
 	}
-
-	// simulate cheque handling
-	err = creditorSwap.handleEmitChequeMsg(ctx, debitorPeer, &EmitChequeMsg{
-		Cheque: cheque,
-	})
-	// cheque should not have gone through as it would put the creditor in debt
-	if err == nil || !strings.Contains(err.Error(), "cause debt") {
-		t.Fatalf("expected invalid cheque to trigger debt cheque error, but got: %v", err)
+	if !reflect.DeepEqual(observed, []int64{10, 30}) {
+		t.Fatalf("expected observed balances [10 30], got %v", observed)
 	}
 
-	// now create a (barely) admissible cheque
-	chequeAmount = int256.Uint256From(ChequeDebtTolerance)
-	cheque, err = newSignedTestCheque(debitorChequebook.ContractParams().ContractAddress, creditorSwap.owner.address, chequeAmount, ownerKey)
-	if err != nil {
+	// without hooks every amount is accounted again
+	swap.SetAccountingHooks(AccountingHooks{})
+	if err := swap.Add(101, testPeer.Peer); err != nil {
 		t.Fatal(err)
 	}
+	if balance, err := swap.PeerBalance(testPeer.ID()); err != nil || balance != 131 {
+		t.Fatalf("expected balance 131, got %d (err: %v)", balance, err)
+	}
+}
 
-	// simulate cheque handling
+//TestPaymentThreshold tests that the payment threshold is reached when subtracting the DefaultPaymentThreshold amount from the peers balance
+func TestPaymentThreshold(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	testDeploy(context.Background(), swap, int256.Uint256From(DefaultPaymentThreshold))
+	testPeer := newDummyPeerWithSpec(Spec)
+	swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress)
+	if err := swap.Add(-int64(DefaultPaymentThreshold), testPeer.Peer); err != nil {
+		t.Fatal()
+	}
+
+	var cheque *Cheque
+	_ = swap.store.Get(pendingChequeKey(testPeer.Peer.ID()), &cheque)
+	if !cheque.CumulativePayout.Equals(int256.Uint256From(DefaultPaymentThreshold)) {
+		t.Fatal()
+	}
+}
+
+// TestZeroPriceCheque tests that no cheque is sent for debt which the oracle prices at zero,
+// so that the balance is not reset without anything being paid
+func TestZeroPriceCheque(t *testing.T) {
+	for _, failOnZeroPrice := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fail=%v", failOnZeroPrice), func(t *testing.T) {
+			swap, clean := newTestSwap(t, ownerKey, nil)
+			defer clean()
+			testDeploy(context.Background(), swap, int256.Uint256From(DefaultPaymentThreshold))
+			swap.params.FailOnZeroPrice = failOnZeroPrice
+			oracle := &testOracle{}
+			swap.honeyPriceOracle = oracle
+
+			testPeer := newDummyPeerWithSpec(Spec)
+			if _, err := swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
+				t.Fatal(err)
+			}
+			err := swap.Add(-int64(DefaultPaymentThreshold), testPeer.Peer)
+			if failOnZeroPrice && !errors.Is(err, ErrZeroPrice) {
+				t.Fatalf("expected error %v, got %v", ErrZeroPrice, err)
+			}
+			if !failOnZeroPrice && err != nil {
+				t.Fatal(err)
+			}
+			if balance, err := swap.PeerBalance(testPeer.ID()); err != nil || balance != -int64(DefaultPaymentThreshold) {
+				t.Fatalf("expected balance %d, got %d (err: %v)", -int64(DefaultPaymentThreshold), balance, err)
+			}
+			pending, err := swap.loadPendingCheque(testPeer.ID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pending != nil {
+				t.Fatalf("expected no cheque, got %v", pending)
+			}
+
+			// once the debt has a price, it is paid
+			oracle.setPrice(1)
+			if err := swap.Add(-1, testPeer.Peer); err != nil {
+				t.Fatal(err)
+			}
+			if balance, err := swap.PeerBalance(testPeer.ID()); err != nil || balance != 0 {
+				t.Fatalf("expected balance 0, got %d (err: %v)", balance, err)
+			}
+			if pending, err = swap.loadPendingCheque(testPeer.ID()); err != nil || pending == nil || pending.Honey != DefaultPaymentThreshold+1 {
+				t.Fatalf("expected a cheque for %d honey, got %v (err: %v)", DefaultPaymentThreshold+1, pending, err)
+			}
+		})
+	}
+}
+
+// TestAddNet tests that a credit and a debit are accounted at once, with the thresholds checked only on the net amount
+func TestAddNet(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(DefaultPaymentThreshold*2)); err != nil {
+		t.Fatal(err)
+	}
+	testPeer := newDummyPeerWithSpec(Spec)
+	if _, err := swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := swap.AddNet(-1, 0, testPeer.Peer); err == nil {
+		t.Fatal("expected a negative credit to fail")
+	}
+	if err := swap.AddNet(0, -1, testPeer.Peer); err == nil {
+		t.Fatal("expected a negative debit to fail")
+	}
+
+	// the debit alone would be over the payment threshold
+	credit, debit := int64(DefaultPaymentThreshold), int64(DefaultPaymentThreshold*2-1)
+	if err := swap.AddNet(credit, debit, testPeer.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := swap.PeerBalance(testPeer.ID()); err != nil || balance != credit-debit {
+		t.Fatalf("expected balance %d, got %d (err: %v)", credit-debit, balance, err)
+	}
+	if pending, err := swap.loadPendingCheque(testPeer.ID()); err != nil || pending != nil {
+		t.Fatalf("expected no cheque, got %v (err: %v)", pending, err)
+	}
+
+	// the net amount reaches the payment threshold
+	if err := swap.AddNet(0, 1, testPeer.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := swap.PeerBalance(testPeer.ID()); err != nil || balance != 0 {
+		t.Fatalf("expected balance 0, got %d (err: %v)", balance, err)
+	}
+	if pending, err := swap.loadPendingCheque(testPeer.ID()); err != nil || pending == nil || pending.Honey != DefaultPaymentThreshold {
+		t.Fatalf("expected a cheque for %d honey, got %v (err: %v)", DefaultPaymentThreshold, pending, err)
+	}
+}
+
+// TestMinChargeableHoney tests that amounts below the minimum are only accounted once they add up to it
+func TestMinChargeableHoney(t *testing.T) {
+	s, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	s.params.MinChargeableHoney = 10
+
+	testPeer := addPeer(t, s)
+	for _, booking := range []struct {
+		amount  int64
+		balance int64
+	}{
+		{3, 0},
+		{6, 0},
+		{1, 10},  // adds up to the minimum
+		{10, 20}, // at the minimum
+		{-4, 20},
+		{2, 20}, // debits and credits offset each other
+		{-8, 10},
+		{-25, -15},
+		{9, -15},
+	} {
+		if err := s.Add(booking.amount, testPeer.Peer); err != nil {
+			t.Fatal(err)
+		}
+		if balance, err := s.PeerBalance(testPeer.ID()); err != nil || balance != booking.balance {
+			t.Fatalf("expected balance %d after adding %d, got %d (err: %v)", booking.balance, booking.amount, balance, err)
+		}
+	}
+}
+
+// TestSendChequeTimeout tests that sending a cheque to a peer which does not read gives up after the send timeout
+// and does not block the accounting with the peer
+func TestSendChequeTimeout(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	testDeploy(context.Background(), swap, int256.Uint256From(DefaultPaymentThreshold))
+	swap.params.SendTimeout = 100 * time.Millisecond
+
+	rw := &blockingMsgRW{release: make(chan struct{})}
+	defer close(rw.release)
+	testPeer := newDummyPeerWithRW(Spec, rw).Peer
+	if _, err := swap.addPeer(testPeer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- swap.Add(-int64(DefaultPaymentThreshold), testPeer)
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected sending the cheque to time out, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending the cheque did not time out")
+	}
+
+	// the lock of the peer was released
+	if err := swap.Check(1, testPeer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentAdd checks that concurrent bookings for many peers are accounted correctly
+// every peer is booked by several goroutines at once, so the payment threshold is crossed exactly once per peer
+// run with -race to detect unsynchronized access to the peer state
+func TestConcurrentAdd(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		peerCount       = 16
+		bookersPerPeer  = 4
+		bookingsPerPeer = 20
+	)
+	// round up so that the last booking of each peer crosses the payment threshold
+	amount := -(int64(DefaultPaymentThreshold) + bookingsPerPeer - 1) / bookingsPerPeer
+	expectedPayout := int256.Uint256From(uint64(-amount * bookingsPerPeer))
+
+	var peers []*protocols.Peer
+	for i := 0; i < peerCount; i++ {
+		testPeer := newDummyPeerWithSpec(Spec)
+		if _, err := swap.addPeer(testPeer.Peer, ownerAddress, testChequeContract); err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, testPeer.Peer)
+	}
+
+	var wg sync.WaitGroup
+	errc := make(chan error, peerCount*bookingsPerPeer)
+	for _, p := range peers {
+		for i := 0; i < bookersPerPeer; i++ {
+			wg.Add(1)
+			go func(p *protocols.Peer) {
+				defer wg.Done()
+				for j := 0; j < bookingsPerPeer/bookersPerPeer; j++ {
+					if err := swap.Add(amount, p); err != nil {
+						errc <- err
+					}
+				}
+			}(p)
+		}
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Fatal(err)
+	}
+
+	for _, p := range peers {
+		swapPeer := swap.getPeer(p.ID())
+		if balance := swapPeer.getBalance(); balance != 0 {
+			t.Fatalf("expected balance of peer %v to be 0, but is %d", p.ID(), balance)
+		}
+		cheque := swapPeer.getPendingCheque()
+		if cheque == nil {
+			t.Fatalf("expected pending cheque for peer %v", p.ID())
+		}
+		if !cheque.CumulativePayout.Equals(expectedPayout) {
+			t.Fatalf("expected cumulative payout for peer %v to be %v, but is %v", p.ID(), expectedPayout, cheque.CumulativePayout)
+		}
+	}
+}
+
+// BenchmarkConcurrentChequeCreation measures cheque creation with every goroutine working on its own peer
+// as peers are locked individually, throughput should scale with GOMAXPROCS (see -cpu)
+func BenchmarkConcurrentChequeCreation(b *testing.B) {
+	swap, clean := newTestSwap(b, ownerKey, nil)
+	defer clean()
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(0)); err != nil {
+		b.Fatal(err)
+	}
+
+	var peers []*Peer
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		swapPeer, err := swap.addPeer(newDummyPeerWithSpec(Spec).Peer, ownerAddress, testChequeContract)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := swapPeer.updateBalance(-int64(DefaultPaymentThreshold)); err != nil {
+			b.Fatal(err)
+		}
+		peers = append(peers, swapPeer)
+	}
+
+	var next int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		swapPeer := peers[int(atomic.AddInt32(&next, 1)-1)%len(peers)]
+		for pb.Next() {
+			swapPeer.lock.Lock()
+			_, err := swapPeer.createCheque()
+			swapPeer.lock.Unlock()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestResetBalance tests that balances are correctly reset
+// The test deploys creates swap instances for each node,
+// deploys simulated contracts, sets the balance of each
+// other node to some arbitrary number above thresholds,
+// and then calls both `sendCheque` on one side and
+// `handleEmitChequeMsg` in order to simulate a roundtrip
+// and see that both have reset the balance correctly
+func TestResetBalance(t *testing.T) {
+	testBackend := newTestBackend(t)
+	defer testBackend.Close()
+	// create both test swap accounts
+	creditorSwap, clean1 := newTestSwap(t, beneficiaryKey, testBackend)
+	debitorSwap, clean2 := newTestSwap(t, ownerKey, testBackend)
+	defer clean1()
+	defer clean2()
+
+	testAmount := DefaultPaymentThreshold + 42
+
+	ctx := context.Background()
+	err := testDeploy(ctx, creditorSwap, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testDeploy(ctx, debitorSwap, int256.Uint256From(testAmount))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create Peer instances
+	// NOTE: remember that these are peer instances representing each **a model of the remote peer** for every local node
+	// so creditor is the model of the remote mode for the debitor! (and vice versa)
+	cPeer := newDummyPeerWithSpec(Spec)
+	dPeer := newDummyPeerWithSpec(Spec)
+	creditor, err := debitorSwap.addPeer(cPeer.Peer, creditorSwap.owner.address, debitorSwap.GetParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	debitor, err := creditorSwap.addPeer(dPeer.Peer, debitorSwap.owner.address, debitorSwap.GetParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// set balances arbitrarily
+	if err = debitor.setBalance(int64(testAmount)); err != nil {
+		t.Fatal(err)
+	}
+	if err = creditor.setBalance(int64(-testAmount)); err != nil {
+		t.Fatal(err)
+	}
+
+	// setup the wait for mined transaction function for testing
+	cleanup := setupContractTest()
+	defer cleanup()
+
+	// now simulate sending the cheque to the creditor from the debitor
+	if _, err = creditor.sendCheque(); err != nil {
+		t.Fatal(err)
+	}
+
+	debitorSwap.handleConfirmChequeMsg(ctx, creditor, &ConfirmChequeMsg{
+		Cheque: creditor.getPendingCheque(),
+	})
+	// the debitor should have already reset its balance
+	if creditor.getBalance() != 0 {
+		t.Fatalf("unexpected balance to be 0, but it is %d", creditor.getBalance())
+	}
+
+	// now load the cheque that the debitor created...
+	cheque := creditor.getLastSentCheque()
+	if cheque == nil {
+		t.Fatal("expected to find a cheque, but it was empty")
+	}
+	// ...create a message...
+	msg := &EmitChequeMsg{
+		Cheque: cheque,
+	}
+
+	// ...and trigger message handling on the receiver side (creditor)
+	// remember that debitor is the model of the remote node for the creditor...
+	err = creditorSwap.handleEmitChequeMsg(ctx, debitor, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ...on which we wait until the cashCheque is actually terminated (ensures proper nonce count)
+	select {
+	case <-testBackend.cashDone:
+		creditorSwap.logger.Debug(CashChequeAction, "cash transaction completed and committed")
+	case <-time.After(4 * time.Second):
+		t.Fatalf("Timeout waiting for cash transactions to complete")
+	}
+	// finally check that the creditor also successfully reset the balances
+	if debitor.getBalance() != 0 {
+		t.Fatalf("unexpected balance to be 0, but it is %d", debitor.getBalance())
+	}
+}
+
+// TestDebtCheques verifies that cheques that would put a node in debt past the defined tolerance are rejected
+// and that ones within the tolerance are accepted
+func TestDebtCheques(t *testing.T) {
+	testBackend := newTestBackend(t)
+	defer testBackend.Close()
+	cleanup := setupContractTest()
+	defer cleanup()
+
+	creditorSwap, cleanup := newTestSwap(t, beneficiaryKey, testBackend)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := testDeploy(ctx, creditorSwap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	debitorChequebook, err := testDeployWithPrivateKey(ctx, testBackend, ownerKey, ownerAddress, int256.Uint256From((DefaultPaymentThreshold * 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	debitorDummyPeer := newDummyPeerWithSpec(Spec)
+	debitorPeer, err := creditorSwap.addPeer(debitorDummyPeer.Peer, ownerAddress, debitorChequebook.ContractParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create debt cheque
+	chequeAmount := int256.Uint256From(ChequeDebtTolerance * 2)
+	cheque, err := newSignedTestCheque(debitorChequebook.ContractParams().ContractAddress, creditorSwap.owner.address, chequeAmount, ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate cheque handling
+	err = creditorSwap.handleEmitChequeMsg(ctx, debitorPeer, &EmitChequeMsg{
+		Cheque: cheque,
+	})
+	// cheque should not have gone through as it would put the creditor in debt
+	if err == nil || !strings.Contains(err.Error(), "cause debt") {
+		t.Fatalf("expected invalid cheque to trigger debt cheque error, but got: %v", err)
+	}
+
+	// now create a (barely) admissible cheque
+	chequeAmount = int256.Uint256From(ChequeDebtTolerance)
+	cheque, err = newSignedTestCheque(debitorChequebook.ContractParams().ContractAddress, creditorSwap.owner.address, chequeAmount, ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate cheque handling
 	err = creditorSwap.handleEmitChequeMsg(ctx, debitorPeer, &EmitChequeMsg{
 		Cheque: cheque,
 	})
@@ -754,6 +1443,75 @@ func TestDebtCheques(t *testing.T) {
 	}
 }
 
+// TestDuplicateEmitChequeMsg verifies that a cheque which is delivered twice is only credited once
+func TestDuplicateEmitChequeMsg(t *testing.T) {
+	testBackend := newTestBackend(t)
+	defer testBackend.Close()
+	cleanup := setupContractTest()
+	defer cleanup()
+
+	creditorSwap, clean := newTestSwap(t, beneficiaryKey, testBackend)
+	defer clean()
+
+	ctx := context.Background()
+	if err := testDeploy(ctx, creditorSwap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	debitorChequebook, err := testDeployWithPrivateKey(ctx, testBackend, ownerKey, ownerAddress, int256.Uint256From(DefaultPaymentThreshold*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	debitor, err := creditorSwap.addPeer(newDummyPeerWithSpec(Spec).Peer, ownerAddress, debitorChequebook.ContractParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initialBalance := int64(DefaultPaymentThreshold * 2)
+	if err := debitor.setBalance(initialBalance); err != nil {
+		t.Fatal(err)
+	}
+
+	cheque, err := newSignedTestCheque(debitorChequebook.ContractParams().ContractAddress, creditorSwap.owner.address, int256.Uint256From(DefaultPaymentThreshold), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedBalance := initialBalance - int64(cheque.Honey)
+
+	if err := creditorSwap.handleEmitChequeMsg(ctx, debitor, &EmitChequeMsg{Cheque: cheque}); err != nil {
+		t.Fatal(err)
+	}
+	// wait until the cashCheque is actually terminated (ensures proper nonce count)
+	select {
+	case <-testBackend.cashDone:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("Timeout waiting for cash transactions to complete")
+	}
+	// the balance is unfrozen by the cashout worker after cashing
+	waitForEmptyCashoutQueue(t, creditorSwap)
+	expectBalance := func(msg string) {
+		t.Helper()
+		debitor.lock.RLock()
+		defer debitor.lock.RUnlock()
+		if debitor.getBalance() != expectedBalance {
+			t.Fatalf("expected balance to be %d%s, but is %d", expectedBalance, msg, debitor.getBalance())
+		}
+	}
+	expectBalance("")
+
+	// deliver the same cheque again
+	if err := creditorSwap.handleEmitChequeMsg(ctx, debitor, &EmitChequeMsg{Cheque: cheque}); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(" after duplicate cheque")
+	debitor.lock.RLock()
+	defer debitor.lock.RUnlock()
+	if !debitor.getLastReceivedCheque().Equal(cheque) {
+		t.Fatalf("expected last received cheque to be %v, but is %v", cheque, debitor.getLastReceivedCheque())
+	}
+}
+
 // generate bookings based on parameters, apply them to a Swap struct and verify the result
 // append generated bookings to slice pointer
 func testPeerBookings(t *testing.T, s *Swap, bookings *[]booking, bookingAmount int64, bookingQuantity int, peer *protocols.Peer) {
@@ -826,6 +1584,59 @@ func calculateExpectedBalances(swap *Swap, bookings []booking) map[enode.ID]int6
 // then closing the state store.
 // Then we re-open the state store and check that
 // the balance is still the same
+// TestClose tests that Close waits for background goroutines, saves unsaved balances and can be called repeatedly
+func TestClose(t *testing.T) {
+	testBackend := newTestBackend(t)
+	defer testBackend.Close()
+
+	swap, testDir := newBaseTestSwap(t, ownerKey, testBackend)
+	defer os.RemoveAll(testDir)
+	swap.params.BalancePersistThreshold = 1000
+
+	testPeer, err := swap.addPeer(newDummyPeer().Peer, common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.Add(42, testPeer.Peer); err != nil {
+		t.Fatal(err)
+	}
+
+	var stopped int32
+	swap.runBackground(func(ctx context.Context) {
+		<-ctx.Done()
+		// give Close a chance to return early if it did not wait
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&stopped, 1)
+	})
+
+	if err := swap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&stopped) != 1 {
+		t.Fatal("expected Close to wait for background goroutines")
+	}
+	if err := swap.Close(); err != nil {
+		t.Fatalf("expected repeated Close to succeed, got %v", err)
+	}
+	// nothing is started after Close
+	swap.runBackground(func(ctx context.Context) {
+		t.Error("unexpected background goroutine after Close")
+	})
+
+	stateStore, err := state.NewDBStore(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stateStore.Close()
+	var balance int64
+	if err := stateStore.Get(balanceKey(testPeer.ID()), &balance); err != nil {
+		t.Fatal(err)
+	}
+	if balance != 42 {
+		t.Fatalf("expected saved balance to be 42, got %d", balance)
+	}
+}
+
 func TestRestoreBalanceFromStateStore(t *testing.T) {
 	testBackend := newTestBackend(t)
 	defer testBackend.Close()
@@ -866,6 +1677,233 @@ func TestRestoreBalanceFromStateStore(t *testing.T) {
 	}
 }
 
+// TestPruneBalances tests that only small balances of peers not seen for long enough are pruned
+func TestPruneBalances(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+
+	// a disconnected peer with a small balance which was seen long ago
+	gonePeer, err := swap.addPeer(newDummyPeer().Peer, common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gonePeer.setBalance(-10); err != nil {
+		t.Fatal(err)
+	}
+	// a disconnected peer with a big balance which was seen long ago
+	debtPeer, err := swap.addPeer(newDummyPeer().Peer, common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := debtPeer.setBalance(1000); err != nil {
+		t.Fatal(err)
+	}
+	// a disconnected peer with a small balance which was seen recently
+	recentPeer, err := swap.addPeer(newDummyPeer().Peer, common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recentPeer.setBalance(10); err != nil {
+		t.Fatal(err)
+	}
+	// a connected peer with a small balance
+	connectedPeer, err := swap.addPeer(newDummyPeer().Peer, common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connectedPeer.setBalance(1); err != nil {
+		t.Fatal(err)
+	}
+
+	swap.removePeer(gonePeer)
+	swap.removePeer(debtPeer)
+	swap.removePeer(recentPeer)
+
+	longAgo := time.Now().Add(-48 * time.Hour)
+	if err := swap.saveLastSeen(gonePeer.ID(), longAgo); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.saveLastSeen(debtPeer.ID(), longAgo); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := swap.PruneBalances(24*time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Fatalf("expected 1 pruned balance, got %d", pruned)
+	}
+
+	var balance int64
+	if err := swap.store.Get(balanceKey(gonePeer.ID()), &balance); err != state.ErrNotFound {
+		t.Fatalf("expected balance of gone peer to be pruned, got err %v", err)
+	}
+	comparePeerBalance(t, swap, debtPeer.ID(), 1000)
+	comparePeerBalance(t, swap, recentPeer.ID(), 10)
+	comparePeerBalance(t, swap, connectedPeer.ID(), 1)
+
+	if _, err := swap.PruneBalances(24*time.Hour, -1); err == nil {
+		t.Fatal("expected negative max absolute balance to be rejected")
+	}
+}
+
+// TestVerifyConsistency tests that inconsistent stored balances and cheques are reported and consistent ones are not
+func TestVerifyConsistency(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+	ownContract := swap.GetParams().ContractAddress
+
+	if inconsistencies := swap.VerifyConsistency(); len(inconsistencies) != 0 {
+		t.Fatalf("expected no inconsistencies for empty state, got %v", inconsistencies)
+	}
+
+	newCheque := func(contract, beneficiary common.Address, cumulativePayout uint64, honey uint64) *Cheque {
+		cheque := newTestCheque()
+		cheque.Contract = contract
+		cheque.Beneficiary = beneficiary
+		cheque.CumulativePayout = int256.Uint256From(cumulativePayout)
+		cheque.Honey = honey
+		return cheque
+	}
+
+	// a peer with consistent state
+	consistentPeer := newDummyPeer().ID()
+	if err := swap.saveBalance(consistentPeer, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.saveLastSentCheque(consistentPeer, newCheque(ownContract, beneficiaryAddress, 42, 42)); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.saveLastReceivedCheque(consistentPeer, newCheque(testChequeContract, ownerAddress, 100, 50)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cheque settling a debt beyond the payment threshold can be deferred, e.g. while the debt is priced at zero
+	deferredPeer := newDummyPeer().ID()
+	if err := swap.saveBalance(deferredPeer, -swap.params.PaymentThreshold); err != nil {
+		t.Fatal(err)
+	}
+
+	regressedPendingPeer := newDummyPeer().ID()
+	if err := swap.saveLastSentCheque(regressedPendingPeer, newCheque(ownContract, beneficiaryAddress, 42, 42)); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.savePendingCheque(regressedPendingPeer, newCheque(ownContract, beneficiaryAddress, 40, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongBeneficiaryPeer := newDummyPeer().ID()
+	if err := swap.saveLastReceivedCheque(wrongBeneficiaryPeer, newCheque(testChequeContract, beneficiaryAddress, 42, 42)); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongContractPeer := newDummyPeer().ID()
+	if err := swap.saveLastSentCheque(wrongContractPeer, newCheque(testChequeContract, beneficiaryAddress, 42, 42)); err != nil {
+		t.Fatal(err)
+	}
+
+	overvaluedPeer := newDummyPeer().ID()
+	if err := swap.saveLastSentCheque(overvaluedPeer, newCheque(ownContract, beneficiaryAddress, 42, 43)); err != nil {
+		t.Fatal(err)
+	}
+
+	// sent cheques are checked against the conversion recorded when they were signed
+	repricedPeer := newDummyPeer().ID()
+	if err := swap.saveLastSentCheque(repricedPeer, newCheque(ownContract, beneficiaryAddress, 42, 43)); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.store.Put(chequeConversionKey(repricedPeer, int256.Uint256From(42)), &ChequeConversion{Honey: 43, Payout: int256.Uint256From(42)}); err != nil {
+		t.Fatal(err)
+	}
+	misconvertedPeer := newDummyPeer().ID()
+	if err := swap.saveLastSentCheque(misconvertedPeer, newCheque(ownContract, beneficiaryAddress, 42, 42)); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.store.Put(chequeConversionKey(misconvertedPeer, int256.Uint256From(42)), &ChequeConversion{Honey: 21, Payout: int256.Uint256From(42)}); err != nil {
+		t.Fatal(err)
+	}
+
+	reported := make(map[enode.ID]int)
+	for _, inconsistency := range swap.VerifyConsistency() {
+		reported[inconsistency.Peer]++
+	}
+	expected := map[enode.ID]int{
+		regressedPendingPeer: 1,
+		wrongBeneficiaryPeer: 1,
+		wrongContractPeer:    1,
+		overvaluedPeer:       1,
+		misconvertedPeer:     1,
+	}
+	if !reflect.DeepEqual(reported, expected) {
+		t.Fatalf("expected inconsistencies %v, got %v", expected, reported)
+	}
+}
+
+// TestFormatAmounts tests the rendering of honey and cheque amounts
+func TestFormatAmounts(t *testing.T) {
+	if s := FormatHoney(-42); s != "-42 honey" {
+		t.Fatalf("unexpected honey format: %s", s)
+	}
+
+	cheque := newTestCheque()
+	cheque.CumulativePayout = int256.Uint256From(1500000000000000000)
+	if s := FormatCheque(cheque); s != "42 honey, cumulative payout 1500000000000000000 wei (1.5 ETH)" {
+		t.Fatalf("unexpected cheque format: %s", s)
+	}
+
+	cheque.CumulativePayout = int256.Uint256From(0)
+	if s := FormatCheque(cheque); s != "42 honey, cumulative payout 0 wei (0 ETH)" {
+		t.Fatalf("unexpected cheque format: %s", s)
+	}
+
+	if s := FormatCheque(nil); s != "<nil>" {
+		t.Fatalf("unexpected nil cheque format: %s", s)
+	}
+}
+
+// TestChequeEqualAndCopy tests that Equal compares all fields of a cheque
+// and that a copy is equal to, but independent of the original
+func TestChequeEqualAndCopy(t *testing.T) {
+	cheque, err := newSignedTestCheque(testChequeContract, beneficiaryAddress, int256.Uint256From(42), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := cheque.Copy()
+	if !copied.Equal(cheque) || !cheque.Equal(copied) {
+		t.Fatal("expected copy to be equal to the original")
+	}
+
+	for name, modify := range map[string]func(c *Cheque){
+		"contract":          func(c *Cheque) { c.Contract = common.HexToAddress("0x1") },
+		"beneficiary":       func(c *Cheque) { c.Beneficiary = common.HexToAddress("0x2") },
+		"cumulative payout": func(c *Cheque) { c.CumulativePayout = int256.Uint256From(43) },
+		"honey":             func(c *Cheque) { c.Honey++ },
+		"signature":         func(c *Cheque) { c.Signature[0]++ },
+	} {
+		modified := cheque.Copy()
+		modify(modified)
+		if modified.Equal(cheque) {
+			t.Fatalf("expected cheques with different %s not to be equal", name)
+		}
+		if !copied.Equal(cheque) {
+			t.Fatalf("modifying the %s of a copy changed the original", name)
+		}
+	}
+
+	var nilCheque *Cheque
+	if !nilCheque.Equal(nil) || nilCheque.Equal(cheque) || cheque.Equal(nil) {
+		t.Fatal("expected only nil cheques to be equal to a nil cheque")
+	}
+	if nilCheque.Copy() != nil {
+		t.Fatal("expected copy of nil cheque to be nil")
+	}
+}
+
 // tests if encodeForSignature encodes the cheque as expected
 func TestChequeEncodeForSignature(t *testing.T) {
 	expectedCheque := newTestCheque()
@@ -892,6 +1930,51 @@ func TestChequeSigHash(t *testing.T) {
 	}
 }
 
+// countingSigner is a Signer which counts the signatures it creates, like an external signer would see them
+type countingSigner struct {
+	Signer
+	signatures int32
+}
+
+func (s *countingSigner) Sign(hash []byte) ([]byte, error) {
+	atomic.AddInt32(&s.signatures, 1)
+	return s.Signer.Sign(hash)
+}
+
+// TestSigner tests that deploying the chequebook and issuing cheques are both signed by the signer of the owner
+func TestSigner(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	signer := &countingSigner{Signer: NewLocalSigner(ownerKey)}
+	swap.owner = createOwner(signer)
+	swap.cashoutProcessor = newCashoutProcessor(swap.backend, signer)
+
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(DefaultPaymentThreshold)); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&signer.signatures) != 1 {
+		t.Fatalf("expected the deploy transaction to be signed by the signer, got %d signatures", signer.signatures)
+	}
+
+	testPeer := newDummyPeerWithSpec(Spec)
+	if _, err := swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.Add(-int64(DefaultPaymentThreshold), testPeer.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&signer.signatures) != 2 {
+		t.Fatalf("expected the cheque to be signed by the signer, got %d signatures", signer.signatures)
+	}
+	var cheque *Cheque
+	if err := swap.store.Get(pendingChequeKey(testPeer.ID()), &cheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := cheque.VerifySig(ownerAddress); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // tests if signContent computes the correct signature
 func TestSignContent(t *testing.T) {
 	// setup test swap object
@@ -902,11 +1985,8 @@ func TestSignContent(t *testing.T) {
 
 	var err error
 
-	// set the owner private key to a known key so we always get the same signature
-	swap.owner.privateKey = ownerKey
-
-	// sign the cheque
-	sig, err := expectedCheque.Sign(swap.owner.privateKey)
+	// sign the cheque with the signer of the owner, whose key is known so we always get the same signature
+	sig, err := expectedCheque.signWith(swap.owner.signer)
 	// expected value (computed through truffle/js)
 	expected := testChequeSig
 	if err != nil {
@@ -947,13 +2027,133 @@ func manipulateSignature(sig []byte) []byte {
 	return invalidSig
 }
 
-// tests if verifyChequeSig reject an invalid signature
-func TestVerifyChequeInvalidSignature(t *testing.T) {
-	expectedCheque := newTestCheque()
-	expectedCheque.Signature = manipulateSignature(testChequeSig)
+// tests if verifyChequeSig reject an invalid signature
+func TestVerifyChequeInvalidSignature(t *testing.T) {
+	expectedCheque := newTestCheque()
+	expectedCheque.Signature = manipulateSignature(testChequeSig)
+
+	if err := expectedCheque.VerifySig(ownerAddress); err == nil {
+		t.Fatal("Valid signature, should have been invalid")
+	}
+}
+
+// TestVerifyCheque tests that VerifyCheque accepts a valid cheque and rejects tampered ones
+func TestVerifyCheque(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		tamper      func(cheque *Cheque)
+		beneficiary common.Address
+		expectedErr error
+	}{
+		{
+			name:        "valid",
+			tamper:      func(cheque *Cheque) {},
+			beneficiary: beneficiaryAddress,
+		},
+		{
+			name: "tampered cumulative payout",
+			tamper: func(cheque *Cheque) {
+				cheque.CumulativePayout = int256.Uint256From(43)
+			},
+			beneficiary: beneficiaryAddress,
+			expectedErr: ErrInvalidChequeSignature,
+		},
+		{
+			name: "tampered beneficiary",
+			tamper: func(cheque *Cheque) {
+				cheque.Beneficiary = ownerAddress
+			},
+			beneficiary: ownerAddress,
+			expectedErr: ErrInvalidChequeSignature,
+		},
+		{
+			name: "tampered contract",
+			tamper: func(cheque *Cheque) {
+				cheque.Contract = common.HexToAddress("0x1234")
+			},
+			beneficiary: beneficiaryAddress,
+			expectedErr: ErrInvalidChequeSignature,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cheque, err := newSignedTestCheque(testChequeContract, beneficiaryAddress, int256.Uint256From(42), ownerKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.tamper(cheque)
+
+			err = VerifyCheque(cheque, ownerAddress, tc.beneficiary)
+			if err != tc.expectedErr {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+
+	// a correctly signed cheque made out to someone else is rejected as well
+	cheque, err := newSignedTestCheque(testChequeContract, beneficiaryAddress, int256.Uint256From(42), ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyCheque(cheque, ownerAddress, ownerAddress); err == nil {
+		t.Fatal("expected cheque for other beneficiary to be rejected")
+	}
+}
+
+// TestVerifyChequeDomain tests that cheques are only accepted for the domain they were signed for
+func TestVerifyChequeDomain(t *testing.T) {
+	signDomain := func(domain string) *Cheque {
+		cheque, err := newSignedTestCheque(testChequeContract, beneficiaryAddress, int256.Uint256From(42), ownerKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cheque.DomainSignature, err = cheque.signDomainWith(NewLocalSigner(ownerKey), domain); err != nil {
+			t.Fatal(err)
+		}
+		return cheque
+	}
+	mainnet, testnet := signDomain("mainnet"), signDomain("testnet")
 
-	if err := expectedCheque.VerifySig(ownerAddress); err == nil {
-		t.Fatal("Valid signature, should have been invalid")
+	for _, tc := range []struct {
+		name        string
+		cheque      *Cheque
+		issuer      common.Address
+		domain      string
+		expectedErr error
+	}{
+		{name: "same domain", cheque: mainnet, issuer: ownerAddress, domain: "mainnet"},
+		{name: "other domain", cheque: testnet, issuer: ownerAddress, domain: "mainnet", expectedErr: ErrInvalidChequeDomain},
+		{name: "other issuer", cheque: mainnet, issuer: beneficiaryAddress, domain: "mainnet", expectedErr: ErrInvalidChequeDomain},
+		{name: "without domain signature", cheque: newTestCheque(), issuer: ownerAddress, domain: "mainnet", expectedErr: ErrInvalidChequeDomain},
+		{name: "verifier without domain", cheque: testnet, issuer: ownerAddress},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := VerifyChequeDomain(tc.cheque, tc.issuer, tc.domain); !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+
+	// the domain signature does not change the signature cashed by the chequebook
+	if err := VerifyCheque(mainnet, ownerAddress, beneficiaryAddress); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mainnet.Signature, testnet.Signature) {
+		t.Fatal("expected the domain not to change the cheque signature")
+	}
+
+	// a peer with a domain rejects cheques of another domain
+	swap, peer, clean := newTestSwapAndPeer(t, ownerKey)
+	defer clean()
+	swap.params.ChequeDomain = "mainnet"
+	cheque := newTestCheque()
+	cheque.Signature, _ = cheque.Sign(ownerKey)
+	cheque.DomainSignature, _ = cheque.signDomainWith(NewLocalSigner(ownerKey), "testnet")
+	if _, err := swap.processAndVerifyCheque(cheque, peer); !errors.Is(err, ErrInvalidChequeDomain) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidChequeDomain, err)
+	}
+	cheque.DomainSignature, _ = cheque.signDomainWith(NewLocalSigner(ownerKey), "mainnet")
+	if _, err := swap.processAndVerifyCheque(cheque, peer); err != nil {
+		t.Fatal(err)
 	}
 }
 
@@ -990,6 +2190,113 @@ func TestVerifyContractNotDeployedByFactory(t *testing.T) {
 	}
 }
 
+// TestSwapVerifyContract tests that a chequebook which fails verification on demand is marked unusable
+// and that no more cheques are issued from it until it passes verification again
+func TestSwapVerifyContract(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	ctx := context.Background()
+	if err := testDeploy(ctx, swap, int256.Uint256From(DefaultPaymentThreshold)); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.VerifyContract(ctx); err != nil {
+		t.Fatalf("expected chequebook to pass verification, got %v", err)
+	}
+	chequebook := swap.contract
+
+	testPeer := newDummyPeerWithSpec(Spec)
+	if _, err := swap.addPeer(testPeer.Peer, swap.owner.address, chequebook.ContractParams().ContractAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	otherChequebook, err := testDeployWithPrivateKey(ctx, swap.backend, beneficiaryKey, beneficiaryAddress, int256.Uint256From(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noCodeChequebook, err := cswap.InstanceAt(common.HexToAddress("0x0123456789abcdef0123456789abcdef01234567"), swap.backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, unusable := range map[string]cswap.Contract{
+		"owner mismatch": otherChequebook,
+		"no code":        noCodeChequebook,
+	} {
+		swap.contract = unusable
+		if err := swap.VerifyContract(ctx); !errors.Is(err, ErrChequebookUnusable) {
+			t.Fatalf("%s: expected error %v, got %v", name, ErrChequebookUnusable, err)
+		}
+		if err := swap.Add(-int64(DefaultPaymentThreshold), testPeer.Peer); !errors.Is(err, ErrChequebookUnusable) {
+			t.Fatalf("%s: expected sending a cheque to fail with %v, got %v", name, ErrChequebookUnusable, err)
+		}
+		if err := swap.Add(int64(DefaultPaymentThreshold), testPeer.Peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	swap.contract = chequebook
+	if err := swap.VerifyContract(ctx); err != nil {
+		t.Fatalf("expected chequebook to pass verification again, got %v", err)
+	}
+	if err := swap.Add(-int64(DefaultPaymentThreshold), testPeer.Peer); err != nil {
+		t.Fatal(err)
+	}
+	var cheque *Cheque
+	if err := swap.store.Get(pendingChequeKey(testPeer.ID()), &cheque); err != nil {
+		t.Fatalf("expected a cheque to be sent, got %v", err)
+	}
+}
+
+// TestChequebookCheck tests that a chequebook which loses its code is detected by the periodic check,
+// that no more cheques are issued from it and that it is usable again once its code is back
+func TestChequebookCheck(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(DefaultPaymentThreshold)); err != nil {
+		t.Fatal(err)
+	}
+	testPeer := newDummyPeerWithSpec(Spec)
+	if _, err := swap.addPeer(testPeer.Peer, swap.owner.address, swap.GetParams().ContractAddress); err != nil {
+		t.Fatal(err)
+	}
+	backend := &selfdestructBackend{Backend: swap.backend}
+	swap.backend = backend
+	swap.params.ChequebookCheckInterval = time.Minute
+	clock := newTestClock(time.Now())
+	swap.clock = clock
+
+	if err := swap.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	// tickers of the cashout queue and the chequebook check
+	clock.waitForTicker(t)
+	clock.waitForTicker(t)
+
+	expectChequebookError := func(unusable bool) {
+		t.Helper()
+		summary, err := swap.Summary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (summary.ChequebookError != "") != unusable {
+			t.Fatalf("expected chequebook to be unusable: %v, got error %q", unusable, summary.ChequebookError)
+		}
+	}
+
+	atomic.StoreInt32(&backend.selfdestructed, 1)
+	// the second check is only received once the first one is done
+	clock.Advance(time.Minute)
+	clock.Advance(time.Minute)
+	expectChequebookError(true)
+	if err := swap.Add(-int64(DefaultPaymentThreshold), testPeer.Peer); !errors.Is(err, ErrChequebookUnusable) {
+		t.Fatalf("expected sending a cheque to fail with %v, got %v", ErrChequebookUnusable, err)
+	}
+
+	atomic.StoreInt32(&backend.selfdestructed, 0)
+	clock.Advance(time.Minute)
+	clock.Advance(time.Minute)
+	expectChequebookError(false)
+}
+
 // TestFactoryAddressForNetwork tests that an address is found for ropsten
 // and no address if for network 32145
 func TestFactoryAddressForNetwork(t *testing.T) {
@@ -1057,6 +2364,85 @@ func TestPeerSetAndGetLastReceivedCheque(t *testing.T) {
 	}
 }
 
+// TestCreateChequeMinBalance tests that no cheque is created for a balance of math.MinInt64, which cannot be negated
+func TestCreateChequeMinBalance(t *testing.T) {
+	swap, peer, clean := newTestSwapAndPeer(t, ownerKey)
+	defer clean()
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := peer.setBalance(math.MinInt64); err != nil {
+		t.Fatal(err)
+	}
+	cheque, err := peer.createCheque()
+	if !errors.Is(err, ErrHoneyOverflow) {
+		t.Fatalf("expected error %v, got %v", ErrHoneyOverflow, err)
+	}
+	if cheque != nil {
+		t.Fatalf("expected no cheque, got %v", cheque)
+	}
+
+	// one honey less can still be paid
+	if err := peer.setBalance(math.MinInt64 + 1); err != nil {
+		t.Fatal(err)
+	}
+	if cheque, err = peer.createCheque(); err != nil {
+		t.Fatal(err)
+	}
+	if cheque.Honey != math.MaxInt64 {
+		t.Fatalf("expected a cheque for %d honey, got %d", uint64(math.MaxInt64), cheque.Honey)
+	}
+}
+
+// TestPeerSetBeneficiary tests that the beneficiary of a peer can only be set to a non-zero address
+// and that no cheques are created for a peer without beneficiary
+func TestPeerSetBeneficiary(t *testing.T) {
+	swap, clean := newTestSwap(t, ownerKey, nil)
+	defer clean()
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := swap.addPeer(newDummyPeer().Peer, common.Address{}, testChequeContract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Beneficiary() != (common.Address{}) {
+		t.Fatalf("expected no beneficiary, got %x", peer.Beneficiary())
+	}
+
+	if err := peer.setBalance(-42); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.createCheque(); err != ErrZeroBeneficiary {
+		t.Fatalf("expected error %v when creating cheque without beneficiary, got %v", ErrZeroBeneficiary, err)
+	}
+
+	if err := peer.SetBeneficiary(common.Address{}); err != ErrZeroBeneficiary {
+		t.Fatalf("expected error %v when setting zero beneficiary, got %v", ErrZeroBeneficiary, err)
+	}
+
+	before := time.Now()
+	if err := peer.SetBeneficiary(beneficiaryAddress); err != nil {
+		t.Fatal(err)
+	}
+	if peer.Beneficiary() != beneficiaryAddress {
+		t.Fatalf("expected beneficiary %x, got %x", beneficiaryAddress, peer.Beneficiary())
+	}
+	if peer.beneficiarySetAt.Before(before) {
+		t.Fatalf("expected beneficiary set time after %v, got %v", before, peer.beneficiarySetAt)
+	}
+
+	cheque, err := peer.createCheque()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cheque.Beneficiary != beneficiaryAddress {
+		t.Fatalf("expected cheque beneficiary %x, got %x", beneficiaryAddress, cheque.Beneficiary)
+	}
+}
+
 // TestPeerVerifyChequeProperties tests that verifyChequeProperties will accept a valid cheque
 func TestPeerVerifyChequeProperties(t *testing.T) {
 	swap, peer, clean := newTestSwapAndPeer(t, ownerKey)
@@ -1128,8 +2514,13 @@ func TestPeerVerifyChequeAgainstLastInvalid(t *testing.T) {
 	oldCheque := newTestCheque()
 	newCheque := newTestCheque()
 
-	if _, err := newCheque.verifyChequeAgainstLast(oldCheque, increase); err == nil {
-		t.Fatal("accepted a cheque with same amount")
+	if _, err := newCheque.verifyChequeAgainstLast(oldCheque, increase); !errors.Is(err, ErrChequeRegression) {
+		t.Fatalf("expected error %v for a cheque with same amount, got %v", ErrChequeRegression, err)
+	}
+	// cheque with lower amount
+	newCheque.CumulativePayout = int256.Uint256From(0)
+	if _, err := newCheque.verifyChequeAgainstLast(oldCheque, increase); !errors.Is(err, ErrChequeRegression) {
+		t.Fatalf("expected error %v for a cheque with lower amount, got %v", ErrChequeRegression, err)
 	}
 
 	// cheque with amount != increase
@@ -1145,12 +2536,12 @@ func TestPeerVerifyChequeAgainstLastInvalid(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := newCheque.verifyChequeAgainstLast(oldCheque, increase); err == nil {
-		t.Fatal("accepted a cheque with unexpected amount")
+	if _, err := newCheque.verifyChequeAgainstLast(oldCheque, increase); err == nil || errors.Is(err, ErrChequeRegression) {
+		t.Fatalf("expected a cheque with unexpected amount to be rejected, but not as a regression, got %v", err)
 	}
 }
 
-// TestPeerProcessAndVerifyCheque tests that processAndVerifyCheque accepts a valid cheque and also saves it
+// TestPeerProcessAndVerifyCheque tests that processAndVerifyCheque accepts a valid cheque and also saves it with the balance it settled
 func TestPeerProcessAndVerifyCheque(t *testing.T) {
 	swap, peer, clean := newTestSwapAndPeer(t, ownerKey)
 	defer clean()
@@ -1172,6 +2563,21 @@ func TestPeerProcessAndVerifyCheque(t *testing.T) {
 	if !peer.getLastReceivedCheque().CumulativePayout.Equals(cheque.CumulativePayout) {
 		t.Fatalf("last received cheque has wrong cumulative payout, was: %v, expected: %v", peer.lastReceivedCheque.CumulativePayout, cheque.CumulativePayout)
 	}
+	// and saved together with the balance it settled
+	stored, err := swap.loadLastReceivedCheque(peer.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Equal(cheque) {
+		t.Fatalf("expected saved cheque %v, got %v", cheque, stored)
+	}
+	balance, err := swap.loadBalance(peer.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := -int64(cheque.Honey); balance != expected || peer.getBalance() != expected {
+		t.Fatalf("expected balance %d to be saved with the cheque, got %d saved and %d in memory", expected, balance, peer.getBalance())
+	}
 
 	// create another cheque with higher amount
 	otherCheque := newTestCheque()
@@ -1234,12 +2640,52 @@ func TestPeerProcessAndVerifyChequeInvalid(t *testing.T) {
 		t.Fatal("accepted a cheque with lower amount")
 	}
 
+	// invalid cheque because honey does not fit into a balance
+	overflowCheque := newTestCheque()
+	overflowCheque.Honey = math.MaxInt64 + 1
+	overflowCheque.CumulativePayout = int256.Uint256From(math.MaxInt64 + 1 + 42)
+	overflowCheque.Signature, _ = overflowCheque.Sign(ownerKey)
+
+	if _, err := swap.processAndVerifyCheque(overflowCheque, peer); !errors.Is(err, ErrHoneyOverflow) {
+		t.Fatalf("expected error %v for overflowing honey, got %v", ErrHoneyOverflow, err)
+	}
+
 	// check that no invalid cheque was saved
 	if peer.getLastReceivedCheque().CumulativePayout != cheque.CumulativePayout {
 		t.Fatalf("last received cheque has wrong cumulative payout, was: %v, expected: %v", peer.lastReceivedCheque.CumulativePayout, cheque.CumulativePayout)
 	}
 }
 
+// TestPeerUpdateBalanceOverflow tests that balance updates which would wrap around are rejected
+func TestPeerUpdateBalanceOverflow(t *testing.T) {
+	_, peer, clean := newTestSwapAndPeer(t, ownerKey)
+	defer clean()
+
+	if err := peer.setBalance(math.MaxInt64 - 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.updateBalance(2); err == nil {
+		t.Fatal("expected overflowing balance update to fail")
+	}
+
+	if err := peer.setBalance(math.MinInt64 + 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.updateBalance(-2); err == nil {
+		t.Fatal("expected underflowing balance update to fail")
+	}
+	if peer.getBalance() != math.MinInt64+1 {
+		t.Fatalf("expected balance to be unchanged, but is %d", peer.getBalance())
+	}
+
+	if err := peer.updateBalance(math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+	if peer.getBalance() != 0 {
+		t.Fatalf("expected balance to be 0, but is %d", peer.getBalance())
+	}
+}
+
 func TestSwapLogToFile(t *testing.T) {
 	// create a log dir
 	logDirDebitor, err := ioutil.TempDir("", "swap_test_log")
@@ -1307,7 +2753,7 @@ func TestSwapLogToFile(t *testing.T) {
 	defer cleanup()
 
 	// now simulate sending the cheque to the creditor from the debitor
-	if err = creditor.sendCheque(); err != nil {
+	if _, err = creditor.sendCheque(); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1428,6 +2874,63 @@ func TestPeerGetLastSentCumulativePayout(t *testing.T) {
 	}
 }
 
+// TestSeedCumulativePayout tests that cheques build upon a cumulative payout seed
+// and that only seeds above every known cumulative payout are accepted
+func TestSeedCumulativePayout(t *testing.T) {
+	swap, peer, clean := newTestSwapAndPeer(t, ownerKey)
+	defer clean()
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	cheque := newTestCheque()
+	if err := peer.setLastSentCheque(cheque); err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.SeedCumulativePayout(peer.ID(), cheque.CumulativePayout); err == nil {
+		t.Fatal("expected seed equal to the last sent cumulative payout to be rejected")
+	}
+
+	seed, err := new(int256.Uint256).Add(cheque.CumulativePayout, int256.Uint256From(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swap.SeedCumulativePayout(peer.ID(), seed); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.getLastSentCumulativePayout().Equals(seed) {
+		t.Fatalf("expected last cumulative payout to be the seed %v, was %v", seed, peer.getLastSentCumulativePayout())
+	}
+
+	if err := peer.setBalance(-100); err != nil {
+		t.Fatal(err)
+	}
+	created, err := peer.createCheque()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPayout, err := new(int256.Uint256).Add(seed, int256.Uint256From(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.CumulativePayout.Equals(expectedPayout) {
+		t.Fatalf("expected cheque to build upon the seed with cumulative payout %v, was %v", expectedPayout, created.CumulativePayout)
+	}
+
+	// the seed is restored when the peer connects again and lower seeds are still rejected
+	swap.removePeer(peer)
+	if err := swap.SeedCumulativePayout(peer.ID(), cheque.CumulativePayout); err == nil {
+		t.Fatal("expected seed below the previous seed to be rejected for a disconnected peer")
+	}
+	reconnected, err := swap.addPeer(peer.Peer, ownerAddress, testChequeContract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reconnected.getLastSentCumulativePayout().Equals(seed) {
+		t.Fatalf("expected restored last cumulative payout to be the seed %v, was %v", seed, reconnected.getLastSentCumulativePayout())
+	}
+}
+
 func TestAvailableBalance(t *testing.T) {
 	testBackend := newTestBackend(t)
 	defer testBackend.Close()
@@ -1465,7 +2968,7 @@ func TestAvailableBalance(t *testing.T) {
 	}
 	withdraw := withdrawAmount.Value()
 
-	opts := bind.NewKeyedTransactor(swap.owner.privateKey)
+	opts := newTransactor(swap.owner.signer)
 	opts.Context = context.TODO()
 	rec, err := swap.contract.Withdraw(opts, withdraw)
 	if err != nil {
@@ -1490,9 +2993,21 @@ func TestAvailableBalance(t *testing.T) {
 	if err = peer.setBalance(int64(-chequeAmount)); err != nil {
 		t.Fatal(err)
 	}
-	if err = peer.sendCheque(); err != nil {
+	cheque, err := peer.sendCheque()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cheque.Honey != chequeAmount || !cheque.CumulativePayout.Equals(int256.Uint256From(chequeAmount)) {
+		t.Fatalf("expected sent cheque worth %d, got honey %d and cumulative payout %v", chequeAmount, cheque.Honey, cheque.CumulativePayout)
+	}
+	// the cheque is not confirmed yet, so sending again resends it
+	resent, err := peer.sendCheque()
+	if err != nil {
 		t.Fatal(err)
 	}
+	if !resent.Equal(cheque) {
+		t.Fatalf("expected pending cheque %v to be resent, got %v", cheque, resent)
+	}
 
 	availableBalance, err = swap.AvailableBalance()
 	if err != nil {
@@ -1508,3 +3023,123 @@ func TestAvailableBalance(t *testing.T) {
 	}
 
 }
+
+// TestPendingChequeSavedBeforeSending tests that a cheque is saved together with the balance it settles before it is sent,
+// so that a cheque which did not reach the peer is resent as it is when the peer connects again
+func TestPendingChequeSavedBeforeSending(t *testing.T) {
+	testBackend := newTestBackend(t)
+	defer testBackend.Close()
+	swap, clean := newTestSwap(t, ownerKey, testBackend)
+	defer clean()
+	cleanup := setupContractTest()
+	defer cleanup()
+
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(1000)); err != nil {
+		t.Fatal(err)
+	}
+	// the peer stops reading, so sending the cheque times out
+	swap.params.SendTimeout = 10 * time.Millisecond
+	blocking := &blockingMsgRW{release: make(chan struct{})}
+	defer close(blocking.release)
+	dummy := newDummyPeerWithRW(Spec, blocking)
+	peer, err := swap.addPeer(dummy.Peer, swap.owner.address, swap.GetParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.setBalance(-42); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = peer.sendCheque(); err == nil {
+		t.Fatal("expected sending the cheque to fail")
+	}
+
+	pending, err := swap.loadPendingCheque(peer.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending == nil || pending.Honey != 42 {
+		t.Fatalf("expected a pending cheque worth 42 to be saved, got %v", pending)
+	}
+	balance, err := swap.loadBalance(peer.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 0 {
+		t.Fatalf("expected the balance settled by the pending cheque to be saved, got %d", balance)
+	}
+
+	// the peer connects again
+	swap.removePeer(peer)
+	rw, peerRW := newBufferedMsgPipe()
+	defer rw.Close()
+	reconnected, err := swap.addPeer(protocols.NewPeer(dummy.Peer.Peer, rw, Spec), swap.owner.address, swap.GetParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reconnected.resendPendingCheque(); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := peerRW.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := Spec.GetCode(&EmitChequeMsg{}); msg.Code != code {
+		t.Fatalf("expected the pending cheque to be resent with message code %d, got %d", code, msg.Code)
+	}
+	if !reconnected.getPendingCheque().Equal(pending) {
+		t.Fatalf("expected pending cheque %v to be kept, got %v", pending, reconnected.getPendingCheque())
+	}
+}
+
+// TestSentChequeConversion tests that the conversion of the honey of a sent cheque into its payout is recorded
+func TestSentChequeConversion(t *testing.T) {
+	testBackend := newTestBackend(t)
+	defer testBackend.Close()
+	swap, clean := newTestSwap(t, ownerKey, testBackend)
+	defer clean()
+	cleanup := setupContractTest()
+	defer cleanup()
+
+	if err := testDeploy(context.Background(), swap, int256.Uint256From(1000)); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := swap.addPeer(newDummyPeerWithSpec(Spec).Peer, swap.owner.address, swap.GetParams().ContractAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conversions []*ChequeConversion
+	for i := 0; i < 2; i++ {
+		if err = peer.setBalance(-42); err != nil {
+			t.Fatal(err)
+		}
+		cheque, err := peer.sendCheque()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = swap.handleConfirmChequeMsg(context.Background(), peer, &ConfirmChequeMsg{Cheque: cheque}); err != nil {
+			t.Fatal(err)
+		}
+		conversion, err := swap.SentChequeConversion(peer.ID(), cheque.CumulativePayout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conversion == nil {
+			t.Fatalf("expected the conversion of cheque %v to be recorded", cheque)
+		}
+		conversions = append(conversions, conversion)
+	}
+
+	price := int256.Uint256From(42 * defaultHoneyPrice)
+	for _, conversion := range conversions {
+		if conversion.Honey != 42 || !conversion.Payout.Equals(price) {
+			t.Fatalf("expected 42 honey to be converted into %v, got %d honey converted into %v", price, conversion.Honey, conversion.Payout)
+		}
+		if conversion.Oracle.Price != defaultHoneyPrice || conversion.Oracle.Source != "fixed" {
+			t.Fatalf("expected the fixed price %d to be recorded, got %+v", defaultHoneyPrice, conversion.Oracle)
+		}
+		if conversion.SignedAt.IsZero() {
+			t.Fatal("expected the signing time to be recorded")
+		}
+	}
+}
@@ -17,7 +17,11 @@
 package swap
 
 import (
+	"math/big"
+	"time"
+
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethersphere/swarm/swap/int256"
 )
 
@@ -33,6 +37,8 @@ type Cheque struct {
 	ChequeParams
 	Honey     uint64 // amount of honey which resulted in the cumulative currency difference
 	Signature []byte // signature Sign(Keccak256(contract, beneficiary, amount), prvKey)
+	// DomainSignature is the signature of the cheque for the domain separator of the issuer, nil if it has none, see Params.ChequeDomain
+	DomainSignature []byte
 }
 
 // HandshakeMsg is exchanged on peer handshake
@@ -44,9 +50,132 @@ type HandshakeMsg struct {
 // EmitChequeMsg is sent from the debitor to the creditor with the actual cheque
 type EmitChequeMsg struct {
 	Cheque *Cheque
+	// SentAt is the unix time in seconds of the debitor when sending the cheque, 0 if it does not include it, see Params.ChequeSendTime
+	SentAt uint64
 }
 
 // ConfirmChequeMsg is sent from the creditor to the debitor with the cheque to confirm successful processing
 type ConfirmChequeMsg struct {
 	Cheque *Cheque
 }
+
+// BalanceChallengeMsg is sent periodically with the view of the sender on the accounting with the receiver,
+// so that views which drifted apart, e.g. after lost messages or a restart, are detected
+// cheques have no serial numbers, they are identified by their cumulative payout, which is 0 if no cheque was exchanged
+// the balance is split into its absolute value and sign, as RLP has no signed integers
+type BalanceChallengeMsg struct {
+	Balance            uint64          // absolute balance of the sender with the receiver
+	Debt               bool            // whether the balance is negative, i.e. the sender owes the receiver
+	LastSentPayout     *int256.Uint256 // cumulative payout of the last cheque the sender sent and got confirmed
+	LastReceivedPayout *int256.Uint256 // cumulative payout of the last cheque the sender received
+}
+
+// newBalanceChallengeMsg creates a BalanceChallengeMsg for balance and the payouts of the last sent and received cheques
+func newBalanceChallengeMsg(balance int64, lastSentPayout, lastReceivedPayout *int256.Uint256) *BalanceChallengeMsg {
+	msg := &BalanceChallengeMsg{
+		Balance:            uint64(balance),
+		LastSentPayout:     lastSentPayout,
+		LastReceivedPayout: lastReceivedPayout,
+	}
+	if balance < 0 {
+		msg.Balance = uint64(-balance)
+		msg.Debt = true
+	}
+	return msg
+}
+
+// balance returns the balance of the sender with the receiver
+func (m *BalanceChallengeMsg) balance() *big.Int {
+	balance := new(big.Int).SetUint64(m.Balance)
+	if m.Debt {
+		balance.Neg(balance)
+	}
+	return balance
+}
+
+// ChequebookUpdateMsg is sent when the sender switches to another chequebook during the session
+// the signature of the issuer of the new chequebook is bound to the owner of the receiver, so it cannot be replayed to other nodes
+type ChequebookUpdateMsg struct {
+	ContractAddress common.Address // address of the new chequebook of the sender
+	Signature       []byte         // signature of chequebookUpdateSigHash by the issuer of the new chequebook
+	PeerSignature   []byte         // signature of chequebookUpdateSigHash by the issuer of the previous chequebook, only needed if the issuer changes
+}
+
+// ConfirmChequebookUpdateMsg is sent in response to a ChequebookUpdateMsg once the receiver switched to the chequebook
+// the sender of the update sends no cheques until then, as the receiver refuses cheques from the previous chequebook afterwards
+type ConfirmChequebookUpdateMsg struct {
+	ContractAddress common.Address // address of the chequebook the receiver switched to
+}
+
+// ChequeEventType tells whether a cheque event is about a sent or a received cheque
+type ChequeEventType string
+
+const (
+	// ChequeSentEvent is journaled when a cheque we sent was confirmed by the peer
+	ChequeSentEvent ChequeEventType = "sent"
+	// ChequeReceivedEvent is journaled when a cheque we received was accepted
+	ChequeReceivedEvent ChequeEventType = "received"
+)
+
+// ChequeEvent is an entry in the cheque event journal
+type ChequeEvent struct {
+	Seq    uint64          // sequence number of the event, starting at 1
+	Type   ChequeEventType // whether the cheque was sent or received
+	Peer   enode.ID        // the peer the cheque was exchanged with
+	Cheque *Cheque         // the full cheque
+	Time   time.Time       // the time the event was journaled
+}
+
+// ChequeConversion records how the honey of a sent cheque was converted into its payout when the cheque was signed,
+// so that the payout of a cheque can still be explained after the price of honey changed
+type ChequeConversion struct {
+	Honey    uint64          // honey of the cheque
+	Payout   *int256.Uint256 // price of the honey, the increase of the cumulative payout over the previous cheque
+	Oracle   OraclePriceInfo // price per honey and its source as described by the oracle which priced the cheque
+	SignedAt time.Time       // when the cheque was signed
+}
+
+// ChequeTotals are the lifetime totals of the cheque event journal
+type ChequeTotals struct {
+	ChequesSent     uint64 // number of sent cheques which were confirmed
+	ChequesReceived uint64 // number of received cheques which were accepted
+	HoneySent       uint64 // honey settled with sent cheques
+	HoneyReceived   uint64 // honey settled with received cheques
+}
+
+// add counts the cheque of an event in the totals
+func (t *ChequeTotals) add(eventType ChequeEventType, cheque *Cheque) {
+	switch eventType {
+	case ChequeSentEvent:
+		t.ChequesSent++
+		t.HoneySent += cheque.Honey
+	case ChequeReceivedEvent:
+		t.ChequesReceived++
+		t.HoneyReceived += cheque.Honey
+	}
+}
+
+// ChequeHistorySummary sums up the cheques pruned from the received cheque history of a peer, see PruneChequeHistory
+type ChequeHistorySummary struct {
+	Cheques          uint64          // number of pruned cheques
+	Honey            uint64          // honey settled with the pruned cheques
+	LastSerial       uint64          // serial of the last pruned cheque, the history continues after it
+	CumulativePayout *int256.Uint256 // cumulative payout of the last pruned cheque
+}
+
+// SwapSummary is a point in time snapshot of the accounting with all peers
+type SwapSummary struct {
+	Peers               int    // number of connected swap peers
+	TotalCredit         int64  // sum of the positive balances of all known peers, owed to us
+	TotalDebt           int64  // sum of the negative balances of all known peers, owed by us
+	PaymentThreshold    int64  // honey amount at which a cheque is sent to a peer, before threshold weights
+	DisconnectThreshold int64  // honey amount at which a peer is disconnected, before threshold weights
+	ChequebookError     string // why the chequebook is unusable and no cheques are issued, empty if it is usable
+	ChequeTotals
+}
+
+// Inconsistency describes stored swap state of a peer which does not add up
+type Inconsistency struct {
+	Peer   enode.ID // the peer the state belongs to, zero if it is not specific to a peer
+	Reason string   // description of the inconsistency
+}
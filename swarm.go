@@ -43,6 +43,7 @@ import (
 	"github.com/ethersphere/swarm/contracts/ens"
 	"github.com/ethersphere/swarm/fuse"
 	"github.com/ethersphere/swarm/log"
+	"github.com/ethersphere/swarm/metrics/prometheus"
 	"github.com/ethersphere/swarm/network"
 	"github.com/ethersphere/swarm/network/retrieval"
 	"github.com/ethersphere/swarm/network/stream"
@@ -131,18 +132,30 @@ func NewSwarm(config *api.Config, mockStore *mock.NodeStore) (self *Swarm, err e
 		if self.config.NetworkID != swap.AllowedNetworkID {
 			return nil, fmt.Errorf("swap can only be enabled under BZZ Network ID %d, found Network ID %d instead", swap.AllowedNetworkID, self.config.NetworkID)
 		}
+		var disconnectPolicy swap.DisconnectPolicy
+		if disconnectPolicy, err = swap.ParseDisconnectPolicy(self.config.SwapDisconnectPolicy); err != nil {
+			return nil, err
+		}
 		swapParams := &swap.Params{
 			BaseAddrs:           bzzconfig.Address,
 			LogPath:             self.config.SwapLogPath,
 			LogLevel:            self.config.SwapLogLevel,
 			DisconnectThreshold: int64(self.config.SwapDisconnectThreshold),
 			PaymentThreshold:    int64(self.config.SwapPaymentThreshold),
+			DisconnectPolicy:    disconnectPolicy,
+			// refuse the debt of peers whose cheques could not be cashed
+			RequireVerifiedPeerContract: self.config.SwapRequireVerified,
+			// stop issuing cheques if the chequebook was selfdestructed
+			ChequebookCheckInterval: swap.DefaultChequebookCheckInterval,
+			// detect balances which drifted apart from the ones of our peers
+			BalanceChallengeInterval:  swap.DefaultBalanceChallengeInterval,
+			BalanceChallengeTolerance: int64(swap.DefaultBalanceChallengeTolerance),
 		}
 
 		// create the accounting objects
 		self.swap, err = swap.New(
 			self.config.Path,
-			self.privateKey,
+			swap.NewLocalSigner(self.privateKey),
 			self.config.SwapBackendURL,
 			swapParams,
 			self.config.Contract,
@@ -249,8 +262,14 @@ func NewSwarm(config *api.Config, mockStore *mock.NodeStore) (self *Swarm, err e
 		syncing = false
 	}
 
-	syncProvider := stream.NewSyncProvider(self.netStore, to, bzzconfig.Address, syncing, false)
+	syncStrategy, err := stream.ParseSyncStrategy(config.SyncStrategy)
+	if err != nil {
+		return nil, err
+	}
+	syncProvider := stream.NewSyncProvider(self.netStore, to, bzzconfig.Address, syncing, false, syncStrategy, config.SyncDedupCacheSize)
 	self.streamer = stream.New(self.stateStore, bzzconfig.Address, syncProvider)
+	self.streamer.SetMaxStreamInfoReqs(config.SyncMaxInfoReqs)
+	self.streamer.SetSyncBudget(config.SyncBudget)
 
 	// Swarm Hash Merklised Chunking for Arbitrary-length Document/File storage
 	lnetStore := storage.NewLNetStore(self.netStore)
@@ -432,6 +451,12 @@ func (s *Swarm) Start(srv *p2p.Server) error {
 		}
 	}(startTime)
 
+	if s.config.PrometheusAddr != "" {
+		if err := s.startPrometheusExporter(); err != nil {
+			return err
+		}
+	}
+
 	startCounter.Inc(1)
 	if err := s.streamer.Start(srv); err != nil {
 		return err
@@ -439,6 +464,41 @@ func (s *Swarm) Start(srv *p2p.Server) error {
 	return s.retrieval.Start(srv)
 }
 
+// startPrometheusExporter serves the swap and syncer metrics in the Prometheus text format at config.PrometheusAddr
+// the samples are labelled with the role of the node and, if swap is enabled, the chain ID of its backend
+func (s *Swarm) startPrometheusExporter() error {
+	if !metrics.Enabled {
+		log.Warn("Prometheus metrics endpoint enabled without metrics collection, all metrics stay empty")
+	}
+	role := "full"
+	if s.config.BootnodeMode {
+		role = "bootnode"
+	} else if s.config.LightNodeEnabled {
+		role = "light"
+	}
+	labels := map[string]string{"role": role}
+	if s.swap != nil {
+		labels["chain_id"] = strconv.FormatUint(s.swap.ChainID(), 10)
+	}
+
+	listener, err := net.Listen("tcp", s.config.PrometheusAddr)
+	if err != nil {
+		return fmt.Errorf("opening Prometheus metrics endpoint: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler(metrics.DefaultRegistry, prometheus.Options{Labels: labels}))
+	server := &http.Server{Handler: mux}
+	s.cleanupFuncs = append(s.cleanupFuncs, server.Close)
+
+	log.Info("Starting Prometheus metrics endpoint", "addr", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Error("Prometheus metrics endpoint failed", "err", err)
+		}
+	}()
+	return nil
+}
+
 // Stop stops all component services.
 // Implements the node.Service interface.
 func (s *Swarm) Stop() error {
@@ -464,6 +524,7 @@ func (s *Swarm) Stop() error {
 		s.accountingMetrics.Close()
 	}
 
+	// the streamer has to be stopped before the netStore is closed, it waits for the syncing store operations in progress
 	if err := s.streamer.Stop(); err != nil {
 		log.Error("streamer stop", "err", err)
 	}